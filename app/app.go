@@ -1,6 +1,8 @@
 package app
 
 import (
+	"context"
+	"fmt"
 	"github.com/json-iterator/go/extra"
 	"github.com/kataras/iris"
 	"github.com/rs/zerolog"
@@ -8,7 +10,14 @@ import (
 	"github.com/sysu-team/Back-end-development/app/configs"
 	"github.com/sysu-team/Back-end-development/app/controllers"
 	"github.com/sysu-team/Back-end-development/app/models"
+	"github.com/sysu-team/Back-end-development/app/services"
+	"github.com/sysu-team/Back-end-development/app/utils"
+	"github.com/sysu-team/Back-end-development/lib"
+	"io"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 )
 
 type LoginReq struct {
@@ -18,18 +27,73 @@ type LoginReq struct {
 	Captcha  string `json:"captcha"`
 }
 
-func initService(config configs.Config) {
-	controllers.InitSession(&config.HTTP.Session)
+// Setup 初始化日志、数据库和各个服务，服务器和命令行工具共用
+// logOut 为日志的输出位置，命令行工具输出到 stderr 避免和命令的输出混在一起
+func Setup(config *configs.Config, logOut io.Writer) error {
+	// 初始化日志, 添加输出行号，敏感字段在输出前隐藏
+	level, format := config.Log.Level, config.Log.Format
+	if level == "" {
+		level = "info"
+		if config.Dev {
+			level = "debug"
+		}
+	}
+	if format == "" {
+		format = "json"
+		if config.Dev {
+			format = "console"
+		}
+	}
+	lvl, err := zerolog.ParseLevel(level)
+	if err != nil {
+		return err
+	}
+	zerolog.SetGlobalLevel(lvl)
+	log.Logger = zerolog.New(lib.NewLogWriter(logOut, format)).With().Timestamp().Caller().Logger()
+
+	// 初始化 Json 设置
+	// 自动转换成小写下划线风格，接口文档使用相同的规则
+	extra.SetNamingStrategy(lib.NamingStrategy)
+
+	// 初始化 database
+	if err := models.InitDB(&config.Db); err != nil {
+		return err
+	}
+
+	// 初始化学生身份验证
+	services.InitVerifier(&config.Verify, utils.NewMailer(&config.Util.SMTP))
+
+	// 初始化附件存储
+	services.InitStorage(&config.Storage)
+
+	// 初始化限流和业务配额，两者共用令牌桶
+	limiter = newLimiter(&config.RateLimit)
+	services.InitQuota(&config.Quota, limiter)
+
+	// 初始化积分规则
+	services.InitCredit(&config.Credit)
+
+	// 初始化支付平台，使用小程序的 appid
+	services.InitPayment(&config.Payment, config.Wx.AppID)
+	return nil
+}
+
+// 限流和业务配额使用的令牌桶
+var limiter lib.Limiter
+
+func newLimiter(config *configs.RateLimitConfig) lib.Limiter {
+	if config.Backend == "mongo" {
+		return models.GetModel().RateLimit
+	}
+	return lib.NewMemoryLimiter()
 }
 
-// Run 程序入口
-func Run(configPath string) {
-	// 初始化日志, 添加输出行号
-	log.Logger = log.With().Caller().Logger().Output(zerolog.ConsoleWriter{Out: os.Stdout})
-	// 读取配置
-	var config configs.Config
-	config.GetConf(configPath)
-	// 初始化各种服务
+// Run 启动服务器，配置已经加载并检查过
+// 收到 SIGINT 或者 SIGTERM 后停止接收新的请求，等待正在处理的请求和后台任务结束后断开数据库连接
+func Run(config *configs.Config) {
+	if err := Setup(config, os.Stdout); err != nil {
+		panic(err)
+	}
 	// 初始化 session
 	controllers.InitSession(&config.HTTP.Session)
 
@@ -37,13 +101,22 @@ func Run(configPath string) {
 	controllers.WxSecret = config.Wx.Secret
 	controllers.WxAppid = config.Wx.AppID
 
-	// 初始化 Json 设置
-	// 自动转换成小写下划线风格
-	extra.SetNamingStrategy(extra.LowerCaseWithUnderscores)
+	// 初始化管理员
+	controllers.AdminOpenIDs = config.Admin.OpenIDs
 
-	// 初始化 database
-	if err := models.InitDB(&config.Db); err != nil {
-		panic(err)
+	// 初始化接口限流
+	controllers.InitRateLimit(&config.RateLimit, limiter)
+	services.InitIdempotency(time.Duration(config.HTTP.IdempotencyTTL) * time.Second)
+
+	if config.Verify.RosterFile != "" {
+		importRoster(config.Verify.RosterFile)
+	}
+
+	// 升级数据库
+	if config.Db.AutoMigrate {
+		if _, err := Migrate(context.Background()); err != nil {
+			panic(err)
+		}
 	}
 
 	//OFFLINE_DEBUG = config.Offline
@@ -52,12 +125,61 @@ func Run(configPath string) {
 
 	if config.Dev {
 		app.Logger().SetLevel("debug")
-		zerolog.SetGlobalLevel(zerolog.DebugLevel)
-	} else {
-		zerolog.SetGlobalLevel(zerolog.WarnLevel)
 	}
+
+	// 启动后台任务
+	workerCtx, stopWorkers := context.WithCancel(context.Background())
+	workers := services.StartWorkers(workerCtx)
+
+	// 收到退出信号后关闭服务器，Shutdown 返回时正在处理的请求已经结束或者超时
+	shutdownTimeout := time.Duration(config.HTTP.ShutdownTimeout) * time.Second
+	drained := make(chan struct{})
+	go func() {
+		defer close(drained)
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+		log.Warn().Msg(fmt.Sprintf("Received %v, shutting down", <-sig))
+		// 实时推送的连接不会自己结束，先关闭它们
+		services.CloseChat()
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if err := app.Shutdown(ctx); err != nil {
+			log.Error().Err(err).Msg("Shutdown server")
+		}
+	}()
+
 	log.Debug().Msg(config.HTTP.Host)
-	if err := app.Run(iris.Addr(config.HTTP.Host + ":" + config.HTTP.Port)); err != nil {
+	err := app.Run(iris.Addr(fmt.Sprintf("%v:%v", config.HTTP.Host, config.HTTP.Port)),
+		iris.WithoutInterruptHandler, iris.WithoutServerError(iris.ErrServerClosed))
+	if err != nil {
 		panic(err)
 	}
+	<-drained
+
+	stopWorkers()
+	workers.Wait()
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := models.Disconnect(ctx); err != nil {
+		log.Error().Err(err).Msg("Disconnect database")
+	}
+	log.Warn().Msg("Server stopped")
+}
+
+// Migrate 写入默认的委托类型并执行还没有执行的数据库升级
+// 补充委托类型标识的升级依赖委托类型，所以先写入默认类型
+func Migrate(ctx context.Context) ([]models.Migration, error) {
+	services.NewCategoryService().InitCategories(ctx)
+	return models.GetModel().Migration.Migrate(ctx)
+}
+
+// 启动时导入学生名单
+func importRoster(path string) {
+	f, err := os.Open(path)
+	if err != nil {
+		log.Panic().Err(err).Msg("Can't open roster file")
+	}
+	defer f.Close()
+	n := services.NewUserService().ImportRoster(context.Background(), f)
+	log.Info().Msg(fmt.Sprintf("Import %v roster entries from %v", n, path))
 }
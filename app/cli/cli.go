@@ -0,0 +1,178 @@
+package cli
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/sysu-team/Back-end-development/app"
+	"github.com/sysu-team/Back-end-development/app/configs"
+	"github.com/sysu-team/Back-end-development/app/models"
+	"github.com/sysu-team/Back-end-development/lib"
+)
+
+// 子命令
+type command struct {
+	name    string
+	usage   string // 参数的说明
+	summary string
+	setup   bool // 是否需要连接数据库和初始化服务
+	run     func(config *configs.Config, args []string) error
+}
+
+func commandList() []*command {
+	return []*command{
+		{"serve", "", "启动服务器（默认）", false, runServe},
+		{"config", "check", "检查并输出生效的配置，敏感的配置项会被隐藏", false, runConfig},
+		{"migrate", "[status]", "执行数据库升级，包括创建索引和补充字段", true, runMigrate},
+		{"seed", "[-force]", "写入用于本地开发的示例用户和委托", true, runSeed},
+		{"user", "<show|ban|suspend|restore|verify> [flags] <openid|student_num>", "查看或者修改用户", true, runUser},
+		{"delegation", "<show|cancel|confirm|set-state> <id> [state]", "查看委托或者强制改变委托的状态", true, runDelegation},
+	}
+}
+
+// 参数错误时返回，会输出命令的用法
+var errUsage = errors.New("invalid arguments")
+
+// 加载配置时的错误，config check 需要在输出配置之后报告
+var loadErr error
+
+// 可以重复出现的命令行参数
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+// Run 解析命令行参数并执行子命令，返回进程的退出码
+// 用法：[-c config.yaml] [-set key=value ...] [command] [args]
+func Run(args []string) int {
+	fs := flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	configFile := fs.String("c", "config.yaml", "Config file, empty to use only defaults and environment variables")
+	var overrides stringList
+	fs.Var(&overrides, "set", "Override a config item, e.g. -set http.port=8080 (repeatable)")
+	fs.Usage = func() { usage(fs) }
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	rest := fs.Args()
+	name := "serve"
+	if len(rest) > 0 {
+		name, rest = rest[0], rest[1:]
+	}
+	var cmd *command
+	for _, c := range commandList() {
+		if c.name == name {
+			cmd = c
+		}
+	}
+	if cmd == nil {
+		fmt.Fprintf(os.Stderr, "unknown command %q\n", name)
+		usage(fs)
+		return 2
+	}
+
+	var config *configs.Config
+	config, loadErr = configs.Load(*configFile, overrides)
+	if loadErr != nil && cmd.name != "config" {
+		fmt.Fprintln(os.Stderr, loadErr)
+		return 1
+	}
+	if cmd.setup {
+		if err := app.Setup(config, os.Stderr); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		defer func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			if err := models.Disconnect(ctx); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+			}
+		}()
+	}
+	return execute(cmd, config, rest)
+}
+
+// 执行子命令，service 中断言失败产生的错误会被输出
+func execute(cmd *command, config *configs.Config, args []string) (code int) {
+	defer func() {
+		if r := recover(); r != nil {
+			appErr, ok := r.(lib.AppError)
+			if !ok {
+				panic(r)
+			}
+			def, _ := lib.LookupError(appErr.Key)
+			fmt.Fprintf(os.Stderr, "error: %v: %v\n", def.Key, def.Message(lib.LangEn))
+			if appErr.Cause != nil {
+				fmt.Fprintf(os.Stderr, "  cause: %v\n", appErr.Cause)
+			}
+			code = 1
+		}
+	}()
+	if err := cmd.run(config, args); err != nil {
+		if err == errUsage {
+			fmt.Fprintf(os.Stderr, "Usage: %v %v %v\n", os.Args[0], cmd.name, cmd.usage)
+			return 2
+		}
+		fmt.Fprintln(os.Stderr, "error:", err)
+		return 1
+	}
+	return 0
+}
+
+func usage(fs *flag.FlagSet) {
+	out := fs.Output()
+	fmt.Fprintf(out, "Usage: %v [flags] [command] [args]\n\nCommands:\n", os.Args[0])
+	for _, c := range commandList() {
+		fmt.Fprintf(out, "  %-11v %v\n", c.name, c.summary)
+		if c.usage != "" {
+			fmt.Fprintf(out, "  %-11v   %v %v\n", "", c.name, c.usage)
+		}
+	}
+	fmt.Fprintln(out, "\nFlags:")
+	fs.PrintDefaults()
+}
+
+// 以 json 格式输出，字段名和 Go 中的一致，方便和代码对照
+func printJSON(v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(data))
+	return nil
+}
+
+func runServe(config *configs.Config, args []string) error {
+	if len(args) != 0 {
+		return errUsage
+	}
+	app.Run(config)
+	return nil
+}
+
+func runConfig(config *configs.Config, args []string) error {
+	if len(args) != 1 || args[0] != "check" {
+		return errUsage
+	}
+	if config != nil {
+		fmt.Print(config.YAML())
+	}
+	if loadErr != nil {
+		return loadErr
+	}
+	fmt.Fprintln(os.Stderr, "config ok")
+	return nil
+}
@@ -0,0 +1,71 @@
+package cli
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	"github.com/sysu-team/Back-end-development/app/configs"
+	"github.com/sysu-team/Back-end-development/app/models"
+	"github.com/sysu-team/Back-end-development/app/services"
+	"github.com/sysu-team/Back-end-development/lib"
+)
+
+// 解析委托状态，可以使用名字或者数字
+func parseDelegationState(s string) (models.EnumDelegationState, error) {
+	for state := models.Published; state <= models.Finished; state++ {
+		if state.String() == s {
+			return state, nil
+		}
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n < int(models.Published) || n > int(models.Finished) {
+		return 0, fmt.Errorf("unknown delegation state %q", s)
+	}
+	return models.EnumDelegationState(n), nil
+}
+
+// 查看委托或者改变委托的状态
+// cancel 和 confirm 以发布者的身份执行，和小程序中的操作一致
+// set-state 直接修改状态，不会调整积分，只用于修复数据
+func runDelegation(config *configs.Config, args []string) error {
+	ctx := context.Background()
+	if len(args) < 2 {
+		return errUsage
+	}
+	action, id := args[0], args[1]
+	lib.Assert(lib.IsObjectID(id), "no_such_delegation")
+	delegationService := services.NewDelegationService()
+	delegation := delegationService.GetSpecificDelegation(ctx, id)
+
+	switch action {
+	case "show":
+		if len(args) != 2 {
+			return errUsage
+		}
+		return printJSON(delegation)
+	case "cancel":
+		if len(args) != 2 {
+			return errUsage
+		}
+		delegationService.CancelDelegation(ctx, delegation.PublisherID, id)
+	case "confirm":
+		if len(args) != 2 {
+			return errUsage
+		}
+		delegationService.FinishDelegation(ctx, delegation.PublisherID, id, nil)
+	case "set-state":
+		if len(args) != 3 {
+			return errUsage
+		}
+		state, err := parseDelegationState(args[2])
+		if err != nil {
+			return err
+		}
+		delegationService.SetDelegationState(ctx, id, state)
+	default:
+		return errUsage
+	}
+	fmt.Printf("delegation %v: %v done\n", id, action)
+	return nil
+}
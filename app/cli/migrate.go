@@ -0,0 +1,43 @@
+package cli
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/sysu-team/Back-end-development/app"
+	"github.com/sysu-team/Back-end-development/app/configs"
+	"github.com/sysu-team/Back-end-development/app/models"
+)
+
+// 执行数据库升级，status 只列出升级的执行情况
+func runMigrate(config *configs.Config, args []string) error {
+	ctx := context.Background()
+	if len(args) > 1 || (len(args) == 1 && args[0] != "status") {
+		return errUsage
+	}
+	if len(args) == 1 {
+		applied, err := models.GetModel().Migration.GetApplied(ctx)
+		if err != nil {
+			return err
+		}
+		for _, m := range models.Migrations() {
+			state := "pending"
+			if doc, ok := applied[m.Version]; ok {
+				state = "applied at " + doc.AppliedAt.Local().Format("2006-01-02 15:04:05")
+			}
+			fmt.Printf("%4v  %-36v %v\n", m.Version, m.Name, state)
+		}
+		return nil
+	}
+	done, err := app.Migrate(ctx)
+	for _, m := range done {
+		fmt.Printf("applied %v_%v\n", m.Version, m.Name)
+	}
+	if err != nil {
+		return err
+	}
+	if len(done) == 0 {
+		fmt.Println("database is up to date")
+	}
+	return nil
+}
@@ -0,0 +1,100 @@
+package cli
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"time"
+
+	"github.com/sysu-team/Back-end-development/app/configs"
+	"github.com/sysu-team/Back-end-development/app/models"
+	"github.com/sysu-team/Back-end-development/app/services"
+)
+
+// 示例用户，openid 可以在 offline 模式下直接作为登陆的 code 使用
+var seedUsers = []struct {
+	OpenID     string
+	Name       string
+	StudentNum string
+}{
+	{"demo_user_1", "张三", "18340001"},
+	{"demo_user_2", "李四", "18340002"},
+	{"demo_user_3", "王五", "18340003"},
+}
+
+// 示例委托，publisher 为 seedUsers 中的下标
+func seedDelegations(now time.Time) []struct {
+	Publisher int
+	Req       services.DelegationInfoReq
+} {
+	deadline := now.Add(7 * 24 * time.Hour).Unix()
+	return []struct {
+		Publisher int
+		Req       services.DelegationInfoReq
+	}{
+		{0, services.DelegationInfoReq{
+			Name: "帮忙取快递", Description: "东校园菜鸟驿站，送到至善园 3 号", Reward: 5, Deadline: deadline,
+			Type: "errand", MaxNumber: 1, Area: "东校园",
+			Pickup:  &services.LocationReq{Lat: 23.0636, Lng: 113.3915},
+			Dropoff: &services.LocationReq{Lat: 23.0660, Lng: 113.3890},
+		}},
+		{1, services.DelegationInfoReq{
+			Name: "代购打印纸", Description: "一包 A4 打印纸", Reward: 10, Deadline: deadline,
+			Type: "purchase", MaxNumber: 1, Area: "东校园",
+		}},
+		{2, services.DelegationInfoReq{
+			Name: "高数辅导", Description: "期末复习，两个小时", Reward: 50, Deadline: deadline,
+			Type: "tutoring", MaxNumber: 1, Area: "南校园",
+		}},
+		{1, services.DelegationInfoReq{
+			Name: "饮食习惯调查", Reward: 2, Deadline: deadline, Type: "questionnaire", MaxNumber: 10,
+			Questionnaire: &models.QuestionnaireDoc{
+				Title: "饮食习惯调查",
+				Questions: []models.Question{
+					{Topic: "你通常在哪里吃午饭", Answers: []models.Answer{{Option: "食堂"}, {Option: "外卖"}, {Option: "其他"}}},
+					{Topic: "你每周吃几次早餐", Answers: []models.Answer{{Option: "0-2"}, {Option: "3-5"}, {Option: "6-7"}}},
+				},
+			},
+		}},
+	}
+}
+
+// 写入示例用户和委托，已经存在的示例用户不会重复写入
+func runSeed(config *configs.Config, args []string) error {
+	ctx := context.Background()
+	fs := flag.NewFlagSet("seed", flag.ContinueOnError)
+	force := fs.Bool("force", false, "seed even if dev mode is off")
+	if err := fs.Parse(args); err != nil || fs.NArg() != 0 {
+		return errUsage
+	}
+	if !config.Dev && !*force {
+		return errors.New("seed is meant for local development, set dev: true or use -force")
+	}
+
+	userService := services.NewUserService()
+	created := make(map[int]bool)
+	for i, u := range seedUsers {
+		if userService.HasRegistered(ctx, u.OpenID) {
+			fmt.Printf("user %v already exists\n", u.OpenID)
+			continue
+		}
+		userService.Register(ctx, u.Name, u.StudentNum, u.OpenID)
+		userService.MarkVerified(ctx, u.OpenID)
+		created[i] = true
+		fmt.Printf("created user %v (%v)\n", u.OpenID, u.Name)
+	}
+
+	// 只为新创建的用户发布委托，重复执行时不会产生重复的委托
+	delegationService := services.NewDelegationService()
+	for _, d := range seedDelegations(time.Now()) {
+		if !created[d.Publisher] {
+			continue
+		}
+		req := d.Req
+		req.Publisher = seedUsers[d.Publisher].OpenID
+		delegationService.CreateDelegation(ctx, &req)
+		fmt.Printf("created delegation %v by %v\n", req.Name, req.Publisher)
+	}
+	return nil
+}
@@ -0,0 +1,57 @@
+package cli
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"time"
+
+	"github.com/sysu-team/Back-end-development/app/configs"
+	"github.com/sysu-team/Back-end-development/app/models"
+	"github.com/sysu-team/Back-end-development/app/services"
+)
+
+// 查看或者修改用户，用户可以用 openid 或者学号指定
+func runUser(config *configs.Config, args []string) error {
+	ctx := context.Background()
+	if len(args) == 0 {
+		return errUsage
+	}
+	action := args[0]
+	fs := flag.NewFlagSet("user "+action, flag.ContinueOnError)
+	reason := fs.String("reason", "", "reason shown to the user when banned or suspended")
+	duration := fs.Duration("for", 0, "suspend duration, e.g. 72h")
+	if err := fs.Parse(args[1:]); err != nil || fs.NArg() != 1 {
+		return errUsage
+	}
+
+	userService := services.NewUserService()
+	user := userService.FindUserByOpenID(ctx, fs.Arg(0))
+	if user == nil {
+		user = userService.FindUserByStudentNum(ctx, fs.Arg(0))
+	}
+	if user == nil {
+		return fmt.Errorf("no user with openid or student number %q", fs.Arg(0))
+	}
+
+	switch action {
+	case "show":
+		return printJSON(user)
+	case "ban":
+		userService.SetUserStatus(ctx, user.OpenID, models.UserBanned, 0, *reason)
+	case "suspend":
+		if *duration <= 0 {
+			return errors.New("suspend requires a positive -for duration")
+		}
+		userService.SetUserStatus(ctx, user.OpenID, models.UserSuspended, time.Now().Add(*duration).Unix(), *reason)
+	case "restore":
+		userService.SetUserStatus(ctx, user.OpenID, models.UserActive, 0, "")
+	case "verify":
+		userService.MarkVerified(ctx, user.OpenID)
+	default:
+		return errUsage
+	}
+	fmt.Printf("user %v: %v done\n", user.OpenID, action)
+	return nil
+}
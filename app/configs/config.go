@@ -1,26 +1,35 @@
 package configs
 
 import (
-	"github.com/rs/zerolog/log"
-	"gopkg.in/yaml.v2"
-	"io/ioutil"
+	"fmt"
+	"strings"
 )
 
 // Config 应用配置
 type Config struct {
-	Dev     bool       `yaml:"dev"`     // 开发模式
-	Offline bool       `yaml:"offline"` // 没有小程序 code 参与
-	HTTP    HTTPConfig `yaml:"http"`    // HTTP配置
-	Db      DBConfig   `yaml:"db"`      // 数据库配置
-	Util    UtilConfig `yaml:"util"`    // 工具配置
-	Wx      WxConfig   `yaml:"wx"`      // 数据库配置
+	Dev       bool            `yaml:"dev"`        // 开发模式
+	Offline   bool            `yaml:"offline"`    // 没有小程序 code 参与
+	HTTP      HTTPConfig      `yaml:"http"`       // HTTP配置
+	Db        DBConfig        `yaml:"db"`         // 数据库配置
+	Util      UtilConfig      `yaml:"util"`       // 工具配置
+	Wx        WxConfig        `yaml:"wx"`         // 微信小程序配置
+	Admin     AdminConfig     `yaml:"admin"`      // 管理员配置
+	Verify    VerifyConfig    `yaml:"verify"`     // 学生身份验证配置
+	Storage   StorageConfig   `yaml:"storage"`    // 上传文件存储配置
+	Log       LogConfig       `yaml:"log"`        // 日志配置
+	RateLimit RateLimitConfig `yaml:"rate_limit"` // 接口限流配置
+	Quota     QuotaConfig     `yaml:"quota"`      // 业务配额
+	Credit    CreditConfig    `yaml:"credit"`     // 积分规则
+	Payment   PaymentConfig   `yaml:"payment"`    // 充值和提现
 }
 
 // HTTPConfig 服务器配置
 type HTTPConfig struct {
-	Host    string        `yaml:"host"`    // 监听地址
-	Port    string        `yaml:"port"`    // 监听端口
-	Session SessionConfig `yaml:"session"` // Session配置
+	Host            string        `yaml:"host"`             // 监听地址
+	Port            int           `yaml:"port"`             // 监听端口
+	Session         SessionConfig `yaml:"session"`          // Session配置
+	ShutdownTimeout int           `yaml:"shutdown_timeout"` // 退出时等待正在处理的请求结束的时间，单位秒
+	IdempotencyTTL  int           `yaml:"idempotency_ttl"`  // 带有 Idempotency-Key 的请求保存响应的时间，单位秒
 }
 
 // SessionConfig Session 配置
@@ -31,33 +40,307 @@ type SessionConfig struct {
 // DBConfig 数据库配置
 type DBConfig struct {
 	Host     string `yaml:"host"`
-	Port     string `yaml:"port"`
+	Port     int    `yaml:"port"`
 	DBName   string `yaml:"db"`
 	User     string `yaml:"user"`
-	Password string `yaml:"password"`
+	Password string `yaml:"password" secret:"true"`
+	// 启动服务器时自动执行数据库升级，关闭时需要手动执行 migrate 命令
+	AutoMigrate    bool `yaml:"auto_migrate"`
+	ConnectTimeout int  `yaml:"connect_timeout"` // 连接数据库的超时时间，单位秒
+	OpTimeout      int  `yaml:"op_timeout"`      // 单次数据库操作的超时时间，单位秒
 }
 
 type WxConfig struct {
 	AppID  string `yaml:"appid"`
-	Secret string `yaml:"secret"`
+	Secret string `yaml:"secret" secret:"true"`
+}
+
+// AdminConfig 管理员配置
+type AdminConfig struct {
+	OpenIDs []string `yaml:"openids"` // 拥有管理权限的用户 openid
+}
+
+// VerifyConfig 学生身份验证配置
+type VerifyConfig struct {
+	Method      string `yaml:"method"`       // 验证方式：none / roster / email
+	RosterFile  string `yaml:"roster_file"`  // 启动时导入的学生名单 CSV，格式为 学号,姓名
+	EmailDomain string `yaml:"email_domain"` // 校园邮箱的域名
+	CodeExpires int64  `yaml:"code_expires"` // 邮箱验证码的有效期，单位秒
+}
+
+// StorageConfig 上传文件存储配置
+type StorageConfig struct {
+	Backend       string   `yaml:"backend"`        // 存储方式：local / s3
+	LocalDir      string   `yaml:"local_dir"`      // 本地存储的目录
+	S3            S3Config `yaml:"s3"`             // 兼容 S3 的对象存储
+	MaxSize       int64    `yaml:"max_size"`       // 单个文件的最大字节数
+	AllowedTypes  []string `yaml:"allowed_types"`  // 允许上传的 MIME 类型
+	ThumbnailSize int      `yaml:"thumbnail_size"` // 缩略图长边的像素数
+}
+
+// S3Config 兼容 S3 的对象存储配置，可以使用 MinIO 代替
+type S3Config struct {
+	Endpoint  string `yaml:"endpoint"` // 例如 http://127.0.0.1:9000
+	Region    string `yaml:"region"`
+	Bucket    string `yaml:"bucket"`
+	AccessKey string `yaml:"access_key" secret:"true"`
+	SecretKey string `yaml:"secret_key" secret:"true"`
+}
+
+// LogConfig 日志配置
+type LogConfig struct {
+	Level  string `yaml:"level"`  // debug / info / warn / error，为空时开发模式为 debug，否则为 info
+	Format string `yaml:"format"` // json / console，为空时开发模式为 console，否则为 json
+}
+
+// RateLimitConfig 接口限流配置，使用令牌桶，超过限制时返回 429
+type RateLimitConfig struct {
+	Backend string        `yaml:"backend"` // memory / mongo，多个实例共享限制时使用 mongo
+	IP      RateLimitRule `yaml:"ip"`      // 每个 IP 对所有接口的请求
+	Login   RateLimitRule `yaml:"login"`   // 每个 IP 对登陆和注册接口的请求，这两个接口会调用微信的接口
+	Write   RateLimitRule `yaml:"write"`   // 每个用户对每个修改数据的接口的请求
+}
+
+// RateLimitRule 令牌桶的参数，rate 为 0 时不限制
+type RateLimitRule struct {
+	Rate  int `yaml:"rate"`  // 每分钟补充的请求数
+	Burst int `yaml:"burst"` // 短时间内最多连续的请求数
+}
+
+// QuotaConfig 业务配额，为 0 时不限制
+type QuotaConfig struct {
+	MaxOpenDelegations int `yaml:"max_open_delegations"` // 每个用户同时进行中（未完成、未取消）的委托数
+	AcceptsPerHour     int `yaml:"accepts_per_hour"`     // 每个用户每小时最多接受的委托数
+}
+
+// CreditConfig 积分规则
+type CreditConfig struct {
+	SignupBonus          int           `yaml:"signup_bonus"`           // 注册时获得的积分
+	CheckIn              CheckInConfig `yaml:"check_in"`               // 每日签到
+	FirstCompletionBonus int           `yaml:"first_completion_bonus"` // 第一次完成委托的额外奖励，为 0 时关闭
+	MinBalance           int           `yaml:"min_balance"`            // 发布、接受委托冻结积分之后余额的下限
+	Decay                DecayConfig   `yaml:"decay"`                  // 长期不活跃的用户的积分衰减
+}
+
+// CheckInConfig 每日签到，连续签到时额外奖励
+type CheckInConfig struct {
+	Reward      int `yaml:"reward"`       // 每次签到的积分，为 0 时关闭签到
+	StreakBonus int `yaml:"streak_bonus"` // 连续签到每多一天额外奖励的积分
+	MaxStreak   int `yaml:"max_streak"`   // 额外奖励最多按照连续多少天计算
+}
+
+// DecayConfig 积分衰减，inactive_days 为 0 时关闭
+type DecayConfig struct {
+	InactiveDays int `yaml:"inactive_days"` // 超过多少天没有登陆、签到或者积分变化之后开始衰减
+	Percent      int `yaml:"percent"`       // 每天扣除高于 min_balance 部分的百分比
+}
+
+// PaymentConfig 充值和提现配置，金额单位为分
+type PaymentConfig struct {
+	Provider      string `yaml:"provider"`              // 支付平台：none / wxpay，none 时关闭充值和提现
+	Endpoint      string `yaml:"endpoint"`              // 支付接口地址，为空时使用微信支付，可以替换为本地的模拟服务
+	MchID         string `yaml:"mch_id"`                // 商户号，appid 使用 wx.appid
+	APIKey        string `yaml:"api_key" secret:"true"` // 签名密钥
+	CertFile      string `yaml:"cert_file"`             // 商户证书，转账时使用
+	KeyFile       string `yaml:"key_file"`              // 商户证书的私钥
+	NotifyURL     string `yaml:"notify_url"`            // 支付结果通知的地址，指向 /payments/notify
+	FenPerCredit  int    `yaml:"fen_per_credit"`        // 每个积分的价格
+	MinTopUp      int    `yaml:"min_top_up"`            // 单次充值的最少积分
+	MaxTopUp      int    `yaml:"max_top_up"`            // 单次充值的最多积分
+	MinWithdrawal int    `yaml:"min_withdrawal"`        // 单次提现的最少积分
+	OrderExpires  int    `yaml:"order_expires"`         // 订单的支付期限，单位秒，超时未支付的订单被关闭
 }
 
 // UtilConfig 工具类配置
 type UtilConfig struct {
+	SMTP SMTPConfig `yaml:"smtp"` // 邮件发送配置
+}
+
+// SMTPConfig 邮件发送配置
+type SMTPConfig struct {
+	Stub     bool   `yaml:"stub"` // 不真正发送邮件，只输出到日志
+	Host     string `yaml:"host"`
+	Port     int    `yaml:"port"`
+	User     string `yaml:"user"`
+	Password string `yaml:"password" secret:"true"`
+	From     string `yaml:"from"`
 }
 
-// GetConf 从文件读取配置信息
-func (c *Config) GetConf(path string) *Config {
-	yamlFile, err := ioutil.ReadFile(path)
-	if err != nil {
-		log.Panic().Err(err).Msg("Can't read config file")
+// Default 默认配置，配置文件、环境变量和命令行参数依次覆盖默认值
+func Default() *Config {
+	return &Config{
+		HTTP: HTTPConfig{
+			Host:            "127.0.0.1",
+			Port:            8080,
+			Session:         SessionConfig{Key: "cddwxm"},
+			ShutdownTimeout: 15,
+			IdempotencyTTL:  86400,
+		},
+		Db: DBConfig{
+			Host:           "127.0.0.1",
+			Port:           27017,
+			DBName:         "swsad_weapp",
+			AutoMigrate:    true,
+			ConnectTimeout: 10,
+			OpTimeout:      5,
+		},
+		Util: UtilConfig{
+			SMTP: SMTPConfig{Stub: true, Port: 25},
+		},
+		Verify: VerifyConfig{
+			Method:      "none",
+			CodeExpires: 600,
+		},
+		RateLimit: RateLimitConfig{
+			Backend: "memory",
+			IP:      RateLimitRule{Rate: 300, Burst: 100},
+			Login:   RateLimitRule{Rate: 10, Burst: 5},
+			Write:   RateLimitRule{Rate: 30, Burst: 10},
+		},
+		Quota: QuotaConfig{
+			MaxOpenDelegations: 10,
+			AcceptsPerHour:     20,
+		},
+		Credit: CreditConfig{
+			SignupBonus:          100,
+			CheckIn:              CheckInConfig{Reward: 2, StreakBonus: 1, MaxStreak: 7},
+			FirstCompletionBonus: 10,
+			Decay:                DecayConfig{Percent: 1},
+		},
+		Payment: PaymentConfig{
+			Provider:      "none",
+			FenPerCredit:  10,
+			MinTopUp:      10,
+			MaxTopUp:      10000,
+			MinWithdrawal: 100,
+			OrderExpires:  1800,
+		},
+		Storage: StorageConfig{
+			Backend:       "local",
+			LocalDir:      "uploads",
+			MaxSize:       5 << 20,
+			AllowedTypes:  []string{"image/jpeg", "image/png", "image/gif", "application/pdf"},
+			ThumbnailSize: 256,
+		},
+	}
+}
+
+// Validate 检查配置，返回所有不合法的配置项
+func (c *Config) Validate() error {
+	errs := make(ValidationErrors, 0)
+	check := func(ok bool, key, format string, args ...interface{}) {
+		if !ok {
+			errs = append(errs, fmt.Sprintf("%v: "+format, append([]interface{}{key}, args...)...))
+		}
+	}
+	checkPort := func(key string, port int) {
+		check(port > 0 && port <= 65535, key, "must be between 1 and 65535, got %v", port)
+	}
+	checkPort("http.port", c.HTTP.Port)
+	check(c.HTTP.Session.Key != "", "http.session.key", "must not be empty")
+	check(c.HTTP.ShutdownTimeout > 0, "http.shutdown_timeout", "must be positive, got %v", c.HTTP.ShutdownTimeout)
+	check(c.HTTP.IdempotencyTTL > 0, "http.idempotency_ttl", "must be positive, got %v", c.HTTP.IdempotencyTTL)
+	check(c.Db.Host != "", "db.host", "must not be empty")
+	checkPort("db.port", c.Db.Port)
+	check(c.Db.DBName != "", "db.db", "must not be empty")
+	check(c.Db.ConnectTimeout > 0, "db.connect_timeout", "must be positive, got %v", c.Db.ConnectTimeout)
+	check(c.Db.OpTimeout > 0, "db.op_timeout", "must be positive, got %v", c.Db.OpTimeout)
+	if !c.Offline {
+		check(c.Wx.AppID != "", "wx.appid", "must not be empty unless offline is set")
+		check(c.Wx.Secret != "", "wx.secret", "must not be empty unless offline is set")
 	}
+	if !c.Util.SMTP.Stub {
+		check(c.Util.SMTP.Host != "", "util.smtp.host", "must not be empty unless stub is set")
+		checkPort("util.smtp.port", c.Util.SMTP.Port)
+		check(c.Util.SMTP.From != "", "util.smtp.from", "must not be empty unless stub is set")
+	}
+	check(oneOf(c.Verify.Method, "none", "roster", "email"), "verify.method",
+		"must be one of none, roster, email, got %q", c.Verify.Method)
+	if c.Verify.Method == "email" {
+		check(c.Verify.EmailDomain != "", "verify.email_domain", "must not be empty when method is email")
+		check(c.Verify.CodeExpires > 0, "verify.code_expires", "must be positive, got %v", c.Verify.CodeExpires)
+		// 验证码需要真正发送出去
+		check(c.Util.SMTP.Host != "", "util.smtp.host", "must not be empty when verify.method is email")
+		check(!c.Util.SMTP.Stub || c.Dev, "util.smtp.stub", "must not be set when verify.method is email unless dev is set")
+	}
+	check(oneOf(c.Storage.Backend, "local", "s3"), "storage.backend",
+		"must be one of local, s3, got %q", c.Storage.Backend)
+	if c.Storage.Backend == "local" {
+		check(c.Storage.LocalDir != "", "storage.local_dir", "must not be empty when backend is local")
+	}
+	if c.Storage.Backend == "s3" {
+		check(strings.HasPrefix(c.Storage.S3.Endpoint, "http://") || strings.HasPrefix(c.Storage.S3.Endpoint, "https://"),
+			"storage.s3.endpoint", "must be an http(s) url, got %q", c.Storage.S3.Endpoint)
+		check(c.Storage.S3.Bucket != "", "storage.s3.bucket", "must not be empty when backend is s3")
+		check(c.Storage.S3.AccessKey != "" && c.Storage.S3.SecretKey != "", "storage.s3",
+			"access_key and secret_key must not be empty when backend is s3")
+	}
+	check(c.Storage.MaxSize > 0, "storage.max_size", "must be positive, got %v", c.Storage.MaxSize)
+	check(len(c.Storage.AllowedTypes) > 0, "storage.allowed_types", "must not be empty")
+	check(c.Storage.ThumbnailSize > 0, "storage.thumbnail_size", "must be positive, got %v", c.Storage.ThumbnailSize)
+	check(oneOf(c.Log.Level, "", "debug", "info", "warn", "error"), "log.level",
+		"must be one of debug, info, warn, error, got %q", c.Log.Level)
+	check(oneOf(c.Log.Format, "", "json", "console"), "log.format",
+		"must be one of json, console, got %q", c.Log.Format)
+	check(oneOf(c.RateLimit.Backend, "memory", "mongo"), "rate_limit.backend",
+		"must be one of memory, mongo, got %q", c.RateLimit.Backend)
+	checkRule := func(key string, rule RateLimitRule) {
+		check(rule.Rate >= 0, key+".rate", "must not be negative, got %v", rule.Rate)
+		check(rule.Rate == 0 || rule.Burst > 0, key+".burst", "must be positive when rate is set, got %v", rule.Burst)
+	}
+	checkRule("rate_limit.ip", c.RateLimit.IP)
+	checkRule("rate_limit.login", c.RateLimit.Login)
+	checkRule("rate_limit.write", c.RateLimit.Write)
+	check(c.Quota.MaxOpenDelegations >= 0, "quota.max_open_delegations", "must not be negative, got %v", c.Quota.MaxOpenDelegations)
+	check(c.Quota.AcceptsPerHour >= 0, "quota.accepts_per_hour", "must not be negative, got %v", c.Quota.AcceptsPerHour)
+	check(c.Credit.SignupBonus >= 0, "credit.signup_bonus", "must not be negative, got %v", c.Credit.SignupBonus)
+	check(c.Credit.CheckIn.Reward >= 0, "credit.check_in.reward", "must not be negative, got %v", c.Credit.CheckIn.Reward)
+	check(c.Credit.CheckIn.StreakBonus >= 0, "credit.check_in.streak_bonus", "must not be negative, got %v", c.Credit.CheckIn.StreakBonus)
+	check(c.Credit.CheckIn.MaxStreak >= 0, "credit.check_in.max_streak", "must not be negative, got %v", c.Credit.CheckIn.MaxStreak)
+	check(c.Credit.FirstCompletionBonus >= 0, "credit.first_completion_bonus", "must not be negative, got %v", c.Credit.FirstCompletionBonus)
+	check(c.Credit.MinBalance >= 0, "credit.min_balance", "must not be negative, got %v", c.Credit.MinBalance)
+	check(c.Credit.Decay.InactiveDays >= 0, "credit.decay.inactive_days", "must not be negative, got %v", c.Credit.Decay.InactiveDays)
+	if c.Credit.Decay.InactiveDays > 0 {
+		check(c.Credit.Decay.Percent > 0 && c.Credit.Decay.Percent <= 100, "credit.decay.percent",
+			"must be between 1 and 100 when inactive_days is set, got %v", c.Credit.Decay.Percent)
+	}
+	check(oneOf(c.Payment.Provider, "none", "wxpay"), "payment.provider",
+		"must be one of none, wxpay, got %q", c.Payment.Provider)
+	if c.Payment.Provider == "wxpay" {
+		check(c.Payment.Endpoint == "" || strings.HasPrefix(c.Payment.Endpoint, "http://") || strings.HasPrefix(c.Payment.Endpoint, "https://"),
+			"payment.endpoint", "must be an http(s) url, got %q", c.Payment.Endpoint)
+		check(c.Wx.AppID != "", "wx.appid", "must not be empty when payment provider is wxpay")
+		check(c.Payment.MchID != "", "payment.mch_id", "must not be empty when provider is wxpay")
+		check(c.Payment.APIKey != "", "payment.api_key", "must not be empty when provider is wxpay")
+		check((c.Payment.CertFile == "") == (c.Payment.KeyFile == ""), "payment.cert_file",
+			"cert_file and key_file must be set together")
+		check(strings.HasPrefix(c.Payment.NotifyURL, "https://") || strings.HasPrefix(c.Payment.NotifyURL, "http://"),
+			"payment.notify_url", "must be an http(s) url when provider is wxpay, got %q", c.Payment.NotifyURL)
+	}
+	check(c.Payment.FenPerCredit > 0, "payment.fen_per_credit", "must be positive, got %v", c.Payment.FenPerCredit)
+	check(c.Payment.MinTopUp > 0, "payment.min_top_up", "must be positive, got %v", c.Payment.MinTopUp)
+	check(c.Payment.MaxTopUp >= c.Payment.MinTopUp, "payment.max_top_up",
+		"must not be less than min_top_up, got %v", c.Payment.MaxTopUp)
+	check(c.Payment.MinWithdrawal > 0, "payment.min_withdrawal", "must be positive, got %v", c.Payment.MinWithdrawal)
+	check(c.Payment.OrderExpires >= 300, "payment.order_expires", "must be at least 300, got %v", c.Payment.OrderExpires)
+	if len(errs) != 0 {
+		return errs
+	}
+	return nil
+}
 
-	err = yaml.Unmarshal(yamlFile, c)
+// ValidationErrors 所有不合法的配置项
+type ValidationErrors []string
+
+func (e ValidationErrors) Error() string {
+	return "invalid config:\n  " + strings.Join(e, "\n  ")
+}
 
-	if err != nil {
-		log.Panic().Err(err).Msg("Can't marshal config file")
+func oneOf(value string, options ...string) bool {
+	for _, option := range options {
+		if value == option {
+			return true
+		}
 	}
-	log.Info().Msg("Read config from " + path)
-	return c
+	return false
 }
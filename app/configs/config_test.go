@@ -0,0 +1,80 @@
+package configs
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeTemp(t *testing.T, dir, name, content string) string {
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadLayers(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	secret := writeTemp(t, dir, "secret", "from-file\n")
+	path := writeTemp(t, dir, "config.yaml", `
+offline: true
+http:
+  port: 9000
+db:
+  host: db.local
+  password: file:`+secret+`
+`)
+	os.Setenv("APP_DB_HOST", "db.env")
+	os.Setenv("APP_STORAGE_ALLOWED_TYPES", "image/png, image/jpeg")
+	defer os.Unsetenv("APP_DB_HOST")
+	defer os.Unsetenv("APP_STORAGE_ALLOWED_TYPES")
+
+	c, err := Load(path, []string{"http.port=9001"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.HTTP.Port != 9001 || c.Db.Host != "db.env" || c.Db.Port != 27017 || c.Db.Password != "from-file" {
+		t.Errorf("unexpected config: %+v", c)
+	}
+	if len(c.Storage.AllowedTypes) != 2 || c.Storage.AllowedTypes[1] != "image/jpeg" {
+		t.Errorf("unexpected allowed types: %v", c.Storage.AllowedTypes)
+	}
+	if c.Redacted().Db.Password != redactedValue || c.Db.Password != "from-file" {
+		t.Error("secret should only be redacted in the copy")
+	}
+}
+
+func TestLoadInvalid(t *testing.T) {
+	if _, err := Load("", []string{"offline=true", "http.port=71919"}); err == nil {
+		t.Error("expected invalid port")
+	}
+	if _, err := Load("", []string{"http.nope=1"}); err == nil {
+		t.Error("expected unknown key")
+	}
+	if _, err := Load("", []string{"offline=true", "credit.decay.inactive_days=30", "credit.decay.percent=0"}); err == nil {
+		t.Error("expected invalid decay percent")
+	}
+	if _, err := Load("", []string{"offline=true", "payment.provider=wxpay", "payment.mch_id=1"}); err == nil {
+		t.Error("expected missing payment api key")
+	}
+	if _, err := Load("", []string{"offline=true", "verify.method=email", "verify.email_domain=mail2.sysu.edu.cn"}); err == nil {
+		t.Error("expected missing smtp host")
+	}
+	if _, err := Load("", []string{"offline=true", "verify.method=email", "verify.email_domain=mail2.sysu.edu.cn",
+		"util.smtp.host=smtp.example.com"}); err == nil {
+		t.Error("expected stub mailer to be rejected outside dev mode")
+	}
+	if _, err := Load("", []string{"offline=true", "dev=true", "verify.method=email", "verify.email_domain=mail2.sysu.edu.cn",
+		"util.smtp.host=smtp.example.com"}); err != nil {
+		t.Errorf("stub mailer should be allowed in dev mode: %v", err)
+	}
+	if _, err := Load("", []string{"offline=true"}); err != nil {
+		t.Errorf("defaults should be valid in offline mode: %v", err)
+	}
+}
@@ -0,0 +1,197 @@
+package configs
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// 配置的加载顺序：默认值 -> 配置文件 -> APP_* 环境变量 -> 命令行参数
+// 环境变量的名字由配置项的路径得到，例如 http.port 对应 APP_HTTP_PORT
+// 带有 secret 标签的配置项可以从文件读取：值为 file:/path，或者设置环境变量 APP_<KEY>_FILE
+const (
+	EnvPrefix        = "APP_"
+	secretFilePrefix = "file:"
+	redactedValue    = "******"
+)
+
+// Load 加载并检查配置
+// path 为空时不读取配置文件，overrides 为命令行中 key=value 形式的配置，例如 http.port=8080
+func Load(path string, overrides []string) (*Config, error) {
+	c := Default()
+	if path != "" {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("can't read config file: %v", err)
+		}
+		// 不认识的配置项同样视为错误，避免拼写错误的配置被忽略
+		if err := yaml.UnmarshalStrict(data, c); err != nil {
+			return nil, fmt.Errorf("can't parse config file %v: %v", path, err)
+		}
+	}
+	fields := fieldsOf(c)
+	if err := applyEnv(fields); err != nil {
+		return nil, err
+	}
+	if err := applyOverrides(fields, overrides); err != nil {
+		return nil, err
+	}
+	if err := loadSecretFiles(fields); err != nil {
+		return nil, err
+	}
+	if err := c.Validate(); err != nil {
+		return c, err
+	}
+	return c, nil
+}
+
+// Redacted 返回隐藏了敏感配置项的副本，用于输出配置
+func (c *Config) Redacted() *Config {
+	r := *c
+	for _, f := range fieldsOf(&r) {
+		if f.secret && f.value.String() != "" {
+			f.value.SetString(redactedValue)
+		}
+	}
+	return &r
+}
+
+// YAML 输出隐藏了敏感配置项的配置
+func (c *Config) YAML() string {
+	data, err := yaml.Marshal(c.Redacted())
+	if err != nil {
+		return err.Error()
+	}
+	return string(data)
+}
+
+// 配置项
+type configField struct {
+	key    string // 配置文件中的路径，例如 http.port
+	env    string // 对应的环境变量，例如 APP_HTTP_PORT
+	secret bool
+	value  reflect.Value
+}
+
+func fieldsOf(c *Config) []configField {
+	res := make([]configField, 0)
+	collectFields(reflect.ValueOf(c).Elem(), nil, &res)
+	return res
+}
+
+func collectFields(v reflect.Value, path []string, res *[]configField) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name := strings.Split(f.Tag.Get("yaml"), ",")[0]
+		if name == "" || name == "-" {
+			continue
+		}
+		fieldPath := append(append([]string{}, path...), name)
+		if f.Type.Kind() == reflect.Struct {
+			collectFields(v.Field(i), fieldPath, res)
+			continue
+		}
+		*res = append(*res, configField{
+			key:    strings.Join(fieldPath, "."),
+			env:    EnvPrefix + strings.ToUpper(strings.Join(fieldPath, "_")),
+			secret: f.Tag.Get("secret") == "true",
+			value:  v.Field(i),
+		})
+	}
+}
+
+func applyEnv(fields []configField) error {
+	for _, f := range fields {
+		raw, ok := os.LookupEnv(f.env)
+		if f.secret {
+			if path, hasFile := os.LookupEnv(f.env + "_FILE"); hasFile {
+				if ok {
+					return fmt.Errorf("%v and %v_FILE can't be set at the same time", f.env, f.env)
+				}
+				raw, ok = secretFilePrefix+path, true
+			}
+		}
+		if !ok {
+			continue
+		}
+		if err := setField(f.value, raw); err != nil {
+			return fmt.Errorf("%v (%v): %v", f.env, f.key, err)
+		}
+	}
+	return nil
+}
+
+func applyOverrides(fields []configField, overrides []string) error {
+	byKey := make(map[string]configField)
+	for _, f := range fields {
+		byKey[f.key] = f
+	}
+	for _, override := range overrides {
+		idx := strings.Index(override, "=")
+		if idx < 0 {
+			return fmt.Errorf("invalid override %q, expected key=value", override)
+		}
+		key, raw := override[:idx], override[idx+1:]
+		f, ok := byKey[key]
+		if !ok {
+			return fmt.Errorf("unknown config key %q", key)
+		}
+		if err := setField(f.value, raw); err != nil {
+			return fmt.Errorf("%v: %v", key, err)
+		}
+	}
+	return nil
+}
+
+// 读取 file: 开头的敏感配置项，去掉结尾的换行
+func loadSecretFiles(fields []configField) error {
+	for _, f := range fields {
+		if !f.secret || !strings.HasPrefix(f.value.String(), secretFilePrefix) {
+			continue
+		}
+		path := strings.TrimPrefix(f.value.String(), secretFilePrefix)
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("%v: can't read secret file: %v", f.key, err)
+		}
+		f.value.SetString(strings.TrimRight(string(data), "\r\n"))
+	}
+	return nil
+}
+
+// 从字符串设置配置项，数组使用逗号分隔
+func setField(v reflect.Value, raw string) error {
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(raw)
+	case reflect.Int, reflect.Int64:
+		n, err := strconv.ParseInt(strings.TrimSpace(raw), 10, 64)
+		if err != nil {
+			return fmt.Errorf("must be an integer, got %q", raw)
+		}
+		v.SetInt(n)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(strings.TrimSpace(raw))
+		if err != nil {
+			return fmt.Errorf("must be a boolean, got %q", raw)
+		}
+		v.SetBool(b)
+	case reflect.Slice:
+		items := make([]string, 0)
+		for _, item := range strings.Split(raw, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+		v.Set(reflect.ValueOf(items))
+	default:
+		return fmt.Errorf("unsupported config type %v", v.Type())
+	}
+	return nil
+}
@@ -0,0 +1,225 @@
+package controllers
+
+import (
+	"github.com/kataras/iris"
+	"github.com/kataras/iris/mvc"
+	"github.com/sysu-team/Back-end-development/app/models"
+	"github.com/sysu-team/Back-end-development/app/services"
+	"github.com/sysu-team/Back-end-development/lib"
+)
+
+// AdminController 管理员操作
+type AdminController struct {
+	BaseController
+	Server   services.UserService
+	Category services.CategoryService
+	Audit    services.AuditService
+	Payment  services.PaymentService
+	Shop     services.ShopService
+}
+
+// BindAdminController 绑定管理员控制器
+func BindAdminController(app *iris.Application) {
+	adminRoute := mvc.New(app.Party("/admin"))
+
+	adminRoute.Register(services.NewUserService(), services.NewCategoryService(), services.NewAuditService(),
+		services.NewPaymentService(), services.NewShopService(), getSession().Start)
+	adminRoute.Handle(new(AdminController))
+}
+
+func (c *AdminController) BeforeActivation(b mvc.BeforeActivation) {
+	// 封禁、停用、恢复用户
+	b.Handle("PUT", "/users/{param1:string}/ban", "PutUsersByBan", withLogin, withAdmin)
+	b.Handle("PUT", "/users/{param1:string}/suspend", "PutUsersBySuspend", withLogin, withAdmin)
+	b.Handle("PUT", "/users/{param1:string}/restore", "PutUsersByRestore", withLogin, withAdmin)
+	// 导入学生名单
+	b.Handle("POST", "/roster", "PostRoster", withLogin, withAdmin)
+	// 管理委托类型
+	b.Handle("GET", "/categories", "GetCategories", withLogin, withAdmin)
+	b.Handle("PUT", "/categories/{param1:string}", "PutCategoriesBy", withLogin, withAdmin)
+	// 查询审计日志
+	b.Handle("GET", "/audit-log", "GetAuditLog", withLogin, withAdmin)
+	// 审核提现申请
+	b.Handle("GET", "/withdrawals", "GetWithdrawals", withLogin, withAdmin)
+	b.Handle("PUT", "/withdrawals/{param1:string}/approve", "PutWithdrawalsByApprove", withLogin, withAdmin)
+	b.Handle("PUT", "/withdrawals/{param1:string}/reject", "PutWithdrawalsByReject", withLogin, withAdmin)
+	// 管理积分商城
+	b.Handle("GET", "/shop/items", "GetShopItems", withLogin, withAdmin)
+	b.Handle("POST", "/shop/items", "PostShopItems", withLogin, withAdmin)
+	b.Handle("PUT", "/shop/items/{param1:string}", "PutShopItemsBy", withLogin, withAdmin)
+	b.Handle("PUT", "/shop/redemptions/{param1:string}/use", "PutShopRedemptionsByUse", withLogin, withAdmin)
+}
+
+// 接口文档
+var adminRouteDocs = []lib.RouteDoc{
+	{Method: "PUT", Path: "/admin/users/{param1:string}/ban", Summary: "封禁用户",
+		Params: []string{"用户的 open id"}, Body: UserStatusReq{}},
+	{Method: "PUT", Path: "/admin/users/{param1:string}/suspend", Summary: "停用用户",
+		Description: "到期后自动恢复", Params: []string{"用户的 open id"}, Body: UserStatusReq{}},
+	{Method: "PUT", Path: "/admin/users/{param1:string}/restore", Summary: "恢复用户", Params: []string{"用户的 open id"}},
+	{Method: "POST", Path: "/admin/roster", Summary: "导入学生名单", Description: "每行为 学号,姓名",
+		RawBody: "text/csv", Res: ImportRosterRes{}},
+	{Method: "GET", Path: "/admin/categories", Summary: "获取所有委托类型", Description: "包括已经停用的类型",
+		Res: []models.CategoryDoc{}},
+	{Method: "PUT", Path: "/admin/categories/{param1:string}", Summary: "创建或者修改委托类型",
+		Params: []string{"委托类型的标识"}, Body: models.CategoryDoc{}},
+	{Method: "GET", Path: "/admin/audit-log", Summary: "查询审计日志", Description: "按照时间从新到旧排序，筛选条件可以组合",
+		Query: AuditLogQuery{}, Res: []services.AuditEntry{}, Paged: true},
+	{Method: "GET", Path: "/admin/withdrawals", Summary: "查询提现申请", Description: "按照申请时间从新到旧排序",
+		Query: WithdrawalQuery{}, Res: []services.WithdrawalInfo{}, Paged: true},
+	{Method: "PUT", Path: "/admin/withdrawals/{param1:string}/approve", Summary: "批准提现申请",
+		Description: "批准之后立即转账，转账结果不确定时保持正在转账的状态，由后台任务重试", Params: []string{"提现申请 id"},
+		Res: services.WithdrawalInfo{}},
+	{Method: "PUT", Path: "/admin/withdrawals/{param1:string}/reject", Summary: "拒绝提现申请", Description: "返还冻结的积分",
+		Params: []string{"提现申请 id"}, Body: RejectWithdrawalReq{}, Res: services.WithdrawalInfo{}},
+	{Method: "GET", Path: "/admin/shop/items", Summary: "获取所有商品", Description: "包括已经下架的商品",
+		Res: []services.ShopItemInfo{}},
+	{Method: "POST", Path: "/admin/shop/items", Summary: "创建商品",
+		Body: services.ShopItemReq{}, Res: services.ShopItemInfo{}},
+	{Method: "PUT", Path: "/admin/shop/items/{param1:string}", Summary: "修改商品",
+		Description: "库存直接设置为请求中的值，已经兑换的记录不受影响", Params: []string{"商品 id"},
+		Body: services.ShopItemReq{}, Res: services.ShopItemInfo{}},
+	{Method: "PUT", Path: "/admin/shop/redemptions/{param1:string}/use", Summary: "核销兑换码",
+		Description: "每个兑换码只能使用一次", Params: []string{"兑换码"}, Res: services.RedemptionInfo{}},
+}
+
+type UserStatusReq struct {
+	Reason string `json:"reason" validate:"max=200"`
+	Until  int64  `json:"until"` // 停用截止时间，Unix时间戳
+}
+
+// 封禁用户
+func (c *AdminController) PutUsersByBan(openid string) {
+	body := UserStatusReq{}
+	c.ReadJSON(&body)
+	c.Server.SetUserStatus(c.Context(), openid, models.UserBanned, 0, body.Reason)
+	c.JSON(200)
+}
+
+// 停用用户，到期后自动恢复
+func (c *AdminController) PutUsersBySuspend(openid string) {
+	body := UserStatusReq{}
+	c.ReadJSON(&body)
+	c.Server.SetUserStatus(c.Context(), openid, models.UserSuspended, body.Until, body.Reason)
+	c.JSON(200)
+}
+
+// 恢复用户
+func (c *AdminController) PutUsersByRestore(openid string) {
+	c.Server.SetUserStatus(c.Context(), openid, models.UserActive, 0, "")
+	c.JSON(200)
+}
+
+type ImportRosterRes struct {
+	Imported int `json:"imported"`
+}
+
+// 导入学生名单，请求体为 CSV，每行为 学号,姓名
+func (c *AdminController) PostRoster() {
+	defer c.Ctx.Request().Body.Close()
+	c.JSON(200, ImportRosterRes{c.Server.ImportRoster(c.Context(), c.Ctx.Request().Body)})
+}
+
+// 获取所有委托类型，包括已经停用的
+func (c *AdminController) GetCategories() {
+	c.JSON(200, c.Category.GetCategories(c.Context(), true))
+}
+
+// 创建或者修改委托类型
+func (c *AdminController) PutCategoriesBy(key string) {
+	body := &models.CategoryDoc{}
+	c.ReadJSON(body)
+	body.Key = key
+	c.Category.SaveCategory(c.Context(), body)
+	c.JSON(200)
+}
+
+// 查询审计日志的参数
+type AuditLogQuery struct {
+	PageQuery
+	Actor  string `form:"actor" validate:"max=64"`  // 操作者的 open id
+	Action string `form:"action" validate:"max=64"` // 例如 delegation.cancel
+	Target string `form:"target" validate:"max=64"` // 委托 id、用户 open id 等
+	Since  int64  `form:"since" validate:"min=0"`   // Unix时间戳
+	Until  int64  `form:"until" validate:"min=0"`   // Unix时间戳
+}
+
+// 查询审计日志
+func (c *AdminController) GetAuditLog() {
+	params := AuditLogQuery{}
+	c.ReadQuery(&params)
+	res := c.Audit.QueryAuditLog(c.Context(), params.Page, params.Limit, &models.AuditQuery{
+		ActorID:  params.Actor,
+		Action:   params.Action,
+		TargetID: params.Target,
+		Since:    params.Since,
+		Until:    params.Until,
+	})
+	c.JSON(200, res, lib.Page{Page: params.Page, Limit: params.Limit, Total: len(res)})
+}
+
+// 查询提现申请的参数
+type WithdrawalQuery struct {
+	PageQuery
+	State string `form:"state" validate:"omitempty,oneof=pending approved paid rejected failed"` // 为空时不限制状态
+}
+
+var withdrawalStates = map[string]models.EnumWithdrawalState{
+	"pending":  models.WithdrawalPending,
+	"approved": models.WithdrawalApproved,
+	"paid":     models.WithdrawalPaid,
+	"rejected": models.WithdrawalRejected,
+	"failed":   models.WithdrawalFailed,
+}
+
+// 查询提现申请
+func (c *AdminController) GetWithdrawals() {
+	params := WithdrawalQuery{}
+	c.ReadQuery(&params)
+	states := []models.EnumWithdrawalState{}
+	if params.State != "" {
+		states = append(states, withdrawalStates[params.State])
+	}
+	res := c.Payment.GetWithdrawals(c.Context(), "", params.Page, params.Limit, states...)
+	c.JSON(200, res, lib.Page{Page: params.Page, Limit: params.Limit, Total: len(res)})
+}
+
+// 批准提现申请
+func (c *AdminController) PutWithdrawalsByApprove(withdrawalID string) {
+	c.JSON(200, c.Payment.ReviewWithdrawal(c.Context(), c.Session.GetString(IdKey), withdrawalID, true, ""))
+}
+
+type RejectWithdrawalReq struct {
+	Reason string `json:"reason" validate:"max=200"`
+}
+
+// 拒绝提现申请
+func (c *AdminController) PutWithdrawalsByReject(withdrawalID string) {
+	body := RejectWithdrawalReq{}
+	c.ReadJSON(&body)
+	c.JSON(200, c.Payment.ReviewWithdrawal(c.Context(), c.Session.GetString(IdKey), withdrawalID, false, body.Reason))
+}
+
+// 获取所有商品，包括已经下架的商品
+func (c *AdminController) GetShopItems() {
+	c.JSON(200, c.Shop.GetItems(c.Context(), true))
+}
+
+// 创建商品
+func (c *AdminController) PostShopItems() {
+	body := services.ShopItemReq{}
+	c.ReadJSON(&body)
+	c.JSON(200, c.Shop.CreateItem(c.Context(), c.Session.GetString(IdKey), &body))
+}
+
+// 修改商品
+func (c *AdminController) PutShopItemsBy(itemID string) {
+	body := services.ShopItemReq{}
+	c.ReadJSON(&body)
+	c.JSON(200, c.Shop.UpdateItem(c.Context(), c.Session.GetString(IdKey), itemID, &body))
+}
+
+// 核销兑换码
+func (c *AdminController) PutShopRedemptionsByUse(code string) {
+	c.JSON(200, c.Shop.UseRedemption(c.Context(), c.Session.GetString(IdKey), code))
+}
@@ -0,0 +1,86 @@
+package controllers
+
+import (
+	"io/ioutil"
+
+	"github.com/kataras/iris"
+	"github.com/kataras/iris/mvc"
+	"github.com/sysu-team/Back-end-development/app/models"
+	"github.com/sysu-team/Back-end-development/app/services"
+	"github.com/sysu-team/Back-end-development/lib"
+)
+
+// AttachmentController 附件控制
+type AttachmentController struct {
+	BaseController
+	Server services.AttachmentService
+}
+
+// BindAttachmentController 绑定附件控制器
+func BindAttachmentController(app *iris.Application) {
+	attachmentRoute := mvc.New(app.Party("/attachments"))
+
+	attachmentRoute.Register(services.NewAttachmentService(), getSession().Start)
+	attachmentRoute.Handle(new(AttachmentController))
+}
+
+func (c *AttachmentController) BeforeActivation(b mvc.BeforeActivation) {
+	b.Handle("POST", "/", "Post", withLogin)
+	b.Handle("GET", "/{param1:string}", "GetBy")
+	b.Handle("GET", "/{param1:string}/thumbnail", "GetByThumbnail")
+}
+
+// 上传附件的表单，只用于接口文档
+type attachmentForm struct {
+	File    []byte `form:"file" validate:"required"`
+	Purpose string `form:"purpose" validate:"required,oneof=delegation proof message"`
+}
+
+// 接口文档
+var attachmentRouteDocs = []lib.RouteDoc{
+	{Method: "POST", Path: "/attachments", Summary: "上传附件", Form: attachmentForm{}, Res: services.AttachmentInfo{}},
+	{Method: "GET", Path: "/attachments/{param1:string}", Summary: "获取附件",
+		Description: "完成凭证只对上传者和委托的发布者可见，聊天图片只对委托的发布者和接受者可见", Params: []string{"附件 id"}, RawRes: "application/octet-stream"},
+	{Method: "GET", Path: "/attachments/{param1:string}/thumbnail", Summary: "获取图片附件的缩略图",
+		Params: []string{"附件 id"}, RawRes: "image/jpeg"},
+}
+
+// 读取表单中上传的文件，超过大小限制的请求会被拒绝
+func readUploadFile(ctx iris.Context, field string) (fileName string, data []byte) {
+	// 预留表单其他字段的空间
+	ctx.SetMaxRequestBodySize(services.MaxAttachmentSize() + 1<<16)
+	file, header, err := ctx.FormFile(field)
+	lib.Assert(err == nil, "invalid_attachment_size")
+	defer file.Close()
+	data, err = ioutil.ReadAll(file)
+	lib.Assert(err == nil, "invalid_attachment_size")
+	return header.Filename, data
+}
+
+// 上传附件
+// 表单字段 file 为文件，purpose 为用途：delegation / proof / message
+func (c *AttachmentController) Post() {
+	fileName, data := readUploadFile(c.Ctx, "file")
+	purpose := models.EnumAttachmentPurpose(c.Ctx.FormValue("purpose"))
+	lib.Assert(purpose == models.PurposeDelegation || purpose == models.PurposeProof || purpose == models.PurposeMessage,
+		"invalid_attachment_purpose")
+	c.JSON(200, c.Server.Upload(c.Context(), c.Session.GetString(IdKey), purpose, fileName, data))
+}
+
+// 获取附件
+func (c *AttachmentController) GetBy(attachmentID string) {
+	info, data := c.Server.GetAttachment(c.Context(), c.Session.GetString(IdKey), attachmentID)
+	c.Ctx.ContentType(info.ContentType)
+	c.Ctx.Header("Cache-Control", "private, max-age=86400")
+	_, err := c.Ctx.Write(data)
+	lib.AssertErr(err)
+}
+
+// 获取图片附件的缩略图
+func (c *AttachmentController) GetByThumbnail(attachmentID string) {
+	data := c.Server.GetThumbnail(c.Context(), c.Session.GetString(IdKey), attachmentID)
+	c.Ctx.ContentType("image/jpeg")
+	c.Ctx.Header("Cache-Control", "private, max-age=86400")
+	_, err := c.Ctx.Write(data)
+	lib.AssertErr(err)
+}
@@ -0,0 +1,37 @@
+package controllers
+
+import (
+	"github.com/kataras/iris"
+	"github.com/kataras/iris/mvc"
+	"github.com/sysu-team/Back-end-development/app/models"
+	"github.com/sysu-team/Back-end-development/app/services"
+	"github.com/sysu-team/Back-end-development/lib"
+)
+
+// CategoryController 委托类型控制
+type CategoryController struct {
+	BaseController
+	Server services.CategoryService
+}
+
+// BindCategoryController 绑定委托类型控制器
+func BindCategoryController(app *iris.Application) {
+	categoryRoute := mvc.New(app.Party("/categories"))
+
+	categoryRoute.Register(services.NewCategoryService(), getSession().Start)
+	categoryRoute.Handle(new(CategoryController))
+}
+
+func (c *CategoryController) BeforeActivation(b mvc.BeforeActivation) {
+	b.Handle("GET", "/", "Get")
+}
+
+// 接口文档
+var categoryRouteDocs = []lib.RouteDoc{
+	{Method: "GET", Path: "/categories", Summary: "获取可以发布的委托类型", Res: []models.CategoryDoc{}},
+}
+
+// 获取可以发布的委托类型
+func (c *CategoryController) Get() {
+	c.JSON(200, c.Server.GetCategories(c.Context(), false))
+}
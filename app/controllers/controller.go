@@ -1,13 +1,13 @@
 package controllers
 
 import (
-	"fmt"
+	"context"
 	"github.com/kataras/iris"
-	"github.com/kataras/iris/middleware/logger"
 	"github.com/kataras/iris/middleware/recover"
 	"github.com/kataras/iris/sessions"
-	"github.com/rs/zerolog/log"
+	"github.com/rs/zerolog"
 	"github.com/sysu-team/Back-end-development/app/configs"
+	"github.com/sysu-team/Back-end-development/app/services"
 	"github.com/sysu-team/Back-end-development/lib"
 	"time"
 )
@@ -27,11 +27,16 @@ const (
 var (
 	WxAppid  string
 	WxSecret string
+	// 拥有管理权限的用户
+	AdminOpenIDs []string
 )
 
 // singleton
 var sessionManager *sessions.Sessions
 
+// 保存 session id 的 cookie 名
+var sessionCookie = "cddwxm"
+
 type BaseController struct {
 	Ctx     iris.Context
 	Session *sessions.Session
@@ -44,15 +49,38 @@ func (c *BaseController) JSON(v ...interface{}) {
 	lib.JSON(c.Ctx, v...)
 }
 
+// 请求的 context，客户端断开连接或者服务器关闭时被取消，带有请求的日志
+func (c *BaseController) Context() context.Context {
+	return lib.RequestContext(c.Ctx)
+}
+
+// 请求的日志，带有请求 id、路由和登录用户
+func (c *BaseController) Log() *zerolog.Logger {
+	return lib.RequestLogger(c.Ctx)
+}
+
+// 读取请求体中的 json，并按照 validate 标签检查参数
+func (c *BaseController) ReadJSON(body interface{}) {
+	lib.Assert(c.Ctx.ReadJSON(body) == nil, "invalid_params")
+	lib.Validate(body)
+}
+
+// 读取 url 中的参数，并按照 validate 标签检查参数
+func (c *BaseController) ReadQuery(query interface{}) {
+	lib.BindQuery(c.Ctx, query)
+}
+
+// 分页参数
 type PageQuery struct {
-	Page  *int `form:"page"`
-	Limit *int `form:"limit"`
+	Page  int `form:"page" validate:"required,min=1"`
+	Limit int `form:"limit" validate:"required,min=1,max=100"`
 }
 
 // InitSession 初始化 Session
 func InitSession(config *configs.SessionConfig) {
+	sessionCookie = config.Key
 	sessionManager = sessions.New(sessions.Config{
-		Cookie: config.Key,
+		Cookie: sessionCookie,
 	})
 }
 
@@ -63,13 +91,29 @@ func NewApp() *iris.Application {
 	// panic handler
 	// recover from any http-relative panics
 	app.Use(recover.New())
-	// log the requests to the terminal.
-	app.Use(logger.New())
+	// 请求数量和耗时
+	app.Use(lib.NewMetricsHandler())
+	// 请求 id 和访问日志
+	app.Use(lib.NewRequestLogger())
 	// error handler 错误集中处理
 	app.Use(lib.NewErrorHandler())
+	// 限流，需要在 error handler 之后，超过限制时返回 429
+	app.Use(withIPRateLimit)
+	// 幂等键，需要在限流之后，重试的请求同样计入限流
+	app.Use(withIdempotency)
 	BindUserController(app)
 	BindDelegationController(app)
 	BindQuestionnaireController(app)
+	BindAttachmentController(app)
+	BindCategoryController(app)
+	BindPaymentController(app)
+	BindShopController(app)
+	BindLeaderboardController(app)
+	BindAdminController(app)
+	BindErrorController(app)
+	BindHealthController(app)
+	// 接口文档需要在所有路由注册之后绑定
+	BindDocsController(app)
 	return app
 }
 
@@ -77,7 +121,7 @@ func getSession() *sessions.Sessions {
 	if sessionManager == nil {
 		// 生成默认 Session
 		sessionManager = sessions.New(sessions.Config{
-			Cookie: "cddwxm",
+			Cookie: sessionCookie,
 		})
 	}
 	return sessionManager
@@ -89,10 +133,26 @@ func withLogin(ctx iris.Context) {
 	session := sessionManager.Start(ctx)
 	id := session.GetString(IdKey)
 	idTime := session.GetInt64Default(IdTimeKey, 0)
-	log.Debug().Msg(fmt.Sprintf("session_id(cookie): %v, user_id: %v, time: %v", session.ID(), id, idTime))
-	lib.Assert(id != "" && idTime != 0 && time.Now().Unix()-idTime <= 86400, "invalid_token", 401)
+	lib.Assert(id != "" && idTime != 0 && time.Now().Unix()-idTime <= 86400, "invalid_token")
+	lib.SetLogUser(ctx, id)
+	checkWriteRateLimit(ctx, id)
+	// 已经登陆的用户被封禁/停用后不能继续操作
+	services.NewUserService().CheckUserStatus(lib.RequestContext(ctx), id)
 	ctx.Values().Set(IdKey, id)
 	ctx.Next()
 }
 
+// 一些接口需要管理员权限，需要放在 withLogin 之后
+func withAdmin(ctx iris.Context) {
+	id := ctx.Values().GetString(IdKey)
+	isAdmin := false
+	for _, adminID := range AdminOpenIDs {
+		if adminID == id {
+			isAdmin = true
+		}
+	}
+	lib.Assert(isAdmin, "permission_denied")
+	ctx.Next()
+}
+
 //func setLogin(ctx)
@@ -1,12 +1,17 @@
 package controllers
 
 import (
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"strconv"
+	"strings"
+	"time"
 
+	jsoniter "github.com/json-iterator/go"
 	"github.com/kataras/iris"
 	"github.com/kataras/iris/mvc"
-	"github.com/rs/zerolog/log"
+	"github.com/sysu-team/Back-end-development/app/models"
 	"github.com/sysu-team/Back-end-development/app/services"
 	"github.com/sysu-team/Back-end-development/lib"
 )
@@ -15,7 +20,8 @@ import (
 type DelegationController struct {
 	BaseController
 	// 使用的是 interface 而不是 struct
-	Server services.DelegationService
+	Server  services.DelegationService
+	Message services.MessageService
 }
 
 // BindUserController 绑定用户控制器
@@ -24,7 +30,7 @@ func BindDelegationController(app *iris.Application) {
 
 	// 使用 Register 来初始化 UserController 中的 Filed
 	// 全局只有一个  sessions ，每一个连接都会生成一个 session
-	delegationRoute.Register(services.NewDelegationService(), getSession().Start)
+	delegationRoute.Register(services.NewDelegationService(), services.NewMessageService(), getSession().Start)
 	delegationRoute.Handle(new(DelegationController))
 }
 
@@ -39,34 +45,96 @@ func (c *DelegationController) BeforeActivation(b mvc.BeforeActivation) {
 	// todo 取消委托 和 完成委托
 	b.Handle("PUT", "/{param1:string}/cancel", "PutByCancel", withLogin)
 	b.Handle("PUT", "/{param1:string}/finish", "PutByFinish", withLogin)
+	// 发布者为接受者评分
+	b.Handle("POST", "/{param1:string}/ratings", "PostByRatings", withLogin)
+	// 发布者和接受者之间的聊天
+	b.Handle("GET", "/{param1:string}/messages", "GetByMessages", withLogin)
+	b.Handle("POST", "/{param1:string}/messages", "PostByMessages", withLogin)
+	b.Handle("PUT", "/{param1:string}/messages/read", "PutByMessagesRead", withLogin)
+	b.Handle("GET", "/{param1:string}/messages/stream", "GetByMessagesStream", withLogin)
+}
+
+// 接口文档
+var delegationRouteDocs = []lib.RouteDoc{
+	{Method: "GET", Path: "/delegations", Summary: "获取委托列表",
+		Description: "near=lat,lng 按与取件地点的距离搜索，radius 为搜索半径（米），sort=distance 按距离排序",
+		Query:       DelegationListQuery{}, Res: []models.DelegationPreviewWrapper{}, Paged: true},
+	{Method: "GET", Path: "/delegations/{param1:string}", Summary: "获取委托详情",
+		Params: []string{"委托 id"}, Res: services.DelegationInfoWrapper{}},
+	{Method: "POST", Path: "/delegations", Summary: "发布委托", Body: services.DelegationInfoReq{}},
+	{Method: "PUT", Path: "/delegations/{param1:string}/accept", Summary: "接受委托", Params: []string{"委托 id"}},
+	{Method: "PUT", Path: "/delegations/{param1:string}/cancel", Summary: "取消委托", Params: []string{"委托 id"}},
+	{Method: "PUT", Path: "/delegations/{param1:string}/finish", Summary: "完成委托",
+		Description: "接受者提交完成凭证，发布者确认完成，请求体可以为空", Params: []string{"委托 id"}, Body: FinishDelegationReq{}},
+	{Method: "POST", Path: "/delegations/{param1:string}/ratings", Summary: "为接受者评分",
+		Description: "只有发布者可以在委托完成之后评分，每个接受者只能评分一次", Params: []string{"委托 id"}, Body: RatingReq{}},
+	{Method: "GET", Path: "/delegations/{param1:string}/messages", Summary: "获取聊天消息",
+		Description: "按发送时间从新到旧，after 为消息 id，只返回这条消息之后的消息",
+		Params:      []string{"委托 id"}, Query: MessageListQuery{}, Res: []services.MessageInfo{}, Paged: true},
+	{Method: "POST", Path: "/delegations/{param1:string}/messages", Summary: "发送聊天消息",
+		Description: "委托有接受者之后才能发送，完成或者取消之后只能查看；图片消息先上传用途为 message 的附件",
+		Params:      []string{"委托 id"}, Body: services.MessageReq{}, Res: services.MessageInfo{}},
+	{Method: "PUT", Path: "/delegations/{param1:string}/messages/read", Summary: "标记消息已读",
+		Description: "把 up_to 以及之前别人发送的消息标记为已读", Params: []string{"委托 id"}, Body: ReadMessagesReq{}},
+	{Method: "GET", Path: "/delegations/{param1:string}/messages/stream", Summary: "实时接收聊天消息",
+		Description: "Server-Sent Events，事件为 message 新消息和 read 已读回执，data 为 ChatEvent；" +
+			"只推送连接之后的事件，断开之后用 after 拉取错过的消息",
+		Params: []string{"委托 id"}, RawRes: "text/event-stream"},
+}
+
+// 获取委托的查询参数
+type DelegationListQuery struct {
+	PageQuery
+	State  int     `form:"state" validate:"min=0,max=4"`
+	Area   string  `form:"area" validate:"max=50"`
+	Near   string  `form:"near"`                    // lat,lng
+	Radius float64 `form:"radius" validate:"min=0"` // 单位米
+	Sort   string  `form:"sort" validate:"oneof=distance time"`
 }
 
 // 获取委托
-// todo: 新的api, 按 url 中参数进行筛选
+// 可选参数：
+// area 按校园区域筛选
+// near=lat,lng 按与取件地点的距离搜索，radius 为搜索半径（米），sort=distance 按距离排序
 func (c *DelegationController) Get() {
-	log.Debug().Msg(fmt.Sprintf("page : %v, limit: %v, state: %v",
-		c.Ctx.URLParam("page"), c.Ctx.URLParam("limit"), c.Ctx.URLParam("state")))
-	page, err := strconv.Atoi(c.Ctx.URLParam("page"))
-	lib.AssertErr(err)
-	limit, err := strconv.Atoi(c.Ctx.URLParam("limit"))
-	lib.AssertErr(err)
-	state, err := strconv.Atoi(c.Ctx.URLParam("state"))
-	lib.AssertErr(err)
-	lib.Assert(page > 0 && limit > 0, "invalid_params")
-	res := c.Server.GetDelegationPreview(page, limit, state)
-	c.JSON(200, res, lib.Page{Page: page, Limit: limit, Total: len(res)})
+	params := DelegationListQuery{}
+	c.ReadQuery(&params)
+	c.Log().Debug().Interface("query", params).Msg("delegation list query")
+	query := &models.DelegationQuery{
+		State: params.State,
+		Area:  params.Area,
+	}
+	if params.Near != "" {
+		query.Near = parseNear(params.Near)
+		query.Radius = params.Radius
+		query.SortByDistance = params.Sort == "distance"
+	} else {
+		lib.Assert(params.Sort != "distance", "invalid_params")
+	}
+	res := c.Server.GetDelegationPreview(c.Context(), params.Page, params.Limit, query)
+	c.JSON(200, res, lib.Page{Page: params.Page, Limit: params.Limit, Total: len(res)})
+}
+
+// 解析 lat,lng 格式的位置参数
+func parseNear(near string) *models.GeoPoint {
+	parts := strings.Split(near, ",")
+	lib.Assert(len(parts) == 2, "invalid_location")
+	lat, err1 := strconv.ParseFloat(strings.TrimSpace(parts[0]), 64)
+	lng, err2 := strconv.ParseFloat(strings.TrimSpace(parts[1]), 64)
+	lib.Assert(err1 == nil && err2 == nil && services.IsValidLocation(lat, lng), "invalid_location")
+	return models.NewGeoPoint(lat, lng)
 }
 
 // 获取特定的委托
 func (c *DelegationController) GetBy(delegationID string) {
 	// 检查参数的合法性
 	lib.Assert(MatchDelegationID(delegationID), "invalid_params")
-	c.JSON(200, c.Server.GetSpecificDelegation(delegationID))
+	c.JSON(200, c.Server.GetSpecificDelegation(c.Context(), delegationID))
 }
 
-// todo
+// 检查委托 id 的格式
 func MatchDelegationID(delegationID string) bool {
-	return true
+	return lib.IsObjectID(delegationID)
 }
 
 // 创建委托
@@ -75,10 +143,10 @@ func MatchDelegationID(delegationID string) bool {
 // 3. 检查用户的积分是否足够冻结
 func (c *DelegationController) Post() {
 	body := &services.DelegationInfoReq{}
-	lib.Assert(c.Ctx.ReadJSON(body) == nil, "invalid_params")
+	c.ReadJSON(body)
 	body.Publisher = c.Session.GetString(IdKey)
-	lib.Assert(body.Publisher != "", "unknown_err")
-	c.Server.CreateDelegation(body)
+	lib.Assert(body.Publisher != "", "not_login")
+	c.Server.CreateDelegation(c.Context(), body)
 	c.JSON(200)
 }
 
@@ -87,8 +155,9 @@ func (c *DelegationController) Post() {
 // 2. 检验委托是否已经被接受了
 // 3. 检验是否满足接受的委托的条件 -- 具体条件积分账户可以被预冻结10个积分
 func (c *DelegationController) PutByAccept(delegationID string) {
-	lib.Assert(c.Session.GetString(IdKey) != "", "unknown_err")
-	c.Server.ReceiveDelegation(c.Session.GetString(IdKey), delegationID)
+	lib.Assert(MatchDelegationID(delegationID), "invalid_params")
+	lib.Assert(c.Session.GetString(IdKey) != "", "not_login")
+	c.Server.ReceiveDelegation(c.Context(), c.Session.GetString(IdKey), delegationID)
 	c.JSON(200)
 }
 
@@ -96,16 +165,120 @@ func (c *DelegationController) PutByAccept(delegationID string) {
 // 1. 检验该委托是否存在
 // 2. 检验委托是否已经被取消/已完成
 func (c *DelegationController) PutByCancel(delegationID string) {
-	lib.Assert(c.Session.GetString(IdKey) != "", "unknown_err")
-	c.Server.CancelDelegation(c.Session.GetString(IdKey), delegationID)
+	lib.Assert(MatchDelegationID(delegationID), "invalid_params")
+	lib.Assert(c.Session.GetString(IdKey) != "", "not_login")
+	c.Server.CancelDelegation(c.Context(), c.Session.GetString(IdKey), delegationID)
 	c.JSON(200)
 }
 
+type FinishDelegationReq struct {
+	Proofs []string `json:"proofs" validate:"max=9,dive,objectid"` // 完成凭证的附件 id
+}
+
 // 完成委托
 // 1. 检验该委托是否存在
 // 2. 检验委托是否已经被取消/已完成
+// 接受者可以在请求体中附带完成凭证，请求体可以为空
 func (c *DelegationController) PutByFinish(delegationID string) {
-	lib.Assert(c.Session.GetString(IdKey) != "", "unknown_err")
-	c.Server.FinishDelegation(c.Session.GetString(IdKey), delegationID)
+	lib.Assert(MatchDelegationID(delegationID), "invalid_params")
+	lib.Assert(c.Session.GetString(IdKey) != "", "not_login")
+	body := FinishDelegationReq{}
+	raw, err := ioutil.ReadAll(c.Ctx.Request().Body)
+	lib.Assert(err == nil, "invalid_params")
+	if len(raw) != 0 {
+		lib.Assert(json.Unmarshal(raw, &body) == nil, "invalid_params")
+		lib.Validate(&body)
+	}
+	c.Server.FinishDelegation(c.Context(), c.Session.GetString(IdKey), delegationID, body.Proofs)
+	c.JSON(200)
+}
+
+type RatingReq struct {
+	ReceiverID string `json:"receiver_id" validate:"required"`
+	Score      int    `json:"score" validate:"min=1,max=5"`
+}
+
+// 为接受者评分
+func (c *DelegationController) PostByRatings(delegationID string) {
+	lib.Assert(MatchDelegationID(delegationID), "invalid_params")
+	body := RatingReq{}
+	c.ReadJSON(&body)
+	c.Server.RateReceiver(c.Context(), c.Session.GetString(IdKey), delegationID, body.ReceiverID, body.Score)
+	c.JSON(200)
+}
+
+// 获取聊天消息的查询参数
+type MessageListQuery struct {
+	PageQuery
+	After string `form:"after" validate:"omitempty,objectid"` // 只返回这条消息之后的消息
+}
+
+// 获取聊天消息
+func (c *DelegationController) GetByMessages(delegationID string) {
+	lib.Assert(MatchDelegationID(delegationID), "invalid_params")
+	params := MessageListQuery{}
+	c.ReadQuery(&params)
+	res := c.Message.GetMessages(c.Context(), c.Session.GetString(IdKey), delegationID, params.After, params.Page, params.Limit)
+	c.JSON(200, res, lib.Page{Page: params.Page, Limit: params.Limit, Total: len(res)})
+}
+
+// 发送聊天消息
+func (c *DelegationController) PostByMessages(delegationID string) {
+	lib.Assert(MatchDelegationID(delegationID), "invalid_params")
+	body := services.MessageReq{}
+	c.ReadJSON(&body)
+	c.JSON(200, c.Message.Send(c.Context(), c.Session.GetString(IdKey), delegationID, &body))
+}
+
+type ReadMessagesReq struct {
+	UpTo string `json:"up_to" validate:"required,objectid"` // 读到的最后一条消息的 id
+}
+
+// 标记消息已读
+func (c *DelegationController) PutByMessagesRead(delegationID string) {
+	lib.Assert(MatchDelegationID(delegationID), "invalid_params")
+	body := ReadMessagesReq{}
+	c.ReadJSON(&body)
+	c.Message.MarkRead(c.Context(), c.Session.GetString(IdKey), delegationID, body.UpTo)
 	c.JSON(200)
 }
+
+// 没有事件时定期发送注释，避免连接被代理当作空闲连接关闭
+const chatHeartbeat = 30 * time.Second
+
+// 实时接收聊天消息
+// 客户端断开、取消订阅或者服务器关闭时结束
+func (c *DelegationController) GetByMessagesStream(delegationID string) {
+	lib.Assert(MatchDelegationID(delegationID), "invalid_params")
+	ctx := c.Context()
+	events, cancel := c.Message.Subscribe(ctx, c.Session.GetString(IdKey), delegationID)
+	defer cancel()
+
+	c.Ctx.ContentType("text/event-stream")
+	c.Ctx.Header("Cache-Control", "no-cache")
+	c.Ctx.Header("X-Accel-Buffering", "no")
+	w := c.Ctx.ResponseWriter()
+	w.Flush()
+	heartbeat := time.NewTicker(chatHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		var err error
+		select {
+		case <-ctx.Done():
+			return
+		case event, ok := <-events:
+			if !ok {
+				return
+			}
+			data, e := jsoniter.Marshal(event)
+			lib.AssertErr(e)
+			_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Type, data)
+		case <-heartbeat.C:
+			_, err = fmt.Fprint(w, ": ping\n\n")
+		}
+		if err != nil {
+			return
+		}
+		w.Flush()
+	}
+}
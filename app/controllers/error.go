@@ -0,0 +1,41 @@
+package controllers
+
+import (
+	"github.com/kataras/iris"
+	"github.com/kataras/iris/mvc"
+	"github.com/sysu-team/Back-end-development/lib"
+)
+
+// ErrorController 错误目录
+type ErrorController struct {
+	BaseController
+}
+
+// BindErrorController 绑定错误目录控制器
+func BindErrorController(app *iris.Application) {
+	errorRoute := mvc.New(app.Party("/errors"))
+
+	errorRoute.Handle(new(ErrorController))
+
+	// 未匹配的路由同样按照错误目录返回
+	app.OnErrorCode(iris.StatusNotFound, func(ctx iris.Context) {
+		lib.RenderError(ctx, lib.AppError{Key: "route_not_found"})
+	})
+	app.OnErrorCode(iris.StatusMethodNotAllowed, func(ctx iris.Context) {
+		lib.RenderError(ctx, lib.AppError{Key: "method_not_allowed"})
+	})
+}
+
+func (c *ErrorController) BeforeActivation(b mvc.BeforeActivation) {
+	b.Handle("GET", "/", "Get")
+}
+
+// 接口文档
+var errorRouteDocs = []lib.RouteDoc{
+	{Method: "GET", Path: "/errors", Summary: "获取所有的错误码及其含义", Res: []lib.ErrorDef{}},
+}
+
+// 获取所有的错误码及其含义
+func (c *ErrorController) Get() {
+	c.JSON(200, lib.ErrorCatalog())
+}
@@ -0,0 +1,65 @@
+package controllers
+
+import (
+	"bytes"
+	"context"
+	"sync"
+	"time"
+
+	"github.com/kataras/iris"
+	"github.com/sysu-team/Back-end-development/app/models"
+	"github.com/sysu-team/Back-end-development/app/services"
+	"github.com/sysu-team/Back-end-development/lib"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+)
+
+// 检查数据库连接的超时时间
+const readyTimeout = 2 * time.Second
+
+var registerGaugesOnce sync.Once
+
+// 业务指标，在采集时查询数据库
+func registerBusinessGauges() {
+	lib.DefaultRegistry.Register(
+		lib.NewGaugeFunc("delegations", "Number of delegations by state.", func() []lib.GaugeSample {
+			samples := make([]lib.GaugeSample, 0)
+			counts := services.NewMetricsService().CountDelegationsByState(context.Background())
+			for state := models.Published; state <= models.Finished; state++ {
+				samples = append(samples, lib.GaugeSample{LabelValues: []string{state.String()}, Value: float64(counts[state])})
+			}
+			return samples
+		}, "state"),
+		lib.NewGaugeFunc("frozen_credit", "Credit frozen by delegations in progress.", func() []lib.GaugeSample {
+			return []lib.GaugeSample{{Value: float64(services.NewMetricsService().GetFrozenCredit(context.Background()))}}
+		}),
+	)
+}
+
+// BindHealthController 绑定健康检查和监控指标
+// 进程管理器使用 /healthz 判断进程是否存活，使用 /readyz 判断是否可以接收请求
+func BindHealthController(app *iris.Application) {
+	registerGaugesOnce.Do(registerBusinessGauges)
+	app.Get("/healthz", func(ctx iris.Context) {
+		lib.JSON(ctx, 200)
+	})
+	app.Get("/readyz", func(ctx iris.Context) {
+		pingCtx, cancel := context.WithTimeout(context.Background(), readyTimeout)
+		defer cancel()
+		lib.AssertErr(models.GetModel().DB.Client().Ping(pingCtx, readpref.Primary()), "not_ready")
+		lib.JSON(ctx, 200)
+	})
+	app.Get("/metrics", func(ctx iris.Context) {
+		buf := &bytes.Buffer{}
+		lib.DefaultRegistry.Write(buf)
+		ctx.ContentType("text/plain; version=0.0.4")
+		_, err := ctx.Write(buf.Bytes())
+		lib.AssertErr(err)
+	})
+}
+
+// 接口文档
+var healthRouteDocs = []lib.RouteDoc{
+	{Method: "GET", Path: "/healthz", Summary: "存活检查"},
+	{Method: "GET", Path: "/readyz", Summary: "就绪检查", Description: "数据库无法连接时返回 503"},
+	{Method: "GET", Path: "/metrics", Summary: "Prometheus 格式的监控指标", RawRes: "text/plain"},
+}
@@ -0,0 +1,84 @@
+package controllers
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"regexp"
+
+	"github.com/kataras/iris"
+	"github.com/sysu-team/Back-end-development/app/services"
+	"github.com/sysu-team/Back-end-development/lib"
+)
+
+const (
+	IdempotencyKeyHeader      = "Idempotency-Key"
+	IdempotentReplayedHeader  = "Idempotent-Replayed"
+	maxIdempotentRequestBytes = 16 << 20
+)
+
+var idempotencyKeyPattern = regexp.MustCompile(`^[\x21-\x7e]{1,128}$`)
+
+// 带有 Idempotency-Key 的 POST / PUT 请求，客户端重试时返回第一次请求的响应
+// 只保存成功的响应，失败的请求可以使用同一个幂等键重试
+func withIdempotency(ctx iris.Context) {
+	key := ctx.GetHeader(IdempotencyKeyHeader)
+	method := ctx.Method()
+	if key == "" || (method != "POST" && method != "PUT") {
+		ctx.Next()
+		return
+	}
+	lib.Assert(idempotencyKeyPattern.MatchString(key), "invalid_idempotency_key")
+
+	// 读取请求体计算摘要，之后还原给 controller
+	body, err := ioutil.ReadAll(io.LimitReader(ctx.Request().Body, maxIdempotentRequestBytes+1))
+	lib.AssertErr(err)
+	lib.Assert(len(body) <= maxIdempotentRequestBytes, "request_too_large")
+	ctx.Request().Body = ioutil.NopCloser(bytes.NewReader(body))
+	hash := sha256.New()
+	hash.Write([]byte(method + " " + ctx.Path() + "\n"))
+	hash.Write(body)
+	requestHash := hex.EncodeToString(hash.Sum(nil))
+
+	scope := idempotencyScope(ctx)
+	service := services.NewIdempotencyService()
+	if saved := service.Begin(lib.RequestContext(ctx), scope, key, requestHash); saved != nil {
+		ctx.Header(IdempotentReplayedHeader, "true")
+		ctx.ContentType(saved.ContentType)
+		ctx.StatusCode(saved.StatusCode)
+		_, err := ctx.Write(saved.Body)
+		lib.AssertErr(err)
+		return
+	}
+
+	completed := false
+	defer func() {
+		// controller 中断言失败产生 panic 时同样需要释放幂等键
+		if !completed {
+			saveCtx, cancel := lib.Detach(lib.RequestContext(ctx))
+			defer cancel()
+			service.Abort(saveCtx, scope, key)
+		}
+	}()
+	ctx.Record()
+	ctx.Next()
+	if recorder, ok := ctx.IsRecording(); ok {
+		if status := recorder.StatusCode(); status >= 200 && status < 300 {
+			// 保存结果不随请求取消，客户端断开之后重试时才能得到结果
+			saveCtx, cancel := lib.Detach(lib.RequestContext(ctx))
+			defer cancel()
+			service.Complete(saveCtx, scope, key, status, ctx.GetContentType(), recorder.Body())
+			completed = true
+		}
+	}
+}
+
+// 幂等键的调用方，已有 session 时为 session，否则为 IP
+func idempotencyScope(ctx iris.Context) string {
+	if cookie, err := ctx.Request().Cookie(sessionCookie); err == nil && cookie.Value != "" {
+		return "session:" + cookie.Value
+	}
+	return "ip:" + ctx.RemoteAddr()
+}
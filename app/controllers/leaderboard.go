@@ -0,0 +1,57 @@
+package controllers
+
+import (
+	"github.com/kataras/iris"
+	"github.com/kataras/iris/mvc"
+	"github.com/sysu-team/Back-end-development/app/models"
+	"github.com/sysu-team/Back-end-development/app/services"
+	"github.com/sysu-team/Back-end-development/lib"
+)
+
+// LeaderboardController 排行榜
+type LeaderboardController struct {
+	BaseController
+	Server services.LeaderboardService
+}
+
+// BindLeaderboardController 绑定排行榜控制器
+func BindLeaderboardController(app *iris.Application) {
+	leaderboardRoute := mvc.New(app.Party("/leaderboards"))
+
+	leaderboardRoute.Register(services.NewLeaderboardService(), getSession().Start)
+	leaderboardRoute.Handle(new(LeaderboardController))
+}
+
+func (c *LeaderboardController) BeforeActivation(b mvc.BeforeActivation) {
+	b.Handle("GET", "/", "Get", withLogin)
+}
+
+// 接口文档
+var leaderboardRouteDocs = []lib.RouteDoc{
+	{Method: "GET", Path: "/leaderboards", Summary: "获取排行榜",
+		Description: "从已经完成的委托统计，每 10 分钟更新一次；关闭了排行榜的用户不会出现",
+		Query:       LeaderboardQuery{}, Res: services.LeaderboardInfo{}},
+}
+
+// 获取排行榜的参数
+type LeaderboardQuery struct {
+	Role   string `form:"role" validate:"omitempty,oneof=helpers publishers"`    // 默认为 helpers
+	Metric string `form:"metric" validate:"omitempty,oneof=count credit rating"` // 默认为 count，rating 只支持 helpers
+	Scope  string `form:"scope" validate:"omitempty,oneof=all month week"`       // 默认为 week
+}
+
+// 获取排行榜
+func (c *LeaderboardController) Get() {
+	params := LeaderboardQuery{}
+	c.ReadQuery(&params)
+	if params.Role == "" {
+		params.Role = services.LeaderboardHelpers
+	}
+	if params.Metric == "" {
+		params.Metric = string(models.LeaderboardByCount)
+	}
+	if params.Scope == "" {
+		params.Scope = services.LeaderboardWeek
+	}
+	c.JSON(200, c.Server.GetLeaderboard(c.Context(), params.Role, models.EnumLeaderboardMetric(params.Metric), params.Scope))
+}
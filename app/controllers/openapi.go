@@ -0,0 +1,114 @@
+package controllers
+
+import (
+	"reflect"
+	"sync"
+
+	jsoniter "github.com/json-iterator/go"
+	"github.com/kataras/iris"
+	"github.com/kataras/iris/core/router"
+	"github.com/sysu-team/Back-end-development/lib"
+)
+
+const (
+	apiTitle   = "Back-end-development API"
+	apiVersion = "1.0.0"
+)
+
+// 所有接口的说明，新增路由时需要在对应控制器的说明中添加
+func routeDocs() []lib.RouteDoc {
+	docs := make([]lib.RouteDoc, 0)
+	for _, group := range [][]lib.RouteDoc{
+		userRouteDocs,
+		delegationRouteDocs,
+		questionnaireRouteDocs,
+		attachmentRouteDocs,
+		categoryRouteDocs,
+		paymentRouteDocs,
+		shopRouteDocs,
+		leaderboardRouteDocs,
+		adminRouteDocs,
+		errorRouteDocs,
+		healthRouteDocs,
+		docsRouteDocs,
+	} {
+		docs = append(docs, group...)
+	}
+	return docs
+}
+
+var docsRouteDocs = []lib.RouteDoc{
+	{Method: "GET", Path: "/openapi.json", Summary: "获取 OpenAPI 文档", RawRes: "application/json"},
+	{Method: "GET", Path: "/docs", Summary: "接口文档页面", RawRes: "text/html"},
+}
+
+// NewOpenAPISpec 根据注册的路由生成 OpenAPI 文档
+// 只包含有说明的路由，登陆和管理员权限根据路由上的中间件判断
+func NewOpenAPISpec(routes []*router.Route) *lib.OpenAPI {
+	docs := make(map[string]lib.RouteDoc)
+	for _, doc := range routeDocs() {
+		docs[doc.Method+" "+lib.OpenAPIPath(doc.Path)] = doc
+	}
+	spec := lib.NewOpenAPI(apiTitle, apiVersion, sessionCookie)
+	for _, route := range routes {
+		doc, ok := docs[route.Method+" "+lib.OpenAPIPath(route.Path)]
+		if !ok {
+			continue
+		}
+		doc.Auth = hasHandler(route, withLogin)
+		doc.Admin = hasHandler(route, withAdmin)
+		spec.AddRoute(doc)
+	}
+	return spec
+}
+
+func hasHandler(route *router.Route, handler iris.Handler) bool {
+	target := reflect.ValueOf(handler).Pointer()
+	for _, h := range route.Handlers {
+		if reflect.ValueOf(h).Pointer() == target {
+			return true
+		}
+	}
+	return false
+}
+
+// BindDocsController 绑定接口文档
+// 文档在第一次请求时生成，之后不再变化
+func BindDocsController(app *iris.Application) {
+	var once sync.Once
+	var spec []byte
+	app.Get("/openapi.json", func(ctx iris.Context) {
+		once.Do(func() {
+			var err error
+			spec, err = jsoniter.ConfigCompatibleWithStandardLibrary.Marshal(NewOpenAPISpec(app.GetRoutes()))
+			lib.AssertErr(err)
+		})
+		ctx.ContentType("application/json")
+		_, err := ctx.Write(spec)
+		lib.AssertErr(err)
+	})
+	app.Get("/docs", func(ctx iris.Context) {
+		_, err := ctx.HTML(docsPage)
+		lib.AssertErr(err)
+	})
+}
+
+// 接口文档页面，使用 Swagger UI 展示 /openapi.json
+const docsPage = `<!DOCTYPE html>
+<html lang="zh-CN">
+<head>
+  <meta charset="utf-8">
+  <title>` + apiTitle + `</title>
+  <link rel="stylesheet" href="https://unpkg.com/swagger-ui-dist@3/swagger-ui.css">
+</head>
+<body>
+  <div id="swagger-ui"></div>
+  <script src="https://unpkg.com/swagger-ui-dist@3/swagger-ui-bundle.js"></script>
+  <script>
+    window.onload = function () {
+      window.ui = SwaggerUIBundle({ url: "/openapi.json", dom_id: "#swagger-ui" });
+    };
+  </script>
+</body>
+</html>
+`
@@ -0,0 +1,29 @@
+package controllers
+
+import (
+	"testing"
+
+	"github.com/sysu-team/Back-end-development/app/models"
+	"github.com/sysu-team/Back-end-development/lib"
+)
+
+// 每个注册的路由都需要出现在接口文档中
+func TestOpenAPICoversRoutes(t *testing.T) {
+	models.UseModel(&models.Model{})
+	app := NewApp()
+	routes := app.GetRoutes()
+	spec := NewOpenAPISpec(routes)
+	registered := make(map[string]bool)
+	for _, route := range routes {
+		registered[route.Method+" "+lib.OpenAPIPath(route.Path)] = true
+		if spec.Operation(route.Method, route.Path) == nil {
+			t.Errorf("route %v %v is missing from the openapi spec", route.Method, route.Path)
+		}
+	}
+	// 说明中的路由也必须已经注册，避免文档中出现不存在的接口
+	for _, doc := range routeDocs() {
+		if len(routes) != 0 && !registered[doc.Method+" "+lib.OpenAPIPath(doc.Path)] {
+			t.Errorf("documented route %v %v is not registered", doc.Method, doc.Path)
+		}
+	}
+}
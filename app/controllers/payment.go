@@ -0,0 +1,102 @@
+package controllers
+
+import (
+	"github.com/kataras/iris"
+	"github.com/kataras/iris/mvc"
+	"github.com/sysu-team/Back-end-development/app/services"
+	"github.com/sysu-team/Back-end-development/lib"
+)
+
+// PaymentController 充值和提现
+type PaymentController struct {
+	BaseController
+	Server services.PaymentService
+}
+
+// BindPaymentController 绑定充值和提现控制器
+func BindPaymentController(app *iris.Application) {
+	paymentRoute := mvc.New(app.Party("/payments"))
+
+	paymentRoute.Register(services.NewPaymentService(), getSession().Start)
+	paymentRoute.Handle(new(PaymentController))
+}
+
+func (c *PaymentController) BeforeActivation(b mvc.BeforeActivation) {
+	// 充值
+	b.Handle("POST", "/orders", "PostOrders", withLogin)
+	b.Handle("GET", "/orders", "GetOrders", withLogin)
+	b.Handle("GET", "/orders/{param1:string}", "GetOrdersBy", withLogin)
+	// 支付平台的支付结果通知，使用签名验证，不需要登陆
+	b.Handle("POST", "/notify", "PostNotify")
+	// 提现
+	b.Handle("POST", "/withdrawals", "PostWithdrawals", withLogin)
+	b.Handle("GET", "/withdrawals", "GetWithdrawals", withLogin)
+}
+
+// 接口文档
+var paymentRouteDocs = []lib.RouteDoc{
+	{Method: "POST", Path: "/payments/orders", Summary: "创建充值订单",
+		Description: "返回小程序发起支付的参数，支付成功之后发放积分", Body: TopUpReq{}, Res: services.TopUpRes{}},
+	{Method: "GET", Path: "/payments/orders", Summary: "获取自己的充值订单", Description: "从新到旧",
+		Query: PageQuery{}, Res: []services.PaymentOrderInfo{}, Paged: true},
+	{Method: "GET", Path: "/payments/orders/{param1:string}", Summary: "获取充值订单",
+		Description: "等待支付的订单会先向支付平台查询最新的状态", Params: []string{"订单 id"}, Res: services.PaymentOrderInfo{}},
+	{Method: "POST", Path: "/payments/notify", Summary: "支付结果通知",
+		Description: "由支付平台调用，请求和响应的格式由支付平台决定", RawBody: "application/xml", RawRes: "application/xml"},
+	{Method: "POST", Path: "/payments/withdrawals", Summary: "申请提现",
+		Description: "冻结积分，管理员批准之后转账到微信零钱", Body: WithdrawalReq{}, Res: services.WithdrawalInfo{}},
+	{Method: "GET", Path: "/payments/withdrawals", Summary: "获取自己的提现申请", Description: "从新到旧",
+		Query: PageQuery{}, Res: []services.WithdrawalInfo{}, Paged: true},
+}
+
+type TopUpReq struct {
+	Credit int `json:"credit" validate:"required,min=1"` // 充值的积分
+}
+
+// 创建充值订单
+func (c *PaymentController) PostOrders() {
+	body := TopUpReq{}
+	c.ReadJSON(&body)
+	c.JSON(200, c.Server.CreateTopUp(c.Context(), c.Session.GetString(IdKey), body.Credit))
+}
+
+// 获取自己的充值订单
+func (c *PaymentController) GetOrders() {
+	params := PageQuery{}
+	c.ReadQuery(&params)
+	res := c.Server.GetOrders(c.Context(), c.Session.GetString(IdKey), params.Page, params.Limit)
+	c.JSON(200, res, lib.Page{Page: params.Page, Limit: params.Limit, Total: len(res)})
+}
+
+// 获取充值订单
+func (c *PaymentController) GetOrdersBy(orderID string) {
+	c.JSON(200, c.Server.GetOrder(c.Context(), c.Session.GetString(IdKey), orderID))
+}
+
+// 支付结果通知，响应的格式由支付平台决定
+func (c *PaymentController) PostNotify() {
+	defer c.Ctx.Request().Body.Close()
+	contentType, body := c.Server.HandleNotify(c.Context(), c.Ctx.Request())
+	c.Ctx.ContentType(contentType)
+	_, err := c.Ctx.Write(body)
+	lib.AssertErr(err)
+}
+
+type WithdrawalReq struct {
+	Credit int `json:"credit" validate:"required,min=1"` // 提现的积分
+}
+
+// 申请提现
+func (c *PaymentController) PostWithdrawals() {
+	body := WithdrawalReq{}
+	c.ReadJSON(&body)
+	c.JSON(200, c.Server.RequestWithdrawal(c.Context(), c.Session.GetString(IdKey), body.Credit))
+}
+
+// 获取自己的提现申请
+func (c *PaymentController) GetWithdrawals() {
+	params := PageQuery{}
+	c.ReadQuery(&params)
+	res := c.Server.GetWithdrawals(c.Context(), c.Session.GetString(IdKey), params.Page, params.Limit)
+	c.JSON(200, res, lib.Page{Page: params.Page, Limit: params.Limit, Total: len(res)})
+}
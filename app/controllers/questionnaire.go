@@ -1,12 +1,11 @@
 package controllers
 
 import (
-	"fmt"
 	//"strconv"
 
 	"github.com/kataras/iris"
 	"github.com/kataras/iris/mvc"
-	"github.com/rs/zerolog/log"
+	"github.com/sysu-team/Back-end-development/app/models"
 	"github.com/sysu-team/Back-end-development/app/services"
 	"github.com/sysu-team/Back-end-development/lib"
 )
@@ -31,26 +30,39 @@ func (c *QuestionnaireController) BeforeActivation(b mvc.BeforeActivation) {
 	b.Handle("GET", "/{param1:string}/result", "GetResult", withLogin)
 }
 
+// 接口文档
+var questionnaireRouteDocs = []lib.RouteDoc{
+	{Method: "PUT", Path: "/questionnaire/{param1:string}", Summary: "填写问卷",
+		Params: []string{"委托 id"}, Body: services.QuestionnaireInfo{}},
+	{Method: "GET", Path: "/questionnaire/{param1:string}", Summary: "获取问卷的题目",
+		Params: []string{"委托 id"}, Res: models.SimpleQuestionnaire{}},
+	{Method: "GET", Path: "/questionnaire/{param1:string}/result", Summary: "获取问卷的统计结果",
+		Description: "只有发布者可以查看", Params: []string{"委托 id"}, Res: models.QuestionnaireDoc{}},
+}
+
 // 填写问卷函数
 // 1. 检查是否已经填写过
 // 2. 检查是否接受了该问卷
 func (c *QuestionnaireController) Put(delegationID string) {
-	lib.Assert(c.Session.GetString(IdKey) != "", "unknown_err")
+	lib.Assert(MatchDelegationID(delegationID), "invalid_params")
+	lib.Assert(c.Session.GetString(IdKey) != "", "not_login")
 	questionnaire := &services.QuestionnaireInfo{}
-	lib.Assert(c.Ctx.ReadJSON(questionnaire) == nil, "invalid_params")
-	log.Debug().Msg(fmt.Sprintf("Controller 填写的问卷: %+v", questionnaire))
-	c.Server.AddRecord(c.Session.GetString(IdKey), delegationID, questionnaire)
+	c.ReadJSON(questionnaire)
+	c.Log().Debug().Interface("questionnaire", questionnaire).Msg("fill questionnaire")
+	c.Server.AddRecord(c.Context(), c.Session.GetString(IdKey), delegationID, questionnaire)
 	c.JSON(200)
 }
 
 // 获得问卷的题目，用于填写
 func (c *QuestionnaireController) Get(delegationID string) {
-	c.JSON(200, c.Server.GetQuestionnairePreview(delegationID))
+	lib.Assert(MatchDelegationID(delegationID), "invalid_params")
+	c.JSON(200, c.Server.GetQuestionnairePreview(c.Context(), delegationID))
 }
 
 // 获得问卷以及统计信息
 // 1. 检查用户是否发布者
 func (c *QuestionnaireController) GetResult(delegationID string) {
-	lib.Assert(c.Session.GetString(IdKey) != "", "unknown_err")
-	c.JSON(200, c.Server.GetFullQuestionnaire(c.Session.GetString(IdKey), delegationID))
+	lib.Assert(MatchDelegationID(delegationID), "invalid_params")
+	lib.Assert(c.Session.GetString(IdKey) != "", "not_login")
+	c.JSON(200, c.Server.GetFullQuestionnaire(c.Context(), c.Session.GetString(IdKey), delegationID))
 }
@@ -0,0 +1,52 @@
+package controllers
+
+import (
+	"github.com/kataras/iris"
+	"github.com/sysu-team/Back-end-development/app/configs"
+	"github.com/sysu-team/Back-end-development/lib"
+)
+
+// 接口限流，InitRateLimit 之前不限流
+var (
+	rateLimit   configs.RateLimitConfig
+	rateLimiter lib.Limiter
+)
+
+// InitRateLimit 初始化接口限流
+func InitRateLimit(config *configs.RateLimitConfig, limiter lib.Limiter) {
+	rateLimit = *config
+	rateLimiter = limiter
+}
+
+func rateRule(name string, rule configs.RateLimitRule) lib.RateRule {
+	return lib.RateRule{Name: name, Rate: rule.Rate, Burst: rule.Burst}
+}
+
+// 路由的模板，例如 POST /delegations/{param1:string}/accept，同一个接口共用一个桶
+func routeKey(ctx iris.Context) string {
+	if r := ctx.GetCurrentRoute(); r != nil {
+		return ctx.Method() + " " + r.Path()
+	}
+	return ctx.Method() + " " + ctx.Path()
+}
+
+// 每个 IP 对所有接口的请求
+func withIPRateLimit(ctx iris.Context) {
+	lib.CheckRateLimit(ctx, rateLimiter, rateRule("ip", rateLimit.IP), ctx.RemoteAddr())
+	ctx.Next()
+}
+
+// 登陆和注册会调用微信的接口，按照 IP 和接口单独限流
+func withLoginRateLimit(ctx iris.Context) {
+	lib.CheckRateLimit(ctx, rateLimiter, rateRule("login", rateLimit.Login), ctx.RemoteAddr()+" "+routeKey(ctx))
+	ctx.Next()
+}
+
+// 每个用户对每个修改数据的接口的请求，在 withLogin 中确定用户之后检查
+func checkWriteRateLimit(ctx iris.Context, userID string) {
+	switch ctx.Method() {
+	case "GET", "HEAD", "OPTIONS":
+		return
+	}
+	lib.CheckRateLimit(ctx, rateLimiter, rateRule("write", rateLimit.Write), userID+" "+routeKey(ctx))
+}
@@ -0,0 +1,53 @@
+package controllers
+
+import (
+	"github.com/kataras/iris"
+	"github.com/kataras/iris/mvc"
+	"github.com/sysu-team/Back-end-development/app/services"
+	"github.com/sysu-team/Back-end-development/lib"
+)
+
+// ShopController 积分商城
+type ShopController struct {
+	BaseController
+	Server services.ShopService
+}
+
+// BindShopController 绑定积分商城控制器
+func BindShopController(app *iris.Application) {
+	shopRoute := mvc.New(app.Party("/shop"))
+
+	shopRoute.Register(services.NewShopService(), getSession().Start)
+	shopRoute.Handle(new(ShopController))
+}
+
+func (c *ShopController) BeforeActivation(b mvc.BeforeActivation) {
+	b.Handle("GET", "/items", "GetItems", withLogin)
+	b.Handle("GET", "/items/{param1:string}", "GetItemsBy", withLogin)
+	b.Handle("POST", "/items/{param1:string}/redeem", "PostItemsByRedeem", withLogin)
+}
+
+// 接口文档
+var shopRouteDocs = []lib.RouteDoc{
+	{Method: "GET", Path: "/shop/items", Summary: "获取上架的商品", Description: "按照展示顺序排列",
+		Res: []services.ShopItemInfo{}},
+	{Method: "GET", Path: "/shop/items/{param1:string}", Summary: "获取商品",
+		Params: []string{"商品 id"}, Res: services.ShopItemInfo{}},
+	{Method: "POST", Path: "/shop/items/{param1:string}/redeem", Summary: "兑换商品", Params: []string{"商品 id"},
+		Description: "扣除积分和一件库存，返回兑换码，兑换记录在 /users/me/redemptions 查询", Res: services.RedemptionInfo{}},
+}
+
+// 获取上架的商品
+func (c *ShopController) GetItems() {
+	c.JSON(200, c.Server.GetItems(c.Context(), false))
+}
+
+// 获取商品
+func (c *ShopController) GetItemsBy(itemID string) {
+	c.JSON(200, c.Server.GetItem(c.Context(), itemID))
+}
+
+// 兑换商品
+func (c *ShopController) PostItemsByRedeem(itemID string) {
+	c.JSON(200, c.Server.Redeem(c.Context(), c.Session.GetString(IdKey), itemID))
+}
@@ -2,16 +2,12 @@ package controllers
 
 import (
 	"encoding/json"
-	"fmt"
 	"github.com/kataras/iris"
-	"github.com/kataras/iris/core/errors"
 	"github.com/kataras/iris/mvc"
-	"github.com/rs/zerolog/log"
 	"github.com/sysu-team/Back-end-development/app/models"
 	"github.com/sysu-team/Back-end-development/app/services"
 	"github.com/sysu-team/Back-end-development/lib"
 	"gopkg.in/resty.v1"
-	"strconv"
 	"time"
 )
 
@@ -20,6 +16,8 @@ type UserController struct {
 	BaseController
 	// 使用的是 interface 而不是 struct
 	Server services.UserService
+	Credit services.CreditService
+	Shop   services.ShopService
 }
 
 // BindUserController 绑定用户控制器
@@ -28,22 +26,63 @@ func BindUserController(app *iris.Application) {
 
 	// 使用 Register 来初始化 UserController 中的 Filed
 	// 全局只有一个  sessions ，每一个连接都会生成一个 session
-	userRoute.Register(services.NewUserService(), getSession().Start)
+	userRoute.Register(services.NewUserService(), services.NewCreditService(), services.NewShopService(), getSession().Start)
 	userRoute.Handle(new(UserController))
 }
 
 func (c *UserController) BeforeActivation(b mvc.BeforeActivation) {
-	b.Handle("POST", "/", "Post")
-	b.Handle("POST", "/session", "PostSession")
+	b.Handle("POST", "/", "Post", withLoginRateLimit)
+	b.Handle("POST", "/session", "PostSession", withLoginRateLimit)
 	b.Handle("DELETE", "/session", "DelSession", withLogin)
 	b.Handle("GET", "/me", "GetMe", withLogin)
+	// 导出个人数据和注销
+	b.Handle("GET", "/me/export", "GetMeExport", withLogin)
+	b.Handle("DELETE", "/me", "DeleteMe", withLogin)
+	// 每日签到
+	b.Handle("POST", "/me/check-in", "PostMeCheckIn", withLogin)
+	// 积分商城的兑换记录
+	b.Handle("GET", "/me/redemptions", "GetMeRedemptions", withLogin)
+	// 个人资料
+	b.Handle("PATCH", "/me", "PatchMe", withLogin)
+	b.Handle("PUT", "/me/avatar", "PutMeAvatar", withLogin)
+	b.Handle("GET", "/{param1:string}/profile", "GetProfile", withLogin)
+	// 学生身份验证
+	b.Handle("POST", "/me/verification", "PostMeVerification", withLogin)
+	b.Handle("PUT", "/me/verification", "PutMeVerification", withLogin)
 
 	// 获取用户相关的委托
 	b.Handle("GET", "/delegations", "GetDelegations", withLogin)
 }
 
+// 接口文档
+var userRouteDocs = []lib.RouteDoc{
+	{Method: "POST", Path: "/users", Summary: "注册", Body: RegisterReq{}},
+	{Method: "POST", Path: "/users/session", Summary: "登陆", Body: LoginReq{}, Res: services.UserInfo{}},
+	{Method: "DELETE", Path: "/users/session", Summary: "退出登陆"},
+	{Method: "GET", Path: "/users/me", Summary: "获取自己的用户信息", Res: services.UserInfo{}},
+	{Method: "GET", Path: "/users/me/export", Summary: "导出个人数据",
+		Description: "包括用户信息、发布和接受的委托、提交的问卷、积分变化、充值和提现记录、兑换记录，作为 JSON 文件下载", Res: services.UserExport{}},
+	{Method: "DELETE", Path: "/users/me", Summary: "注销账号",
+		Description: "个人信息被匿名化，委托的另一方的记录保留；还有进行中的委托或者未完成的提现申请时不能注销"},
+	{Method: "POST", Path: "/users/me/check-in", Summary: "每日签到",
+		Description: "每天一次，连续签到时额外奖励", Res: services.CheckInResult{}},
+	{Method: "GET", Path: "/users/me/redemptions", Summary: "获取自己的兑换记录", Description: "从新到旧，包括兑换码",
+		Query: PageQuery{}, Res: []services.RedemptionInfo{}, Paged: true},
+	{Method: "PATCH", Path: "/users/me", Summary: "修改个人资料", Description: "只修改请求中出现的字段",
+		Body: services.ProfileUpdateReq{}, Res: services.UserInfo{}},
+	{Method: "PUT", Path: "/users/me/avatar", Summary: "上传头像", Form: avatarForm{}, Res: AvatarRes{}},
+	{Method: "GET", Path: "/users/{param1:string}/profile", Summary: "获取其他用户的个人资料",
+		Description: "联系方式等字段按照用户设置的可见范围返回", Params: []string{"用户的 open id"}, Res: services.ProfileInfo{}},
+	{Method: "POST", Path: "/users/me/verification", Summary: "发起学生身份验证",
+		Description: "名单验证直接返回结果，邮箱验证会向校园邮箱发送验证码", Body: StartVerificationReq{}, Res: VerificationRes{}},
+	{Method: "PUT", Path: "/users/me/verification", Summary: "提交邮箱验证码", Body: ConfirmVerificationReq{}, Res: VerificationRes{}},
+	{Method: "GET", Path: "/users/delegations", Summary: "获取用户相关的委托",
+		Description: "query_type：0 发布的委托，1 接受的委托，2 待确认的委托", Query: UserDelegationQuery{},
+		Res: []models.DelegationPreviewWrapper{}, Paged: true},
+}
+
 type LoginReq struct {
-	Code string `json:"code"`
+	Code string `json:"code" validate:"required"`
 }
 
 type WxSessionRes struct {
@@ -54,7 +93,7 @@ type WxSessionRes struct {
 	ErrMsg     string `json:"errmsg"`
 }
 
-func wxAuth(code string) *WxSessionRes {
+func wxAuth(ctx iris.Context, code string) *WxSessionRes {
 	res := &WxSessionRes{}
 	if OFFLINE_DEBUG {
 		// 如果不是使用小程序后端进行实验，采用body中的code作为id
@@ -70,68 +109,153 @@ func wxAuth(code string) *WxSessionRes {
 		}).
 		SetResult(&WxSessionRes{}).
 		Get("https://api.weixin.qq.com/sns/jscode2session")
-	lib.AssertErr(err)
-	log.Debug().Msg(resp.String())
+	lib.AssertErr(err, "wx_auth_failed")
+	lib.RequestLogger(ctx).Debug().Str("wx_res", resp.String()).Msg("wx auth")
 	err = json.Unmarshal(resp.Body(), res)
-	lib.AssertErr(err)
+	lib.AssertErr(err, "wx_auth_failed")
 	return res
 }
 
 // 登陆 需要微信授权
 func (c *UserController) PostSession() {
 	// 防止重复登陆
-	lib.Assert(c.Session.Get(WxSessionKey) == nil, "already_login", 401)
+	lib.Assert(c.Session.Get(WxSessionKey) == nil, "already_login")
 	// 获取请求中的code
 	body := LoginReq{}
-	lib.Assert(c.Ctx.ReadJSON(&body) == nil, "invalid_params", 400)
-	wxRes := wxAuth(body.Code)
-	log.Debug().Msg(fmt.Sprintf("code in request : %v, wxRes: %v", body.Code, wxRes))
-	lib.Assert(wxRes.ErrCode == 0, wxRes.ErrMsg, 400)
-	lib.Assert(c.Server.HasRegistered(wxRes.OpenId), "unregister_user", 401)
+	c.ReadJSON(&body)
+	wxRes := wxAuth(c.Ctx, body.Code)
+	c.Log().Debug().Str("code", body.Code).Str("openid", wxRes.OpenId).Int64("errcode", wxRes.ErrCode).Msg("login")
+	lib.Assert(wxRes.ErrCode == 0, "invalid_wx_code")
+	lib.Assert(c.Server.HasRegistered(c.Context(), wxRes.OpenId), "unregister_user")
+	// 被封禁或者停用中的用户不能登陆
+	c.Server.CheckUserStatus(c.Context(), wxRes.OpenId)
 	// 维护自定义登陆状态，维护登陆状态
-	log.Debug().Msg("session id : " + c.Session.ID())
 	c.Session.Set(IdKey, wxRes.OpenId)
 	c.Session.Set(WxSessionKey, wxRes.SessionKey) // 用于构建后续的特殊请求（可能会过期）
 	c.Session.Set(IdTimeKey, time.Now().Unix())
+	c.Server.RecordLogin(c.Context(), wxRes.OpenId)
 	// 构建返回信息
-	c.JSON(200, c.Server.GetUserInfo(wxRes.OpenId))
+	c.JSON(200, c.Server.GetUserInfo(c.Context(), wxRes.OpenId))
+}
+
+// 导出个人数据，作为 JSON 文件下载
+func (c *UserController) GetMeExport() {
+	c.Ctx.Header("Content-Disposition", `attachment; filename="export.json"`)
+	c.JSON(200, c.Server.ExportUserData(c.Context(), c.Session.GetString(IdKey)))
+}
+
+// 注销账号，同时退出登陆
+func (c *UserController) DeleteMe() {
+	c.Server.DeleteAccount(c.Context(), c.Session.GetString(IdKey))
+	c.Session.Destroy()
+	c.JSON(200)
+}
+
+// 每日签到
+func (c *UserController) PostMeCheckIn() {
+	c.JSON(200, c.Credit.CheckIn(c.Context(), c.Session.GetString(IdKey)))
+}
+
+// 获取自己的兑换记录
+func (c *UserController) GetMeRedemptions() {
+	params := PageQuery{}
+	c.ReadQuery(&params)
+	res := c.Shop.GetRedemptions(c.Context(), c.Session.GetString(IdKey), params.Page, params.Limit)
+	c.JSON(200, res, lib.Page{Page: params.Page, Limit: params.Limit, Total: len(res)})
 }
 
 // 退出登陆
 func (c *UserController) DelSession() {
-	lib.Assert(c.Session.Get(IdKey) != nil, "not_login", 401)
+	lib.Assert(c.Session.Get(IdKey) != nil, "not_login")
 	c.Session.Destroy()
 	c.JSON(200)
 }
 
 type RegisterReq struct {
-	Code       string `json:"code"`
-	Name       string `json:"name"`
-	StudentNum string `json:"student_number"`
+	Code       string `json:"code" validate:"required"`
+	Name       string `json:"name" validate:"required,max=20"`
+	StudentNum string `json:"student_number" validate:"required,numeric,max=20"`
 }
 
 // 已经授权的用户进行注册
 func (c *UserController) Post() {
 	body := RegisterReq{}
-	lib.Assert(c.Ctx.ReadJSON(&body) == nil, "invalid_params", 400)
+	c.ReadJSON(&body)
 	// 检查用户是否注册
-	wxRes := wxAuth(body.Code)
-	log.Debug().Msg(fmt.Sprintf("body : %v, wxRes : %v ", body, wxRes))
-	lib.Assert(wxRes.ErrCode == 0, wxRes.ErrMsg, 400)
+	wxRes := wxAuth(c.Ctx, body.Code)
+	c.Log().Debug().Interface("body", body).Str("openid", wxRes.OpenId).Int64("errcode", wxRes.ErrCode).Msg("register")
+	lib.Assert(wxRes.ErrCode == 0, "invalid_wx_code")
 	if OFFLINE_DEBUG {
 		wxRes.OpenId = body.Code
 	}
 	// 防止重复注册
-	lib.Assert(!c.Server.HasRegistered(wxRes.OpenId), "duplicated_username", 401)
-	lib.Assert(!c.Server.HasRegistered(body.StudentNum), "duplicated_student_num", 402)
-	c.Server.Register(body.Name, body.StudentNum, wxRes.OpenId)
+	lib.Assert(!c.Server.HasRegistered(c.Context(), wxRes.OpenId), "duplicated_username")
+	lib.Assert(!c.Server.HasStudentNumRegistered(c.Context(), body.StudentNum), "duplicated_student_num")
+	c.Server.Register(c.Context(), body.Name, body.StudentNum, wxRes.OpenId)
 	//lib.JSON(c.Ctx, 200)
 	c.JSON(200)
 }
 
+type StartVerificationReq struct {
+	Email string `json:"email" validate:"max=100"`
+}
+
+type VerificationRes struct {
+	Verified bool `json:"verified"`
+}
+
+// 发起学生身份验证
+// 名单验证直接返回结果，邮箱验证会向校园邮箱发送验证码
+func (c *UserController) PostMeVerification() {
+	body := StartVerificationReq{}
+	c.ReadJSON(&body)
+	verified := c.Server.StartVerification(c.Context(), c.Session.GetString(IdKey), body.Email)
+	c.JSON(200, VerificationRes{verified})
+}
+
+type ConfirmVerificationReq struct {
+	Code string `json:"code" validate:"required,numeric"`
+}
+
+// 提交邮箱验证码
+func (c *UserController) PutMeVerification() {
+	body := ConfirmVerificationReq{}
+	c.ReadJSON(&body)
+	c.Server.ConfirmVerification(c.Context(), c.Session.GetString(IdKey), body.Code)
+	c.JSON(200, VerificationRes{true})
+}
+
 //  已经登陆的用户获取用户信息
 func (c *UserController) GetMe() {
-	c.JSON(200, c.Server.GetUserInfo(c.Session.GetString(IdKey)))
+	c.JSON(200, c.Server.GetUserInfo(c.Context(), c.Session.GetString(IdKey)))
+}
+
+// 修改个人资料，只修改请求中出现的字段
+func (c *UserController) PatchMe() {
+	body := &services.ProfileUpdateReq{}
+	c.ReadJSON(body)
+	c.Server.UpdateProfile(c.Context(), c.Session.GetString(IdKey), body)
+	c.JSON(200, c.Server.GetUserInfo(c.Context(), c.Session.GetString(IdKey)))
+}
+
+// 上传头像的表单，只用于接口文档
+type avatarForm struct {
+	Avatar []byte `form:"avatar" validate:"required"`
+}
+
+type AvatarRes struct {
+	AvatarURL string `json:"avatar_url"`
+}
+
+// 上传头像，表单字段为 avatar
+func (c *UserController) PutMeAvatar() {
+	fileName, data := readUploadFile(c.Ctx, "avatar")
+	c.JSON(200, AvatarRes{c.Server.SaveAvatar(c.Context(), c.Session.GetString(IdKey), fileName, data)})
+}
+
+// 获取其他用户的个人资料
+func (c *UserController) GetProfile(openid string) {
+	c.JSON(200, c.Server.GetProfile(c.Context(), c.Session.GetString(IdKey), openid))
 }
 
 type UserDelegationQueryType int
@@ -142,28 +266,28 @@ const (
 	finished  UserDelegationQueryType = 2
 )
 
+// 获取用户相关的委托的查询参数
+type UserDelegationQuery struct {
+	PageQuery
+	QueryType int `form:"query_type" validate:"min=0,max=2"`
+}
+
 // 获取用户相关的委托
 func (c *UserController) GetDelegations() {
-	log.Debug().Msg(fmt.Sprintf("page : %v, limit: %v, query_type: %v",
-		c.Ctx.URLParam("page"), c.Ctx.URLParam("limit"), c.Ctx.URLParam("query_type")))
-	page, err1 := strconv.Atoi(c.Ctx.URLParam("page"))
-	limit, err2 := strconv.Atoi(c.Ctx.URLParam("limit"))
-	queryType, err3 := strconv.Atoi(c.Ctx.URLParam("query_type"))
-	lib.Assert(err1 == nil && err2 == nil && err3 == nil && page > 0 && limit > 0,
-		"invalid_params")
+	params := UserDelegationQuery{}
+	c.ReadQuery(&params)
+	c.Log().Debug().Interface("query", params).Msg("user delegation query")
+	page, limit := params.Page, params.Limit
 	userID := c.Session.GetString(IdKey)
 	var res []models.DelegationPreviewWrapper
-	switch UserDelegationQueryType(queryType) {
+	switch UserDelegationQueryType(params.QueryType) {
 	case published:
-		res = c.Server.GetUserPublishDelegation(page, limit, userID)
+		res = c.Server.GetUserPublishDelegation(c.Context(), page, limit, userID)
 	case accepted:
-		res = c.Server.GetUserReceiveDelegation(page, limit, userID)
+		res = c.Server.GetUserReceiveDelegation(c.Context(), page, limit, userID)
 	case finished:
-		res = c.Server.GetUserPendingDelegation(page, limit, userID)
-	default:
-		lib.AssertErr(errors.New("invalid_query_type"), 400)
+		res = c.Server.GetUserPendingDelegation(c.Context(), page, limit, userID)
 	}
-	log.Debug().Msg(fmt.Sprintf("return %v delegtaions with query_type: %v, ",
-		len(res), c.Ctx.URLParam("query_type")))
+	c.Log().Debug().Int("count", len(res)).Int("query_type", params.QueryType).Msg("user delegations")
 	c.JSON(200, res, lib.Page{Page: page, Limit: limit, Total: len(res)})
 }
@@ -0,0 +1,179 @@
+package models
+
+import (
+	"context"
+	"time"
+
+	"github.com/sysu-team/Back-end-development/lib"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+type AttachmentModel struct {
+	db *mongo.Database
+}
+
+// 附件的用途
+type EnumAttachmentPurpose string
+
+const (
+	PurposeDelegation EnumAttachmentPurpose = "delegation" // 发布委托时的图片，例如取件码
+	PurposeProof      EnumAttachmentPurpose = "proof"      // 接受者完成委托的凭证
+	PurposeAvatar     EnumAttachmentPurpose = "avatar"     // 用户头像
+	PurposeMessage    EnumAttachmentPurpose = "message"    // 委托聊天中的图片
+)
+
+const (
+	ATTACHMENT_ID_KEY            string = "_id"
+	ATTACHMENT_OWNER_ID_KEY      string = "owner_id"
+	ATTACHMENT_PURPOSE_KEY       string = "purpose"
+	ATTACHMENT_DELEGATION_ID_KEY string = "delegation_id"
+)
+
+type AttachmentDoc struct {
+	ID           primitive.ObjectID    `bson:"_id,omitempty"`
+	OwnerID      string                `bson:"owner_id"`
+	Purpose      EnumAttachmentPurpose `bson:"purpose"`
+	FileName     string                `bson:"file_name"`
+	ContentType  string                `bson:"content_type"`
+	Size         int                   `bson:"size"`
+	Key          string                `bson:"key"`           // 在存储中的 key
+	ThumbnailKey string                `bson:"thumbnail_key"` // 图片才有缩略图
+	DelegationID string                `bson:"delegation_id"` // 关联的委托，上传时为空
+	CreateTime   int64                 `bson:"create_time"`
+}
+
+// 使用/创建 collection, 初始化子 model
+func NewAttachmentModel(db *mongo.Database) *AttachmentModel {
+	return &AttachmentModel{db}
+}
+
+// 保存附件信息，返回附件 id
+func (m *AttachmentModel) CreateAttachment(ctx context.Context, doc *AttachmentDoc) string {
+	ctx, cancel := withTimeout(ctx)
+	defer cancel()
+	doc.CreateTime = time.Now().Unix()
+	res, err := m.db.Collection(AttachmentCollectionName).InsertOne(ctx, doc)
+	lib.AssertErr(err)
+	lib.Log(ctx).Debug().Interface("id", res.InsertedID).Msg("insert attachment")
+	return res.InsertedID.(primitive.ObjectID).Hex()
+}
+
+// 返回nil代表没有这个附件
+func (m *AttachmentModel) GetAttachment(ctx context.Context, attachmentID string) *AttachmentDoc {
+	ctx, cancel := withTimeout(ctx)
+	defer cancel()
+	objID, err := primitive.ObjectIDFromHex(attachmentID)
+	if err != nil {
+		return nil
+	}
+	res := &AttachmentDoc{}
+	err = m.db.Collection(AttachmentCollectionName).FindOne(
+		ctx,
+		bson.D{{
+			ATTACHMENT_ID_KEY,
+			objID,
+		}},
+	).Decode(res)
+	if err == mongo.ErrNoDocuments {
+		return nil
+	}
+	lib.AssertErr(err)
+	return res
+}
+
+// 把用户上传的、还没有关联的附件关联到委托上
+// 返回关联成功的数量
+func (m *AttachmentModel) LinkToDelegation(ctx context.Context, attachmentIDs []string, ownerID string, purpose EnumAttachmentPurpose, delegationID string) int {
+	ctx, cancel := withTimeout(ctx)
+	defer cancel()
+	objIDs := make(bson.A, 0, len(attachmentIDs))
+	for _, attachmentID := range attachmentIDs {
+		objID, err := primitive.ObjectIDFromHex(attachmentID)
+		lib.Assert(err == nil, "no_such_attachment")
+		objIDs = append(objIDs, objID)
+	}
+	res, err := m.db.Collection(AttachmentCollectionName).UpdateMany(
+		ctx,
+		bson.D{
+			{ATTACHMENT_ID_KEY, bson.D{{"$in", objIDs}}},
+			{ATTACHMENT_OWNER_ID_KEY, ownerID},
+			{ATTACHMENT_PURPOSE_KEY, purpose},
+			{ATTACHMENT_DELEGATION_ID_KEY, ""},
+		},
+		bson.D{{
+			"$set", bson.D{
+				{ATTACHMENT_DELEGATION_ID_KEY, delegationID},
+			},
+		}},
+	)
+	lib.AssertErr(err)
+	return int(res.ModifiedCount)
+}
+
+// 统计可以被关联的附件数量，用于在创建委托前检查
+func (m *AttachmentModel) CountLinkable(ctx context.Context, attachmentIDs []string, ownerID string, purpose EnumAttachmentPurpose) int {
+	ctx, cancel := withTimeout(ctx)
+	defer cancel()
+	objIDs := make(bson.A, 0, len(attachmentIDs))
+	for _, attachmentID := range attachmentIDs {
+		objID, err := primitive.ObjectIDFromHex(attachmentID)
+		lib.Assert(err == nil, "no_such_attachment")
+		objIDs = append(objIDs, objID)
+	}
+	count, err := m.db.Collection(AttachmentCollectionName).CountDocuments(
+		ctx,
+		bson.D{
+			{ATTACHMENT_ID_KEY, bson.D{{"$in", objIDs}}},
+			{ATTACHMENT_OWNER_ID_KEY, ownerID},
+			{ATTACHMENT_PURPOSE_KEY, purpose},
+			{ATTACHMENT_DELEGATION_ID_KEY, ""},
+		},
+	)
+	lib.AssertErr(err)
+	return int(count)
+}
+
+// 获取注销用户时需要删除的附件：头像和还没有关联到委托的附件
+func (m *AttachmentModel) GetUnlinkedByOwner(ctx context.Context, ownerID string) []AttachmentDoc {
+	ctx, cancel := withTimeout(ctx)
+	defer cancel()
+	cursor, err := m.db.Collection(AttachmentCollectionName).Find(ctx, bson.D{
+		{ATTACHMENT_OWNER_ID_KEY, ownerID},
+		{"$or", bson.A{
+			bson.D{{ATTACHMENT_PURPOSE_KEY, PurposeAvatar}},
+			bson.D{{ATTACHMENT_DELEGATION_ID_KEY, ""}},
+		}},
+	})
+	lib.AssertErr(err)
+	defer cursor.Close(ctx)
+	res := []AttachmentDoc{}
+	for cursor.Next(ctx) {
+		doc := AttachmentDoc{}
+		lib.AssertErr(cursor.Decode(&doc))
+		res = append(res, doc)
+	}
+	lib.AssertErr(cursor.Err())
+	return res
+}
+
+// 删除附件信息，存储中的文件需要先删除
+func (m *AttachmentModel) DeleteAttachment(ctx context.Context, id primitive.ObjectID) {
+	ctx, cancel := withTimeout(ctx)
+	defer cancel()
+	_, err := m.db.Collection(AttachmentCollectionName).DeleteOne(ctx, bson.D{{ATTACHMENT_ID_KEY, id}})
+	lib.AssertErr(err)
+}
+
+// 注销用户时将已经关联到委托的附件的上传者替换为匿名 id
+func (m *AttachmentModel) ReplaceOwner(ctx context.Context, ownerID, anonID string) {
+	ctx, cancel := withTimeout(ctx)
+	defer cancel()
+	_, err := m.db.Collection(AttachmentCollectionName).UpdateMany(
+		ctx,
+		bson.D{{ATTACHMENT_OWNER_ID_KEY, ownerID}},
+		bson.D{{"$set", bson.D{{ATTACHMENT_OWNER_ID_KEY, anonID}}}},
+	)
+	lib.AssertErr(err)
+}
@@ -0,0 +1,121 @@
+package models
+
+import (
+	"context"
+	"time"
+
+	"github.com/sysu-team/Back-end-development/lib"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	AUDIT_ACTION_KEY     string = "action"
+	AUDIT_ACTOR_ID_KEY   string = "actor_id"
+	AUDIT_TARGET_ID_KEY  string = "target_id"
+	AUDIT_BEFORE_KEY     string = "before"
+	AUDIT_AFTER_KEY      string = "after"
+	AUDIT_CREATED_AT_KEY string = "created_at"
+)
+
+// 审计日志的一条记录，只插入不修改
+// 唯一的例外是注销账号：ReplaceUser 把用户替换为匿名 id 并删除个人资料的快照，
+// 注销的用户有权要求删除个人数据，记录本身和操作的时间保留
+type AuditDoc struct {
+	ID        primitive.ObjectID `bson:"_id,omitempty"`
+	Action    string             `bson:"action"`     // 操作，例如 delegation.cancel
+	ActorID   string             `bson:"actor_id"`   // 操作者的 open id，后台任务为 system
+	IP        string             `bson:"ip"`         // 后台任务为空
+	RequestID string             `bson:"request_id"` // 后台任务为空
+	TargetID  string             `bson:"target_id"`  // 操作的对象，例如委托 id、用户 open id
+	Before    bson.Raw           `bson:"before,omitempty"`
+	After     bson.Raw           `bson:"after,omitempty"`
+	CreatedAt time.Time          `bson:"created_at"`
+}
+
+// 审计日志的筛选条件，为空代表不限制
+type AuditQuery struct {
+	ActorID  string
+	Action   string
+	TargetID string
+	Since    int64 // Unix时间戳，包括
+	Until    int64 // Unix时间戳，不包括
+}
+
+type AuditModel struct {
+	db *mongo.Database
+}
+
+// 使用/创建 collection, 初始化子 model
+func NewAuditModel(db *mongo.Database) *AuditModel {
+	return &AuditModel{db}
+}
+
+// 插入一条记录
+func (m *AuditModel) Insert(ctx context.Context, doc *AuditDoc) error {
+	ctx, cancel := withTimeout(ctx)
+	defer cancel()
+	_, err := m.db.Collection(AuditCollectionName).InsertOne(ctx, doc)
+	return err
+}
+
+// 按照条件查询记录，从新到旧
+func (m *AuditModel) Query(ctx context.Context, page, limit int64, query *AuditQuery) []AuditDoc {
+	ctx, cancel := withTimeout(ctx)
+	defer cancel()
+	filters := bson.D{}
+	if query.ActorID != "" {
+		filters = append(filters, bson.E{AUDIT_ACTOR_ID_KEY, query.ActorID})
+	}
+	if query.Action != "" {
+		filters = append(filters, bson.E{AUDIT_ACTION_KEY, query.Action})
+	}
+	if query.TargetID != "" {
+		filters = append(filters, bson.E{AUDIT_TARGET_ID_KEY, query.TargetID})
+	}
+	createdAt := bson.D{}
+	if query.Since > 0 {
+		createdAt = append(createdAt, bson.E{"$gte", time.Unix(query.Since, 0)})
+	}
+	if query.Until > 0 {
+		createdAt = append(createdAt, bson.E{"$lt", time.Unix(query.Until, 0)})
+	}
+	if len(createdAt) != 0 {
+		filters = append(filters, bson.E{AUDIT_CREATED_AT_KEY, createdAt})
+	}
+	cursor, err := m.db.Collection(AuditCollectionName).Find(ctx, filters, options.Find().
+		SetSort(bson.D{{AUDIT_CREATED_AT_KEY, -1}, {"_id", -1}}).
+		SetSkip((page-1)*limit).
+		SetLimit(limit))
+	lib.AssertErr(err)
+	defer cursor.Close(ctx)
+	res := make([]AuditDoc, 0, limit)
+	for cursor.Next(ctx) {
+		doc := AuditDoc{}
+		lib.AssertErr(cursor.Decode(&doc))
+		res = append(res, doc)
+	}
+	lib.AssertErr(cursor.Err())
+	return res
+}
+
+// 注销用户时将记录中的操作者和操作对象替换为匿名 id
+// 以用户为对象的 user.* 记录的快照包含个人资料，一并删除
+// 这是审计日志只插入不修改的唯一例外，其他代码不能修改已有的记录
+func (m *AuditModel) ReplaceUser(ctx context.Context, openid, anonID string) {
+	ctx, cancel := withTimeout(ctx)
+	defer cancel()
+	collection := m.db.Collection(AuditCollectionName)
+	_, err := collection.UpdateMany(
+		ctx,
+		bson.D{{AUDIT_TARGET_ID_KEY, openid}, {AUDIT_ACTION_KEY, bson.D{{"$regex", "^user\\."}}}},
+		bson.D{{"$unset", bson.D{{AUDIT_BEFORE_KEY, ""}, {AUDIT_AFTER_KEY, ""}}}},
+	)
+	lib.AssertErr(err)
+	for _, key := range []string{AUDIT_ACTOR_ID_KEY, AUDIT_TARGET_ID_KEY} {
+		_, err = collection.UpdateMany(ctx, bson.D{{key, openid}}, bson.D{{"$set", bson.D{{key, anonID}}}})
+		lib.AssertErr(err)
+	}
+}
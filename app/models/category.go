@@ -0,0 +1,112 @@
+package models
+
+import (
+	"context"
+
+	"github.com/sysu-team/Back-end-development/lib"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+type CategoryModel struct {
+	db *mongo.Database
+}
+
+const (
+	CATEGORY_KEY_KEY     string = "key"
+	CATEGORY_NAME_KEY    string = "name"
+	CATEGORY_ORDER_KEY   string = "order"
+	CATEGORY_ENABLED_KEY string = "enabled"
+)
+
+// 委托的类型
+type CategoryDoc struct {
+	Key            string   `bson:"key" json:"key"`                         // 唯一的标识，保存在委托的 delegation_type 中
+	Name           string   `bson:"name" json:"name"`                       // 展示的名字
+	Icon           string   `bson:"icon" json:"icon"`                       // 图标
+	RequiredFields []string `bson:"required_fields" json:"required_fields"` // 发布时必须填写的字段
+	MinReward      int      `bson:"min_reward" json:"min_reward"`
+	MaxReward      int      `bson:"max_reward" json:"max_reward"` // 0 代表不限制
+	Handler        string   `bson:"handler" json:"handler"`       // 发布时的特殊处理，例如创建问卷
+	Order          int      `bson:"order" json:"order"`           // 展示的顺序
+	Enabled        bool     `bson:"enabled" json:"enabled"`       // 停用的类型不能发布新的委托
+}
+
+// 使用/创建 collection, 初始化子 model
+func NewCategoryModel(db *mongo.Database) *CategoryModel {
+	return &CategoryModel{db}
+}
+
+// 获取所有委托类型，按照展示顺序排列
+func (m *CategoryModel) GetCategories(ctx context.Context, onlyEnabled bool) []CategoryDoc {
+	ctx, cancel := withTimeout(ctx)
+	defer cancel()
+	filters := bson.D{}
+	if onlyEnabled {
+		filters = bson.D{{CATEGORY_ENABLED_KEY, true}}
+	}
+	cursor, err := m.db.Collection(CategoryCollectionName).Find(
+		ctx,
+		filters,
+		&options.FindOptions{Sort: bson.D{{CATEGORY_ORDER_KEY, 1}}},
+	)
+	lib.AssertErr(err)
+	defer func() {
+		lib.AssertErr(cursor.Close(ctx))
+	}()
+	res := make([]CategoryDoc, 0)
+	for cursor.Next(ctx) {
+		tmp := CategoryDoc{}
+		lib.AssertErr(cursor.Decode(&tmp))
+		res = append(res, tmp)
+	}
+	return res
+}
+
+// 按照标识或者名字获取委托类型，返回nil代表没有这个类型
+// 旧版本的客户端使用名字作为委托类型
+func (m *CategoryModel) GetCategory(ctx context.Context, keyOrName string) *CategoryDoc {
+	ctx, cancel := withTimeout(ctx)
+	defer cancel()
+	res := &CategoryDoc{}
+	err := m.db.Collection(CategoryCollectionName).FindOne(
+		ctx,
+		bson.D{{"$or", bson.A{
+			bson.D{{CATEGORY_KEY_KEY, keyOrName}},
+			bson.D{{CATEGORY_NAME_KEY, keyOrName}},
+		}}},
+	).Decode(res)
+	if err == mongo.ErrNoDocuments {
+		return nil
+	}
+	lib.AssertErr(err)
+	return res
+}
+
+// 创建或者修改委托类型
+func (m *CategoryModel) SaveCategory(ctx context.Context, doc *CategoryDoc) {
+	ctx, cancel := withTimeout(ctx)
+	defer cancel()
+	upsert := true
+	res, err := m.db.Collection(CategoryCollectionName).ReplaceOne(
+		ctx,
+		bson.D{{
+			CATEGORY_KEY_KEY,
+			doc.Key,
+		}},
+		doc,
+		&options.ReplaceOptions{Upsert: &upsert},
+	)
+	lib.AssertErr(err)
+	lib.Log(ctx).Debug().Str("key", doc.Key).Int64("matched", res.MatchedCount).Int64("upserted", res.UpsertedCount).Msg("save category")
+}
+
+// 统计委托类型的数量
+func (m *CategoryModel) CountCategories(ctx context.Context) int64 {
+	ctx, cancel := withTimeout(ctx)
+	defer cancel()
+	count, err := m.db.Collection(CategoryCollectionName).CountDocuments(ctx, bson.D{})
+	lib.AssertErr(err)
+	return count
+}
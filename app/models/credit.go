@@ -0,0 +1,157 @@
+package models
+
+import (
+	"context"
+	"time"
+
+	"github.com/sysu-team/Back-end-development/lib"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// 修改用户的积分，delta 为负数时要求修改后的积分不低于 floor
+// 返回修改后的积分，用户不存在或者积分不足时返回 false
+// 使用 $inc 修改，并发的修改不会互相覆盖
+func (m *UserModel) AddCredit(ctx context.Context, openid string, delta, floor int) (int, bool) {
+	return m.incCredit(ctx, openid, delta, floor, USER_LAST_ACTIVE_AT_KEY)
+}
+
+// 保留的已经发放过积分的单号数量，同一个单号的重复发放只会发生在通知和对账重试的几分钟内
+const grantedOrdersKept = 100
+
+// 按单号增加用户的积分，同一个单号只增加一次，用于充值和返还
+// 返回修改后的积分，已经按这个单号增加过或者用户不存在时返回 false
+func (m *UserModel) AddCreditForOrder(ctx context.Context, openid string, delta int, orderNo string) (int, bool) {
+	ctx, cancel := withTimeout(ctx)
+	defer cancel()
+	user := &UserDoc{}
+	err := m.db.Collection(UserCollectionName).FindOneAndUpdate(
+		ctx,
+		bson.D{{USER_OPEN_ID_KEY, openid}, {USER_GRANTED_ORDERS_KEY, bson.D{{"$ne", orderNo}}}},
+		bson.D{
+			{"$inc", bson.D{{CREDIT_KEY, delta}}},
+			{"$set", bson.D{{USER_LAST_ACTIVE_AT_KEY, time.Now().Unix()}}},
+			{"$push", bson.D{{USER_GRANTED_ORDERS_KEY, bson.D{{"$each", bson.A{orderNo}}, {"$slice", -grantedOrdersKept}}}}},
+		},
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(user)
+	if err == mongo.ErrNoDocuments {
+		return 0, false
+	}
+	lib.AssertErr(err)
+	lib.Log(ctx).Debug().Str("openid", openid).Int("delta", delta).Str("order_no", orderNo).Int("credit", user.Credit).Msg("add credit for order")
+	return user.Credit, true
+}
+
+// 积分衰减，不更新最近活跃的时间
+func (m *UserModel) DecayCredit(ctx context.Context, openid string, delta, floor int) (int, bool) {
+	return m.incCredit(ctx, openid, delta, floor, USER_DECAYED_AT_KEY)
+}
+
+// 修改积分，同时将 timeKey 设置为当前时间
+func (m *UserModel) incCredit(ctx context.Context, openid string, delta, floor int, timeKey string) (int, bool) {
+	ctx, cancel := withTimeout(ctx)
+	defer cancel()
+	filters := bson.D{{USER_OPEN_ID_KEY, openid}}
+	if delta < 0 {
+		filters = append(filters, bson.E{CREDIT_KEY, bson.D{{"$gte", floor - delta}}})
+	}
+	user := &UserDoc{}
+	err := m.db.Collection(UserCollectionName).FindOneAndUpdate(
+		ctx,
+		filters,
+		bson.D{
+			{"$inc", bson.D{{CREDIT_KEY, delta}}},
+			{"$set", bson.D{{timeKey, time.Now().Unix()}}},
+		},
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(user)
+	if err == mongo.ErrNoDocuments {
+		return 0, false
+	}
+	lib.AssertErr(err)
+	lib.Log(ctx).Debug().Str("openid", openid).Int("delta", delta).Int("credit", user.Credit).Msg("add credit")
+	return user.Credit, true
+}
+
+// 更新最近活跃的时间
+func (m *UserModel) TouchByOpenID(ctx context.Context, openid string) {
+	ctx, cancel := withTimeout(ctx)
+	defer cancel()
+	_, err := m.db.Collection(UserCollectionName).UpdateOne(
+		ctx,
+		bson.D{{USER_OPEN_ID_KEY, openid}},
+		bson.D{{"$set", bson.D{{USER_LAST_ACTIVE_AT_KEY, time.Now().Unix()}}}},
+	)
+	lib.AssertErr(err)
+}
+
+// 签到并发放奖励，要求上次签到的日期仍然为 lastDay
+// 签到的日期和积分在同一次更新中修改，不会出现已经签到但是没有获得奖励
+// 返回修改后的积分，同一天重复签到时返回 false
+func (m *UserModel) CheckIn(ctx context.Context, openid, lastDay, today string, streak, reward int) (int, bool) {
+	ctx, cancel := withTimeout(ctx)
+	defer cancel()
+	user := &UserDoc{}
+	err := m.db.Collection(UserCollectionName).FindOneAndUpdate(
+		ctx,
+		bson.D{
+			{USER_OPEN_ID_KEY, openid},
+			{USER_CHECK_IN_DAY_KEY, lastDay},
+		},
+		bson.D{
+			{"$inc", bson.D{{CREDIT_KEY, reward}}},
+			{"$set", bson.D{
+				{USER_CHECK_IN_DAY_KEY, today},
+				{USER_CHECK_IN_STREAK_KEY, streak},
+				{USER_LAST_ACTIVE_AT_KEY, time.Now().Unix()},
+			}},
+		},
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(user)
+	if err == mongo.ErrNoDocuments {
+		return 0, false
+	}
+	lib.AssertErr(err)
+	lib.Log(ctx).Debug().Str("openid", openid).Int("reward", reward).Int("credit", user.Credit).Msg("check in")
+	return user.Credit, true
+}
+
+// 标记已经获得第一次完成委托的奖励，已经标记过时返回 false
+func (m *UserModel) MarkFirstCompleted(ctx context.Context, openid string) bool {
+	ctx, cancel := withTimeout(ctx)
+	defer cancel()
+	res, err := m.db.Collection(UserCollectionName).UpdateOne(
+		ctx,
+		bson.D{
+			{USER_OPEN_ID_KEY, openid},
+			{USER_FIRST_COMPLETED_KEY, bson.D{{"$ne", true}}},
+		},
+		bson.D{{"$set", bson.D{{USER_FIRST_COMPLETED_KEY, true}}}},
+	)
+	lib.AssertErr(err)
+	return res.ModifiedCount == 1
+}
+
+// 获取需要衰减积分的用户：inactiveBefore 之后没有活跃、decayedBefore 之后没有衰减过、积分高于 floor
+func (m *UserModel) GetDecayCandidates(ctx context.Context, inactiveBefore, decayedBefore int64, floor int, limit int64) []UserDoc {
+	ctx, cancel := withTimeout(ctx)
+	defer cancel()
+	cursor, err := m.db.Collection(UserCollectionName).Find(ctx, bson.D{
+		{USER_LAST_ACTIVE_AT_KEY, bson.D{{"$lt", inactiveBefore}}},
+		{USER_DECAYED_AT_KEY, bson.D{{"$lt", decayedBefore}}},
+		{CREDIT_KEY, bson.D{{"$gt", floor}}},
+		{USER_STATUS_KEY, bson.D{{"$ne", UserDeleted}}},
+	}, options.Find().SetLimit(limit))
+	lib.AssertErr(err)
+	defer cursor.Close(ctx)
+	res := make([]UserDoc, 0, limit)
+	for cursor.Next(ctx) {
+		doc := UserDoc{}
+		lib.AssertErr(cursor.Decode(&doc))
+		res = append(res, doc)
+	}
+	lib.AssertErr(cursor.Err())
+	return res
+}
@@ -2,10 +2,10 @@ package models
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"time"
 
-	"github.com/rs/zerolog/log"
 	"github.com/sysu-team/Back-end-development/lib"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
@@ -28,13 +28,44 @@ const (
 	ANY       EnumDelegationState = 0xff
 )
 
+var delegationStateNames = map[EnumDelegationState]string{
+	Published: "published",
+	Accepted:  "accepted",
+	Canceled:  "canceled",
+	Pending:   "pending",
+	Finished:  "finished",
+	ANY:       "any",
+}
+
+// 状态的名字，用于命令行工具和监控指标
+func (s EnumDelegationState) String() string {
+	if name, ok := delegationStateNames[s]; ok {
+		return name
+	}
+	return fmt.Sprintf("unknown(%d)", uint8(s))
+}
+
 const (
 	RECEIVER_ID_KEY       string = "receiver_id"
 	PUBLISHER_ID_KEY      string = "publisher_id"
 	DELETAION_ID_KEY      string = "_id"
 	DELEGATAION_STATE_KEY string = "delegation_state"
+	DELEGATION_TYPE_KEY   string = "delegation_type"
 	CURRENT_NUMBER_KEY    string = "current_number"
 	MAX_NUMBER_KEY        string = "max_number"
+	REWARD_KEY            string = "reward"
+	PENDING_TIME_KEY      string = "pending_time"
+	VERSION_KEY           string = "version"
+	PROOFS_KEY            string = "proofs"
+	PICKUP_KEY            string = "pickup"
+	DROPOFF_KEY           string = "dropoff"
+	AREA_KEY              string = "area"
+	START_TIME_KEY        string = "start_time"
+	DISTANCE_KEY          string = "distance"
+	FINISH_TIME_KEY       string = "finish_time"
+	EARNED_CREDIT_KEY     string = "earned_credit"
+	RATINGS_KEY           string = "ratings"
+	SCORE_KEY             string = "score"
 )
 
 // 所有字段名字都是小写 + 下划线连接
@@ -51,6 +82,56 @@ type DelegationDoc struct {
 	QuestionnaireID string              `bson:"questionnaire_id"`
 	MaxNumber       int                 `bson:"max_number"`
 	CurrentNumber   int                 `bson:"current_number"`
+	Attachments     []string            `bson:"attachments"`       // 发布时上传的附件 id
+	Proofs          []ProofDoc          `bson:"proofs"`            // 接受者提交的完成凭证
+	Pickup          *GeoPoint           `bson:"pickup,omitempty"`  // 取件地点
+	Dropoff         *GeoPoint           `bson:"dropoff,omitempty"` // 送达地点
+	Area            string              `bson:"area"`              // 校园区域的名字
+	PendingTime     int64               `bson:"pending_time"`      // 接受者完成、等待发布者确认的开始时间
+	Version         int64               `bson:"version"`           // 每次修改加一，用于条件更新
+	FinishTime      int64               `bson:"finish_time"`       // 发布者确认或者自动确认完成的时间
+	EarnedCredit    int                 `bson:"earned_credit"`     // 完成时每个接受者获得的积分
+	Ratings         []RatingDoc         `bson:"ratings,omitempty"` // 完成之后发布者对接受者的评分
+}
+
+// ErrConflict 委托在读取之后被其他请求修改，条件更新没有生效
+// service 可以重新读取委托后重试，或者返回 delegation_conflict
+var ErrConflict = errors.New("delegation was modified concurrently")
+
+// DelegationVersion 条件更新时期望的委托的版本和状态
+type DelegationVersion struct {
+	Version int64
+	State   EnumDelegationState
+}
+
+// Expected 返回读取时委托的版本和状态，用于之后的条件更新
+func (d *DelegationDoc) Expected() DelegationVersion {
+	return DelegationVersion{d.Version, d.DelegationState}
+}
+
+// GeoJSON 格式的坐标点，坐标的顺序为 [经度, 纬度]
+type GeoPoint struct {
+	Type        string    `bson:"type" json:"type"`
+	Coordinates []float64 `bson:"coordinates" json:"coordinates"`
+}
+
+// 由经纬度创建坐标点
+func NewGeoPoint(lat, lng float64) *GeoPoint {
+	return &GeoPoint{"Point", []float64{lng, lat}}
+}
+
+// 接受者完成委托时提交的凭证
+type ProofDoc struct {
+	ReceiverID    string   `bson:"receiver_id"`
+	AttachmentIDs []string `bson:"attachment_ids"`
+	SubmitTime    int64    `bson:"submit_time"`
+}
+
+// 发布者对接受者的评分，每个接受者只能评分一次
+type RatingDoc struct {
+	ReceiverID string `bson:"receiver_id"`
+	Score      int    `bson:"score"` // 1 到 5
+	RateTime   int64  `bson:"rate_time"`
 }
 
 type delegationPreviewDoc struct {
@@ -59,6 +140,8 @@ type delegationPreviewDoc struct {
 	ID          primitive.ObjectID `json:"id" bson:"_id"`
 	Reward      int
 	Deadline    int64
+	Area        string
+	Distance    *float64 `bson:"distance"`
 }
 
 // 使用/创建 collection, 初始化子 model
@@ -70,72 +153,119 @@ func NewDelegationModel(db *mongo.Database) *DelegationModel {
 // 创建新的委托
 // 状态未活跃的委托没有接收者
 // 返回委托 did
-func (m *DelegationModel) CreateNewDelegation(publisher, name, description string, reward int, deadline int64, delegationType string, qid string, max int) (did string) {
-	var receivers = make([]string, 0, max)
-	id, err := m.db.Collection(DelegationCollectionName).InsertOne(context.TODO(), DelegationDoc{
-		publisher,
-		receivers,
-		name,
-		time.Now().Unix(),
-		Published,
-		reward,
-		description,
-		deadline,
-		delegationType,
-		qid,
-		max,
-		0,
-	})
+func (m *DelegationModel) CreateNewDelegation(ctx context.Context, doc *DelegationDoc) (did string) {
+	ctx, cancel := withTimeout(ctx)
+	defer cancel()
+	doc.ReceiverID = make([]string, 0, doc.MaxNumber)
+	doc.StartTime = time.Now().Unix()
+	doc.DelegationState = Published
+	doc.CurrentNumber = 0
+	doc.Version = 0
+	if doc.Attachments == nil {
+		doc.Attachments = []string{}
+	}
+	doc.Proofs = []ProofDoc{}
+	id, err := m.db.Collection(DelegationCollectionName).InsertOne(ctx, doc)
 	lib.AssertErr(err)
 	lib.Assert(id != nil, "unknown_error")
-	log.Debug().Msg(fmt.Sprintf("insert a doc with id = %v", id.InsertedID))
+	lib.Log(ctx).Debug().Interface("id", id.InsertedID).Msg("insert delegation")
 	return id.InsertedID.(primitive.ObjectID).Hex()
 }
 
 type DelegationPreviewWrapper struct {
-	Id          string `json:"id"`
-	Name        string
-	Description string
-	Reward      int
-	Deadline    int64
+	Id          string   `json:"id"`
+	Name        string   `json:"name"`
+	Description string   `json:"description"`
+	Reward      int      `json:"reward"`
+	Deadline    int64    `json:"deadline"`
+	Area        string   `json:"area"`
+	Distance    *float64 `json:"distance,omitempty"` // 与查询位置的距离，单位米
 }
 
 // with key and value
 type DelegationFilters = bson.D
 
+// 委托列表的筛选条件
+type DelegationQuery struct {
+	State          int
+	Area           string    // 为空代表不限制区域
+	Near           *GeoPoint // 为 nil 代表不按位置搜索
+	Radius         float64   // 搜索半径，单位米，0 代表不限制
+	SortByDistance bool      // 按距离从近到远排序，否则按发布时间从新到旧
+}
+
 // 获取委托预览
 // 按照分页的规格返回特定的委托
 // 长度为0代表没有找到 不会返回 error，只有一个数据来源，error 的处理直接在中间件中处理
-func (m *DelegationModel) GetDelegationPreviewByState(page, limit int64, state int) []DelegationPreviewWrapper {
-	return m.getDelegationPreviewListBy(page, limit, DelegationFilters{
-		{DELEGATAION_STATE_KEY, state},
-	})
+func (m *DelegationModel) GetDelegationPreview(ctx context.Context, page, limit int64, query *DelegationQuery) []DelegationPreviewWrapper {
+	ctx, cancel := withTimeout(ctx)
+	defer cancel()
+	filters := DelegationFilters{
+		{DELEGATAION_STATE_KEY, query.State},
+	}
+	if query.Area != "" {
+		filters = append(filters, bson.E{AREA_KEY, query.Area})
+	}
+	if query.Near == nil {
+		return m.getDelegationPreviewListBy(ctx, page, limit, filters)
+	}
+	return m.getDelegationPreviewNear(ctx, page, limit, filters, query)
+}
+
+// 按照与取件地点的距离搜索委托
+func (m *DelegationModel) getDelegationPreviewNear(ctx context.Context, page, limit int64, filters DelegationFilters, query *DelegationQuery) []DelegationPreviewWrapper {
+	geoNear := bson.D{
+		{"near", query.Near},
+		{"distanceField", DISTANCE_KEY},
+		{"key", PICKUP_KEY},
+		{"spherical", true},
+		{"query", filters},
+	}
+	if query.Radius > 0 {
+		geoNear = append(geoNear, bson.E{"maxDistance", query.Radius})
+	}
+	// $geoNear 默认按照距离排序
+	pipeline := []bson.D{{{"$geoNear", geoNear}}}
+	if !query.SortByDistance {
+		pipeline = append(pipeline, bson.D{{"$sort", bson.D{{START_TIME_KEY, -1}}}})
+	}
+	pipeline = append(pipeline,
+		bson.D{{"$skip", (page - 1) * limit}},
+		bson.D{{"$limit", limit}},
+	)
+	cursor, err := m.db.Collection(DelegationCollectionName).Aggregate(ctx, pipeline)
+	lib.AssertErr(err)
+	return decodeDelegationPreviewList(ctx, cursor, limit)
 }
 
 // 获取用户接受的委托的处于某个状态的委托
 // ANY 意味着对状态没有要求
 // 状态的检查应该再 service 层中完成
-func (m *DelegationModel) GetUserAcceptedDelegationPreviewWithState(page, limit int64, userID string, state EnumDelegationState) []DelegationPreviewWrapper {
+func (m *DelegationModel) GetUserAcceptedDelegationPreviewWithState(ctx context.Context, page, limit int64, userID string, state EnumDelegationState) []DelegationPreviewWrapper {
+	ctx, cancel := withTimeout(ctx)
+	defer cancel()
 	if state != ANY {
-		return m.getDelegationPreviewListBy(page, limit, DelegationFilters{
+		return m.getDelegationPreviewListBy(ctx, page, limit, DelegationFilters{
 			{RECEIVER_ID_KEY, userID},
 			{DELEGATAION_STATE_KEY, state},
 		})
 	}
-	return m.getDelegationPreviewListBy(page, limit, DelegationFilters{
+	return m.getDelegationPreviewListBy(ctx, page, limit, DelegationFilters{
 		{RECEIVER_ID_KEY, userID},
 	})
 }
 
 // 获取用户发布的委托
-func (m *DelegationModel) GetUserPublishDelegationPreviewWithState(page, limit int64, userID string, state EnumDelegationState) []DelegationPreviewWrapper {
+func (m *DelegationModel) GetUserPublishDelegationPreviewWithState(ctx context.Context, page, limit int64, userID string, state EnumDelegationState) []DelegationPreviewWrapper {
+	ctx, cancel := withTimeout(ctx)
+	defer cancel()
 	if state != ANY {
-		return m.getDelegationPreviewListBy(page, limit, DelegationFilters{
+		return m.getDelegationPreviewListBy(ctx, page, limit, DelegationFilters{
 			{PUBLISHER_ID_KEY, userID},
 			{DELEGATAION_STATE_KEY, state},
 		})
 	}
-	return m.getDelegationPreviewListBy(page, limit, DelegationFilters{
+	return m.getDelegationPreviewListBy(ctx, page, limit, DelegationFilters{
 		{PUBLISHER_ID_KEY, userID},
 	})
 }
@@ -144,8 +274,10 @@ func (m *DelegationModel) GetUserPublishDelegationPreviewWithState(page, limit i
 // 分成两部分
 // 1. 用户发布的 -》 已经完成整个流程了
 // 2. 用户接受的 -》 等待整个流程
-func (m *DelegationModel) GetUserPendingDelegationPreviewWithState(page, limit int64, userID string, state EnumDelegationState) []DelegationPreviewWrapper {
-	return m.getDelegationPreviewListBy(page, limit, DelegationFilters{
+func (m *DelegationModel) GetUserPendingDelegationPreviewWithState(ctx context.Context, page, limit int64, userID string, state EnumDelegationState) []DelegationPreviewWrapper {
+	ctx, cancel := withTimeout(ctx)
+	defer cancel()
+	return m.getDelegationPreviewListBy(ctx, page, limit, DelegationFilters{
 		{RECEIVER_ID_KEY, userID},
 		{DELEGATAION_STATE_KEY, state},
 	})
@@ -154,86 +286,158 @@ func (m *DelegationModel) GetUserPendingDelegationPreviewWithState(page, limit i
 // 接受委托
 // 输入object id, 和接受委托人
 // 更新数据库中的委托信息
-// 可能抛出的错误：
-// 1. 这是一个已经被接受的委托
-// 2. 不存在该委托
-func (m *DelegationModel) ReceiveDelegation(delegationID string, receiverID string, state uint8) {
-	objID, err := primitive.ObjectIDFromHex(delegationID)
-	lib.AssertErr(err)
-	res, err := m.db.Collection(DelegationCollectionName).UpdateOne(
-		context.TODO(),
-		bson.D{{
-			DELETAION_ID_KEY,
-			objID,
-		}},
-		bson.D{
-			{
-				"$addToSet", bson.D{
-					{RECEIVER_ID_KEY, receiverID},
-				},
+// 委托在读取之后被修改时返回 ErrConflict，例如其他用户同时接受了该委托
+func (m *DelegationModel) ReceiveDelegation(ctx context.Context, delegationID string, expected DelegationVersion, receiverID string, state uint8) error {
+	ctx, cancel := withTimeout(ctx)
+	defer cancel()
+	return m.updateVersioned(ctx, "receive delegation", delegationID, expected, bson.D{
+		{
+			"$addToSet", bson.D{
+				{RECEIVER_ID_KEY, receiverID},
 			},
-			{
-				"$set", bson.D{
-					{DELEGATAION_STATE_KEY, state},
-				},
+		},
+		{
+			"$set", bson.D{
+				{DELEGATAION_STATE_KEY, state},
 			},
-			{
-				"$inc", bson.D{
-					{CURRENT_NUMBER_KEY, 1},
-				},
+		},
+		{
+			"$inc", bson.D{
+				{CURRENT_NUMBER_KEY, 1},
 			},
 		},
-	)
-	lib.AssertErr(err)
-	log.Debug().Msg(fmt.Sprintf("update result: %v", res))
-	return
+	})
 }
 
-func (m *DelegationModel) SetDelegationState(delegationID string, state uint8) {
+func (m *DelegationModel) SetDelegationState(ctx context.Context, delegationID string, expected DelegationVersion, state uint8) error {
+	ctx, cancel := withTimeout(ctx)
+	defer cancel()
+	return m.updateVersioned(ctx, "set delegation state", delegationID, expected, bson.D{{
+		"$set", bson.D{
+			{DELEGATAION_STATE_KEY, state},
+		},
+	}})
+}
+
+// 发布者确认完成，记录完成的时间和每个接受者获得的积分，用于排行榜
+func (m *DelegationModel) SetFinished(ctx context.Context, delegationID string, expected DelegationVersion, finishTime int64, earnedCredit int) error {
+	ctx, cancel := withTimeout(ctx)
+	defer cancel()
+	return m.updateVersioned(ctx, "set finished", delegationID, expected, bson.D{{
+		"$set", bson.D{
+			{DELEGATAION_STATE_KEY, Finished},
+			{FINISH_TIME_KEY, finishTime},
+			{EARNED_CREDIT_KEY, earnedCredit},
+		},
+	}})
+}
+
+// 接受者完成委托，等待发布者确认
+func (m *DelegationModel) SetPending(ctx context.Context, delegationID string, expected DelegationVersion, pendingTime int64) error {
+	ctx, cancel := withTimeout(ctx)
+	defer cancel()
+	return m.updateVersioned(ctx, "set pending", delegationID, expected, bson.D{{
+		"$set", bson.D{
+			{DELEGATAION_STATE_KEY, Pending},
+			{PENDING_TIME_KEY, pendingTime},
+		},
+	}})
+}
+
+// 委托的版本和状态与 expected 一致时更新，同时将版本加一
+// 没有匹配的委托时返回 ErrConflict
+func (m *DelegationModel) updateVersioned(ctx context.Context, op, delegationID string, expected DelegationVersion, update bson.D) error {
 	objID, err := primitive.ObjectIDFromHex(delegationID)
-	lib.AssertErr(err)
+	lib.Assert(err == nil, "no_such_delegation")
+	inc := false
+	for i, e := range update {
+		if e.Key == "$inc" {
+			update[i].Value = append(e.Value.(bson.D), bson.E{VERSION_KEY, 1})
+			inc = true
+		}
+	}
+	if !inc {
+		update = append(update, bson.E{"$inc", bson.D{{VERSION_KEY, 1}}})
+	}
 	res, err := m.db.Collection(DelegationCollectionName).UpdateOne(
-		context.TODO(),
-		bson.D{{
-			DELETAION_ID_KEY,
-			objID,
-		}},
-		bson.D{{
-			"$set", bson.D{
-				{DELEGATAION_STATE_KEY, state},
-			},
-		}},
+		ctx,
+		bson.D{
+			{DELETAION_ID_KEY, objID},
+			{VERSION_KEY, expected.Version},
+			{DELEGATAION_STATE_KEY, expected.State},
+		},
+		update,
 	)
 	lib.AssertErr(err)
-	log.Debug().Msg(fmt.Sprintf("set result: %v", res))
-	return
+	lib.Log(ctx).Debug().Int64("matched", res.MatchedCount).Int64("version", expected.Version).Msg(op)
+	if res.MatchedCount == 0 {
+		return ErrConflict
+	}
+	return nil
+}
+
+// 获取在 before 之前进入待确认状态的委托的 id，最多返回 limit 个
+// 没有记录开始时间的旧委托同样返回
+func (m *DelegationModel) GetPendingIDsBefore(ctx context.Context, before, limit int64) []string {
+	ctx, cancel := withTimeout(ctx)
+	defer cancel()
+	cursor, err := m.db.Collection(DelegationCollectionName).Find(
+		ctx,
+		bson.D{
+			{DELEGATAION_STATE_KEY, Pending},
+			{"$or", bson.A{
+				bson.D{{PENDING_TIME_KEY, bson.D{{"$lte", before}}}},
+				bson.D{{PENDING_TIME_KEY, bson.D{{"$exists", false}}}},
+			}},
+		},
+		&options.FindOptions{
+			Limit:      &limit,
+			Projection: bson.D{{DELETAION_ID_KEY, 1}},
+		},
+	)
+	lib.AssertErr(err)
+	defer func() {
+		lib.AssertErr(cursor.Close(ctx))
+	}()
+	res := make([]string, 0)
+	for cursor.Next(ctx) {
+		tmp := struct {
+			ID primitive.ObjectID `bson:"_id"`
+		}{}
+		lib.AssertErr(cursor.Decode(&tmp))
+		res = append(res, tmp.ID.Hex())
+	}
+	return res
 }
 
 // 获取委托详细情况
 // 根据委托 id 获取委托
 // Object ID 获取和返回
-func (m *DelegationModel) GetSpecificDelegation(uniqueID string) (d *DelegationDoc) {
+func (m *DelegationModel) GetSpecificDelegation(ctx context.Context, uniqueID string) (d *DelegationDoc) {
+	ctx, cancel := withTimeout(ctx)
+	defer cancel()
 	objID, err := primitive.ObjectIDFromHex(uniqueID)
-	lib.AssertErr(err)
+	lib.Assert(err == nil, "no_such_delegation")
 	d = &DelegationDoc{}
 	res := m.db.Collection(DelegationCollectionName).FindOne(
-		context.TODO(),
+		ctx,
 		bson.D{{
 			DELETAION_ID_KEY,
 			objID,
 		}},
 	)
-	lib.Assert(res != nil, "no_such_delegation")
-	lib.Assert(res.Decode(d) == nil, "unknown_error")
+	err = res.Decode(d)
+	lib.Assert(err != mongo.ErrNoDocuments, "no_such_delegation")
+	lib.AssertErr(err)
 	return
 }
 
-func (m *DelegationModel) getDelegationPreviewListBy(page, limit int64, filters DelegationFilters) []DelegationPreviewWrapper {
+func (m *DelegationModel) getDelegationPreviewListBy(ctx context.Context, page, limit int64, filters DelegationFilters) []DelegationPreviewWrapper {
 	res := make([]DelegationPreviewWrapper, 0, limit)
 	offset := (page - 1) * limit
 	cursor, err := m.db.Collection(DelegationCollectionName).
 		Find(
-			context.TODO(),
+			ctx,
 			filters,
 			&options.FindOptions{
 				Limit: &limit,
@@ -243,54 +447,261 @@ func (m *DelegationModel) getDelegationPreviewListBy(page, limit int64, filters
 		return res
 	}
 	lib.AssertErr(err)
-	lib.Assert(cursor != nil, "unknown_error", 401)
+	lib.Assert(cursor != nil, "unknown_error")
+	return decodeDelegationPreviewList(ctx, cursor, limit)
+}
+
+func decodeDelegationPreviewList(ctx context.Context, cursor *mongo.Cursor, limit int64) []DelegationPreviewWrapper {
+	res := make([]DelegationPreviewWrapper, 0, limit)
 	defer func() {
-		lib.AssertErr(cursor.Close(context.TODO()))
+		lib.AssertErr(cursor.Close(ctx))
 	}()
-	for cursor.Next(context.TODO()) {
+	for cursor.Next(ctx) {
 		tmp := delegationPreviewDoc{}
 		// 这是一个应该直接抛出的错误
 		lib.AssertErr(cursor.Decode(&tmp))
 		res = append(res, DelegationPreviewWrapper{
-			tmp.ID.Hex(),
-			tmp.Name,
-			tmp.Description,
-			tmp.Reward,
-			tmp.Deadline,
+			Id:          tmp.ID.Hex(),
+			Name:        tmp.Name,
+			Description: tmp.Description,
+			Reward:      tmp.Reward,
+			Deadline:    tmp.Deadline,
+			Area:        tmp.Area,
+			Distance:    tmp.Distance,
 		})
 	}
 	return res
 }
 
 // 问卷的接受者取消/完成，将最大人数和当前人数各减一，同时将取消/完成者从列表中删除
-func (m *DelegationModel) DeleteReceiver(delegationID, userID string, newState uint8) {
-	objID, err := primitive.ObjectIDFromHex(delegationID)
+// 发布者取消时一次删除所有的接受者
+func (m *DelegationModel) DeleteReceiver(ctx context.Context, delegationID string, expected DelegationVersion, newState uint8, userIDs ...string) error {
+	ctx, cancel := withTimeout(ctx)
+	defer cancel()
+	return m.updateVersioned(ctx, "delete receiver", delegationID, expected, bson.D{
+		{
+			"$pullAll", bson.D{
+				{RECEIVER_ID_KEY, userIDs},
+			},
+		},
+		{
+			"$set", bson.D{
+				{DELEGATAION_STATE_KEY, newState},
+			},
+		},
+		{
+			"$inc", bson.D{
+				{CURRENT_NUMBER_KEY, -len(userIDs)},
+				{MAX_NUMBER_KEY, -len(userIDs)},
+			},
+		},
+	})
+}
+
+// 判断两个用户之间是否有已经被接受、还在进行中的委托
+// 多人委托在名额满之前仍然是发布中，已经接受的用户同样算作另一方
+func (m *DelegationModel) HasAcceptedRelation(ctx context.Context, userID, otherID string) bool {
+	ctx, cancel := withTimeout(ctx)
+	defer cancel()
+	var limit int64 = 1
+	count, err := m.db.Collection(DelegationCollectionName).CountDocuments(
+		ctx,
+		bson.D{
+			{DELEGATAION_STATE_KEY, bson.D{{"$in", bson.A{Published, Accepted, Pending}}}},
+			{"$or", bson.A{
+				bson.D{{PUBLISHER_ID_KEY, userID}, {RECEIVER_ID_KEY, otherID}},
+				bson.D{{PUBLISHER_ID_KEY, otherID}, {RECEIVER_ID_KEY, userID}},
+			}},
+		},
+		&options.CountOptions{Limit: &limit},
+	)
 	lib.AssertErr(err)
+	return count > 0
+}
+
+// 添加接受者提交的完成凭证
+func (m *DelegationModel) AddProof(ctx context.Context, delegationID string, proof ProofDoc) {
+	ctx, cancel := withTimeout(ctx)
+	defer cancel()
+	objID, err := primitive.ObjectIDFromHex(delegationID)
+	lib.Assert(err == nil, "no_such_delegation")
 	res, err := m.db.Collection(DelegationCollectionName).UpdateOne(
-		context.TODO(),
+		ctx,
 		bson.D{{
 			DELETAION_ID_KEY,
 			objID,
 		}},
-		bson.D{
-			{
-				"$pull", bson.D{
-					{RECEIVER_ID_KEY, userID},
-				},
-			},
-			{
-				"$set", bson.D{
-					{DELEGATAION_STATE_KEY, newState},
-				},
-			},
-			{
-				"$inc", bson.D{
-					{CURRENT_NUMBER_KEY, -1},
-					{MAX_NUMBER_KEY, -1},
-				},
+		bson.D{{
+			"$push", bson.D{
+				{PROOFS_KEY, proof},
 			},
+		}},
+	)
+	lib.AssertErr(err)
+	lib.Log(ctx).Debug().Int64("matched", res.MatchedCount).Int64("modified", res.ModifiedCount).Msg("add proof")
+}
+
+// 为已经完成的委托的接受者评分
+// 委托没有完成、不是这个委托的接受者或者已经评分过时返回 false
+func (m *DelegationModel) AddRating(ctx context.Context, delegationID string, rating RatingDoc) bool {
+	ctx, cancel := withTimeout(ctx)
+	defer cancel()
+	objID, err := primitive.ObjectIDFromHex(delegationID)
+	lib.Assert(err == nil, "no_such_delegation")
+	res, err := m.db.Collection(DelegationCollectionName).UpdateOne(
+		ctx,
+		bson.D{
+			{DELETAION_ID_KEY, objID},
+			{DELEGATAION_STATE_KEY, Finished},
+			{RECEIVER_ID_KEY, rating.ReceiverID},
+			{RATINGS_KEY + "." + RECEIVER_ID_KEY, bson.D{{"$ne", rating.ReceiverID}}},
 		},
+		bson.D{{
+			"$push", bson.D{
+				{RATINGS_KEY, rating},
+			},
+		}},
 	)
 	lib.AssertErr(err)
-	log.Debug().Msg(fmt.Sprintf("DeleteReceiver result: %v", res))
+	lib.Log(ctx).Debug().Int64("matched", res.MatchedCount).Int64("modified", res.ModifiedCount).Msg("add rating")
+	return res.ModifiedCount == 1
+}
+
+// 某个状态的委托数量
+type DelegationStateCount struct {
+	State EnumDelegationState `bson:"_id"`
+	Count int64               `bson:"count"`
+}
+
+// 统计用户发布的进行中（未完成、未取消）的委托数量
+func (m *DelegationModel) CountOpenByPublisher(ctx context.Context, publisherID string) int64 {
+	ctx, cancel := withTimeout(ctx)
+	defer cancel()
+	n, err := m.db.Collection(DelegationCollectionName).CountDocuments(ctx, bson.D{
+		{PUBLISHER_ID_KEY, publisherID},
+		{DELEGATAION_STATE_KEY, bson.D{{"$in", bson.A{Published, Accepted, Pending}}}},
+	})
+	lib.AssertErr(err)
+	return n
+}
+
+// 按状态统计委托的数量，没有委托的状态不会出现在结果中
+func (m *DelegationModel) CountByState(ctx context.Context) []DelegationStateCount {
+	ctx, cancel := withTimeout(ctx)
+	defer cancel()
+	cursor, err := m.db.Collection(DelegationCollectionName).Aggregate(ctx, []bson.D{
+		{{"$group", bson.D{{"_id", "$" + DELEGATAION_STATE_KEY}, {"count", bson.D{{"$sum", 1}}}}}},
+	})
+	lib.AssertErr(err)
+	defer func() {
+		lib.AssertErr(cursor.Close(ctx))
+	}()
+	res := make([]DelegationStateCount, 0)
+	for cursor.Next(ctx) {
+		tmp := DelegationStateCount{}
+		lib.AssertErr(cursor.Decode(&tmp))
+		res = append(res, tmp)
+	}
+	return res
+}
+
+// 统计进行中的委托预冻结的积分
+// 发布者为每个名额冻结一份奖励，每个接受者接受时冻结一份奖励
+func (m *DelegationModel) SumFrozenCredit(ctx context.Context) int64 {
+	ctx, cancel := withTimeout(ctx)
+	defer cancel()
+	cursor, err := m.db.Collection(DelegationCollectionName).Aggregate(ctx, []bson.D{
+		{{"$match", bson.D{{DELEGATAION_STATE_KEY, bson.D{{"$in", bson.A{Published, Accepted, Pending}}}}}}},
+		{{"$group", bson.D{
+			{"_id", nil},
+			{"total", bson.D{{"$sum", bson.D{{"$multiply", bson.A{
+				"$" + REWARD_KEY,
+				bson.D{{"$add", bson.A{"$" + MAX_NUMBER_KEY, "$" + CURRENT_NUMBER_KEY}}},
+			}}}}}},
+		}}},
+	})
+	lib.AssertErr(err)
+	defer func() {
+		lib.AssertErr(cursor.Close(ctx))
+	}()
+	res := struct {
+		Total int64 `bson:"total"`
+	}{}
+	if cursor.Next(ctx) {
+		lib.AssertErr(cursor.Decode(&res))
+	}
+	return res.Total
+}
+
+// 委托和委托的 id，用于导出
+type DelegationWithID struct {
+	ID            primitive.ObjectID `bson:"_id"`
+	DelegationDoc `bson:",inline"`
+}
+
+// 获取用户发布的所有委托
+func (m *DelegationModel) GetAllByPublisher(ctx context.Context, publisherID string) []DelegationWithID {
+	return m.getAllBy(ctx, bson.D{{PUBLISHER_ID_KEY, publisherID}})
+}
+
+// 获取用户接受过的所有委托，包括已经完成或者放弃、不在接受者列表中的委托
+func (m *DelegationModel) GetAllByReceiver(ctx context.Context, receiverID string) []DelegationWithID {
+	return m.getAllBy(ctx, bson.D{{"$or", bson.A{
+		bson.D{{RECEIVER_ID_KEY, receiverID}},
+		bson.D{{PROOFS_KEY + "." + RECEIVER_ID_KEY, receiverID}},
+	}}})
+}
+
+func (m *DelegationModel) getAllBy(ctx context.Context, filters bson.D) []DelegationWithID {
+	ctx, cancel := withTimeout(ctx)
+	defer cancel()
+	cursor, err := m.db.Collection(DelegationCollectionName).Find(ctx, filters,
+		options.Find().SetSort(bson.D{{START_TIME_KEY, -1}}))
+	lib.AssertErr(err)
+	defer cursor.Close(ctx)
+	res := []DelegationWithID{}
+	for cursor.Next(ctx) {
+		doc := DelegationWithID{}
+		lib.AssertErr(cursor.Decode(&doc))
+		res = append(res, doc)
+	}
+	lib.AssertErr(cursor.Err())
+	return res
+}
+
+// 统计用户作为发布者或者接受者、还冻结着积分的委托
+func (m *DelegationModel) CountActiveByUser(ctx context.Context, openid string) int64 {
+	ctx, cancel := withTimeout(ctx)
+	defer cancel()
+	n, err := m.db.Collection(DelegationCollectionName).CountDocuments(ctx, bson.D{
+		{"$or", bson.A{
+			bson.D{{PUBLISHER_ID_KEY, openid}},
+			bson.D{{RECEIVER_ID_KEY, openid}},
+		}},
+		{DELEGATAION_STATE_KEY, bson.D{{"$in", bson.A{Published, Accepted, Pending}}}},
+	})
+	lib.AssertErr(err)
+	return n
+}
+
+// 注销用户时将委托中的发布者、接受者和凭证的提交者替换为匿名 id
+// 委托本身保留，另一方的记录不受影响
+func (m *DelegationModel) ReplaceUser(ctx context.Context, openid, anonID string) {
+	ctx, cancel := withTimeout(ctx)
+	defer cancel()
+	collection := m.db.Collection(DelegationCollectionName)
+	updates := []struct {
+		filters bson.D
+		set     bson.D
+	}{
+		{bson.D{{PUBLISHER_ID_KEY, openid}}, bson.D{{PUBLISHER_ID_KEY, anonID}}},
+		{bson.D{{RECEIVER_ID_KEY, openid}}, bson.D{{RECEIVER_ID_KEY + ".$", anonID}}},
+		{bson.D{{PROOFS_KEY + "." + RECEIVER_ID_KEY, openid}}, bson.D{{PROOFS_KEY + ".$." + RECEIVER_ID_KEY, anonID}}},
+		{bson.D{{RATINGS_KEY + "." + RECEIVER_ID_KEY, openid}}, bson.D{{RATINGS_KEY + ".$." + RECEIVER_ID_KEY, anonID}}},
+	}
+	for _, u := range updates {
+		res, err := collection.UpdateMany(ctx, u.filters, bson.D{{"$set", u.set}})
+		lib.AssertErr(err)
+		lib.Log(ctx).Debug().Int64("modified", res.ModifiedCount).Msg("replace delegation user")
+	}
 }
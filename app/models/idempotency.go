@@ -0,0 +1,122 @@
+package models
+
+import (
+	"context"
+	"time"
+
+	"github.com/sysu-team/Back-end-development/lib"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const (
+	IDEMPOTENCY_ID_KEY           string = "_id"
+	IDEMPOTENCY_STATE_KEY        string = "state"
+	IDEMPOTENCY_STATUS_CODE_KEY  string = "status_code"
+	IDEMPOTENCY_CONTENT_TYPE_KEY string = "content_type"
+	IDEMPOTENCY_BODY_KEY         string = "body"
+	IDEMPOTENCY_CREATED_AT_KEY   string = "created_at"
+	IDEMPOTENCY_EXPIRE_AT_KEY    string = "expire_at"
+)
+
+type EnumIdempotencyState uint8
+
+const (
+	IdempotencyProcessing EnumIdempotencyState = 0 // 第一次请求正在处理
+	IdempotencyDone       EnumIdempotencyState = 1 // 已经保存了响应
+)
+
+// 幂等键的记录，过期后由 TTL 索引删除
+type IdempotencyDoc struct {
+	ID          string               `bson:"_id"`          // 调用方和幂等键的摘要
+	RequestHash string               `bson:"request_hash"` // 请求方法、路径和请求体的摘要
+	State       EnumIdempotencyState `bson:"state"`
+	StatusCode  int                  `bson:"status_code"`
+	ContentType string               `bson:"content_type"`
+	Body        []byte               `bson:"body"`
+	CreatedAt   time.Time            `bson:"created_at"`
+	ExpireAt    time.Time            `bson:"expire_at"`
+}
+
+type IdempotencyModel struct {
+	db *mongo.Database
+}
+
+// 使用/创建 collection, 初始化子 model
+func NewIdempotencyModel(db *mongo.Database) *IdempotencyModel {
+	return &IdempotencyModel{db}
+}
+
+// 插入处理中的记录，返回是否插入成功
+// 已经存在同一个幂等键时返回 false 和已有的记录
+func (m *IdempotencyModel) Begin(ctx context.Context, doc *IdempotencyDoc) (bool, *IdempotencyDoc) {
+	ctx, cancel := withTimeout(ctx)
+	defer cancel()
+	collection := m.db.Collection(IdempotencyCollectionName)
+	_, err := collection.InsertOne(ctx, doc)
+	if err == nil {
+		return true, nil
+	}
+	if !isDuplicateKey(err) {
+		lib.AssertErr(err)
+	}
+	existing := &IdempotencyDoc{}
+	err = collection.FindOne(ctx, bson.D{{IDEMPOTENCY_ID_KEY, doc.ID}}).Decode(existing)
+	if err == mongo.ErrNoDocuments {
+		// 已有的记录刚好被删除，由客户端重试
+		existing.State = IdempotencyProcessing
+		existing.RequestHash = doc.RequestHash
+		return false, existing
+	}
+	lib.AssertErr(err)
+	return false, existing
+}
+
+// 接管处理了太久的记录，第一次请求可能已经崩溃或者被中断，没有调用 Complete 或者 Abort
+// 以读取到的开始时间为条件，同时重试的请求只有一个可以接管，返回是否接管成功
+func (m *IdempotencyModel) TakeOver(ctx context.Context, id string, staleCreatedAt, createdAt, expireAt time.Time) bool {
+	ctx, cancel := withTimeout(ctx)
+	defer cancel()
+	res, err := m.db.Collection(IdempotencyCollectionName).UpdateOne(
+		ctx,
+		bson.D{
+			{IDEMPOTENCY_ID_KEY, id},
+			{IDEMPOTENCY_STATE_KEY, IdempotencyProcessing},
+			{IDEMPOTENCY_CREATED_AT_KEY, staleCreatedAt},
+		},
+		bson.D{{"$set", bson.D{
+			{IDEMPOTENCY_CREATED_AT_KEY, createdAt},
+			{IDEMPOTENCY_EXPIRE_AT_KEY, expireAt},
+		}}},
+	)
+	lib.AssertErr(err)
+	return res.MatchedCount == 1
+}
+
+// 保存响应
+func (m *IdempotencyModel) Complete(ctx context.Context, id string, statusCode int, contentType string, body []byte) {
+	ctx, cancel := withTimeout(ctx)
+	defer cancel()
+	_, err := m.db.Collection(IdempotencyCollectionName).UpdateOne(
+		ctx,
+		bson.D{{IDEMPOTENCY_ID_KEY, id}},
+		bson.D{{"$set", bson.D{
+			{IDEMPOTENCY_STATE_KEY, IdempotencyDone},
+			{IDEMPOTENCY_STATUS_CODE_KEY, statusCode},
+			{IDEMPOTENCY_CONTENT_TYPE_KEY, contentType},
+			{IDEMPOTENCY_BODY_KEY, body},
+		}}},
+	)
+	lib.AssertErr(err)
+}
+
+// 删除处理中的记录，请求失败后允许使用同一个幂等键重试
+func (m *IdempotencyModel) Abort(ctx context.Context, id string) {
+	ctx, cancel := withTimeout(ctx)
+	defer cancel()
+	_, err := m.db.Collection(IdempotencyCollectionName).DeleteOne(ctx, bson.D{
+		{IDEMPOTENCY_ID_KEY, id},
+		{IDEMPOTENCY_STATE_KEY, IdempotencyProcessing},
+	})
+	lib.AssertErr(err)
+}
@@ -0,0 +1,178 @@
+package models
+
+import (
+	"context"
+	"time"
+
+	"github.com/sysu-team/Back-end-development/lib"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// 排行榜排名使用的数值
+type EnumLeaderboardMetric string
+
+const (
+	LeaderboardByCount  EnumLeaderboardMetric = "count"  // 完成的委托数量
+	LeaderboardByCredit EnumLeaderboardMetric = "credit" // 接受者获得的积分，发布者支付的积分
+	LeaderboardByRating EnumLeaderboardMetric = "rating" // 接受者获得的平均评分
+)
+
+const (
+	LEADERBOARD_ENTRIES_KEY string = "entries"
+	LEADERBOARD_USER_ID_KEY string = "user_id"
+)
+
+// 排行榜中的一名用户
+type LeaderboardEntry struct {
+	UserID    string  `bson:"user_id"`
+	Name      string  `bson:"name"`
+	AvatarURL string  `bson:"avatar_url"`
+	Value     float64 `bson:"value"` // 排名使用的数值：完成数量、获得的积分或者平均评分
+	Count     int64   `bson:"count"` // 完成的委托数量，按评分排名时为评分的数量
+}
+
+// 缓存的排行榜，由后台任务定期重新计算
+type LeaderboardDoc struct {
+	ID          string             `bson:"_id"` // 排行榜的名字，例如 helpers.count.week
+	PeriodStart int64              `bson:"period_start"`
+	Entries     []LeaderboardEntry `bson:"entries"`
+	UpdateTime  int64              `bson:"update_time"`
+}
+
+// 排行榜的统计方式
+type LeaderboardQuery struct {
+	ByPublisher bool                  // 统计发布者，否则统计接受者
+	Metric      EnumLeaderboardMetric // 按评分排名时只统计接受者
+	Since       int64                 // 只统计这个时间之后完成的委托，为 0 时统计所有时间
+	MinRatings  int                   // 按评分排名时最少需要的评分数量
+	Limit       int64
+}
+
+type LeaderboardModel struct {
+	db *mongo.Database
+}
+
+// 使用/创建 collection, 初始化子 model
+func NewLeaderboardModel(db *mongo.Database) *LeaderboardModel {
+	return &LeaderboardModel{db}
+}
+
+// 返回nil代表这个排行榜还没有计算过
+func (m *LeaderboardModel) GetBoard(ctx context.Context, id string) *LeaderboardDoc {
+	ctx, cancel := withTimeout(ctx)
+	defer cancel()
+	res := &LeaderboardDoc{}
+	err := m.db.Collection(LeaderboardCollectionName).FindOne(ctx, bson.D{{"_id", id}}).Decode(res)
+	if err == mongo.ErrNoDocuments {
+		return nil
+	}
+	lib.AssertErr(err)
+	return res
+}
+
+// 保存重新计算的排行榜，覆盖之前的结果
+func (m *LeaderboardModel) SaveBoard(ctx context.Context, doc *LeaderboardDoc) {
+	ctx, cancel := withTimeout(ctx)
+	defer cancel()
+	doc.UpdateTime = time.Now().Unix()
+	_, err := m.db.Collection(LeaderboardCollectionName).ReplaceOne(
+		ctx,
+		bson.D{{"_id", doc.ID}},
+		doc,
+		options.Replace().SetUpsert(true),
+	)
+	lib.AssertErr(err)
+}
+
+// 从所有缓存的排行榜中移除用户，用户关闭排行榜或者注销时立即生效
+func (m *LeaderboardModel) RemoveUser(ctx context.Context, openid string) {
+	ctx, cancel := withTimeout(ctx)
+	defer cancel()
+	_, err := m.db.Collection(LeaderboardCollectionName).UpdateMany(
+		ctx,
+		bson.D{{LEADERBOARD_ENTRIES_KEY + "." + LEADERBOARD_USER_ID_KEY, openid}},
+		bson.D{{"$pull", bson.D{{LEADERBOARD_ENTRIES_KEY, bson.D{{LEADERBOARD_USER_ID_KEY, openid}}}}}},
+	)
+	lib.AssertErr(err)
+}
+
+// 从已经完成的委托统计排行榜
+// 关闭了排行榜的用户和已经注销的用户不参与排名，数值相同时按照 open id 排序
+func (m *LeaderboardModel) Rank(ctx context.Context, query *LeaderboardQuery) []LeaderboardEntry {
+	ctx, cancel := withTimeout(ctx)
+	defer cancel()
+	match := bson.D{{DELEGATAION_STATE_KEY, Finished}}
+	if query.Since > 0 {
+		match = append(match, bson.E{FINISH_TIME_KEY, bson.D{{"$gte", query.Since}}})
+	}
+	pipeline := []bson.D{{{"$match", match}}}
+	switch {
+	case query.Metric == LeaderboardByRating:
+		pipeline = append(pipeline,
+			bson.D{{"$unwind", "$" + RATINGS_KEY}},
+			bson.D{{"$group", bson.D{
+				{"_id", "$" + RATINGS_KEY + "." + RECEIVER_ID_KEY},
+				{"value", bson.D{{"$avg", "$" + RATINGS_KEY + "." + SCORE_KEY}}},
+				{"count", bson.D{{"$sum", 1}}},
+			}}},
+			bson.D{{"$match", bson.D{{"count", bson.D{{"$gte", query.MinRatings}}}}}},
+		)
+	case query.ByPublisher:
+		// 发布者的积分为支付给所有接受者的积分
+		value := bson.D{{"$sum", 1}}
+		if query.Metric == LeaderboardByCredit {
+			value = bson.D{{"$sum", bson.D{{"$multiply", bson.A{
+				"$" + EARNED_CREDIT_KEY,
+				bson.D{{"$size", bson.D{{"$ifNull", bson.A{"$" + RECEIVER_ID_KEY, bson.A{}}}}}},
+			}}}}}
+		}
+		pipeline = append(pipeline,
+			bson.D{{"$group", bson.D{{"_id", "$" + PUBLISHER_ID_KEY}, {"value", value}, {"count", bson.D{{"$sum", 1}}}}}},
+		)
+	default:
+		value := bson.D{{"$sum", 1}}
+		if query.Metric == LeaderboardByCredit {
+			value = bson.D{{"$sum", "$" + EARNED_CREDIT_KEY}}
+		}
+		pipeline = append(pipeline,
+			bson.D{{"$unwind", "$" + RECEIVER_ID_KEY}},
+			bson.D{{"$group", bson.D{{"_id", "$" + RECEIVER_ID_KEY}, {"value", value}, {"count", bson.D{{"$sum", 1}}}}}},
+		)
+	}
+	pipeline = append(pipeline,
+		bson.D{{"$lookup", bson.D{
+			{"from", UserCollectionName},
+			{"localField", "_id"},
+			{"foreignField", USER_OPEN_ID_KEY},
+			{"as", "user"},
+		}}},
+		bson.D{{"$unwind", "$user"}},
+		bson.D{{"$match", bson.D{
+			{"user." + USER_HIDE_FROM_LEADERBOARD_KEY, bson.D{{"$ne", true}}},
+			{"user." + USER_STATUS_KEY, bson.D{{"$ne", UserDeleted}}},
+		}}},
+		bson.D{{"$sort", bson.D{{"value", -1}, {"count", -1}, {"_id", 1}}}},
+		bson.D{{"$limit", query.Limit}},
+		bson.D{{"$project", bson.D{
+			{"_id", 0},
+			{LEADERBOARD_USER_ID_KEY, "$_id"},
+			{"name", "$user.name"},
+			{"avatar_url", "$user.avatar_url"},
+			{"value", 1},
+			{"count", 1},
+		}}},
+	)
+	cursor, err := m.db.Collection(DelegationCollectionName).Aggregate(ctx, pipeline)
+	lib.AssertErr(err)
+	defer cursor.Close(ctx)
+	res := make([]LeaderboardEntry, 0, query.Limit)
+	for cursor.Next(ctx) {
+		entry := LeaderboardEntry{}
+		lib.AssertErr(cursor.Decode(&entry))
+		res = append(res, entry)
+	}
+	lib.AssertErr(cursor.Err())
+	return res
+}
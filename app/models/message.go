@@ -0,0 +1,154 @@
+package models
+
+import (
+	"context"
+	"time"
+
+	"github.com/sysu-team/Back-end-development/lib"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// 消息的种类
+type EnumMessageKind string
+
+const (
+	MessageText  EnumMessageKind = "text"  // 文字消息
+	MessageImage EnumMessageKind = "image" // 图片消息，图片为用途是 message 的附件
+)
+
+const (
+	MESSAGE_DELEGATION_ID_KEY string = "delegation_id"
+	MESSAGE_SENDER_ID_KEY     string = "sender_id"
+	MESSAGE_READ_BY_KEY       string = "read_by"
+	MESSAGE_USER_ID_KEY       string = "user_id"
+)
+
+// 已读回执
+type ReadReceipt struct {
+	UserID   string `bson:"user_id"`
+	ReadTime int64  `bson:"read_time"` // Unix时间戳
+}
+
+// 委托的发布者和接受者之间的消息
+type MessageDoc struct {
+	ID           primitive.ObjectID `bson:"_id,omitempty"`
+	DelegationID string             `bson:"delegation_id"`
+	SenderID     string             `bson:"sender_id"`
+	Kind         EnumMessageKind    `bson:"kind"`
+	Text         string             `bson:"text"`
+	AttachmentID string             `bson:"attachment_id"` // 图片消息的附件
+	ReadBy       []ReadReceipt      `bson:"read_by"`       // 除发送者之外已经读过的用户
+	CreateTime   int64              `bson:"create_time"`
+}
+
+type MessageModel struct {
+	db *mongo.Database
+}
+
+// 使用/创建 collection, 初始化子 model
+func NewMessageModel(db *mongo.Database) *MessageModel {
+	return &MessageModel{db}
+}
+
+// 保存消息，返回消息 id
+func (m *MessageModel) CreateMessage(ctx context.Context, doc *MessageDoc) string {
+	ctx, cancel := withTimeout(ctx)
+	defer cancel()
+	if doc.ID.IsZero() {
+		doc.ID = primitive.NewObjectID()
+	}
+	if doc.ReadBy == nil {
+		doc.ReadBy = []ReadReceipt{}
+	}
+	doc.CreateTime = time.Now().Unix()
+	res, err := m.db.Collection(MessageCollectionName).InsertOne(ctx, doc)
+	lib.AssertErr(err)
+	lib.Log(ctx).Debug().Interface("id", res.InsertedID).Msg("insert message")
+	return doc.ID.Hex()
+}
+
+// 获取委托的消息，按发送时间从新到旧
+// after 不为空时只返回这条消息之后的消息，用于断线之后补齐
+func (m *MessageModel) GetMessages(ctx context.Context, page, limit int64, delegationID, after string) []MessageDoc {
+	ctx, cancel := withTimeout(ctx)
+	defer cancel()
+	filters := bson.D{{MESSAGE_DELEGATION_ID_KEY, delegationID}}
+	if after != "" {
+		filters = append(filters, bson.E{"_id", bson.D{{"$gt", toObjectID(after)}}})
+	}
+	cursor, err := m.db.Collection(MessageCollectionName).Find(ctx, filters, options.Find().
+		SetSort(bson.D{{"_id", -1}}).
+		SetSkip((page-1)*limit).
+		SetLimit(limit))
+	lib.AssertErr(err)
+	defer cursor.Close(ctx)
+	res := make([]MessageDoc, 0, limit)
+	for cursor.Next(ctx) {
+		doc := MessageDoc{}
+		lib.AssertErr(cursor.Decode(&doc))
+		res = append(res, doc)
+	}
+	lib.AssertErr(cursor.Err())
+	return res
+}
+
+// 获取用户发送的所有消息，用于导出个人数据
+func (m *MessageModel) GetMessagesBySender(ctx context.Context, senderID string) []MessageDoc {
+	ctx, cancel := withTimeout(ctx)
+	defer cancel()
+	cursor, err := m.db.Collection(MessageCollectionName).Find(ctx, bson.D{{MESSAGE_SENDER_ID_KEY, senderID}},
+		options.Find().SetSort(bson.D{{"_id", 1}}))
+	lib.AssertErr(err)
+	defer cursor.Close(ctx)
+	res := make([]MessageDoc, 0)
+	for cursor.Next(ctx) {
+		doc := MessageDoc{}
+		lib.AssertErr(cursor.Decode(&doc))
+		res = append(res, doc)
+	}
+	lib.AssertErr(cursor.Err())
+	return res
+}
+
+// 把委托中 upTo 以及之前别人发送的消息标记为 reader 已读，返回新标记的数量
+func (m *MessageModel) MarkRead(ctx context.Context, delegationID, upTo, readerID string, readTime int64) int64 {
+	ctx, cancel := withTimeout(ctx)
+	defer cancel()
+	res, err := m.db.Collection(MessageCollectionName).UpdateMany(
+		ctx,
+		bson.D{
+			{MESSAGE_DELEGATION_ID_KEY, delegationID},
+			{"_id", bson.D{{"$lte", toObjectID(upTo)}}},
+			{MESSAGE_SENDER_ID_KEY, bson.D{{"$ne", readerID}}},
+			{MESSAGE_READ_BY_KEY + "." + MESSAGE_USER_ID_KEY, bson.D{{"$ne", readerID}}},
+		},
+		bson.D{{"$push", bson.D{{MESSAGE_READ_BY_KEY, ReadReceipt{UserID: readerID, ReadTime: readTime}}}}},
+	)
+	lib.AssertErr(err)
+	return res.ModifiedCount
+}
+
+// 注销账号时把发送者和已读回执中的用户替换为匿名 id
+func (m *MessageModel) ReplaceUser(ctx context.Context, openid, anonID string) {
+	ctx, cancel := withTimeout(ctx)
+	defer cancel()
+	collection := m.db.Collection(MessageCollectionName)
+	updates := []struct {
+		filters bson.D
+		set     bson.D
+	}{
+		{bson.D{{MESSAGE_SENDER_ID_KEY, openid}}, bson.D{{MESSAGE_SENDER_ID_KEY, anonID}}},
+		{
+			bson.D{{MESSAGE_READ_BY_KEY + "." + MESSAGE_USER_ID_KEY, openid}},
+			bson.D{{MESSAGE_READ_BY_KEY + ".$." + MESSAGE_USER_ID_KEY, anonID}},
+		},
+	}
+	for _, u := range updates {
+		res, err := collection.UpdateMany(ctx, u.filters, bson.D{{"$set", u.set}})
+		lib.AssertErr(err)
+		lib.Log(ctx).Debug().Int64("modified", res.ModifiedCount).Msg("replace message user")
+	}
+}
@@ -0,0 +1,444 @@
+package models
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const MigrationCollectionName = "schema_migrations"
+
+const (
+	MIGRATION_VERSION_KEY    string = "_id"
+	MIGRATION_NAME_KEY       string = "name"
+	MIGRATION_APPLIED_AT_KEY string = "applied_at"
+)
+
+// Migration 数据库结构的一次升级
+// 升级可能在中途失败后重新执行，Up 需要保证重复执行的结果相同
+type Migration struct {
+	Version int
+	Name    string
+	Up      func(ctx context.Context, db *mongo.Database) error
+}
+
+// 已经执行的升级记录，版本号作为 _id 保证同一个版本只记录一次
+type MigrationDoc struct {
+	Version   int       `bson:"_id" json:"version"`
+	Name      string    `bson:"name" json:"name"`
+	AppliedAt time.Time `bson:"applied_at" json:"applied_at"`
+}
+
+// 所有的升级，按照版本号从小到大排列
+// 已经发布的升级不能修改，结构变化时在末尾添加新的版本
+var migrations = []Migration{
+	{1, "create_indexes", createIndexes},
+	{2, "backfill_user_status", backfillUserStatus},
+	{3, "backfill_delegation_category_key", backfillDelegationCategoryKey},
+	{4, "create_rate_limit_indexes", createRateLimitIndexes},
+	{5, "create_idempotency_indexes", createIdempotencyIndexes},
+	{6, "backfill_delegation_version", backfillDelegationVersion},
+	{7, "create_audit_log_indexes", createAuditLogIndexes},
+	{8, "backfill_user_credit_fields", backfillUserCreditFields},
+	{9, "create_payment_indexes", createPaymentIndexes},
+	{10, "create_shop_indexes", createShopIndexes},
+	{11, "backfill_delegation_finish_fields", backfillDelegationFinishFields},
+	{12, "create_leaderboard_indexes", createLeaderboardIndexes},
+	{13, "create_message_indexes", createMessageIndexes},
+	{14, "create_user_email_index", createUserEmailIndex},
+	{15, "create_user_identity_index", createUserIdentityIndex},
+}
+
+type MigrationModel struct {
+	db *mongo.Database
+}
+
+// 使用/创建 collection, 初始化子 model
+func NewMigrationModel(db *mongo.Database) *MigrationModel {
+	return &MigrationModel{db}
+}
+
+// Migrations 返回所有的升级
+func Migrations() []Migration {
+	return migrations
+}
+
+// 获取已经执行的升级，key 为版本号
+func (m *MigrationModel) GetApplied(ctx context.Context) (map[int]MigrationDoc, error) {
+	cursor, err := m.db.Collection(MigrationCollectionName).Find(ctx, bson.D{})
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+	res := make(map[int]MigrationDoc)
+	for cursor.Next(ctx) {
+		doc := MigrationDoc{}
+		if err := cursor.Decode(&doc); err != nil {
+			return nil, err
+		}
+		res[doc.Version] = doc
+	}
+	return res, cursor.Err()
+}
+
+// Migrate 按顺序执行还没有执行的升级，返回这次执行的升级
+// 某个升级失败时停止，之后的升级不会执行
+// 创建索引等操作可能耗时较长，不使用单次数据库操作的超时时间
+func (m *MigrationModel) Migrate(ctx context.Context) ([]Migration, error) {
+	applied, err := m.GetApplied(ctx)
+	if err != nil {
+		return nil, err
+	}
+	done := make([]Migration, 0)
+	for _, migration := range migrations {
+		if _, ok := applied[migration.Version]; ok {
+			continue
+		}
+		if err := migration.Up(ctx, m.db); err != nil {
+			return done, fmt.Errorf("migration %v_%v failed: %v", migration.Version, migration.Name, err)
+		}
+		upsert := true
+		_, err := m.db.Collection(MigrationCollectionName).UpdateOne(
+			ctx,
+			bson.D{{MIGRATION_VERSION_KEY, migration.Version}},
+			bson.D{{
+				"$set", bson.D{
+					{MIGRATION_NAME_KEY, migration.Name},
+					{MIGRATION_APPLIED_AT_KEY, time.Now()},
+				},
+			}},
+			&options.UpdateOptions{Upsert: &upsert},
+		)
+		if err != nil {
+			return done, err
+		}
+		done = append(done, migration)
+		log.Info().Int("version", migration.Version).Str("name", migration.Name).Msg("applied migration")
+	}
+	return done, nil
+}
+
+// 创建索引
+// 查询用户、按状态和发布时间列出委托、查询用户相关的委托都需要索引
+// 验证码在过期之后由 TTL 索引自动删除
+// 旧版本注册时没有正确检查学号，创建学号的唯一索引之前先处理重复的学号
+func createIndexes(ctx context.Context, db *mongo.Database) error {
+	if err := dedupeStudentNumbers(ctx, db); err != nil {
+		return fmt.Errorf("dedupe student numbers: %v", err)
+	}
+	unique := options.Index().SetUnique(true)
+	indexes := map[string][]mongo.IndexModel{
+		UserCollectionName: {
+			{Keys: bson.D{{USER_OPEN_ID_KEY, 1}}, Options: unique},
+			// 学号为空的用户不受限制
+			{Keys: bson.D{{USER_STUDENT_NUM_KEY, 1}}, Options: options.Index().SetUnique(true).
+				SetPartialFilterExpression(bson.D{{USER_STUDENT_NUM_KEY, bson.D{{"$gt", ""}}}})},
+		},
+		DelegationCollectionName: {
+			{Keys: bson.D{{DELEGATAION_STATE_KEY, 1}, {START_TIME_KEY, -1}}},
+			{Keys: bson.D{{DELEGATAION_STATE_KEY, 1}, {AREA_KEY, 1}, {START_TIME_KEY, -1}}},
+			{Keys: bson.D{{PUBLISHER_ID_KEY, 1}, {DELEGATAION_STATE_KEY, 1}}},
+			{Keys: bson.D{{RECEIVER_ID_KEY, 1}, {DELEGATAION_STATE_KEY, 1}}},
+			{Keys: bson.D{{PICKUP_KEY, "2dsphere"}}},
+			{Keys: bson.D{{DROPOFF_KEY, "2dsphere"}}},
+		},
+		RosterCollectionName: {
+			{Keys: bson.D{{ROSTER_STUDENT_NUM_KEY, 1}}, Options: unique},
+		},
+		VerificationCollectionName: {
+			{Keys: bson.D{{VERIFICATION_OPEN_ID_KEY, 1}}, Options: unique},
+			{Keys: bson.D{{VERIFICATION_EXPIRE_AT_KEY, 1}}, Options: options.Index().SetExpireAfterSeconds(0)},
+		},
+		AttachmentCollectionName: {
+			{Keys: bson.D{{ATTACHMENT_OWNER_ID_KEY, 1}}},
+			{Keys: bson.D{{ATTACHMENT_DELEGATION_ID_KEY, 1}}},
+		},
+		CategoryCollectionName: {
+			{Keys: bson.D{{CATEGORY_KEY_KEY, 1}}, Options: unique},
+		},
+	}
+	for collection, models := range indexes {
+		if _, err := db.Collection(collection).Indexes().CreateMany(ctx, models); err != nil {
+			return fmt.Errorf("create indexes on %v: %v", collection, err)
+		}
+	}
+	return nil
+}
+
+// 同一个学号注册了多个账号时，最早注册的账号保留学号
+// 其他账号的学号清空并取消身份验证，记录日志由管理员手动处理，积分和委托不受影响
+func dedupeStudentNumbers(ctx context.Context, db *mongo.Database) error {
+	users := db.Collection(UserCollectionName)
+	cursor, err := users.Aggregate(ctx, []bson.D{
+		{{"$match", bson.D{{USER_STUDENT_NUM_KEY, bson.D{{"$gt", ""}}}}}},
+		{{"$sort", bson.D{{"_id", 1}}}},
+		{{"$group", bson.D{
+			{"_id", "$" + USER_STUDENT_NUM_KEY},
+			{"ids", bson.D{{"$push", "$_id"}}},
+			{"open_ids", bson.D{{"$push", "$" + USER_OPEN_ID_KEY}}},
+		}}},
+		{{"$match", bson.D{{"ids.1", bson.D{{"$exists", true}}}}}},
+	})
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(ctx)
+	for cursor.Next(ctx) {
+		group := struct {
+			StudentNum string        `bson:"_id"`
+			IDs        []interface{} `bson:"ids"`
+			OpenIDs    []string      `bson:"open_ids"`
+		}{}
+		if err := cursor.Decode(&group); err != nil {
+			return err
+		}
+		if _, err := users.UpdateMany(
+			ctx,
+			bson.D{{"_id", bson.D{{"$in", group.IDs[1:]}}}},
+			bson.D{{"$set", bson.D{
+				{USER_STUDENT_NUM_KEY, ""},
+				{USER_VERIFIED_KEY, false},
+			}}},
+		); err != nil {
+			return err
+		}
+		log.Warn().Str("student_num", group.StudentNum).Str("kept", group.OpenIDs[0]).Strs("cleared", group.OpenIDs[1:]).
+			Msg("cleared duplicated student number")
+	}
+	return cursor.Err()
+}
+
+// 补充账号状态和身份验证之前注册的用户的字段
+// 这些用户在引入学生身份验证之前注册，视为已经验证
+func backfillUserStatus(ctx context.Context, db *mongo.Database) error {
+	users := db.Collection(UserCollectionName)
+	if _, err := users.UpdateMany(
+		ctx,
+		bson.D{{USER_STATUS_KEY, bson.D{{"$exists", false}}}},
+		bson.D{{"$set", bson.D{
+			{USER_STATUS_KEY, UserActive},
+			{USER_SUSPENDED_UNTIL_KEY, 0},
+			{USER_STATUS_REASON_KEY, ""},
+		}}},
+	); err != nil {
+		return err
+	}
+	_, err := users.UpdateMany(
+		ctx,
+		bson.D{{USER_VERIFIED_KEY, bson.D{{"$exists", false}}}},
+		bson.D{{"$set", bson.D{{USER_VERIFIED_KEY, true}}}},
+	)
+	return err
+}
+
+// 旧的委托在 delegation_type 中保存类型的名字，统一改为类型的标识
+func backfillDelegationCategoryKey(ctx context.Context, db *mongo.Database) error {
+	cursor, err := db.Collection(CategoryCollectionName).Find(ctx, bson.D{})
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(ctx)
+	for cursor.Next(ctx) {
+		category := CategoryDoc{}
+		if err := cursor.Decode(&category); err != nil {
+			return err
+		}
+		if category.Name == category.Key {
+			continue
+		}
+		if _, err := db.Collection(DelegationCollectionName).UpdateMany(
+			ctx,
+			bson.D{{DELEGATION_TYPE_KEY, category.Name}},
+			bson.D{{"$set", bson.D{{DELEGATION_TYPE_KEY, category.Key}}}},
+		); err != nil {
+			return err
+		}
+	}
+	return cursor.Err()
+}
+
+// 令牌桶装满之后和新建的桶没有区别，由 TTL 索引删除
+func createRateLimitIndexes(ctx context.Context, db *mongo.Database) error {
+	_, err := db.Collection(RateLimitCollectionName).Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{RATE_LIMIT_EXPIRE_AT_KEY, 1}},
+		Options: options.Index().SetExpireAfterSeconds(0),
+	})
+	return err
+}
+
+// 幂等键保存的响应在过期后由 TTL 索引删除
+func createIdempotencyIndexes(ctx context.Context, db *mongo.Database) error {
+	_, err := db.Collection(IdempotencyCollectionName).Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{IDEMPOTENCY_EXPIRE_AT_KEY, 1}},
+		Options: options.Index().SetExpireAfterSeconds(0),
+	})
+	return err
+}
+
+// 旧的委托没有版本号，条件更新无法匹配，统一从 0 开始
+func backfillDelegationVersion(ctx context.Context, db *mongo.Database) error {
+	_, err := db.Collection(DelegationCollectionName).UpdateMany(
+		ctx,
+		bson.D{{VERSION_KEY, bson.D{{"$exists", false}}}},
+		bson.D{{"$set", bson.D{{VERSION_KEY, 0}}}},
+	)
+	return err
+}
+
+// 审计日志按照操作者、操作对象或者操作查询，从新到旧排序
+func createAuditLogIndexes(ctx context.Context, db *mongo.Database) error {
+	_, err := db.Collection(AuditCollectionName).Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{AUDIT_ACTOR_ID_KEY, 1}, {AUDIT_CREATED_AT_KEY, -1}}},
+		{Keys: bson.D{{AUDIT_TARGET_ID_KEY, 1}, {AUDIT_CREATED_AT_KEY, -1}}},
+		{Keys: bson.D{{AUDIT_ACTION_KEY, 1}, {AUDIT_CREATED_AT_KEY, -1}}},
+		{Keys: bson.D{{AUDIT_CREATED_AT_KEY, -1}}},
+	})
+	return err
+}
+
+// 为旧用户补充积分规则使用的字段，升级时视为刚刚活跃
+// 已经完成过委托的用户不再获得第一次完成的奖励
+func backfillUserCreditFields(ctx context.Context, db *mongo.Database) error {
+	users := db.Collection(UserCollectionName)
+	if _, err := users.UpdateMany(
+		ctx,
+		bson.D{{USER_LAST_ACTIVE_AT_KEY, bson.D{{"$exists", false}}}},
+		bson.D{{"$set", bson.D{
+			{USER_LAST_ACTIVE_AT_KEY, time.Now().Unix()},
+			{USER_DECAYED_AT_KEY, 0},
+			{USER_CHECK_IN_DAY_KEY, ""},
+			{USER_CHECK_IN_STREAK_KEY, 0},
+		}}},
+	); err != nil {
+		return err
+	}
+	completed := bson.A{}
+	for _, key := range []string{RECEIVER_ID_KEY, PROOFS_KEY + "." + RECEIVER_ID_KEY} {
+		ids, err := db.Collection(DelegationCollectionName).Distinct(ctx, key, bson.D{{DELEGATAION_STATE_KEY, Finished}})
+		if err != nil {
+			return err
+		}
+		completed = append(completed, ids...)
+	}
+	if _, err := users.UpdateMany(
+		ctx,
+		bson.D{{USER_FIRST_COMPLETED_KEY, bson.D{{"$exists", false}}}, {USER_OPEN_ID_KEY, bson.D{{"$nin", completed}}}},
+		bson.D{{"$set", bson.D{{USER_FIRST_COMPLETED_KEY, false}}}},
+	); err != nil {
+		return err
+	}
+	_, err := users.UpdateMany(
+		ctx,
+		bson.D{{USER_FIRST_COMPLETED_KEY, bson.D{{"$exists", false}}}},
+		bson.D{{"$set", bson.D{{USER_FIRST_COMPLETED_KEY, true}}}},
+	)
+	return err
+}
+
+// 订单号唯一，支付结果通知按照订单号查询
+// 用户查询自己的订单和提现申请，对账和审核按照状态查询
+func createPaymentIndexes(ctx context.Context, db *mongo.Database) error {
+	for _, collection := range []string{PaymentOrderCollectionName, WithdrawalCollectionName} {
+		if _, err := db.Collection(collection).Indexes().CreateMany(ctx, []mongo.IndexModel{
+			{Keys: bson.D{{PAYMENT_ORDER_NO_KEY, 1}}, Options: options.Index().SetUnique(true)},
+			{Keys: bson.D{{PAYMENT_USER_ID_KEY, 1}, {PAYMENT_CREATE_TIME_KEY, -1}}},
+			{Keys: bson.D{{PAYMENT_STATE_KEY, 1}, {PAYMENT_CREATE_TIME_KEY, -1}}},
+		}); err != nil {
+			return fmt.Errorf("create indexes on %v: %v", collection, err)
+		}
+	}
+	return nil
+}
+
+// 兑换单号和兑换码唯一，用户查询自己的兑换记录
+func createShopIndexes(ctx context.Context, db *mongo.Database) error {
+	if _, err := db.Collection(RedemptionCollectionName).Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{REDEMPTION_ORDER_NO_KEY, 1}}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.D{{REDEMPTION_CODE_KEY, 1}}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.D{{REDEMPTION_USER_ID_KEY, 1}, {REDEMPTION_CREATE_TIME_KEY, -1}}},
+	}); err != nil {
+		return fmt.Errorf("create indexes on %v: %v", RedemptionCollectionName, err)
+	}
+	_, err := db.Collection(ShopItemCollectionName).Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{SHOP_ITEM_ENABLED_KEY, 1}, {SHOP_ITEM_ORDER_KEY, 1}},
+	})
+	return err
+}
+
+// 旧的已完成委托没有记录完成时间，使用进入待确认的时间，没有时使用发布时间
+// 发布者从待确认状态确认时接受者获得两倍的奖励
+func backfillDelegationFinishFields(ctx context.Context, db *mongo.Database) error {
+	delegations := db.Collection(DelegationCollectionName)
+	cursor, err := delegations.Find(
+		ctx,
+		bson.D{{DELEGATAION_STATE_KEY, Finished}, {FINISH_TIME_KEY, bson.D{{"$exists", false}}}},
+		options.Find().SetProjection(bson.D{{REWARD_KEY, 1}, {PENDING_TIME_KEY, 1}, {START_TIME_KEY, 1}}),
+	)
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(ctx)
+	for cursor.Next(ctx) {
+		doc := struct {
+			ID          interface{} `bson:"_id"`
+			Reward      int         `bson:"reward"`
+			PendingTime int64       `bson:"pending_time"`
+			StartTime   int64       `bson:"start_time"`
+		}{}
+		if err := cursor.Decode(&doc); err != nil {
+			return err
+		}
+		finishTime := doc.PendingTime
+		if finishTime == 0 {
+			finishTime = doc.StartTime
+		}
+		if _, err := delegations.UpdateOne(
+			ctx,
+			bson.D{{DELETAION_ID_KEY, doc.ID}},
+			bson.D{{"$set", bson.D{{FINISH_TIME_KEY, finishTime}, {EARNED_CREDIT_KEY, 2 * doc.Reward}}}},
+		); err != nil {
+			return err
+		}
+	}
+	return cursor.Err()
+}
+
+// 排行榜按照完成时间统计已经完成的委托
+func createLeaderboardIndexes(ctx context.Context, db *mongo.Database) error {
+	_, err := db.Collection(DelegationCollectionName).Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{DELEGATAION_STATE_KEY, 1}, {FINISH_TIME_KEY, -1}},
+	})
+	return err
+}
+
+// 按委托分页查询消息
+func createMessageIndexes(ctx context.Context, db *mongo.Database) error {
+	_, err := db.Collection(MessageCollectionName).Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{MESSAGE_DELEGATION_ID_KEY, 1}, {"_id", -1}},
+	})
+	return err
+}
+
+// 同一个校园邮箱只能验证一个账号，没有邮箱的用户不受限制
+func createUserEmailIndex(ctx context.Context, db *mongo.Database) error {
+	_, err := db.Collection(UserCollectionName).Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{USER_EMAIL_KEY, 1}},
+		Options: options.Index().SetUnique(true).
+			SetPartialFilterExpression(bson.D{{USER_EMAIL_KEY, bson.D{{"$gt", ""}}}}),
+	})
+	return err
+}
+
+// 注册时按哈希查找注销过的微信账号和学生，只有注销的用户有这个字段
+func createUserIdentityIndex(ctx context.Context, db *mongo.Database) error {
+	_, err := db.Collection(UserCollectionName).Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{USER_IDENTITY_HASHES_KEY, 1}},
+		Options: options.Index().SetSparse(true),
+	})
+	return err
+}
@@ -7,6 +7,8 @@ import (
 
 	"github.com/rs/zerolog/log"
 	"github.com/sysu-team/Back-end-development/app/configs"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 	"go.mongodb.org/mongo-driver/mongo/readpref"
@@ -16,22 +18,77 @@ const (
 	UserCollectionName          = "users"
 	DelegationCollectionName    = "delegations"
 	QuestionnaireCollectionName = "questionnaires"
+	RosterCollectionName        = "student_roster"
+	VerificationCollectionName  = "verification_codes"
+	AttachmentCollectionName    = "attachments"
+	CategoryCollectionName      = "categories"
+	RateLimitCollectionName     = "rate_limits"
+	IdempotencyCollectionName   = "idempotency_keys"
+	AuditCollectionName         = "audit_log"
+	PaymentOrderCollectionName  = "payment_orders"
+	WithdrawalCollectionName    = "withdrawals"
+	ShopItemCollectionName      = "shop_items"
+	RedemptionCollectionName    = "redemptions"
+	LeaderboardCollectionName   = "leaderboards"
+	MessageCollectionName       = "messages"
 )
 
 var model *Model
 
+// 单次数据库操作的超时时间，由配置中的 db.op_timeout 设置
+var opTimeout = 5 * time.Second
+
+// 为一次数据库操作设置超时时间，ctx 被取消时操作同样会被取消
+func withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(ctx, opTimeout)
+}
+
+// 按照 _id 查询，id 格式错误时不会匹配任何记录
+func objectIDFilter(id string) bson.D {
+	return bson.D{{"_id", toObjectID(id)}}
+}
+
+// id 格式错误时返回 NilObjectID
+func toObjectID(id string) primitive.ObjectID {
+	objID, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return primitive.NilObjectID
+	}
+	return objID
+}
+
 // Model 数据库实例
 type Model struct {
 	DB            *mongo.Database
 	User          *UserModel
 	Delegation    *DelegationModel
 	Questionnaire *QuestionnaireModel
+	Roster        *RosterModel
+	Verification  *VerificationModel
+	Attachment    *AttachmentModel
+	Category      *CategoryModel
+	Migration     *MigrationModel
+	RateLimit     *RateLimitModel
+	Idempotency   *IdempotencyModel
+	Audit         *AuditModel
+	Payment       *PaymentModel
+	Shop          *ShopModel
+	Leaderboard   *LeaderboardModel
+	Message       *MessageModel
 }
 
 // 连接到数据库
 func InitDB(config *configs.DBConfig) error {
 	model = &Model{}
-	ctx, _ := context.WithTimeout(context.Background(), 10*time.Second)
+	if config.OpTimeout > 0 {
+		opTimeout = time.Duration(config.OpTimeout) * time.Second
+	}
+	connectTimeout := 10 * time.Second
+	if config.ConnectTimeout > 0 {
+		connectTimeout = time.Duration(config.ConnectTimeout) * time.Second
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), connectTimeout)
+	defer cancel()
 	client, err := mongo.Connect(ctx, options.Client().
 		ApplyURI(fmt.Sprintf("mongodb://%v:%v@%v:%v/?authSource=admin", config.User, config.Password, config.Host, config.Port)))
 	if err != nil {
@@ -47,11 +104,35 @@ func InitDB(config *configs.DBConfig) error {
 	model.User = NewUserModel(model.DB)
 	model.Delegation = NewDelegationModel(model.DB)
 	model.Questionnaire = NewQuestionnaireModel(model.DB)
-
+	model.Roster = NewRosterModel(model.DB)
+	model.Verification = NewVerificationModel(model.DB)
+	model.Attachment = NewAttachmentModel(model.DB)
+	model.Category = NewCategoryModel(model.DB)
+	model.Migration = NewMigrationModel(model.DB)
+	model.RateLimit = NewRateLimitModel(model.DB)
+	model.Idempotency = NewIdempotencyModel(model.DB)
+	model.Audit = NewAuditModel(model.DB)
+	model.Payment = NewPaymentModel(model.DB)
+	model.Shop = NewShopModel(model.DB)
+	model.Leaderboard = NewLeaderboardModel(model.DB)
+	model.Message = NewMessageModel(model.DB)
 	return nil
 }
 
+// Disconnect 断开与数据库的连接，等待正在进行的操作结束或者 ctx 超时
+func Disconnect(ctx context.Context) error {
+	if model == nil || model.DB == nil {
+		return nil
+	}
+	return model.DB.Client().Disconnect(ctx)
+}
+
 // access the model object
 func GetModel() *Model {
 	return model
 }
+
+// 替换使用的数据库实例，用于测试和生成接口文档等不需要连接数据库的场景
+func UseModel(m *Model) {
+	model = m
+}
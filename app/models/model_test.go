@@ -13,7 +13,7 @@ import (
 	"time"
 )
 
-func initDB(host, port, dbname string) {
+func initDB(host string, port int, dbname string) {
 	err := InitDB(&configs.DBConfig{
 		Host:   host,
 		Port:   port,
@@ -27,7 +27,7 @@ func TestInitDB(t *testing.T) {
 	t.Log("test start")
 	err := InitDB(&configs.DBConfig{
 		Host:   "127.0.0.1",
-		Port:   "27017",
+		Port:   27017,
 		DBName: "swsad_weapp",
 	})
 	t.Log("after init")
@@ -37,11 +37,11 @@ func TestInitDB(t *testing.T) {
 	test := GetModel().User
 	t.Log(test)
 
-	res := test.AddUser(&UserDoc{
-		"abc",
-		"wxm",
-		"110",
-		20,
+	res := test.AddUser(context.Background(), &UserDoc{
+		OpenID:        "abc",
+		Name:          "wxm",
+		StudentNumber: "110",
+		Credit:        20,
 	})
 
 	if err != nil {
@@ -49,7 +49,7 @@ func TestInitDB(t *testing.T) {
 	}
 	t.Log(res)
 
-	user := test.GetUserByName("wxm")
+	user := test.GetUserByName(context.Background(), "wxm")
 
 	if user == nil {
 		t.Log("no such user")
@@ -60,12 +60,12 @@ func TestInitDB(t *testing.T) {
 }
 
 func TestRunner(t *testing.T) {
-	initDB("127.0.0.1", "27017", "swsad_weapp")
+	initDB("127.0.0.1", 27017, "swsad_weapp")
 	// dm := GetModel().Delegation
 
 	ds := GetModel().Questionnaire
 
-	qid := ds.CreateNewQuestionnaire()
+	qid := ds.CreateNewQuestionnaire(context.Background(), &QuestionnaireDoc{})
 
 	log.Debug().Msg(fmt.Sprintf("create qid = %v", qid))
 
@@ -97,7 +97,8 @@ func TestRunner(t *testing.T) {
 
 func deleleAllDoc() {
 	// 需要数据库已连接上
-	ctx, _ := context.WithTimeout(context.Background(), 10*time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
 	client, err := mongo.Connect(ctx, options.Client().ApplyURI("mongodb://localhost:27017"))
 	lib.AssertErr(err)
 
@@ -112,3 +113,112 @@ func TestMisc(t *testing.T) {
 	//res, err := resty.R().Get("https://www.gstatic.com/webp/gallery3/1.png")
 	//lib.Assert(err)
 }
+
+func TestMigrate(t *testing.T) {
+	initDB("127.0.0.1", 27017, "swsad_weapp")
+	m := GetModel().Migration
+	if _, err := m.Migrate(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	// 已经执行的升级不会重复执行
+	done, err := m.Migrate(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(done) != 0 {
+		t.Errorf("expected no pending migrations, applied %v", done)
+	}
+	applied, err := m.GetApplied(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, migration := range Migrations() {
+		if _, ok := applied[migration.Version]; !ok {
+			t.Errorf("migration %v_%v not recorded", migration.Version, migration.Name)
+		}
+	}
+}
+
+func TestMigrationVersionsAscending(t *testing.T) {
+	for i := 1; i < len(migrations); i++ {
+		if migrations[i].Version <= migrations[i-1].Version {
+			t.Errorf("migration %v must have a larger version than %v", migrations[i].Name, migrations[i-1].Name)
+		}
+	}
+}
+
+func TestUpdateVersionedConflict(t *testing.T) {
+	initDB("127.0.0.1", 27017, "swsad_weapp")
+	dm := GetModel().Delegation
+	ctx := context.Background()
+	did := dm.CreateNewDelegation(ctx, &DelegationDoc{PublisherID: "wxm", DelegationName: "wxm's food", MaxNumber: 1})
+	expected := dm.GetSpecificDelegation(ctx, did).Expected()
+
+	// 两个请求读取到同一个版本之后同时接受委托，只有一个可以成功
+	errs := make(chan error, 2)
+	for _, receiverID := range []string{"abc", "def"} {
+		go func(receiverID string) {
+			errs <- dm.ReceiveDelegation(ctx, did, expected, receiverID, uint8(Accepted))
+		}(receiverID)
+	}
+	succeeded, conflicted := 0, 0
+	for i := 0; i < 2; i++ {
+		switch err := <-errs; err {
+		case nil:
+			succeeded++
+		case ErrConflict:
+			conflicted++
+		default:
+			t.Fatal(err)
+		}
+	}
+	if succeeded != 1 || conflicted != 1 {
+		t.Errorf("expected one success and one conflict, got %v and %v", succeeded, conflicted)
+	}
+
+	d := dm.GetSpecificDelegation(ctx, did)
+	if d.Version != expected.Version+1 || len(d.ReceiverID) != 1 || d.CurrentNumber != 1 {
+		t.Errorf("expected a single receive to be applied, got version %v receivers %v", d.Version, d.ReceiverID)
+	}
+	if err := dm.SetDelegationState(ctx, did, expected, uint8(Canceled)); err != ErrConflict {
+		t.Errorf("expected stale version to conflict, got %v", err)
+	}
+}
+
+func TestIdempotencyTakeOver(t *testing.T) {
+	initDB("127.0.0.1", 27017, "swsad_weapp")
+	im := GetModel().Idempotency
+	ctx := context.Background()
+	// 数据库中的时间精确到毫秒
+	stale := time.Now().Add(-time.Hour).Truncate(time.Millisecond)
+	doc := &IdempotencyDoc{
+		ID:          fmt.Sprintf("test-take-over-%v", time.Now().UnixNano()),
+		RequestHash: "hash",
+		State:       IdempotencyProcessing,
+		CreatedAt:   stale,
+		ExpireAt:    time.Now().Add(time.Hour),
+	}
+	if inserted, _ := im.Begin(ctx, doc); !inserted {
+		t.Fatal("expected the record to be inserted")
+	}
+	inserted, existing := im.Begin(ctx, doc)
+	if inserted || existing.State != IdempotencyProcessing || !existing.CreatedAt.Equal(stale) {
+		t.Fatalf("expected the stale record, got %+v", existing)
+	}
+
+	// 两个重试的请求读取到同一个开始时间，只有一个可以接管
+	now := time.Now()
+	if !im.TakeOver(ctx, doc.ID, existing.CreatedAt, now, now.Add(time.Hour)) {
+		t.Error("expected the stale record to be taken over")
+	}
+	if im.TakeOver(ctx, doc.ID, existing.CreatedAt, now, now.Add(time.Hour)) {
+		t.Error("expected the second take over to fail")
+	}
+
+	// 已经保存了响应的记录不能接管
+	im.Complete(ctx, doc.ID, 200, "application/json", []byte("{}"))
+	_, existing = im.Begin(ctx, doc)
+	if existing.State != IdempotencyDone || im.TakeOver(ctx, doc.ID, existing.CreatedAt, now, now.Add(time.Hour)) {
+		t.Errorf("expected a completed record not to be taken over, got %+v", existing)
+	}
+}
@@ -0,0 +1,284 @@
+package models
+
+import (
+	"context"
+	"time"
+
+	"github.com/sysu-team/Back-end-development/lib"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// 充值订单的状态
+type EnumPaymentState uint8
+
+const (
+	PaymentCreated EnumPaymentState = 0 // 等待支付
+	PaymentPaid    EnumPaymentState = 1 // 已经支付，积分已经发放
+	PaymentClosed  EnumPaymentState = 2 // 超时未支付或者下单失败
+)
+
+// 提现的状态
+type EnumWithdrawalState uint8
+
+const (
+	WithdrawalPending  EnumWithdrawalState = 0 // 等待管理员审核，积分已经冻结
+	WithdrawalApproved EnumWithdrawalState = 1 // 已经批准，正在转账
+	WithdrawalPaid     EnumWithdrawalState = 2 // 已经转账
+	WithdrawalRejected EnumWithdrawalState = 3 // 被拒绝，积分已经返还
+	WithdrawalFailed   EnumWithdrawalState = 4 // 转账失败，积分已经返还
+)
+
+const (
+	PAYMENT_ID_KEY             string = "_id"
+	PAYMENT_ORDER_NO_KEY       string = "order_no"
+	PAYMENT_USER_ID_KEY        string = "user_id"
+	PAYMENT_STATE_KEY          string = "state"
+	PAYMENT_TRANSACTION_ID_KEY string = "transaction_id"
+	PAYMENT_CREATE_TIME_KEY    string = "create_time"
+	PAYMENT_UPDATE_TIME_KEY    string = "update_time"
+	WITHDRAWAL_REVIEWER_KEY    string = "reviewer"
+	WITHDRAWAL_REASON_KEY      string = "reason"
+)
+
+// 充值订单，金额单位为分
+type PaymentOrderDoc struct {
+	ID            primitive.ObjectID `bson:"_id,omitempty"`
+	OrderNo       string             `bson:"order_no"` // 商户订单号，发送给支付平台
+	UserID        string             `bson:"user_id"`
+	Credit        int                `bson:"credit"` // 支付成功后获得的积分
+	Amount        int64              `bson:"amount"`
+	State         EnumPaymentState   `bson:"state"`
+	TransactionID string             `bson:"transaction_id"` // 支付平台的订单号
+	ExpireTime    int64              `bson:"expire_time"`    // 支付期限，Unix时间戳
+	CreateTime    int64              `bson:"create_time"`
+	UpdateTime    int64              `bson:"update_time"` // 最近一次状态变化的时间
+}
+
+// 提现申请，金额单位为分，order_no 同时作为转账的单号
+type WithdrawalDoc struct {
+	ID            primitive.ObjectID  `bson:"_id,omitempty"`
+	OrderNo       string              `bson:"order_no"`
+	UserID        string              `bson:"user_id"`
+	Credit        int                 `bson:"credit"`
+	Amount        int64               `bson:"amount"`
+	State         EnumWithdrawalState `bson:"state"`
+	Reviewer      string              `bson:"reviewer"`       // 审核的管理员
+	Reason        string              `bson:"reason"`         // 拒绝或者转账失败的原因
+	TransactionID string              `bson:"transaction_id"` // 支付平台的转账单号
+	CreateTime    int64               `bson:"create_time"`
+	UpdateTime    int64               `bson:"update_time"` // 最近一次状态变化的时间
+}
+
+type PaymentModel struct {
+	db *mongo.Database
+}
+
+// 使用/创建 collection, 初始化子 model
+func NewPaymentModel(db *mongo.Database) *PaymentModel {
+	return &PaymentModel{db}
+}
+
+// 创建充值订单，返回订单 id
+func (m *PaymentModel) CreateOrder(ctx context.Context, doc *PaymentOrderDoc) string {
+	return m.insert(ctx, PaymentOrderCollectionName, doc)
+}
+
+// 返回nil代表没有这个订单
+func (m *PaymentModel) GetOrder(ctx context.Context, id string) *PaymentOrderDoc {
+	res := &PaymentOrderDoc{}
+	if !m.findOne(ctx, PaymentOrderCollectionName, objectIDFilter(id), res) {
+		return nil
+	}
+	return res
+}
+
+// 返回nil代表没有这个订单
+func (m *PaymentModel) GetOrderByNo(ctx context.Context, orderNo string) *PaymentOrderDoc {
+	res := &PaymentOrderDoc{}
+	if !m.findOne(ctx, PaymentOrderCollectionName, bson.D{{PAYMENT_ORDER_NO_KEY, orderNo}}, res) {
+		return nil
+	}
+	return res
+}
+
+// 用户的充值订单，从新到旧
+func (m *PaymentModel) GetOrdersByUser(ctx context.Context, page, limit int64, userID string) []PaymentOrderDoc {
+	res := make([]PaymentOrderDoc, 0, limit)
+	m.find(ctx, PaymentOrderCollectionName, bson.D{{PAYMENT_USER_ID_KEY, userID}}, page, limit, func(cursor *mongo.Cursor) {
+		doc := PaymentOrderDoc{}
+		lib.AssertErr(cursor.Decode(&doc))
+		res = append(res, doc)
+	})
+	return res
+}
+
+// 创建时间早于 before 的等待支付的订单，用于对账
+func (m *PaymentModel) GetCreatedOrders(ctx context.Context, before int64, limit int64) []PaymentOrderDoc {
+	res := make([]PaymentOrderDoc, 0, limit)
+	m.find(ctx, PaymentOrderCollectionName, bson.D{
+		{PAYMENT_STATE_KEY, PaymentCreated},
+		{PAYMENT_CREATE_TIME_KEY, bson.D{{"$lt", before}}},
+	}, 1, limit, func(cursor *mongo.Cursor) {
+		doc := PaymentOrderDoc{}
+		lib.AssertErr(cursor.Decode(&doc))
+		res = append(res, doc)
+	})
+	return res
+}
+
+// 把状态为 from 的订单标记为已经支付，from 为等待支付或者已关闭
+// 重复的支付结果通知返回 false，积分只发放一次
+func (m *PaymentModel) MarkOrderPaid(ctx context.Context, orderNo, transactionID string, from EnumPaymentState) bool {
+	return m.transition(ctx, PaymentOrderCollectionName,
+		bson.D{{PAYMENT_ORDER_NO_KEY, orderNo}, {PAYMENT_STATE_KEY, from}},
+		bson.D{{PAYMENT_STATE_KEY, PaymentPaid}, {PAYMENT_TRANSACTION_ID_KEY, transactionID}})
+}
+
+// 关闭等待支付的订单
+func (m *PaymentModel) MarkOrderClosed(ctx context.Context, orderNo string) bool {
+	return m.transition(ctx, PaymentOrderCollectionName,
+		bson.D{{PAYMENT_ORDER_NO_KEY, orderNo}, {PAYMENT_STATE_KEY, PaymentCreated}},
+		bson.D{{PAYMENT_STATE_KEY, PaymentClosed}})
+}
+
+// 创建提现申请，返回提现 id
+func (m *PaymentModel) CreateWithdrawal(ctx context.Context, doc *WithdrawalDoc) string {
+	return m.insert(ctx, WithdrawalCollectionName, doc)
+}
+
+// 返回nil代表没有这个提现申请
+func (m *PaymentModel) GetWithdrawal(ctx context.Context, id string) *WithdrawalDoc {
+	res := &WithdrawalDoc{}
+	if !m.findOne(ctx, WithdrawalCollectionName, objectIDFilter(id), res) {
+		return nil
+	}
+	return res
+}
+
+// 按照用户和状态查询提现申请，从新到旧，userID 为空时不限制用户，states 为空时不限制状态
+func (m *PaymentModel) GetWithdrawals(ctx context.Context, page, limit int64, userID string, states ...EnumWithdrawalState) []WithdrawalDoc {
+	filters := bson.D{}
+	if userID != "" {
+		filters = append(filters, bson.E{PAYMENT_USER_ID_KEY, userID})
+	}
+	if len(states) != 0 {
+		in := make(bson.A, 0, len(states))
+		for _, state := range states {
+			in = append(in, state)
+		}
+		filters = append(filters, bson.E{PAYMENT_STATE_KEY, bson.D{{"$in", in}}})
+	}
+	res := make([]WithdrawalDoc, 0, limit)
+	m.find(ctx, WithdrawalCollectionName, filters, page, limit, func(cursor *mongo.Cursor) {
+		doc := WithdrawalDoc{}
+		lib.AssertErr(cursor.Decode(&doc))
+		res = append(res, doc)
+	})
+	return res
+}
+
+// 审核等待审核的提现申请，state 为 WithdrawalApproved 或者 WithdrawalRejected
+func (m *PaymentModel) ReviewWithdrawal(ctx context.Context, id string, state EnumWithdrawalState, reviewer, reason string) bool {
+	return m.transition(ctx, WithdrawalCollectionName,
+		append(objectIDFilter(id), bson.E{PAYMENT_STATE_KEY, WithdrawalPending}),
+		bson.D{{PAYMENT_STATE_KEY, state}, {WITHDRAWAL_REVIEWER_KEY, reviewer}, {WITHDRAWAL_REASON_KEY, reason}})
+}
+
+// 记录已经批准的提现的转账结果，state 为 WithdrawalPaid 或者 WithdrawalFailed
+func (m *PaymentModel) FinishWithdrawal(ctx context.Context, id string, state EnumWithdrawalState, transactionID, reason string) bool {
+	return m.transition(ctx, WithdrawalCollectionName,
+		append(objectIDFilter(id), bson.E{PAYMENT_STATE_KEY, WithdrawalApproved}),
+		bson.D{{PAYMENT_STATE_KEY, state}, {PAYMENT_TRANSACTION_ID_KEY, transactionID}, {WITHDRAWAL_REASON_KEY, reason}})
+}
+
+// 批准时间早于 before 但是还没有转账结果的提现申请，转账的结果不确定，需要使用相同的单号重试
+func (m *PaymentModel) GetStaleApprovedWithdrawals(ctx context.Context, before int64, limit int64) []WithdrawalDoc {
+	res := make([]WithdrawalDoc, 0, limit)
+	m.find(ctx, WithdrawalCollectionName, bson.D{
+		{PAYMENT_STATE_KEY, WithdrawalApproved},
+		{PAYMENT_UPDATE_TIME_KEY, bson.D{{"$lt", before}}},
+	}, 1, limit, func(cursor *mongo.Cursor) {
+		doc := WithdrawalDoc{}
+		lib.AssertErr(cursor.Decode(&doc))
+		res = append(res, doc)
+	})
+	return res
+}
+
+// 统计用户还没有结束的提现申请
+func (m *PaymentModel) CountOpenWithdrawals(ctx context.Context, userID string) int {
+	ctx, cancel := withTimeout(ctx)
+	defer cancel()
+	count, err := m.db.Collection(WithdrawalCollectionName).CountDocuments(ctx, bson.D{
+		{PAYMENT_USER_ID_KEY, userID},
+		{PAYMENT_STATE_KEY, bson.D{{"$in", bson.A{WithdrawalPending, WithdrawalApproved}}}},
+	})
+	lib.AssertErr(err)
+	return int(count)
+}
+
+// 注销用户时将订单和提现申请中的 open id 替换为匿名 id
+func (m *PaymentModel) ReplaceUser(ctx context.Context, openid, anonID string) {
+	ctx, cancel := withTimeout(ctx)
+	defer cancel()
+	for _, collection := range []string{PaymentOrderCollectionName, WithdrawalCollectionName} {
+		_, err := m.db.Collection(collection).UpdateMany(
+			ctx,
+			bson.D{{PAYMENT_USER_ID_KEY, openid}},
+			bson.D{{"$set", bson.D{{PAYMENT_USER_ID_KEY, anonID}}}},
+		)
+		lib.AssertErr(err)
+	}
+}
+
+func (m *PaymentModel) insert(ctx context.Context, collection string, doc interface{}) string {
+	ctx, cancel := withTimeout(ctx)
+	defer cancel()
+	res, err := m.db.Collection(collection).InsertOne(ctx, doc)
+	lib.AssertErr(err)
+	lib.Log(ctx).Debug().Str("collection", collection).Interface("id", res.InsertedID).Msg("insert payment")
+	return res.InsertedID.(primitive.ObjectID).Hex()
+}
+
+func (m *PaymentModel) findOne(ctx context.Context, collection string, filters bson.D, res interface{}) bool {
+	ctx, cancel := withTimeout(ctx)
+	defer cancel()
+	err := m.db.Collection(collection).FindOne(ctx, filters).Decode(res)
+	if err == mongo.ErrNoDocuments {
+		return false
+	}
+	lib.AssertErr(err)
+	return true
+}
+
+// 分页查询，从新到旧
+func (m *PaymentModel) find(ctx context.Context, collection string, filters bson.D, page, limit int64, decode func(cursor *mongo.Cursor)) {
+	ctx, cancel := withTimeout(ctx)
+	defer cancel()
+	cursor, err := m.db.Collection(collection).Find(ctx, filters, options.Find().
+		SetSort(bson.D{{PAYMENT_CREATE_TIME_KEY, -1}, {PAYMENT_ID_KEY, -1}}).
+		SetSkip((page-1)*limit).
+		SetLimit(limit))
+	lib.AssertErr(err)
+	defer cursor.Close(ctx)
+	for cursor.Next(ctx) {
+		decode(cursor)
+	}
+	lib.AssertErr(cursor.Err())
+}
+
+// 有条件地修改状态，同时更新 update_time，没有匹配的记录时返回 false
+func (m *PaymentModel) transition(ctx context.Context, collection string, filters, set bson.D) bool {
+	ctx, cancel := withTimeout(ctx)
+	defer cancel()
+	res, err := m.db.Collection(collection).UpdateOne(
+		ctx,
+		filters,
+		bson.D{{"$set", append(set, bson.E{PAYMENT_UPDATE_TIME_KEY, time.Now().Unix()})}},
+	)
+	lib.AssertErr(err)
+	return res.ModifiedCount == 1
+}
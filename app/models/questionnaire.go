@@ -3,10 +3,8 @@ package models
 import (
 	"context"
 	//"encoding/json"
-	"fmt"
 	//"strings"
 
-	"github.com/rs/zerolog/log"
 	"github.com/sysu-team/Back-end-development/lib"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
@@ -28,22 +26,22 @@ const (
 )
 
 type Answer struct {
-	Option string `bson:"option" json:"option"`
-	Count  int    `bson:"count" json:"count"`
+	Option string `bson:"option" json:"option" validate:"required,max=100"`
+	Count  int    `bson:"count" json:"count" validate:"min=0,max=1"`
 }
 
 type Question struct {
-	Topic   string   `bson:"topic" json:"topic"`
-	Answers []Answer `bson:"answers" json:"answers"`
+	Topic   string   `bson:"topic" json:"topic" validate:"required,max=200"`
+	Answers []Answer `bson:"answers" json:"answers" validate:"min=1,max=20"`
 }
 
 type QuestionnaireDoc struct {
-	Title     string     `bson:"questionnaire_name"`
-	Questions []Question `bson:"questions"`
+	Title     string     `bson:"questionnaire_name" json:"title" validate:"required,max=50"`
+	Questions []Question `bson:"questions" json:"questions" validate:"min=1,max=50"`
 }
 
 type SimpleAnswer struct {
-	Option string `json: option`
+	Option string `json:"option"`
 }
 
 type SimpleQuestion struct {
@@ -52,7 +50,7 @@ type SimpleQuestion struct {
 }
 
 type SimpleQuestionnaire struct {
-	Title     string           `json:"Title"`
+	Title     string           `json:"title"`
 	Questions []SimpleQuestion `json:"questions"`
 }
 
@@ -63,30 +61,35 @@ func NewQuestionnaireModel(db *mongo.Database) *QuestionnaireModel {
 
 // 创建一个新的问卷
 // 输入参数为问卷的json数据，将json数据转换成一个string，调用unmarshal来解析
-func (m *QuestionnaireModel) CreateNewQuestionnaire(q *QuestionnaireDoc) (qid string) {
-	id, errInsert := m.db.Collection(QuestionnaireCollectionName).InsertOne(context.TODO(), q)
+func (m *QuestionnaireModel) CreateNewQuestionnaire(ctx context.Context, q *QuestionnaireDoc) (qid string) {
+	ctx, cancel := withTimeout(ctx)
+	defer cancel()
+	id, errInsert := m.db.Collection(QuestionnaireCollectionName).InsertOne(ctx, q)
 	lib.AssertErr(errInsert)
 	lib.Assert(id != nil, "unknown_error")
-	log.Debug().Msg(fmt.Sprintf("insert a questionnaire with id = %v", id.InsertedID))
+	lib.Log(ctx).Debug().Interface("id", id.InsertedID).Msg("insert questionnaire")
 	return id.InsertedID.(primitive.ObjectID).Hex()
 }
 
 // 获得一个问卷的题目，用于填写问卷
 // 输入参数为问卷的id
 // 返回指定的问卷，不包括统计数据
-func (m *QuestionnaireModel) GetQuestionnaire(qid string) (q *SimpleQuestionnaire) {
+func (m *QuestionnaireModel) GetQuestionnaire(ctx context.Context, qid string) (q *SimpleQuestionnaire) {
+	ctx, cancel := withTimeout(ctx)
+	defer cancel()
 	objID, err := primitive.ObjectIDFromHex(qid)
-	lib.AssertErr(err)
+	lib.Assert(err == nil, "no_such_questionnaire")
 	tempQuestionnaire := &QuestionnaireDoc{}
 	res := m.db.Collection(QuestionnaireCollectionName).FindOne(
-		context.TODO(),
+		ctx,
 		bson.D{{
 			QUESTIONNAIRE_ID_KEY,
 			objID,
 		}},
 	)
-	lib.Assert(res != nil, "no_such_questionnaire")
-	lib.AssertErr(res.Decode(tempQuestionnaire))
+	err = res.Decode(tempQuestionnaire)
+	lib.Assert(err != mongo.ErrNoDocuments, "no_such_questionnaire")
+	lib.AssertErr(err)
 	q = &SimpleQuestionnaire{}
 	q.Title = tempQuestionnaire.Title
 	for _, tempQuestion := range tempQuestionnaire.Questions {
@@ -102,30 +105,35 @@ func (m *QuestionnaireModel) GetQuestionnaire(qid string) (q *SimpleQuestionnair
 // 返回完整的问卷，即题目和问卷的回答统计
 // 输入参数为问卷的id
 // 返回指定的问卷，包括统计数据
-func (m *QuestionnaireModel) GetFullQuestionnaire(qid string) (q *QuestionnaireDoc) {
+func (m *QuestionnaireModel) GetFullQuestionnaire(ctx context.Context, qid string) (q *QuestionnaireDoc) {
+	ctx, cancel := withTimeout(ctx)
+	defer cancel()
 	objID, err := primitive.ObjectIDFromHex(qid)
-	lib.AssertErr(err)
+	lib.Assert(err == nil, "no_such_questionnaire")
 	q = &QuestionnaireDoc{}
 	res := m.db.Collection(QuestionnaireCollectionName).FindOne(
-		context.TODO(),
+		ctx,
 		bson.D{{
 			QUESTIONNAIRE_ID_KEY,
 			objID,
 		}},
 	)
-	lib.Assert(res != nil, "no_such_questionnaire")
-	lib.Assert(res.Decode(q) == nil, "unknown_error")
+	err = res.Decode(q)
+	lib.Assert(err != mongo.ErrNoDocuments, "no_such_questionnaire")
+	lib.AssertErr(err)
 	return
 }
 
 // 向问卷添加一条记录
 // 输入为一个QuestionnaireDoc
 // 不返回参数
-func (m *QuestionnaireModel) AddOneRecord(qid string, questions []Question) {
+func (m *QuestionnaireModel) AddOneRecord(ctx context.Context, qid string, questions []Question) {
+	ctx, cancel := withTimeout(ctx)
+	defer cancel()
 	objID, err := primitive.ObjectIDFromHex(qid)
-	lib.AssertErr(err)
+	lib.Assert(err == nil, "no_such_questionnaire")
 	res, err := m.db.Collection(QuestionnaireCollectionName).UpdateOne(
-		context.TODO(),
+		ctx,
 		bson.D{{
 			QUESTIONNAIRE_ID_KEY,
 			objID,
@@ -138,6 +146,6 @@ func (m *QuestionnaireModel) AddOneRecord(qid string, questions []Question) {
 		}},
 	)
 	lib.AssertErr(err)
-	log.Debug().Msg(fmt.Sprintf("set result: %v", res))
+	lib.Log(ctx).Debug().Int64("matched", res.MatchedCount).Int64("modified", res.ModifiedCount).Msg("add questionnaire record")
 	return
 }
@@ -0,0 +1,98 @@
+package models
+
+import (
+	"context"
+	"time"
+
+	"github.com/sysu-team/Back-end-development/lib"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	RATE_LIMIT_KEY_KEY       string = "_id"
+	RATE_LIMIT_TAT_KEY       string = "tat"
+	RATE_LIMIT_EXPIRE_AT_KEY string = "expire_at"
+)
+
+// 令牌桶，使用 GCRA 表示：tat 为桶重新装满的时间，每取出一个令牌向后推迟 1/rate 秒
+// tat 不晚于 now + (burst-1)/rate 时还有令牌；桶装满之后由 TTL 索引删除
+type RateLimitDoc struct {
+	Key      string    `bson:"_id"`
+	TAT      int64     `bson:"tat"` // Unix 纳秒
+	ExpireAt time.Time `bson:"expire_at"`
+}
+
+// RateLimitModel 保存在数据库中的令牌桶，多个实例共享限制
+type RateLimitModel struct {
+	db  *mongo.Database
+	now func() time.Time
+}
+
+// 使用/创建 collection, 初始化子 model
+func NewRateLimitModel(db *mongo.Database) *RateLimitModel {
+	return &RateLimitModel{db, time.Now}
+}
+
+// Take 实现 lib.Limiter
+// 先把 tat 提前到 now，再在还有令牌的条件下把 tat 推迟 1/rate 秒，两步都是单个文档的原子更新
+// 并发的请求不会多取令牌，条件更新失败说明令牌已经被其他请求取完；数据库出错时不限流，避免限流影响正常的请求
+func (m *RateLimitModel) Take(ctx context.Context, key string, rate float64, burst int) (bool, time.Duration) {
+	ctx, cancel := withTimeout(ctx)
+	defer cancel()
+	collection := m.db.Collection(RateLimitCollectionName)
+	now := m.now()
+	interval := time.Duration(float64(time.Second) / rate)
+	limit := now.Add(time.Duration(burst-1) * interval).UnixNano()
+	update := bson.D{
+		{"$max", bson.D{
+			{RATE_LIMIT_TAT_KEY, now.UnixNano()},
+			{RATE_LIMIT_EXPIRE_AT_KEY, now.Add(time.Duration(burst) * interval)},
+		}},
+	}
+	doc := RateLimitDoc{}
+	err := collection.FindOneAndUpdate(ctx, bson.D{{RATE_LIMIT_KEY_KEY, key}}, update,
+		options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After)).Decode(&doc)
+	if isDuplicateKey(err) {
+		// 并发创建同一个桶，另一个请求已经创建，重新更新
+		err = collection.FindOneAndUpdate(ctx, bson.D{{RATE_LIMIT_KEY_KEY, key}}, update,
+			options.FindOneAndUpdate().SetReturnDocument(options.After)).Decode(&doc)
+	}
+	if err != nil {
+		lib.Log(ctx).Warn().Err(err).Str("key", key).Msg("read rate limit bucket")
+		return true, 0
+	}
+	if doc.TAT > limit {
+		return false, time.Duration(doc.TAT - limit)
+	}
+	res, err := collection.UpdateOne(
+		ctx,
+		bson.D{{RATE_LIMIT_KEY_KEY, key}, {RATE_LIMIT_TAT_KEY, bson.D{{"$lte", limit}}}},
+		bson.D{{"$inc", bson.D{{RATE_LIMIT_TAT_KEY, int64(interval)}}}},
+	)
+	if err != nil {
+		lib.Log(ctx).Warn().Err(err).Str("key", key).Msg("save rate limit bucket")
+		return true, 0
+	}
+	if res.MatchedCount == 0 {
+		return false, interval
+	}
+	return true, 0
+}
+
+// 是否为唯一索引冲突
+// FindOneAndUpdate 的 upsert 冲突返回 CommandError
+func isDuplicateKey(err error) bool {
+	if e, ok := err.(mongo.CommandError); ok {
+		return e.Code == 11000
+	}
+	if e, ok := err.(mongo.WriteException); ok {
+		for _, writeErr := range e.WriteErrors {
+			if writeErr.Code == 11000 {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,75 @@
+package models
+
+import (
+	"context"
+
+	"github.com/sysu-team/Back-end-development/lib"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+type RosterModel struct {
+	db *mongo.Database
+}
+
+const (
+	ROSTER_STUDENT_NUM_KEY string = "student_num"
+	ROSTER_NAME_KEY        string = "name"
+)
+
+// 学生名单，用于验证注册时填写的学号
+type RosterDoc struct {
+	StudentNumber string `bson:"student_num"`
+	Name          string `bson:"name"`
+}
+
+// 使用/创建 collection, 初始化子 model
+func NewRosterModel(db *mongo.Database) *RosterModel {
+	return &RosterModel{db}
+}
+
+// 导入学生名单，已经存在的学号会被覆盖
+// 返回导入的条数
+func (m *RosterModel) ImportRoster(ctx context.Context, entries []RosterDoc) int {
+	ctx, cancel := withTimeout(ctx)
+	defer cancel()
+	upsert := true
+	for _, entry := range entries {
+		_, err := m.db.Collection(RosterCollectionName).UpdateOne(
+			ctx,
+			bson.D{{
+				ROSTER_STUDENT_NUM_KEY,
+				entry.StudentNumber,
+			}},
+			bson.D{{
+				"$set", bson.D{
+					{ROSTER_NAME_KEY, entry.Name},
+				},
+			}},
+			&options.UpdateOptions{Upsert: &upsert},
+		)
+		lib.AssertErr(err)
+	}
+	lib.Log(ctx).Debug().Int("count", len(entries)).Msg("import roster")
+	return len(entries)
+}
+
+// 返回nil代表名单中没有这个学号
+func (m *RosterModel) GetByStudentNum(ctx context.Context, studentNum string) *RosterDoc {
+	ctx, cancel := withTimeout(ctx)
+	defer cancel()
+	res := &RosterDoc{}
+	err := m.db.Collection(RosterCollectionName).FindOne(
+		ctx,
+		bson.D{{
+			ROSTER_STUDENT_NUM_KEY,
+			studentNum,
+		}},
+	).Decode(res)
+	if err == mongo.ErrNoDocuments {
+		return nil
+	}
+	lib.AssertErr(err)
+	return res
+}
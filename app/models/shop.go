@@ -0,0 +1,261 @@
+package models
+
+import (
+	"context"
+	"time"
+
+	"github.com/sysu-team/Back-end-development/lib"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// 商品的种类
+type EnumShopItemKind string
+
+const (
+	ShopItemCoupon      EnumShopItemKind = "coupon"      // 优惠券，兑换码在商家处使用
+	ShopItemMerchandise EnumShopItemKind = "merchandise" // 周边商品，凭兑换码领取
+)
+
+// 兑换记录的状态
+type EnumRedemptionState uint8
+
+const (
+	RedemptionIssued EnumRedemptionState = 0 // 已经兑换，兑换码还没有使用
+	RedemptionUsed   EnumRedemptionState = 1 // 兑换码已经使用
+)
+
+const (
+	SHOP_ITEM_NAME_KEY         string = "name"
+	SHOP_ITEM_DESCRIPTION_KEY  string = "description"
+	SHOP_ITEM_KIND_KEY         string = "kind"
+	SHOP_ITEM_PRICE_KEY        string = "price"
+	SHOP_ITEM_STOCK_KEY        string = "stock"
+	SHOP_ITEM_ORDER_KEY        string = "order"
+	SHOP_ITEM_ENABLED_KEY      string = "enabled"
+	SHOP_ITEM_CREATE_TIME_KEY  string = "create_time"
+	SHOP_ITEM_UPDATE_TIME_KEY  string = "update_time"
+	REDEMPTION_ORDER_NO_KEY    string = "order_no"
+	REDEMPTION_CODE_KEY        string = "code"
+	REDEMPTION_USER_ID_KEY     string = "user_id"
+	REDEMPTION_STATE_KEY       string = "state"
+	REDEMPTION_USED_BY_KEY     string = "used_by"
+	REDEMPTION_USED_TIME_KEY   string = "used_time"
+	REDEMPTION_CREATE_TIME_KEY string = "create_time"
+)
+
+// 积分商城的商品
+type ShopItemDoc struct {
+	ID          primitive.ObjectID `bson:"_id,omitempty"`
+	Name        string             `bson:"name"`
+	Description string             `bson:"description"`
+	Kind        EnumShopItemKind   `bson:"kind"`
+	Price       int                `bson:"price"` // 兑换需要的积分
+	Stock       int                `bson:"stock"` // 剩余的库存
+	Order       int                `bson:"order"` // 展示的顺序
+	Enabled     bool               `bson:"enabled"`
+	CreateTime  int64              `bson:"create_time"`
+	UpdateTime  int64              `bson:"update_time"`
+}
+
+// 兑换记录，商品的名字、种类和价格在兑换时复制，之后修改商品不影响记录
+type RedemptionDoc struct {
+	ID         primitive.ObjectID  `bson:"_id,omitempty"`
+	OrderNo    string              `bson:"order_no"` // 兑换的单号，记录在积分变化中
+	Code       string              `bson:"code"`     // 兑换码，唯一
+	UserID     string              `bson:"user_id"`
+	ItemID     string              `bson:"item_id"`
+	ItemName   string              `bson:"item_name"`
+	ItemKind   EnumShopItemKind    `bson:"item_kind"`
+	Price      int                 `bson:"price"`
+	State      EnumRedemptionState `bson:"state"`
+	UsedBy     string              `bson:"used_by"`   // 核销兑换码的管理员
+	UsedTime   int64               `bson:"used_time"` // Unix时间戳
+	CreateTime int64               `bson:"create_time"`
+}
+
+type ShopModel struct {
+	db *mongo.Database
+}
+
+// 使用/创建 collection, 初始化子 model
+func NewShopModel(db *mongo.Database) *ShopModel {
+	return &ShopModel{db}
+}
+
+// 创建商品，返回商品 id
+func (m *ShopModel) CreateItem(ctx context.Context, doc *ShopItemDoc) string {
+	ctx, cancel := withTimeout(ctx)
+	defer cancel()
+	doc.CreateTime = time.Now().Unix()
+	doc.UpdateTime = doc.CreateTime
+	res, err := m.db.Collection(ShopItemCollectionName).InsertOne(ctx, doc)
+	lib.AssertErr(err)
+	lib.Log(ctx).Debug().Interface("id", res.InsertedID).Msg("insert shop item")
+	return res.InsertedID.(primitive.ObjectID).Hex()
+}
+
+// 修改商品，库存直接设置为 doc 中的值，没有这个商品时返回 false
+func (m *ShopModel) UpdateItem(ctx context.Context, itemID string, doc *ShopItemDoc) bool {
+	ctx, cancel := withTimeout(ctx)
+	defer cancel()
+	res, err := m.db.Collection(ShopItemCollectionName).UpdateOne(
+		ctx,
+		objectIDFilter(itemID),
+		bson.D{{"$set", bson.D{
+			{SHOP_ITEM_NAME_KEY, doc.Name},
+			{SHOP_ITEM_DESCRIPTION_KEY, doc.Description},
+			{SHOP_ITEM_KIND_KEY, doc.Kind},
+			{SHOP_ITEM_PRICE_KEY, doc.Price},
+			{SHOP_ITEM_STOCK_KEY, doc.Stock},
+			{SHOP_ITEM_ORDER_KEY, doc.Order},
+			{SHOP_ITEM_ENABLED_KEY, doc.Enabled},
+			{SHOP_ITEM_UPDATE_TIME_KEY, time.Now().Unix()},
+		}}},
+	)
+	lib.AssertErr(err)
+	return res.MatchedCount == 1
+}
+
+// 返回nil代表没有这个商品
+func (m *ShopModel) GetItem(ctx context.Context, itemID string) *ShopItemDoc {
+	ctx, cancel := withTimeout(ctx)
+	defer cancel()
+	res := &ShopItemDoc{}
+	err := m.db.Collection(ShopItemCollectionName).FindOne(ctx, objectIDFilter(itemID)).Decode(res)
+	if err == mongo.ErrNoDocuments {
+		return nil
+	}
+	lib.AssertErr(err)
+	return res
+}
+
+// 获取商品列表，按照展示顺序排列
+func (m *ShopModel) GetItems(ctx context.Context, onlyEnabled bool) []ShopItemDoc {
+	ctx, cancel := withTimeout(ctx)
+	defer cancel()
+	filters := bson.D{}
+	if onlyEnabled {
+		filters = bson.D{{SHOP_ITEM_ENABLED_KEY, true}}
+	}
+	cursor, err := m.db.Collection(ShopItemCollectionName).Find(ctx, filters, options.Find().
+		SetSort(bson.D{{SHOP_ITEM_ORDER_KEY, 1}, {SHOP_ITEM_CREATE_TIME_KEY, -1}}))
+	lib.AssertErr(err)
+	defer cursor.Close(ctx)
+	res := make([]ShopItemDoc, 0)
+	for cursor.Next(ctx) {
+		doc := ShopItemDoc{}
+		lib.AssertErr(cursor.Decode(&doc))
+		res = append(res, doc)
+	}
+	lib.AssertErr(cursor.Err())
+	return res
+}
+
+// 扣减一件库存，商品不存在、已经下架或者没有库存时返回 nil
+// 使用库存作为条件的 $inc，并发兑换不会超卖
+func (m *ShopModel) TakeStock(ctx context.Context, itemID string) *ShopItemDoc {
+	ctx, cancel := withTimeout(ctx)
+	defer cancel()
+	res := &ShopItemDoc{}
+	err := m.db.Collection(ShopItemCollectionName).FindOneAndUpdate(
+		ctx,
+		append(objectIDFilter(itemID),
+			bson.E{SHOP_ITEM_ENABLED_KEY, true},
+			bson.E{SHOP_ITEM_STOCK_KEY, bson.D{{"$gte", 1}}},
+		),
+		bson.D{{"$inc", bson.D{{SHOP_ITEM_STOCK_KEY, -1}}}},
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(res)
+	if err == mongo.ErrNoDocuments {
+		return nil
+	}
+	lib.AssertErr(err)
+	return res
+}
+
+// 兑换失败时归还扣减的库存
+func (m *ShopModel) ReturnStock(ctx context.Context, itemID string) {
+	ctx, cancel := withTimeout(ctx)
+	defer cancel()
+	_, err := m.db.Collection(ShopItemCollectionName).UpdateOne(
+		ctx,
+		objectIDFilter(itemID),
+		bson.D{{"$inc", bson.D{{SHOP_ITEM_STOCK_KEY, 1}}}},
+	)
+	lib.AssertErr(err)
+}
+
+// 保存兑换记录，返回记录 id
+func (m *ShopModel) CreateRedemption(ctx context.Context, doc *RedemptionDoc) string {
+	ctx, cancel := withTimeout(ctx)
+	defer cancel()
+	res, err := m.db.Collection(RedemptionCollectionName).InsertOne(ctx, doc)
+	lib.AssertErr(err)
+	lib.Log(ctx).Debug().Interface("id", res.InsertedID).Msg("insert redemption")
+	return res.InsertedID.(primitive.ObjectID).Hex()
+}
+
+// 返回nil代表没有这个兑换码
+func (m *ShopModel) GetRedemptionByCode(ctx context.Context, code string) *RedemptionDoc {
+	ctx, cancel := withTimeout(ctx)
+	defer cancel()
+	res := &RedemptionDoc{}
+	err := m.db.Collection(RedemptionCollectionName).FindOne(ctx, bson.D{{REDEMPTION_CODE_KEY, code}}).Decode(res)
+	if err == mongo.ErrNoDocuments {
+		return nil
+	}
+	lib.AssertErr(err)
+	return res
+}
+
+// 用户的兑换记录，从新到旧
+func (m *ShopModel) GetRedemptionsByUser(ctx context.Context, page, limit int64, userID string) []RedemptionDoc {
+	ctx, cancel := withTimeout(ctx)
+	defer cancel()
+	cursor, err := m.db.Collection(RedemptionCollectionName).Find(ctx, bson.D{{REDEMPTION_USER_ID_KEY, userID}}, options.Find().
+		SetSort(bson.D{{REDEMPTION_CREATE_TIME_KEY, -1}, {"_id", -1}}).
+		SetSkip((page-1)*limit).
+		SetLimit(limit))
+	lib.AssertErr(err)
+	defer cursor.Close(ctx)
+	res := make([]RedemptionDoc, 0, limit)
+	for cursor.Next(ctx) {
+		doc := RedemptionDoc{}
+		lib.AssertErr(cursor.Decode(&doc))
+		res = append(res, doc)
+	}
+	lib.AssertErr(cursor.Err())
+	return res
+}
+
+// 核销兑换码，已经使用过时返回 false
+func (m *ShopModel) UseRedemption(ctx context.Context, code, adminID string) bool {
+	ctx, cancel := withTimeout(ctx)
+	defer cancel()
+	res, err := m.db.Collection(RedemptionCollectionName).UpdateOne(
+		ctx,
+		bson.D{{REDEMPTION_CODE_KEY, code}, {REDEMPTION_STATE_KEY, RedemptionIssued}},
+		bson.D{{"$set", bson.D{
+			{REDEMPTION_STATE_KEY, RedemptionUsed},
+			{REDEMPTION_USED_BY_KEY, adminID},
+			{REDEMPTION_USED_TIME_KEY, time.Now().Unix()},
+		}}},
+	)
+	lib.AssertErr(err)
+	return res.ModifiedCount == 1
+}
+
+// 注销用户时将兑换记录中的 open id 替换为匿名 id
+func (m *ShopModel) ReplaceUser(ctx context.Context, openid, anonID string) {
+	ctx, cancel := withTimeout(ctx)
+	defer cancel()
+	_, err := m.db.Collection(RedemptionCollectionName).UpdateMany(
+		ctx,
+		bson.D{{REDEMPTION_USER_ID_KEY, openid}},
+		bson.D{{"$set", bson.D{{REDEMPTION_USER_ID_KEY, anonID}}}},
+	)
+	lib.AssertErr(err)
+}
@@ -2,8 +2,8 @@ package models
 
 import (
 	"context"
-	"fmt"
-	"github.com/rs/zerolog/log"
+	"crypto/sha256"
+	"encoding/hex"
 	"github.com/sysu-team/Back-end-development/lib"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
@@ -14,17 +14,105 @@ type UserModel struct {
 	db *mongo.Database
 }
 
+type EnumUserStatus uint8
+
+const (
+	UserActive    EnumUserStatus = 0
+	UserSuspended EnumUserStatus = 1
+	UserBanned    EnumUserStatus = 2
+	UserDeleted   EnumUserStatus = 3 // 已注销，个人信息已经匿名化
+)
+
+// 注销的用户显示的名字
+const DeletedUserName = "已注销用户"
+
+// 资料字段的可见范围
+type EnumVisibility string
+
+const (
+	VisibilityDefault      EnumVisibility = ""
+	VisibilityPublic       EnumVisibility = "public"       // 所有人可见
+	VisibilityCounterparty EnumVisibility = "counterparty" // 只有进行中委托的另一方可见
+	VisibilityPrivate      EnumVisibility = "private"      // 只有自己可见
+)
+
 const (
-	USER_OPEN_ID_KEY string = "open_id"
-	CREDIT_KEY       string = "credit"
+	USER_OPEN_ID_KEY               string = "open_id"
+	USER_STUDENT_NUM_KEY           string = "student_num"
+	CREDIT_KEY                     string = "credit"
+	USER_STATUS_KEY                string = "status"
+	USER_SUSPENDED_UNTIL_KEY       string = "suspended_until"
+	USER_STATUS_REASON_KEY         string = "status_reason"
+	USER_VERIFIED_KEY              string = "verified"
+	USER_EMAIL_KEY                 string = "email"
+	USER_LAST_ACTIVE_AT_KEY        string = "last_active_at"
+	USER_DECAYED_AT_KEY            string = "decayed_at"
+	USER_CHECK_IN_DAY_KEY          string = "check_in_day"
+	USER_CHECK_IN_STREAK_KEY       string = "check_in_streak"
+	USER_FIRST_COMPLETED_KEY       string = "first_completed"
+	USER_HIDE_FROM_LEADERBOARD_KEY string = "hide_from_leaderboard"
+	USER_GRANTED_ORDERS_KEY        string = "granted_orders"
+	USER_IDENTITY_HASHES_KEY       string = "identity_hashes"
 )
 
 // 所有字段名字都是小写的
 type UserDoc struct {
-	OpenID        string `bson:"open_id"`
-	Name          string `bson:"name"`
-	StudentNumber string `bson:"student_num"`
-	Credit        int    `bson:"credit"`
+	OpenID         string         `bson:"open_id"`
+	Name           string         `bson:"name"`
+	StudentNumber  string         `bson:"student_num"`
+	Credit         int            `bson:"credit"`
+	Status         EnumUserStatus `bson:"status"`
+	SuspendedUntil int64          `bson:"suspended_until"` // 停用截止时间，Unix时间戳
+	StatusReason   string         `bson:"status_reason"`
+	Verified       bool           `bson:"verified"` // 是否通过学生身份验证
+	Email          string         `bson:"email"`    // 通过验证的校园邮箱
+	// 个人资料
+	AvatarURL  string            `bson:"avatar_url"`
+	Campus     string            `bson:"campus"`
+	Dormitory  string            `bson:"dormitory"`
+	WechatID   string            `bson:"wechat_id"`
+	Phone      string            `bson:"phone"`
+	Bio        string            `bson:"bio"`
+	Visibility ProfileVisibility `bson:"visibility"`
+	// 积分规则
+	LastActiveAt   int64  `bson:"last_active_at"`  // 最近一次登陆、签到或者积分变化的时间，Unix时间戳
+	DecayedAt      int64  `bson:"decayed_at"`      // 最近一次积分衰减的时间，Unix时间戳
+	CheckInDay     string `bson:"check_in_day"`    // 最近一次签到的日期，格式为 2006-01-02
+	CheckInStreak  int    `bson:"check_in_streak"` // 连续签到的天数
+	FirstCompleted bool   `bson:"first_completed"` // 是否已经获得第一次完成委托的奖励
+	// 隐私
+	HideFromLeaderboard bool `bson:"hide_from_leaderboard"` // 不出现在排行榜中
+	// 注销之后原来的 open id 和学号的哈希，同一个微信账号或者学生重新注册时不再发放注册奖励
+	IdentityHashes []string `bson:"identity_hashes,omitempty"`
+}
+
+// 各个资料字段的可见范围，为空时使用默认值
+type ProfileVisibility struct {
+	Campus    EnumVisibility `bson:"campus" json:"campus"`
+	Dormitory EnumVisibility `bson:"dormitory" json:"dormitory"`
+	WechatID  EnumVisibility `bson:"wechat_id" json:"wechat_id"`
+	Phone     EnumVisibility `bson:"phone" json:"phone"`
+}
+
+// 个人资料的部分更新，为 nil 的字段不会被修改
+type ProfileUpdate struct {
+	Name                *string         `bson:"name,omitempty"`
+	AvatarURL           *string         `bson:"avatar_url,omitempty"`
+	Campus              *string         `bson:"campus,omitempty"`
+	Dormitory           *string         `bson:"dormitory,omitempty"`
+	WechatID            *string         `bson:"wechat_id,omitempty"`
+	Phone               *string         `bson:"phone,omitempty"`
+	Bio                 *string         `bson:"bio,omitempty"`
+	CampusVisibility    *EnumVisibility `bson:"visibility.campus,omitempty"`
+	DormitoryVisibility *EnumVisibility `bson:"visibility.dormitory,omitempty"`
+	WechatIDVisibility  *EnumVisibility `bson:"visibility.wechat_id,omitempty"`
+	PhoneVisibility     *EnumVisibility `bson:"visibility.phone,omitempty"`
+	HideFromLeaderboard *bool           `bson:"hide_from_leaderboard,omitempty"`
+}
+
+// 是否没有要修改的字段
+func (u *ProfileUpdate) IsEmpty() bool {
+	return *u == ProfileUpdate{}
 }
 
 // 使用/创建 collcetion, 初始化子 model
@@ -33,33 +121,72 @@ func NewUserModel(db *mongo.Database) *UserModel {
 	return &UserModel{db}
 }
 
-func (m *UserModel) AddUser(newUser *UserDoc) string {
+func (m *UserModel) AddUser(ctx context.Context, newUser *UserDoc) string {
+	ctx, cancel := withTimeout(ctx)
+	defer cancel()
 	// insert user doc into
-	res, err := m.db.Collection(UserCollectionName).InsertOne(context.TODO(), newUser)
+	res, err := m.db.Collection(UserCollectionName).InsertOne(ctx, newUser)
 	lib.AssertErr(err)
 	return res.InsertedID.(primitive.ObjectID).String()
 }
 
 // 返回nil，代表没有找到对应的用户
-func (m *UserModel) GetUserByName(name string) *UserDoc {
-	return m.findUserBy("name", name)
+func (m *UserModel) GetUserByName(ctx context.Context, name string) *UserDoc {
+	ctx, cancel := withTimeout(ctx)
+	defer cancel()
+	return m.findUserBy(ctx, "name", name)
 }
 
 // 返回nil代表没有找到该 openid 对应的用户
-func (m *UserModel) GetUserByOpenID(openid string) *UserDoc {
-	return m.findUserBy("open_id", openid)
+func (m *UserModel) GetUserByOpenID(ctx context.Context, openid string) *UserDoc {
+	ctx, cancel := withTimeout(ctx)
+	defer cancel()
+	return m.findUserBy(ctx, "open_id", openid)
 }
 
-// 返回nil代表没有找到该 openid 对应的用户
-func (m *UserModel) GetUserByStudentNum(studentNum string) *UserDoc {
-	return m.findUserBy("student_num", studentNum)
+// 返回nil代表没有找到该学号对应的用户
+func (m *UserModel) GetUserByStudentNum(ctx context.Context, studentNum string) *UserDoc {
+	ctx, cancel := withTimeout(ctx)
+	defer cancel()
+	return m.findUserBy(ctx, USER_STUDENT_NUM_KEY, studentNum)
 }
 
-func (m *UserModel) findUserBy(key, value string) *UserDoc {
+// 微信账号或者学生是否注销过账号
+func (m *UserModel) HasDeletedIdentity(ctx context.Context, openid, studentNum string) bool {
+	ctx, cancel := withTimeout(ctx)
+	defer cancel()
+	n, err := m.db.Collection(UserCollectionName).CountDocuments(ctx, bson.D{
+		{USER_IDENTITY_HASHES_KEY, bson.D{{"$in", identityHashes(openid, studentNum)}}},
+	})
+	lib.AssertErr(err)
+	return n > 0
+}
+
+// open id 和学号的哈希，只用于判断是否注销过，不保存原文
+func identityHashes(openid, studentNum string) []string {
+	res := make([]string, 0, 2)
+	for _, id := range []struct{ key, value string }{{USER_OPEN_ID_KEY, openid}, {USER_STUDENT_NUM_KEY, studentNum}} {
+		if id.value == "" {
+			continue
+		}
+		sum := sha256.Sum256([]byte(id.key + ":" + id.value))
+		res = append(res, hex.EncodeToString(sum[:]))
+	}
+	return res
+}
+
+// 返回nil代表没有用户使用这个邮箱通过验证
+func (m *UserModel) GetUserByEmail(ctx context.Context, email string) *UserDoc {
+	ctx, cancel := withTimeout(ctx)
+	defer cancel()
+	return m.findUserBy(ctx, USER_EMAIL_KEY, email)
+}
+
+func (m *UserModel) findUserBy(ctx context.Context, key, value string) *UserDoc {
 	filter := bson.D{{key, value}}
 	res := &UserDoc{}
 	// 找不到对应的用户抛出 no document error
-	err := m.db.Collection(UserCollectionName).FindOne(context.TODO(), filter).Decode(res)
+	err := m.db.Collection(UserCollectionName).FindOne(ctx, filter).Decode(res)
 	if err == mongo.ErrNoDocuments {
 		return nil
 	}
@@ -67,21 +194,90 @@ func (m *UserModel) findUserBy(key, value string) *UserDoc {
 	return res
 }
 
-func (m *UserModel) SetCreditByOpenID(openid string, newCredit int) {
-	// filter := bson.D{{"open_id", openid}}
+// 设置用户的账号状态
+// 只有处于停用状态时 until 才有意义
+func (m *UserModel) SetStatusByOpenID(ctx context.Context, openid string, status EnumUserStatus, until int64, reason string) {
+	ctx, cancel := withTimeout(ctx)
+	defer cancel()
 	res, err := m.db.Collection(UserCollectionName).UpdateOne(
-		context.TODO(),
+		ctx,
 		bson.D{{
 			USER_OPEN_ID_KEY,
 			openid,
 		}},
 		bson.D{{
 			"$set", bson.D{
-				{CREDIT_KEY, newCredit},
+				{USER_STATUS_KEY, status},
+				{USER_SUSPENDED_UNTIL_KEY, until},
+				{USER_STATUS_REASON_KEY, reason},
 			},
 		}},
 	)
 	lib.AssertErr(err)
-	log.Debug().Msg(fmt.Sprintf("update result :%v", res))
-	return
+	lib.Assert(res.MatchedCount == 1, "no_such_user")
+	lib.Log(ctx).Debug().Int64("matched", res.MatchedCount).Int64("modified", res.ModifiedCount).Msg("set status")
+}
+
+// 标记用户已经通过学生身份验证
+func (m *UserModel) SetVerifiedByOpenID(ctx context.Context, openid, email string) {
+	ctx, cancel := withTimeout(ctx)
+	defer cancel()
+	res, err := m.db.Collection(UserCollectionName).UpdateOne(
+		ctx,
+		bson.D{{
+			USER_OPEN_ID_KEY,
+			openid,
+		}},
+		bson.D{{
+			"$set", bson.D{
+				{USER_VERIFIED_KEY, true},
+				{USER_EMAIL_KEY, email},
+			},
+		}},
+	)
+	// 邮箱有唯一索引，同一个邮箱只能验证一个账号
+	lib.Assert(!isDuplicateKey(err), "email_already_used")
+	lib.AssertErr(err)
+	lib.Log(ctx).Debug().Int64("matched", res.MatchedCount).Int64("modified", res.ModifiedCount).Msg("set verified")
+}
+
+// 更新用户的个人资料
+func (m *UserModel) UpdateProfileByOpenID(ctx context.Context, openid string, update *ProfileUpdate) {
+	ctx, cancel := withTimeout(ctx)
+	defer cancel()
+	res, err := m.db.Collection(UserCollectionName).UpdateOne(
+		ctx,
+		bson.D{{
+			USER_OPEN_ID_KEY,
+			openid,
+		}},
+		bson.D{{
+			"$set", update,
+		}},
+	)
+	lib.AssertErr(err)
+	lib.Log(ctx).Debug().Int64("matched", res.MatchedCount).Int64("modified", res.ModifiedCount).Msg("update profile")
+}
+
+// 注销用户，用匿名 id 替换 open id 和学号，清空个人资料
+// 积分保留，其他集合中的 open id 需要先替换为同一个匿名 id
+func (m *UserModel) AnonymizeByOpenID(ctx context.Context, openid, anonID string) {
+	ctx, cancel := withTimeout(ctx)
+	defer cancel()
+	user := m.findUserBy(ctx, USER_OPEN_ID_KEY, openid)
+	lib.Assert(user != nil, "no_such_user")
+	res, err := m.db.Collection(UserCollectionName).ReplaceOne(
+		ctx,
+		bson.D{{USER_OPEN_ID_KEY, openid}},
+		&UserDoc{
+			OpenID:         anonID,
+			Name:           DeletedUserName,
+			StudentNumber:  anonID,
+			Credit:         user.Credit,
+			Status:         UserDeleted,
+			IdentityHashes: identityHashes(openid, user.StudentNumber),
+		},
+	)
+	lib.AssertErr(err)
+	lib.Log(ctx).Debug().Int64("matched", res.MatchedCount).Int64("modified", res.ModifiedCount).Msg("anonymize user")
 }
@@ -0,0 +1,113 @@
+package models
+
+import (
+	"context"
+	"time"
+
+	"github.com/sysu-team/Back-end-development/lib"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+type VerificationModel struct {
+	db *mongo.Database
+}
+
+const (
+	VERIFICATION_OPEN_ID_KEY   string = "open_id"
+	VERIFICATION_EMAIL_KEY     string = "email"
+	VERIFICATION_CODE_KEY      string = "code"
+	VERIFICATION_EXPIRE_AT_KEY string = "expire_at"
+	VERIFICATION_ATTEMPTS_KEY  string = "attempts"
+)
+
+// 邮箱验证码，每个用户同时只有一个有效的验证码
+type VerificationDoc struct {
+	OpenID   string    `bson:"open_id"`
+	Email    string    `bson:"email"`
+	Code     string    `bson:"code"`
+	ExpireAt time.Time `bson:"expire_at"`
+	Attempts int       `bson:"attempts"` // 提交验证码的次数
+}
+
+// 使用/创建 collection, 初始化子 model
+func NewVerificationModel(db *mongo.Database) *VerificationModel {
+	return &VerificationModel{db}
+}
+
+// 保存用户的验证码，覆盖之前的验证码并重新计算提交次数
+func (m *VerificationModel) SetCode(ctx context.Context, openid, email, code string, expireAt time.Time) {
+	ctx, cancel := withTimeout(ctx)
+	defer cancel()
+	upsert := true
+	_, err := m.db.Collection(VerificationCollectionName).UpdateOne(
+		ctx,
+		bson.D{{
+			VERIFICATION_OPEN_ID_KEY,
+			openid,
+		}},
+		bson.D{{
+			"$set", bson.D{
+				{VERIFICATION_EMAIL_KEY, email},
+				{VERIFICATION_CODE_KEY, code},
+				{VERIFICATION_EXPIRE_AT_KEY, expireAt},
+				{VERIFICATION_ATTEMPTS_KEY, 0},
+			},
+		}},
+		&options.UpdateOptions{Upsert: &upsert},
+	)
+	lib.AssertErr(err)
+}
+
+// 返回nil代表用户没有申请过验证码
+func (m *VerificationModel) GetCode(ctx context.Context, openid string) *VerificationDoc {
+	ctx, cancel := withTimeout(ctx)
+	defer cancel()
+	res := &VerificationDoc{}
+	err := m.db.Collection(VerificationCollectionName).FindOne(
+		ctx,
+		bson.D{{
+			VERIFICATION_OPEN_ID_KEY,
+			openid,
+		}},
+	).Decode(res)
+	if err == mongo.ErrNoDocuments {
+		return nil
+	}
+	lib.AssertErr(err)
+	return res
+}
+
+// 记录一次提交，返回包括这一次在内的提交次数，没有验证码时返回 0
+// 并发的提交各自计数，不会超过限制多比较验证码
+func (m *VerificationModel) AddAttempt(ctx context.Context, openid string) int {
+	ctx, cancel := withTimeout(ctx)
+	defer cancel()
+	res := &VerificationDoc{}
+	err := m.db.Collection(VerificationCollectionName).FindOneAndUpdate(
+		ctx,
+		bson.D{{VERIFICATION_OPEN_ID_KEY, openid}},
+		bson.D{{"$inc", bson.D{{VERIFICATION_ATTEMPTS_KEY, 1}}}},
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(res)
+	if err == mongo.ErrNoDocuments {
+		return 0
+	}
+	lib.AssertErr(err)
+	return res.Attempts
+}
+
+// 验证通过或者提交次数过多后删除验证码
+func (m *VerificationModel) DeleteCode(ctx context.Context, openid string) {
+	ctx, cancel := withTimeout(ctx)
+	defer cancel()
+	_, err := m.db.Collection(VerificationCollectionName).DeleteOne(
+		ctx,
+		bson.D{{
+			VERIFICATION_OPEN_ID_KEY,
+			openid,
+		}},
+	)
+	lib.AssertErr(err)
+}
@@ -0,0 +1,98 @@
+package services
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"time"
+
+	"github.com/sysu-team/Back-end-development/app/models"
+	"github.com/sysu-team/Back-end-development/lib"
+)
+
+// 导出时每类审计日志的最大数量
+const exportAuditLimit = 1000
+
+// 导出的个人数据
+type UserExport struct {
+	ExportedAt             int64                     `json:"exported_at"` // Unix时间戳
+	User                   models.UserDoc            `json:"user"`
+	Published              []models.DelegationWithID `json:"published_delegations"`
+	Received               []models.DelegationWithID `json:"received_delegations"` // 包括已经完成或者放弃的委托
+	QuestionnaireResponses []AuditEntry              `json:"questionnaire_responses"`
+	CreditHistory          []AuditEntry              `json:"credit_history"`
+	TopUpOrders            []PaymentOrderInfo        `json:"top_up_orders"`
+	Withdrawals            []WithdrawalInfo          `json:"withdrawals"`
+	Redemptions            []RedemptionInfo          `json:"redemptions"`
+	Messages               []MessageInfo             `json:"messages"` // 发送的聊天消息
+}
+
+// 导出用户的个人数据
+// 问卷只保存了统计结果，每次提交的答案和积分变化从审计日志中获取
+func (s *userService) ExportUserData(ctx context.Context, openid string) *UserExport {
+	user := s.FindUserByOpenID(ctx, openid)
+	lib.Assert(user != nil, "no_such_user")
+	audit := NewAuditService()
+	payment := NewPaymentService()
+	messageDocs := s.messageModel.GetMessagesBySender(ctx, openid)
+	messages := make([]MessageInfo, 0, len(messageDocs))
+	for i := range messageDocs {
+		messages = append(messages, messageInfo(&messageDocs[i]))
+	}
+	return &UserExport{
+		ExportedAt: time.Now().Unix(),
+		User:       *user,
+		Published:  s.delegationModel.GetAllByPublisher(ctx, openid),
+		Received:   s.delegationModel.GetAllByReceiver(ctx, openid),
+		QuestionnaireResponses: audit.QueryAuditLog(ctx, 1, exportAuditLimit, &models.AuditQuery{
+			ActorID: openid,
+			Action:  AuditQuestionnaireSubmit,
+		}),
+		CreditHistory: audit.QueryAuditLog(ctx, 1, exportAuditLimit, &models.AuditQuery{
+			TargetID: openid,
+			Action:   AuditCreditChange,
+		}),
+		TopUpOrders: payment.GetOrders(ctx, openid, 1, exportAuditLimit),
+		Withdrawals: payment.GetWithdrawals(ctx, openid, 1, exportAuditLimit),
+		Redemptions: NewShopService().GetRedemptions(ctx, openid, 1, exportAuditLimit),
+		Messages:    messages,
+	}
+}
+
+// 注销用户
+// 还有冻结积分的委托或者未完成的提现申请时不能注销；头像和没有关联到委托的附件被删除
+// 其他集合中的 open id 替换为同一个匿名 id，委托的另一方的记录保持完整
+// 用户最后匿名化，中途失败时可以重新注销
+func (s *userService) DeleteAccount(ctx context.Context, openid string) {
+	user := s.FindUserByOpenID(ctx, openid)
+	lib.Assert(user != nil, "no_such_user")
+	lib.Assert(s.delegationModel.CountActiveByUser(ctx, openid) == 0, "account_has_active_delegations")
+	lib.Assert(s.paymentModel.CountOpenWithdrawals(ctx, openid) == 0, "account_has_open_withdrawals")
+	anonID := newAnonymousID()
+	for _, doc := range s.attachmentModel.GetUnlinkedByOwner(ctx, openid) {
+		lib.AssertErr(blobStore.Delete(ctx, doc.Key))
+		if doc.ThumbnailKey != "" {
+			lib.AssertErr(blobStore.Delete(ctx, doc.ThumbnailKey))
+		}
+		s.attachmentModel.DeleteAttachment(ctx, doc.ID)
+	}
+	s.attachmentModel.ReplaceOwner(ctx, openid, anonID)
+	s.delegationModel.ReplaceUser(ctx, openid, anonID)
+	s.verificationModel.DeleteCode(ctx, openid)
+	s.paymentModel.ReplaceUser(ctx, openid, anonID)
+	s.shopModel.ReplaceUser(ctx, openid, anonID)
+	s.messageModel.ReplaceUser(ctx, openid, anonID)
+	NewLeaderboardService().Forget(ctx, openid)
+	s.auditModel.ReplaceUser(ctx, openid, anonID)
+	s.userModel.AnonymizeByOpenID(ctx, openid, anonID)
+	recordAudit(ctx, anonID, AuditAccountDelete, anonID, nil, nil)
+	lib.Log(ctx).Info().Str("anon_id", anonID).Msg("delete account")
+}
+
+// 注销的用户的匿名 id
+func newAnonymousID() string {
+	b := make([]byte, 12)
+	_, err := rand.Read(b)
+	lib.AssertErr(err)
+	return "deleted_" + hex.EncodeToString(b)
+}
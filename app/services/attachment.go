@@ -0,0 +1,182 @@
+package services
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"path"
+	"time"
+
+	"github.com/sysu-team/Back-end-development/app/configs"
+	"github.com/sysu-team/Back-end-development/app/models"
+	"github.com/sysu-team/Back-end-development/app/utils"
+	"github.com/sysu-team/Back-end-development/lib"
+)
+
+const (
+	defaultMaxAttachmentSize = 5 << 20
+	defaultThumbnailSize     = 256
+)
+
+var defaultAllowedTypes = []string{"image/jpeg", "image/png", "image/gif", "application/pdf"}
+
+// singleton
+var (
+	blobStore     utils.BlobStore = utils.NewBlobStore(&configs.StorageConfig{})
+	storageConfig                 = configs.StorageConfig{
+		MaxSize:       defaultMaxAttachmentSize,
+		AllowedTypes:  defaultAllowedTypes,
+		ThumbnailSize: defaultThumbnailSize,
+	}
+)
+
+// InitStorage 根据配置初始化附件存储和限制
+func InitStorage(config *configs.StorageConfig) {
+	storageConfig = *config
+	if storageConfig.MaxSize <= 0 {
+		storageConfig.MaxSize = defaultMaxAttachmentSize
+	}
+	if len(storageConfig.AllowedTypes) == 0 {
+		storageConfig.AllowedTypes = defaultAllowedTypes
+	}
+	if storageConfig.ThumbnailSize <= 0 {
+		storageConfig.ThumbnailSize = defaultThumbnailSize
+	}
+	blobStore = utils.NewBlobStore(config)
+}
+
+// MaxAttachmentSize 单个附件的最大字节数
+func MaxAttachmentSize() int64 {
+	return storageConfig.MaxSize
+}
+
+// AttachmentService 附件逻辑
+type AttachmentService interface {
+	Upload(ctx context.Context, ownerID string, purpose models.EnumAttachmentPurpose, fileName string, data []byte) *AttachmentInfo
+	GetAttachment(ctx context.Context, viewerID, attachmentID string) (info *AttachmentInfo, data []byte)
+	GetThumbnail(ctx context.Context, viewerID, attachmentID string) []byte
+}
+
+func NewAttachmentService() AttachmentService {
+	return &attachmentService{
+		models.GetModel().Attachment,
+		models.GetModel().Delegation,
+	}
+}
+
+type attachmentService struct {
+	attachmentModel *models.AttachmentModel
+	delegationModel *models.DelegationModel
+}
+
+type AttachmentInfo struct {
+	ID           string `json:"id"`
+	URL          string `json:"url"`
+	ThumbnailURL string `json:"thumbnail_url,omitempty"`
+	FileName     string `json:"file_name"`
+	ContentType  string `json:"content_type"`
+	Size         int    `json:"size"`
+}
+
+func attachmentURL(attachmentID string) string {
+	return "/attachments/" + attachmentID
+}
+
+func toAttachmentInfo(attachmentID string, doc *models.AttachmentDoc) *AttachmentInfo {
+	info := &AttachmentInfo{
+		ID:          attachmentID,
+		URL:         attachmentURL(attachmentID),
+		FileName:    doc.FileName,
+		ContentType: doc.ContentType,
+		Size:        doc.Size,
+	}
+	if doc.ThumbnailKey != "" {
+		info.ThumbnailURL = attachmentURL(attachmentID) + "/thumbnail"
+	}
+	return info
+}
+
+// 上传附件
+// 文件类型通过内容判断，不信任客户端给出的类型；图片会额外生成缩略图
+func (as *attachmentService) Upload(ctx context.Context, ownerID string, purpose models.EnumAttachmentPurpose, fileName string, data []byte) *AttachmentInfo {
+	lib.Assert(purpose == models.PurposeDelegation || purpose == models.PurposeProof || purpose == models.PurposeAvatar ||
+		purpose == models.PurposeMessage, "invalid_attachment_purpose")
+	lib.Assert(len(data) > 0 && int64(len(data)) <= storageConfig.MaxSize, "invalid_attachment_size")
+	contentType := http.DetectContentType(data)
+	allowed := false
+	for _, t := range storageConfig.AllowedTypes {
+		if t == contentType {
+			allowed = true
+		}
+	}
+	lib.Assert(allowed, "invalid_attachment_type")
+
+	key := newAttachmentKey()
+	lib.AssertErr(blobStore.Put(ctx, key, data, contentType))
+	doc := &models.AttachmentDoc{
+		OwnerID:     ownerID,
+		Purpose:     purpose,
+		FileName:    path.Base(fileName),
+		ContentType: contentType,
+		Size:        len(data),
+		Key:         key,
+	}
+	if isImage(contentType) {
+		// 缩略图生成失败不影响上传
+		thumbnail, err := utils.MakeThumbnail(data, storageConfig.ThumbnailSize)
+		if err == nil && blobStore.Put(ctx, key+"_thumb", thumbnail, "image/jpeg") == nil {
+			doc.ThumbnailKey = key + "_thumb"
+		} else if err != nil {
+			lib.Log(ctx).Debug().Err(err).Str("key", key).Msg("make thumbnail failed")
+		}
+	}
+	attachmentID := as.attachmentModel.CreateAttachment(ctx, doc)
+	return toAttachmentInfo(attachmentID, doc)
+}
+
+// 获取附件内容
+// 完成凭证只有上传者和委托的发布者可以查看，聊天图片只有委托的发布者和接受者可以查看
+func (as *attachmentService) GetAttachment(ctx context.Context, viewerID, attachmentID string) (*AttachmentInfo, []byte) {
+	doc := as.getVisibleAttachment(ctx, viewerID, attachmentID)
+	data, err := blobStore.Get(ctx, doc.Key)
+	lib.AssertErr(err)
+	return toAttachmentInfo(attachmentID, doc), data
+}
+
+// 获取图片附件的缩略图
+func (as *attachmentService) GetThumbnail(ctx context.Context, viewerID, attachmentID string) []byte {
+	doc := as.getVisibleAttachment(ctx, viewerID, attachmentID)
+	lib.Assert(doc.ThumbnailKey != "", "no_such_thumbnail")
+	data, err := blobStore.Get(ctx, doc.ThumbnailKey)
+	lib.AssertErr(err)
+	return data
+}
+
+func (as *attachmentService) getVisibleAttachment(ctx context.Context, viewerID, attachmentID string) *models.AttachmentDoc {
+	doc := as.attachmentModel.GetAttachment(ctx, attachmentID)
+	lib.Assert(doc != nil, "no_such_attachment")
+	if doc.Purpose == models.PurposeProof && doc.OwnerID != viewerID {
+		lib.Assert(doc.DelegationID != "" && viewerID != "", "permission_denied")
+		delegation := as.delegationModel.GetSpecificDelegation(ctx, doc.DelegationID)
+		lib.Assert(delegation.PublisherID == viewerID, "permission_denied")
+	}
+	if doc.Purpose == models.PurposeMessage && doc.OwnerID != viewerID {
+		lib.Assert(doc.DelegationID != "" && viewerID != "", "permission_denied")
+		delegation := as.delegationModel.GetSpecificDelegation(ctx, doc.DelegationID)
+		lib.Assert(isChatMember(delegation, viewerID), "permission_denied")
+	}
+	return doc
+}
+
+func isImage(contentType string) bool {
+	return contentType == "image/jpeg" || contentType == "image/png" || contentType == "image/gif"
+}
+
+// 生成附件在存储中的 key，按照上传月份分目录
+func newAttachmentKey() string {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	lib.AssertErr(err)
+	return time.Now().Format("200601") + "/" + hex.EncodeToString(b)
+}
@@ -0,0 +1,143 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"time"
+
+	"github.com/sysu-team/Back-end-development/app/models"
+	"github.com/sysu-team/Back-end-development/lib"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// 审计日志中的操作
+const (
+	AuditLogin               = "user.login"
+	AuditRegister            = "user.register"
+	AuditAccountDelete       = "user.delete"
+	AuditDelegationCreate    = "delegation.create"
+	AuditDelegationAccept    = "delegation.accept"
+	AuditDelegationCancel    = "delegation.cancel"
+	AuditDelegationFinish    = "delegation.finish"  // 接受者完成
+	AuditDelegationConfirm   = "delegation.confirm" // 发布者确认或者自动确认
+	AuditDelegationRate      = "delegation.rate"    // 发布者为接受者评分
+	AuditQuestionnaireSubmit = "questionnaire.submit"
+	AuditCreditChange        = "credit.change"
+	AuditPaymentTopUp        = "payment.top_up"   // 充值订单支付成功
+	AuditWithdrawalRequest   = "payment.withdraw" // 申请提现
+	AuditWithdrawalTransfer  = "payment.transfer" // 提现转账成功或者失败
+	AuditShopRedeem          = "shop.redeem"
+	AuditAdminUserStatus     = "admin.user_status"
+	AuditAdminVerifyUser     = "admin.verify_user"
+	AuditAdminImportRoster   = "admin.import_roster"
+	AuditAdminSaveCategory   = "admin.save_category"
+	AuditAdminDelegation     = "admin.delegation" // 命令行中直接修改委托
+	AuditAdminWithdrawal     = "admin.withdrawal" // 审核提现申请
+	AuditAdminShopItem       = "admin.shop_item"  // 创建或者修改商品
+	AuditAdminRedemptionUse  = "admin.redemption_use"
+)
+
+// 后台任务和命令行的操作者
+const AuditSystemActor = "system"
+
+// AuditService 审计日志
+type AuditService interface {
+	QueryAuditLog(ctx context.Context, page, limit int, query *models.AuditQuery) []AuditEntry
+}
+
+func NewAuditService() AuditService {
+	return &auditService{
+		models.GetModel().Audit,
+	}
+}
+
+type auditService struct {
+	auditModel *models.AuditModel
+}
+
+// 审计日志的一条记录
+type AuditEntry struct {
+	ID        string          `json:"id"`
+	Action    string          `json:"action"`
+	ActorID   string          `json:"actor_id"`
+	IP        string          `json:"ip"`
+	RequestID string          `json:"request_id"`
+	TargetID  string          `json:"target_id"`
+	Before    json.RawMessage `json:"before,omitempty"` // 操作之前的快照
+	After     json.RawMessage `json:"after,omitempty"`  // 操作之后的快照
+	CreatedAt int64           `json:"created_at"`       // Unix时间戳
+}
+
+// 查询审计日志，从新到旧
+func (s *auditService) QueryAuditLog(ctx context.Context, page, limit int, query *models.AuditQuery) []AuditEntry {
+	docs := s.auditModel.Query(ctx, int64(page), int64(limit), query)
+	res := make([]AuditEntry, 0, len(docs))
+	for _, doc := range docs {
+		res = append(res, AuditEntry{
+			ID:        doc.ID.Hex(),
+			Action:    doc.Action,
+			ActorID:   doc.ActorID,
+			IP:        doc.IP,
+			RequestID: doc.RequestID,
+			TargetID:  doc.TargetID,
+			Before:    snapshotJSON(doc.Before),
+			After:     snapshotJSON(doc.After),
+			CreatedAt: doc.CreatedAt.Unix(),
+		})
+	}
+	return res
+}
+
+// 快照转换为 JSON，没有快照时返回 nil
+func snapshotJSON(raw bson.Raw) json.RawMessage {
+	if len(raw) == 0 {
+		return nil
+	}
+	b, err := bson.MarshalExtJSON(raw, false, false)
+	lib.AssertErr(err)
+	return b
+}
+
+// 记录一条审计日志，IP 和请求 id 从 ctx 中获取
+// before 和 after 为操作前后的快照，可以为 nil，需要是结构体或者 bson.D
+// 操作已经完成，写入失败时只记录错误日志
+func recordAudit(ctx context.Context, actorID, action, targetID string, before, after interface{}) {
+	info := lib.RequestInfoFrom(ctx)
+	doc := &models.AuditDoc{
+		Action:    action,
+		ActorID:   actorID,
+		IP:        info.IP,
+		RequestID: info.ID,
+		TargetID:  targetID,
+		Before:    snapshot(ctx, before),
+		After:     snapshot(ctx, after),
+		CreatedAt: time.Now(),
+	}
+	if err := models.GetModel().Audit.Insert(ctx, doc); err != nil {
+		lib.Log(ctx).Error().Err(err).Str("action", action).Str("target_id", targetID).Msg("write audit log")
+	}
+}
+
+// 请求中登录的用户，用于管理员的操作；命令行等没有请求时为 system
+func auditActor(ctx context.Context) string {
+	if id := lib.RequestInfoFrom(ctx).UserID; id != "" {
+		return id
+	}
+	return AuditSystemActor
+}
+
+func snapshot(ctx context.Context, v interface{}) bson.Raw {
+	if v == nil {
+		return nil
+	}
+	if rv := reflect.ValueOf(v); rv.Kind() == reflect.Ptr && rv.IsNil() {
+		return nil
+	}
+	b, err := bson.Marshal(v)
+	if err != nil {
+		lib.Log(ctx).Error().Err(err).Msg("marshal audit snapshot")
+		return nil
+	}
+	return b
+}
@@ -0,0 +1,161 @@
+package services
+
+import (
+	"context"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/rs/zerolog/log"
+	"github.com/sysu-team/Back-end-development/app/models"
+	"github.com/sysu-team/Back-end-development/lib"
+)
+
+// 委托类型的特殊处理
+const (
+	HandlerDefault       = ""
+	HandlerQuestionnaire = "questionnaire"
+)
+
+// 可以被设置为必填的字段
+const (
+	FieldDescription   = "description"
+	FieldPickup        = "pickup"
+	FieldDropoff       = "dropoff"
+	FieldArea          = "area"
+	FieldAttachments   = "attachments"
+	FieldQuestionnaire = "questionnaire"
+)
+
+var requirableFields = []string{FieldDescription, FieldPickup, FieldDropoff, FieldArea, FieldAttachments, FieldQuestionnaire}
+
+// 数据库中没有委托类型时使用的默认类型
+var defaultCategories = []models.CategoryDoc{
+	{Key: "errand", Name: "跑腿代取", Icon: "errand", RequiredFields: []string{FieldDescription, FieldPickup},
+		MinReward: 1, MaxReward: 100, Order: 1, Enabled: true},
+	{Key: "purchase", Name: "代购", Icon: "purchase", RequiredFields: []string{FieldDescription},
+		MinReward: 1, MaxReward: 200, Order: 2, Enabled: true},
+	{Key: "questionnaire", Name: "填写问卷", Icon: "questionnaire", RequiredFields: []string{FieldQuestionnaire},
+		MinReward: 1, MaxReward: 20, Handler: HandlerQuestionnaire, Order: 3, Enabled: true},
+	{Key: "tutoring", Name: "学业辅导", Icon: "tutoring", RequiredFields: []string{FieldDescription},
+		MinReward: 1, MaxReward: 500, Order: 4, Enabled: true},
+	{Key: "other", Name: "其他", Icon: "other", RequiredFields: []string{FieldDescription},
+		MinReward: 1, Order: 5, Enabled: true},
+}
+
+// CategoryService 委托类型逻辑
+type CategoryService interface {
+	InitCategories(ctx context.Context)
+	GetCategories(ctx context.Context, includeDisabled bool) []models.CategoryDoc
+	SaveCategory(ctx context.Context, doc *models.CategoryDoc)
+}
+
+func NewCategoryService() CategoryService {
+	return &categoryService{
+		models.GetModel().Category,
+	}
+}
+
+type categoryService struct {
+	categoryModel *models.CategoryModel
+}
+
+// 没有任何委托类型时写入默认类型
+func (cs *categoryService) InitCategories(ctx context.Context) {
+	if cs.categoryModel.CountCategories(ctx) != 0 {
+		return
+	}
+	for i := range defaultCategories {
+		cs.categoryModel.SaveCategory(ctx, &defaultCategories[i])
+	}
+	log.Info().Msg("Init default delegation categories")
+}
+
+// 获取委托类型列表
+func (cs *categoryService) GetCategories(ctx context.Context, includeDisabled bool) []models.CategoryDoc {
+	return cs.categoryModel.GetCategories(ctx, !includeDisabled)
+}
+
+// 创建或者修改委托类型
+func (cs *categoryService) SaveCategory(ctx context.Context, doc *models.CategoryDoc) {
+	doc.Key = strings.TrimSpace(doc.Key)
+	lib.Assert(doc.Key != "" && utf8.RuneCountInString(doc.Key) <= 32, "invalid_category_key")
+	lib.Assert(strings.TrimSpace(doc.Name) != "", "invalid_category_name")
+	lib.Assert(doc.MinReward >= 0 && (doc.MaxReward == 0 || doc.MaxReward >= doc.MinReward), "invalid_category_reward")
+	lib.Assert(doc.Handler == HandlerDefault || doc.Handler == HandlerQuestionnaire, "invalid_category_handler")
+	for _, field := range doc.RequiredFields {
+		lib.Assert(containsString(requirableFields, field), "invalid_category_required_field")
+	}
+	if doc.RequiredFields == nil {
+		doc.RequiredFields = []string{}
+	}
+	before := cs.categoryModel.GetCategory(ctx, doc.Key)
+	cs.categoryModel.SaveCategory(ctx, doc)
+	recordAudit(ctx, auditActor(ctx), AuditAdminSaveCategory, doc.Key, before, doc)
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// 检查发布的委托满足类型的要求
+func assertCategoryRequirements(category *models.CategoryDoc, info *DelegationInfoReq) {
+	lib.Assert(category.Enabled, "invalid_delegation_type")
+	lib.Assert(info.Reward >= category.MinReward && (category.MaxReward == 0 || info.Reward <= category.MaxReward),
+		"reward_out_of_category_range")
+	for _, field := range category.RequiredFields {
+		var present bool
+		switch field {
+		case FieldDescription:
+			present = strings.TrimSpace(info.Description) != ""
+		case FieldPickup:
+			present = info.Pickup != nil
+		case FieldDropoff:
+			present = info.Dropoff != nil
+		case FieldArea:
+			present = info.Area != ""
+		case FieldAttachments:
+			present = len(info.Attachments) != 0
+		case FieldQuestionnaire:
+			present = info.Questionnaire != nil
+		default:
+			present = true
+		}
+		lib.Assert(present, "missing_required_field")
+	}
+}
+
+// 不同类型委托的处理
+type categoryHandler interface {
+	// 创建委托之前调用，可以修改将要保存的委托
+	BeforeCreate(ctx context.Context, info *DelegationInfoReq, doc *models.DelegationDoc)
+}
+
+func (ds *delegationService) categoryHandler(category *models.CategoryDoc) categoryHandler {
+	switch category.Handler {
+	case HandlerQuestionnaire:
+		return &questionnaireHandler{ds.questionnaireModel}
+	default:
+		return &defaultHandler{}
+	}
+}
+
+// 没有特殊处理的类型
+type defaultHandler struct{}
+
+func (h *defaultHandler) BeforeCreate(ctx context.Context, info *DelegationInfoReq, doc *models.DelegationDoc) {
+}
+
+// 填写问卷，发布时创建问卷
+type questionnaireHandler struct {
+	questionnaireModel *models.QuestionnaireModel
+}
+
+func (h *questionnaireHandler) BeforeCreate(ctx context.Context, info *DelegationInfoReq, doc *models.DelegationDoc) {
+	lib.Assert(info.Questionnaire != nil, "missing_required_field")
+	doc.QuestionnaireID = h.questionnaireModel.CreateNewQuestionnaire(ctx, info.Questionnaire)
+}
@@ -0,0 +1,197 @@
+package services
+
+import (
+	"context"
+	"time"
+
+	"github.com/sysu-team/Back-end-development/app/configs"
+	"github.com/sysu-team/Back-end-development/app/models"
+	"github.com/sysu-team/Back-end-development/lib"
+)
+
+// 积分变化的原因，记录在审计日志中
+const (
+	CreditSignup          = "signup"
+	CreditDelegation      = "delegation" // 发布、接受委托时冻结，完成、取消时发放或者返还
+	CreditRefund          = "refund"     // 冻结之后操作失败，返还冻结的积分
+	CreditCheckIn         = "check_in"
+	CreditFirstCompletion = "first_completion"
+	CreditDecay           = "decay"
+	CreditTopUp           = "top_up"
+	CreditWithdrawal      = "withdrawal" // 申请提现时冻结，拒绝或者转账失败时返还
+	CreditRedeem          = "redeem"     // 在积分商城兑换商品
+)
+
+// 积分规则，InitCredit 之前注册送 100 积分，没有其他规则
+var creditPolicy = configs.CreditConfig{SignupBonus: 100}
+
+// InitCredit 根据配置初始化积分规则
+func InitCredit(config *configs.CreditConfig) {
+	creditPolicy = *config
+}
+
+// CreditService 积分逻辑，所有积分的变化都经过这里并记录在审计日志中
+type CreditService interface {
+	// 是否可以花费 amount 积分，花费之后余额不能低于 min_balance
+	CanSpend(user *models.UserDoc, amount int) bool
+	// 花费积分，余额不足时返回错误 key
+	Spend(ctx context.Context, actorID, openid string, amount int, delegationID, key string)
+	// 增加积分
+	Grant(ctx context.Context, actorID, openid string, amount int, delegationID, reason string)
+	// 充值和提现的积分变化，orderNo 为充值订单或者提现申请的单号
+	SpendForOrder(ctx context.Context, actorID, openid string, amount int, orderNo, reason, key string)
+	GrantForOrder(ctx context.Context, actorID, openid string, amount int, orderNo, reason string)
+	GrantSignupBonus(ctx context.Context, openid string)
+	AwardFirstCompletion(ctx context.Context, actorID, openid, delegationID string)
+	CheckIn(ctx context.Context, openid string) *CheckInResult
+	// 衰减长期不活跃的用户的积分，由后台任务调用，返回衰减的用户数
+	Decay(ctx context.Context) int
+}
+
+func NewCreditService() CreditService {
+	return &creditService{
+		models.GetModel().User,
+	}
+}
+
+type creditService struct {
+	userModel *models.UserModel
+}
+
+// 积分变化的快照
+type creditSnapshot struct {
+	Credit       int    `bson:"credit"`
+	Reason       string `bson:"reason,omitempty"`
+	DelegationID string `bson:"delegation_id,omitempty"` // 引起积分变化的委托
+	OrderNo      string `bson:"order_no,omitempty"`      // 引起积分变化的充值订单或者提现申请
+}
+
+// 记录积分变化，after 中只需要填写原因和引起变化的委托或者订单
+func auditCredit(ctx context.Context, actorID, openid string, newCredit, delta int, after creditSnapshot) {
+	after.Credit = newCredit
+	recordAudit(ctx, actorID, AuditCreditChange, openid, creditSnapshot{Credit: newCredit - delta}, after)
+}
+
+func (s *creditService) CanSpend(user *models.UserDoc, amount int) bool {
+	return user.Credit-amount >= creditPolicy.MinBalance
+}
+
+func (s *creditService) Spend(ctx context.Context, actorID, openid string, amount int, delegationID, key string) {
+	s.spend(ctx, actorID, openid, amount, key, creditSnapshot{Reason: CreditDelegation, DelegationID: delegationID})
+}
+
+func (s *creditService) Grant(ctx context.Context, actorID, openid string, amount int, delegationID, reason string) {
+	s.grant(ctx, actorID, openid, amount, creditSnapshot{Reason: reason, DelegationID: delegationID})
+}
+
+func (s *creditService) SpendForOrder(ctx context.Context, actorID, openid string, amount int, orderNo, reason, key string) {
+	s.spend(ctx, actorID, openid, amount, key, creditSnapshot{Reason: reason, OrderNo: orderNo})
+}
+
+// 同一个单号只发放一次，重复调用时不做任何修改
+func (s *creditService) GrantForOrder(ctx context.Context, actorID, openid string, amount int, orderNo, reason string) {
+	if amount == 0 {
+		return
+	}
+	newCredit, ok := s.userModel.AddCreditForOrder(ctx, openid, amount, orderNo)
+	if !ok {
+		lib.Assert(s.userModel.GetUserByOpenID(ctx, openid) != nil, "no_such_user")
+		lib.Log(ctx).Info().Str("order_no", orderNo).Msg("credit already granted for order")
+		return
+	}
+	auditCredit(ctx, actorID, openid, newCredit, amount, creditSnapshot{Reason: reason, OrderNo: orderNo})
+}
+
+func (s *creditService) spend(ctx context.Context, actorID, openid string, amount int, key string, after creditSnapshot) {
+	newCredit, ok := s.userModel.AddCredit(ctx, openid, -amount, creditPolicy.MinBalance)
+	lib.Assert(ok, key)
+	auditCredit(ctx, actorID, openid, newCredit, -amount, after)
+}
+
+func (s *creditService) grant(ctx context.Context, actorID, openid string, amount int, after creditSnapshot) {
+	if amount == 0 {
+		return
+	}
+	newCredit, ok := s.userModel.AddCredit(ctx, openid, amount, 0)
+	lib.Assert(ok, "no_such_user")
+	auditCredit(ctx, actorID, openid, newCredit, amount, after)
+}
+
+// 注册奖励
+func (s *creditService) GrantSignupBonus(ctx context.Context, openid string) {
+	s.Grant(ctx, openid, openid, creditPolicy.SignupBonus, "", CreditSignup)
+}
+
+// 接受者第一次完成委托时的额外奖励，每个用户只发放一次
+func (s *creditService) AwardFirstCompletion(ctx context.Context, actorID, openid, delegationID string) {
+	if creditPolicy.FirstCompletionBonus <= 0 || !s.userModel.MarkFirstCompleted(ctx, openid) {
+		return
+	}
+	s.Grant(ctx, actorID, openid, creditPolicy.FirstCompletionBonus, delegationID, CreditFirstCompletion)
+}
+
+// 签到的结果
+type CheckInResult struct {
+	Reward int `json:"reward"`
+	Streak int `json:"streak"` // 连续签到的天数
+	Credit int `json:"credit"` // 签到后的积分
+}
+
+const checkInDayLayout = "2006-01-02"
+
+// 每日签到，按照服务器的时区计算日期
+// 连续签到每多一天额外奖励 streak_bonus，最多按照 max_streak 天计算
+func (s *creditService) CheckIn(ctx context.Context, openid string) *CheckInResult {
+	lib.Assert(creditPolicy.CheckIn.Reward > 0, "check_in_disabled")
+	user := s.userModel.GetUserByOpenID(ctx, openid)
+	lib.Assert(user != nil, "no_such_user")
+	now := time.Now()
+	today := now.Format(checkInDayLayout)
+	lib.Assert(user.CheckInDay != today, "already_checked_in")
+	streak := 1
+	if user.CheckInDay == now.AddDate(0, 0, -1).Format(checkInDayLayout) {
+		streak = user.CheckInStreak + 1
+	}
+	bonusDays := streak - 1
+	if bonusDays > creditPolicy.CheckIn.MaxStreak {
+		bonusDays = creditPolicy.CheckIn.MaxStreak
+	}
+	reward := creditPolicy.CheckIn.Reward + bonusDays*creditPolicy.CheckIn.StreakBonus
+	// 并发签到时只有一个请求成功，签到和奖励同时生效
+	newCredit, ok := s.userModel.CheckIn(ctx, openid, user.CheckInDay, today, streak, reward)
+	lib.Assert(ok, "already_checked_in")
+	auditCredit(ctx, openid, openid, newCredit, reward, creditSnapshot{Reason: CreditCheckIn})
+	return &CheckInResult{reward, streak, newCredit}
+}
+
+// 每轮衰减的用户数量上限，剩下的在下一轮处理
+const decayBatch = 100
+
+// 超过 inactive_days 天没有活跃的用户，每天扣除高于 min_balance 部分的 percent%，至少 1 分
+func (s *creditService) Decay(ctx context.Context) int {
+	decay := creditPolicy.Decay
+	if decay.InactiveDays <= 0 || decay.Percent <= 0 {
+		return 0
+	}
+	now := time.Now()
+	users := s.userModel.GetDecayCandidates(ctx,
+		now.AddDate(0, 0, -decay.InactiveDays).Unix(), now.Add(-24*time.Hour).Unix(), creditPolicy.MinBalance, decayBatch)
+	n := 0
+	for _, user := range users {
+		if ctx.Err() != nil {
+			break
+		}
+		amount := (user.Credit - creditPolicy.MinBalance) * decay.Percent / 100
+		if amount < 1 {
+			amount = 1
+		}
+		newCredit, ok := s.userModel.DecayCredit(ctx, user.OpenID, -amount, creditPolicy.MinBalance)
+		if !ok {
+			// 积分在这期间被花费，下一轮重新计算
+			continue
+		}
+		auditCredit(ctx, AuditSystemActor, user.OpenID, newCredit, -amount, creditSnapshot{Reason: CreditDecay})
+		n++
+	}
+	return n
+}
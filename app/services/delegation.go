@@ -1,6 +1,7 @@
 package services
 
 import (
+	"context"
 	//"fmt"
 	"time"
 
@@ -11,12 +12,17 @@ import (
 
 // DelegationService 用户逻辑
 type DelegationService interface {
-	GetDelegationPreview(page, limit, state int) []models.DelegationPreviewWrapper
-	GetSpecificDelegation(delegationID string) *DelegationInfoWrapper
-	CreateDelegation(info *DelegationInfoReq)
-	ReceiveDelegation(receiverID, delegationID string)
-	CancelDelegation(cancelerID, delegationID string)
-	FinishDelegation(finisherID, delegationID string)
+	GetDelegationPreview(ctx context.Context, page, limit int, query *models.DelegationQuery) []models.DelegationPreviewWrapper
+	GetSpecificDelegation(ctx context.Context, delegationID string) *DelegationInfoWrapper
+	CreateDelegation(ctx context.Context, info *DelegationInfoReq)
+	ReceiveDelegation(ctx context.Context, receiverID, delegationID string)
+	CancelDelegation(ctx context.Context, cancelerID, delegationID string)
+	FinishDelegation(ctx context.Context, finisherID, delegationID string, proofs []string)
+	// 发布者为已经完成的委托的接受者评分，用于排行榜
+	RateReceiver(ctx context.Context, publisherID, delegationID, receiverID string, score int)
+	AutoConfirm(ctx context.Context) int
+	// 直接修改委托的状态，不会调整积分，只用于修复数据
+	SetDelegationState(ctx context.Context, delegationID string, state models.EnumDelegationState)
 }
 
 func NewDelegationService() DelegationService {
@@ -24,6 +30,9 @@ func NewDelegationService() DelegationService {
 		models.GetModel().Delegation,
 		models.GetModel().User,
 		models.GetModel().Questionnaire,
+		models.GetModel().Attachment,
+		models.GetModel().Category,
+		NewCreditService(),
 	}
 }
 
@@ -31,10 +40,13 @@ type delegationService struct {
 	delegationModel    *models.DelegationModel
 	userModel          *models.UserModel
 	questionnaireModel *models.QuestionnaireModel
+	attachmentModel    *models.AttachmentModel
+	categoryModel      *models.CategoryModel
+	credit             CreditService
 }
 
-func (ds *delegationService) GetDelegationPreview(page, limit, state int) []models.DelegationPreviewWrapper {
-	return ds.delegationModel.GetDelegationPreviewByState(int64(page), int64(limit), state)
+func (ds *delegationService) GetDelegationPreview(ctx context.Context, page, limit int, query *models.DelegationQuery) []models.DelegationPreviewWrapper {
+	return ds.delegationModel.GetDelegationPreview(ctx, int64(page), int64(limit), query)
 }
 
 type DelegationInfoWrapper struct {
@@ -43,15 +55,15 @@ type DelegationInfoWrapper struct {
 	ReceiverName  string
 }
 
-func (ds *delegationService) GetSpecificDelegation(delegationID string) *DelegationInfoWrapper {
-	doc := ds.delegationModel.GetSpecificDelegation(delegationID)
+func (ds *delegationService) GetSpecificDelegation(ctx context.Context, delegationID string) *DelegationInfoWrapper {
+	doc := ds.delegationModel.GetSpecificDelegation(ctx, delegationID)
 	receiverName := ""
 	if len(doc.ReceiverID) != 0 {
-		receiverName = ds.userModel.GetUserByOpenID(doc.ReceiverID[0]).Name
+		receiverName = ds.userModel.GetUserByOpenID(ctx, doc.ReceiverID[0]).Name
 	}
 	return &DelegationInfoWrapper{
 		*doc,
-		ds.userModel.GetUserByOpenID(doc.PublisherID).Name,
+		ds.userModel.GetUserByOpenID(ctx, doc.PublisherID).Name,
 		receiverName,
 	}
 }
@@ -59,154 +71,379 @@ func (ds *delegationService) GetSpecificDelegation(delegationID string) *Delegat
 //// info
 type DelegationInfoReq struct {
 	Publisher     string                   `json:"publisher"`
-	Name          string                   `json:"name"`
-	Description   string                   `json:"description"`
-	Reward        int                      `json:"reward"`
-	Deadline      int64                    `json:"deadline"`
-	Type          string                   `json:"type"`
-	MaxNumber     int                      `json:"max_number"`
+	Name          string                   `json:"name" validate:"required,max=50"`
+	Description   string                   `json:"description" validate:"max=1000"`
+	Reward        int                      `json:"reward" validate:"positive"`
+	Deadline      int64                    `json:"deadline" validate:"future"`
+	Type          string                   `json:"type" validate:"required"` // 委托类型的标识，兼容类型的名字
+	MaxNumber     int                      `json:"max_number" validate:"positive,max=100"`
 	Questionnaire *models.QuestionnaireDoc `json:"questionnaire"`
+	Attachments   []string                 `json:"attachments" validate:"max=9,dive,objectid"` // 已经上传的附件 id
+	Pickup        *LocationReq             `json:"pickup"`                                     // 取件地点，可选
+	Dropoff       *LocationReq             `json:"dropoff"`                                    // 送达地点，可选
+	Area          string                   `json:"area" validate:"max=50"`                     // 校园区域的名字，可选
 }
 
-// todo: 基本的检查
-func (ds *delegationService) CreateDelegation(info *DelegationInfoReq) {
+// 经纬度坐标
+type LocationReq struct {
+	Lat float64 `json:"lat" validate:"min=-90,max=90"`
+	Lng float64 `json:"lng" validate:"min=-180,max=180"`
+}
+
+// 检查坐标合法并转换成 GeoJSON 坐标点，nil 代表没有填写
+func (l *LocationReq) toGeoPoint() *models.GeoPoint {
+	if l == nil {
+		return nil
+	}
+	lib.Assert(IsValidLocation(l.Lat, l.Lng), "invalid_location")
+	return models.NewGeoPoint(l.Lat, l.Lng)
+}
+
+// 判断经纬度是否在合法范围内
+func IsValidLocation(lat, lng float64) bool {
+	return lat >= -90 && lat <= 90 && lng >= -180 && lng <= 180
+}
+
+// 请求的参数在 controller 中已经检查过
+func (ds *delegationService) CreateDelegation(ctx context.Context, info *DelegationInfoReq) {
 	// 检查积分是否满足要求
-	publisher := ds.userModel.GetUserByOpenID(info.Publisher)
-	newCredit := publisher.Credit - info.MaxNumber*info.Reward
-	lib.Assert(newCredit >= 0, "no_enough_credit_to_create_delegation", 401)
-	var qid string
-	if info.Type == "填写问卷" {
-		qid = ds.questionnaireModel.CreateNewQuestionnaire(info.Questionnaire)
+	publisher := ds.userModel.GetUserByOpenID(ctx, info.Publisher)
+	lib.Assert(publisher != nil, "unregister_user")
+	assertUserActive(ctx, ds.userModel, publisher)
+	assertUserVerified(publisher)
+	assertOpenDelegationQuota(ctx, ds.delegationModel, info.Publisher)
+	cost := info.MaxNumber * info.Reward
+	lib.Assert(ds.credit.CanSpend(publisher, cost), "no_enough_credit_to_create_delegation")
+	// 检查委托类型的要求
+	category := ds.categoryModel.GetCategory(ctx, info.Type)
+	lib.Assert(category != nil, "invalid_delegation_type")
+	info.Attachments = uniqueStrings(info.Attachments)
+	assertCategoryRequirements(category, info)
+	ds.assertAttachmentsLinkable(ctx, info.Attachments, info.Publisher, models.PurposeDelegation)
+	doc := &models.DelegationDoc{
+		PublisherID:    info.Publisher,
+		DelegationName: info.Name,
+		Description:    info.Description,
+		Reward:         info.Reward,
+		Deadline:       info.Deadline,
+		DelegationType: category.Key,
+		MaxNumber:      info.MaxNumber,
+		Attachments:    info.Attachments,
+		Pickup:         info.Pickup.toGeoPoint(),
+		Dropoff:        info.Dropoff.toGeoPoint(),
+		Area:           info.Area,
 	}
-	ds.delegationModel.CreateNewDelegation(
-		info.Publisher,
-		info.Name,
-		info.Description,
-		info.Reward,
-		info.Deadline,
-		info.Type,
-		qid,
-		info.MaxNumber,
-	)
-	ds.userModel.SetCreditByOpenID(info.Publisher, newCredit)
+	// 不同类型的委托的特殊处理，例如创建问卷
+	ds.categoryHandler(category).BeforeCreate(ctx, info, doc)
+	// 先冻结积分再创建委托，创建失败时返还
+	// 冻结之后的操作不随请求取消，客户端断开时也要创建或者返还
+	ctx, cancel := lib.Detach(ctx)
+	defer cancel()
+	ds.credit.Spend(ctx, info.Publisher, info.Publisher, cost, "", "no_enough_credit_to_create_delegation")
+	did := ""
+	defer func() {
+		if did == "" {
+			ds.credit.Grant(ctx, info.Publisher, info.Publisher, cost, "", CreditRefund)
+		}
+	}()
+	did = ds.delegationModel.CreateNewDelegation(ctx, doc)
+	if len(info.Attachments) != 0 {
+		ds.attachmentModel.LinkToDelegation(ctx, info.Attachments, info.Publisher, models.PurposeDelegation, did)
+	}
+	recordAudit(ctx, info.Publisher, AuditDelegationCreate, did, nil, doc)
 }
 
-//  接受委托
-func (ds *delegationService) ReceiveDelegation(receiverID, delegationID string) {
-	// 判断委托接收者是否合法的, 委托和接收者不能是同一个人
-	delegation := ds.GetSpecificDelegation(delegationID)
-	lib.Assert(delegation.PublisherID != receiverID, "invalid_receiver_same_as_publisher", 401)
-	for _, tempReceiverID := range delegation.ReceiverID {
-		lib.Assert(tempReceiverID != receiverID, "invalid_delegation_already_receive", 402)
+// 记录委托的操作，after 为修改之后重新读取的委托
+func (ds *delegationService) auditDelegation(ctx context.Context, actorID, action, delegationID string, before *DelegationInfoWrapper) {
+	recordAudit(ctx, actorID, action, delegationID, &before.DelegationDoc, ds.delegationModel.GetSpecificDelegation(ctx, delegationID))
+}
+
+// 检查附件都是由该用户上传的，并且还没有关联到其他委托
+func (ds *delegationService) assertAttachmentsLinkable(ctx context.Context, attachmentIDs []string, ownerID string, purpose models.EnumAttachmentPurpose) {
+	if len(attachmentIDs) == 0 {
+		return
 	}
-	lib.Assert(delegation.DelegationState == 0, "invalid_delegation_already_received", 402)
-	lib.Assert(delegation.Deadline > time.Now().Unix(), "invalid_delegation_timeout", 403)
-	// 计算是否有足够的积分进行接受时的预冻结，不够则报错
-	receiver := ds.userModel.GetUserByOpenID(receiverID)
-	newCredit := receiver.Credit - delegation.Reward
-	lib.Assert(newCredit >= 0, "not_enough_credit_to_receive", 403)
-	var newState uint8
-	if delegation.CurrentNumber == delegation.MaxNumber-1 {
-		newState = 1
+	lib.Assert(ds.attachmentModel.CountLinkable(ctx, attachmentIDs, ownerID, purpose) == len(attachmentIDs), "invalid_attachments")
+}
+
+// 去掉重复的元素，保持原来的顺序
+func uniqueStrings(values []string) []string {
+	seen := make(map[string]bool, len(values))
+	res := make([]string, 0, len(values))
+	for _, v := range values {
+		if !seen[v] {
+			seen[v] = true
+			res = append(res, v)
+		}
 	}
-	ds.delegationModel.ReceiveDelegation(delegationID, receiverID, newState)
-	ds.userModel.SetCreditByOpenID(receiverID, newCredit)
+	return res
+}
+
+// 委托被并发修改时重试的次数
+const conflictRetries = 3
+
+// 执行读取委托、检查并条件更新委托的 fn
+// 委托在读取之后被其他请求修改时重新执行，一直冲突时返回 delegation_conflict
+func retryOnConflict(fn func() error) {
+	for i := 0; i < conflictRetries; i++ {
+		if err := fn(); err != models.ErrConflict {
+			lib.AssertErr(err)
+			return
+		}
+	}
+	lib.Assert(false, "delegation_conflict")
+}
+
+//  接受委托
+func (ds *delegationService) ReceiveDelegation(ctx context.Context, receiverID, delegationID string) {
+	// 判断委托接收者是否合法的, 委托和接收者不能是同一个人
+	receiver := ds.userModel.GetUserByOpenID(ctx, receiverID)
+	lib.Assert(receiver != nil, "unregister_user")
+	assertUserActive(ctx, ds.userModel, receiver)
+	assertUserVerified(receiver)
+	quotaTaken := false
+	retryOnConflict(func() error {
+		delegation := ds.GetSpecificDelegation(ctx, delegationID)
+		lib.Assert(delegation.PublisherID != receiverID, "invalid_receiver_same_as_publisher")
+		for _, tempReceiverID := range delegation.ReceiverID {
+			lib.Assert(tempReceiverID != receiverID, "invalid_delegation_already_received")
+		}
+		lib.Assert(delegation.DelegationState == 0, "invalid_delegation_already_received")
+		lib.Assert(delegation.Deadline > time.Now().Unix(), "invalid_delegation_timeout")
+		// 计算是否有足够的积分进行接受时的预冻结，不够则报错
+		lib.Assert(ds.credit.CanSpend(receiver, delegation.Reward), "not_enough_credit_to_receive")
+		// 重试时不重复扣除配额
+		if !quotaTaken {
+			takeAcceptQuota(ctx, receiverID)
+			quotaTaken = true
+		}
+		var newState uint8
+		if delegation.CurrentNumber == delegation.MaxNumber-1 {
+			newState = 1
+		}
+		// 先冻结积分，接受失败时返还，冻结之后的操作不随请求取消
+		ctx, cancel := lib.Detach(ctx)
+		defer cancel()
+		ds.credit.Spend(ctx, receiverID, receiverID, delegation.Reward, delegationID, "not_enough_credit_to_receive")
+		if err := ds.delegationModel.ReceiveDelegation(ctx, delegationID, delegation.Expected(), receiverID, newState); err != nil {
+			ds.credit.Grant(ctx, receiverID, receiverID, delegation.Reward, delegationID, CreditRefund)
+			return err
+		}
+		ds.auditDelegation(ctx, receiverID, AuditDelegationAccept, delegationID, delegation)
+		return nil
+	})
 }
 
 // 判断这个委托是否处于活跃状态
 // 没有被接受 + 没有过期
-func (ds *delegationService) isActiveDelegation(delegationID string) bool {
-	delegation := ds.GetSpecificDelegation(delegationID)
+func (ds *delegationService) isActiveDelegation(ctx context.Context, delegationID string) bool {
+	delegation := ds.GetSpecificDelegation(ctx, delegationID)
 	return delegation.Deadline < time.Now().Unix() && delegation.CurrentNumber < delegation.MaxNumber
 }
 
 // 取消委托
-func (ds *delegationService) CancelDelegation(cancelerID, delegationID string) {
-	// 先检查该用户是否有资格取消该委托
-	// 对于委托的发布者，可以取消
-	// 对于委托的接受者，可以放弃
-	delegation := ds.GetSpecificDelegation(delegationID)
-	flag := 0
-	for _, tempReceiverID := range delegation.ReceiverID {
-		if tempReceiverID == cancelerID {
-			flag = 1
+// 先条件更新委托，成功之后再返还积分，避免并发的取消和确认重复返还
+func (ds *delegationService) CancelDelegation(ctx context.Context, cancelerID, delegationID string) {
+	retryOnConflict(func() error {
+		// 先检查该用户是否有资格取消该委托
+		// 对于委托的发布者，可以取消
+		// 对于委托的接受者，可以放弃
+		delegation := ds.GetSpecificDelegation(ctx, delegationID)
+		flag := 0
+		for _, tempReceiverID := range delegation.ReceiverID {
+			if tempReceiverID == cancelerID {
+				flag = 1
+			}
+		}
+		lib.Assert(delegation.PublisherID == cancelerID || flag == 1, "invalid_canceler_not_publisher_or_receiver")
+		// 检查该委托是否能被取消
+		lib.Assert(delegation.DelegationState == 0 || delegation.DelegationState == 1, "invalid_delegation_state_cannot_be_canceled")
+		// 修改状态之后的返还不随请求取消
+		ctx, cancel := lib.Detach(ctx)
+		defer cancel()
+		// 还没有被接受，所有名额预冻结的积分返还发布者
+		var newState uint8 = 2
+		if delegation.CurrentNumber == 0 {
+			if err := ds.delegationModel.SetDelegationState(ctx, delegationID, delegation.Expected(), newState); err != nil {
+				return err
+			}
+			ds.credit.Grant(ctx, cancelerID, delegation.PublisherID, unfilledReward(&delegation.DelegationDoc), delegationID, CreditDelegation)
+			ds.auditDelegation(ctx, cancelerID, AuditDelegationCancel, delegationID, delegation)
+			return nil
 		}
-	}
-	lib.Assert(delegation.PublisherID == cancelerID || flag == 1, "invalid_canceler_not_cancelled_by_pulisher_or_receiver")
-	// 检查该委托是否能被取消
-	lib.Assert(delegation.DelegationState == 0 || delegation.DelegationState == 1, "invalid_delegation_state_cannot_be_canceled", 402)
-	publisher := ds.userModel.GetUserByOpenID(delegation.PublisherID)
-	// 还没有被接受，预冻结的积分返还发布者
-	var newState uint8 = 2
-	if delegation.CurrentNumber == 0 {
-		ds.userModel.SetCreditByOpenID(publisher.OpenID, publisher.Credit+delegation.Reward)
-		ds.delegationModel.SetDelegationState(delegationID, newState)
-	} else {
 		// 已接受后，取消方损失所有的预冻结积分，被取消方获得双方预冻结的所有积分
+		// 发布者取消时没有被接受的名额预冻结的积分返还发布者
 		if delegation.PublisherID == cancelerID {
-			for _, tempReceiverID := range delegation.ReceiverID {
-				receiver := ds.userModel.GetUserByOpenID(tempReceiverID)
-				ds.userModel.SetCreditByOpenID(tempReceiverID, receiver.Credit+2*delegation.Reward)
-				ds.delegationModel.DeleteReceiver(delegationID, tempReceiverID, newState)
+			if err := ds.delegationModel.DeleteReceiver(ctx, delegationID, delegation.Expected(), newState, delegation.ReceiverID...); err != nil {
+				return err
 			}
-		} else {
-			ds.userModel.SetCreditByOpenID(publisher.OpenID, publisher.Credit+2*delegation.Reward)
-			if delegation.MaxNumber != 1 {
-				newState = 1
+			for _, tempReceiverID := range delegation.ReceiverID {
+				ds.credit.Grant(ctx, cancelerID, tempReceiverID, 2*delegation.Reward, delegationID, CreditDelegation)
 			}
-			ds.delegationModel.DeleteReceiver(delegationID, cancelerID, newState)
+			ds.credit.Grant(ctx, cancelerID, delegation.PublisherID, unfilledReward(&delegation.DelegationDoc), delegationID, CreditDelegation)
+			ds.auditDelegation(ctx, cancelerID, AuditDelegationCancel, delegationID, delegation)
+			return nil
 		}
-	}
+		if delegation.MaxNumber != 1 {
+			newState = 1
+		}
+		if err := ds.delegationModel.DeleteReceiver(ctx, delegationID, delegation.Expected(), newState, cancelerID); err != nil {
+			return err
+		}
+		ds.credit.Grant(ctx, cancelerID, delegation.PublisherID, 2*delegation.Reward, delegationID, CreditDelegation)
+		ds.auditDelegation(ctx, cancelerID, AuditDelegationCancel, delegationID, delegation)
+		return nil
+	})
 
 	// TODO:判断委托是否已经过DDL
 }
 
-var timer *time.Timer
+// 发布者为没有被接受的名额预冻结的积分
+func unfilledReward(delegation *models.DelegationDoc) int {
+	return (delegation.MaxNumber - delegation.CurrentNumber) * delegation.Reward
+}
 
 // 完成委托
-func (ds *delegationService) FinishDelegation(finisherID, delegationID string) {
-	// 首先检查该用户是否有资格完成该委托，必须接收者本人才能完成
-	delegation := ds.GetSpecificDelegation(delegationID)
-	flag := 0
-	for _, tempReceiver := range delegation.ReceiverID {
-		if finisherID == tempReceiver {
-			flag = 1
-		}
-	}
-	lib.Assert(flag == 1 || delegation.PublisherID == finisherID, "invalid_canceler_not_finished_by_receiver", 401)
-	FinishByPublisher := func() {
-		var newState uint8 = 4
-		rewardCoe := 2
-		if delegation.DelegationState == 1 {
-			rewardCoe = 1
-			if delegation.MaxNumber != 1 {
-				newState = 1
+// 接受者完成时可以附带完成凭证
+func (ds *delegationService) FinishDelegation(ctx context.Context, finisherID, delegationID string, proofs []string) {
+	proofs = uniqueStrings(proofs)
+	retryOnConflict(func() error {
+		// 首先检查该用户是否有资格完成该委托，必须接收者本人才能完成
+		delegation := ds.GetSpecificDelegation(ctx, delegationID)
+		flag := 0
+		for _, tempReceiver := range delegation.ReceiverID {
+			if finisherID == tempReceiver {
+				flag = 1
 			}
 		}
-		for _, tempReceiverID := range delegation.ReceiverID {
-			receiver := ds.userModel.GetUserByOpenID(tempReceiverID)
-			ds.userModel.SetCreditByOpenID(tempReceiverID, receiver.Credit+rewardCoe*delegation.Reward)
+		lib.Assert(flag == 1 || delegation.PublisherID == finisherID, "invalid_canceler_not_finished_by_receiver")
+		// 对于不同的用户，检查委托的状态的不同条件
+		if delegation.PublisherID == finisherID {
+			// 当发布者确认完成后，将双方预冻结的积分给接受者
+			lib.Assert(delegation.DelegationState == 3, "invalid_delegation_not_pending")
+			return ds.finishByPublisher(ctx, finisherID, delegationID, delegation)
 		}
-		ds.delegationModel.SetDelegationState(delegationID, newState)
-	}
-	// 对于不同的用户，检查委托的状态的不同条件
-	if delegation.PublisherID == finisherID {
-		// 当发布者确认完成后，将双方预冻结的积分给接受者
-		lib.Assert(delegation.DelegationState == 3, "invalid_delegation_not_pending", 402)
-		FinishByPublisher()
-	} else {
 		// 接受者完成，等待发布者确认
-		lib.Assert(delegation.DelegationState == 1, "invalid_delegation_not_accepted", 402)
-		// 若所有的用户都完成了
+		lib.Assert(delegation.DelegationState == 1, "invalid_delegation_not_accepted")
+		ds.assertAttachmentsLinkable(ctx, proofs, finisherID, models.PurposeProof)
+		// 若所有的用户都完成了，发布者超过 AutoConfirmDelay 没有确认时由后台任务自动确认
+		var err error
 		if delegation.MaxNumber == 1 {
-			ds.delegationModel.SetDelegationState(delegationID, 3)
-			timer = time.AfterFunc(3600*time.Second, FinishByPublisher)
+			err = ds.delegationModel.SetPending(ctx, delegationID, delegation.Expected(), time.Now().Unix())
 		} else {
 			// 若不是，则删掉一个用户
-			ds.delegationModel.DeleteReceiver(delegationID, finisherID, 1)
+			err = ds.delegationModel.DeleteReceiver(ctx, delegationID, delegation.Expected(), 1, finisherID)
 		}
-	}
+		if err != nil {
+			return err
+		}
+		if len(proofs) != 0 {
+			ds.attachmentModel.LinkToDelegation(ctx, proofs, finisherID, models.PurposeProof, delegationID)
+			ds.delegationModel.AddProof(ctx, delegationID, models.ProofDoc{
+				ReceiverID:    finisherID,
+				AttachmentIDs: proofs,
+				SubmitTime:    time.Now().Unix(),
+			})
+		}
+		ds.auditDelegation(ctx, finisherID, AuditDelegationFinish, delegationID, delegation)
+		return nil
+	})
 	//log.Debug().Msg("End finish")
 	// TODO:判断委托是否已经过DDL
 	// ds.delegationModel.SetDelegationState(delegationID, 4)
 }
+
+// 发布者确认完成，将预冻结的积分给接受者
+// 委托已经被其他请求修改时返回 models.ErrConflict，不发放积分
+// 自动确认时 actorID 为 AuditSystemActor
+func (ds *delegationService) finishByPublisher(ctx context.Context, actorID, delegationID string, delegation *DelegationInfoWrapper) error {
+	// 修改状态之后的发放不随请求取消，也不随后台任务停止
+	ctx, cancel := lib.Detach(ctx)
+	defer cancel()
+	var newState uint8 = 4
+	rewardCoe := 2
+	if delegation.DelegationState == 1 {
+		rewardCoe = 1
+		if delegation.MaxNumber != 1 {
+			newState = 1
+		}
+	}
+	var err error
+	if newState == uint8(models.Finished) {
+		err = ds.delegationModel.SetFinished(ctx, delegationID, delegation.Expected(), time.Now().Unix(), rewardCoe*delegation.Reward)
+	} else {
+		err = ds.delegationModel.SetDelegationState(ctx, delegationID, delegation.Expected(), newState)
+	}
+	if err != nil {
+		return err
+	}
+	for _, tempReceiverID := range delegation.ReceiverID {
+		ds.credit.Grant(ctx, actorID, tempReceiverID, rewardCoe*delegation.Reward, delegationID, CreditDelegation)
+		ds.credit.AwardFirstCompletion(ctx, actorID, tempReceiverID, delegationID)
+	}
+	ds.auditDelegation(ctx, actorID, AuditDelegationConfirm, delegationID, delegation)
+	return nil
+}
+
+// 为接受者评分，每个接受者只能评分一次
+func (ds *delegationService) RateReceiver(ctx context.Context, publisherID, delegationID, receiverID string, score int) {
+	delegation := ds.GetSpecificDelegation(ctx, delegationID)
+	lib.Assert(delegation.PublisherID == publisherID, "invalid_rater_not_publisher")
+	lib.Assert(delegation.DelegationState == models.Finished, "invalid_delegation_not_finished")
+	isReceiver := false
+	for _, id := range delegation.ReceiverID {
+		if id == receiverID {
+			isReceiver = true
+		}
+	}
+	lib.Assert(isReceiver, "invalid_rating_receiver")
+	lib.Assert(ds.delegationModel.AddRating(ctx, delegationID, models.RatingDoc{
+		ReceiverID: receiverID,
+		Score:      score,
+		RateTime:   time.Now().Unix(),
+	}), "already_rated")
+	ds.auditDelegation(ctx, publisherID, AuditDelegationRate, delegationID, delegation)
+}
+
+// 直接修改委托的状态，由命令行调用
+func (ds *delegationService) SetDelegationState(ctx context.Context, delegationID string, state models.EnumDelegationState) {
+	retryOnConflict(func() error {
+		delegation := ds.GetSpecificDelegation(ctx, delegationID)
+		if err := ds.delegationModel.SetDelegationState(ctx, delegationID, delegation.Expected(), uint8(state)); err != nil {
+			return err
+		}
+		ds.auditDelegation(ctx, auditActor(ctx), AuditAdminDelegation, delegationID, delegation)
+		return nil
+	})
+}
+
+// 接受者完成后发布者没有确认时，自动确认的等待时间
+const AutoConfirmDelay = time.Hour
+
+// 每轮自动确认的委托数量上限，剩下的在下一轮处理
+const autoConfirmBatch = 100
+
+// AutoConfirm 自动确认待确认超过 AutoConfirmDelay 的委托，返回确认的数量
+// 由后台任务定期调用，服务器重启不会影响自动确认
+func (ds *delegationService) AutoConfirm(ctx context.Context) int {
+	ids := ds.delegationModel.GetPendingIDsBefore(ctx, time.Now().Add(-AutoConfirmDelay).Unix(), autoConfirmBatch)
+	n := 0
+	for _, id := range ids {
+		if ctx.Err() != nil {
+			break
+		}
+		// 重新读取委托，发布者可能已经在这期间确认
+		delegation := ds.GetSpecificDelegation(ctx, id)
+		if delegation.DelegationState != models.Pending {
+			continue
+		}
+		err := ds.finishByPublisher(ctx, AuditSystemActor, id, delegation)
+		if err == models.ErrConflict {
+			// 发布者同时确认或者取消，由对方的请求处理
+			continue
+		}
+		lib.AssertErr(err)
+		n++
+	}
+	return n
+}
@@ -0,0 +1,26 @@
+package services
+
+import (
+	"testing"
+
+	"github.com/sysu-team/Back-end-development/app/models"
+)
+
+func TestUnfilledReward(t *testing.T) {
+	cases := []struct {
+		maxNumber, currentNumber, reward, expected int
+	}{
+		// 还没有被接受，创建时冻结的积分全部返还
+		{1, 0, 10, 10},
+		{3, 0, 10, 30},
+		// 发布者取消时只返还没有被接受的名额
+		{3, 1, 10, 20},
+		{3, 3, 10, 0},
+	}
+	for _, c := range cases {
+		d := &models.DelegationDoc{MaxNumber: c.maxNumber, CurrentNumber: c.currentNumber, Reward: c.reward}
+		if got := unfilledReward(d); got != c.expected {
+			t.Errorf("max %v current %v reward %v: expected %v, got %v", c.maxNumber, c.currentNumber, c.reward, c.expected, got)
+		}
+	}
+}
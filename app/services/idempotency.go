@@ -0,0 +1,82 @@
+package services
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"time"
+
+	"github.com/sysu-team/Back-end-development/app/models"
+	"github.com/sysu-team/Back-end-development/lib"
+)
+
+// 幂等键保存响应的时间
+var idempotencyTTL = 24 * time.Hour
+
+// 第一次请求处理超过这个时间仍然没有结果时视为已经中断，重试的请求可以接管幂等键
+// 需要长于请求的处理时间加上 lib.Detach 保存结果的时间
+const idempotencyLease = 2 * time.Minute
+
+// InitIdempotency 设置幂等键保存响应的时间
+func InitIdempotency(ttl time.Duration) {
+	idempotencyTTL = ttl
+}
+
+// IdempotencyService 幂等键，客户端重试时返回第一次请求的响应
+// scope 区分不同的调用方，同一个幂等键只对同一个调用方有效
+type IdempotencyService interface {
+	// 开始处理请求，第一次请求返回 nil，重试的请求返回保存的响应
+	// 幂等键对应的请求不同或者第一次请求还在处理时返回 409
+	Begin(ctx context.Context, scope, key, requestHash string) *models.IdempotencyDoc
+	// 保存第一次请求的响应
+	Complete(ctx context.Context, scope, key string, statusCode int, contentType string, body []byte)
+	// 第一次请求失败，允许使用同一个幂等键重试
+	Abort(ctx context.Context, scope, key string)
+}
+
+func NewIdempotencyService() IdempotencyService {
+	return &idempotencyService{
+		models.GetModel().Idempotency,
+	}
+}
+
+type idempotencyService struct {
+	idempotencyModel *models.IdempotencyModel
+}
+
+// 数据库中只保存摘要，不保存 session id
+func idempotencyID(scope, key string) string {
+	sum := sha256.Sum256([]byte(scope + "\n" + key))
+	return hex.EncodeToString(sum[:])
+}
+
+func (s *idempotencyService) Begin(ctx context.Context, scope, key, requestHash string) *models.IdempotencyDoc {
+	now := time.Now()
+	doc := &models.IdempotencyDoc{
+		ID:          idempotencyID(scope, key),
+		RequestHash: requestHash,
+		State:       models.IdempotencyProcessing,
+		CreatedAt:   now,
+		ExpireAt:    now.Add(idempotencyTTL),
+	}
+	inserted, existing := s.idempotencyModel.Begin(ctx, doc)
+	if inserted {
+		return nil
+	}
+	lib.Assert(existing.RequestHash == requestHash, "idempotency_key_conflict")
+	if existing.State == models.IdempotencyProcessing && now.Sub(existing.CreatedAt) > idempotencyLease &&
+		s.idempotencyModel.TakeOver(ctx, doc.ID, existing.CreatedAt, doc.CreatedAt, doc.ExpireAt) {
+		lib.Log(ctx).Warn().Time("created_at", existing.CreatedAt).Msg("take over stale idempotency key")
+		return nil
+	}
+	lib.AssertRate(existing.State == models.IdempotencyDone, time.Second, "idempotency_key_in_progress")
+	return existing
+}
+
+func (s *idempotencyService) Complete(ctx context.Context, scope, key string, statusCode int, contentType string, body []byte) {
+	s.idempotencyModel.Complete(ctx, idempotencyID(scope, key), statusCode, contentType, body)
+}
+
+func (s *idempotencyService) Abort(ctx context.Context, scope, key string) {
+	s.idempotencyModel.Abort(ctx, idempotencyID(scope, key))
+}
@@ -0,0 +1,177 @@
+package services
+
+import (
+	"context"
+	"time"
+
+	"github.com/sysu-team/Back-end-development/app/models"
+	"github.com/sysu-team/Back-end-development/lib"
+)
+
+// 排行榜统计的用户
+const (
+	LeaderboardHelpers    = "helpers"    // 接受者
+	LeaderboardPublishers = "publishers" // 发布者
+)
+
+// 排行榜统计的时间范围，按服务器时区的自然周（从周一开始）和自然月计算
+const (
+	LeaderboardAllTime = "all"
+	LeaderboardMonth   = "month"
+	LeaderboardWeek    = "week"
+)
+
+// 每个排行榜保存的用户数量
+const leaderboardSize = 50
+
+// 按评分排名时最少需要的评分数量，避免一次好评就排在前面
+const leaderboardMinRatings = 3
+
+// LeaderboardService 排行榜
+// 排行榜从已经完成的委托统计，缓存在数据库中，由后台任务定期重新计算
+type LeaderboardService interface {
+	GetLeaderboard(ctx context.Context, role string, metric models.EnumLeaderboardMetric, scope string) *LeaderboardInfo
+	// 重新计算所有排行榜，返回计算的数量，由后台任务调用
+	Refresh(ctx context.Context) int
+	// 从缓存的排行榜中移除用户
+	Forget(ctx context.Context, openid string)
+}
+
+func NewLeaderboardService() LeaderboardService {
+	return &leaderboardService{
+		models.GetModel().Leaderboard,
+	}
+}
+
+type leaderboardService struct {
+	leaderboardModel *models.LeaderboardModel
+}
+
+// 排行榜
+type LeaderboardInfo struct {
+	Role        string                       `json:"role"`
+	Metric      models.EnumLeaderboardMetric `json:"metric"`
+	Scope       string                       `json:"scope"`
+	PeriodStart int64                        `json:"period_start"` // 统计的开始时间，统计所有时间时为 0
+	UpdateTime  int64                        `json:"update_time"`  // 最近一次计算的时间
+	Entries     []LeaderboardEntryInfo       `json:"entries"`
+}
+
+// 排行榜中的一名用户
+type LeaderboardEntryInfo struct {
+	Rank      int     `json:"rank"` // 从 1 开始，数值相同的用户排名相同
+	UserID    string  `json:"user_id"`
+	Name      string  `json:"name"`
+	AvatarURL string  `json:"avatar_url"`
+	Value     float64 `json:"value"` // 完成的委托数量、积分或者平均评分
+	Count     int64   `json:"count"` // 完成的委托数量，按评分排名时为评分的数量
+}
+
+// 一个排行榜统计的用户、数值和时间范围
+type leaderboardKey struct {
+	role   string
+	metric models.EnumLeaderboardMetric
+	scope  string
+}
+
+// 缓存的排行榜的 id，例如 helpers.count.week
+func (k leaderboardKey) id() string {
+	return k.role + "." + string(k.metric) + "." + k.scope
+}
+
+// 所有的排行榜，发布者没有评分
+func leaderboards() []leaderboardKey {
+	res := make([]leaderboardKey, 0)
+	for _, role := range []string{LeaderboardHelpers, LeaderboardPublishers} {
+		for _, metric := range []models.EnumLeaderboardMetric{models.LeaderboardByCount, models.LeaderboardByCredit, models.LeaderboardByRating} {
+			if role == LeaderboardPublishers && metric == models.LeaderboardByRating {
+				continue
+			}
+			for _, scope := range []string{LeaderboardAllTime, LeaderboardMonth, LeaderboardWeek} {
+				res = append(res, leaderboardKey{role, metric, scope})
+			}
+		}
+	}
+	return res
+}
+
+// 时间范围的开始时间
+func leaderboardPeriodStart(scope string, now time.Time) int64 {
+	year, month, day := now.Date()
+	switch scope {
+	case LeaderboardMonth:
+		return time.Date(year, month, 1, 0, 0, 0, 0, now.Location()).Unix()
+	case LeaderboardWeek:
+		weekday := (int(now.Weekday()) + 6) % 7
+		return time.Date(year, month, day-weekday, 0, 0, 0, 0, now.Location()).Unix()
+	}
+	return 0
+}
+
+// 获取排行榜
+// 还没有计算过或者已经进入新的周期时立即重新计算
+func (s *leaderboardService) GetLeaderboard(ctx context.Context, role string, metric models.EnumLeaderboardMetric, scope string) *LeaderboardInfo {
+	lib.Assert(role != LeaderboardPublishers || metric != models.LeaderboardByRating, "invalid_leaderboard")
+	key := leaderboardKey{role, metric, scope}
+	board := s.leaderboardModel.GetBoard(ctx, key.id())
+	if board == nil || board.PeriodStart != leaderboardPeriodStart(scope, time.Now()) {
+		board = s.refresh(ctx, key)
+	}
+	info := &LeaderboardInfo{
+		Role:        role,
+		Metric:      metric,
+		Scope:       scope,
+		PeriodStart: board.PeriodStart,
+		UpdateTime:  board.UpdateTime,
+		Entries:     make([]LeaderboardEntryInfo, 0, len(board.Entries)),
+	}
+	for i, entry := range board.Entries {
+		rank := i + 1
+		if i > 0 && entry.Value == board.Entries[i-1].Value {
+			rank = info.Entries[i-1].Rank
+		}
+		info.Entries = append(info.Entries, LeaderboardEntryInfo{
+			Rank:      rank,
+			UserID:    entry.UserID,
+			Name:      entry.Name,
+			AvatarURL: entry.AvatarURL,
+			Value:     entry.Value,
+			Count:     entry.Count,
+		})
+	}
+	return info
+}
+
+// 重新计算一个排行榜并保存
+func (s *leaderboardService) refresh(ctx context.Context, key leaderboardKey) *models.LeaderboardDoc {
+	periodStart := leaderboardPeriodStart(key.scope, time.Now())
+	board := &models.LeaderboardDoc{
+		ID:          key.id(),
+		PeriodStart: periodStart,
+		Entries: s.leaderboardModel.Rank(ctx, &models.LeaderboardQuery{
+			ByPublisher: key.role == LeaderboardPublishers,
+			Metric:      key.metric,
+			Since:       periodStart,
+			MinRatings:  leaderboardMinRatings,
+			Limit:       leaderboardSize,
+		}),
+	}
+	s.leaderboardModel.SaveBoard(ctx, board)
+	return board
+}
+
+func (s *leaderboardService) Refresh(ctx context.Context) int {
+	n := 0
+	for _, key := range leaderboards() {
+		if ctx.Err() != nil {
+			break
+		}
+		s.refresh(ctx, key)
+		n++
+	}
+	return n
+}
+
+func (s *leaderboardService) Forget(ctx context.Context, openid string) {
+	s.leaderboardModel.RemoveUser(ctx, openid)
+}
@@ -0,0 +1,246 @@
+package services
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sysu-team/Back-end-development/app/models"
+	"github.com/sysu-team/Back-end-development/lib"
+)
+
+// MessageService 委托聊天
+// 委托有接受者之后发布者和接受者可以聊天，委托完成或者取消之后聊天只能查看
+// 新消息和已读回执实时推送给同一个实例上订阅了这个委托的连接，其他实例上的连接需要重新拉取
+type MessageService interface {
+	Send(ctx context.Context, senderID, delegationID string, msg *MessageReq) *MessageInfo
+	// after 不为空时只返回这条消息之后的消息
+	GetMessages(ctx context.Context, viewerID, delegationID, after string, page, limit int) []MessageInfo
+	// 把 upTo 以及之前别人发送的消息标记为已读
+	MarkRead(ctx context.Context, readerID, delegationID, upTo string)
+	// 订阅委托的新消息和已读回执，返回的 channel 在取消订阅或者服务器关闭时被关闭
+	Subscribe(ctx context.Context, viewerID, delegationID string) (events <-chan ChatEvent, cancel func())
+}
+
+func NewMessageService() MessageService {
+	return &messageService{
+		models.GetModel().Message,
+		models.GetModel().Delegation,
+		models.GetModel().Attachment,
+		models.GetModel().User,
+	}
+}
+
+type messageService struct {
+	messageModel    *models.MessageModel
+	delegationModel *models.DelegationModel
+	attachmentModel *models.AttachmentModel
+	userModel       *models.UserModel
+}
+
+// 发送消息
+type MessageReq struct {
+	Kind         models.EnumMessageKind `json:"kind" validate:"required,oneof=text image"`
+	Text         string                 `json:"text" validate:"max=1000"`                    // 文字消息的内容
+	AttachmentID string                 `json:"attachment_id" validate:"omitempty,objectid"` // 图片消息的附件，上传时用途为 message
+}
+
+// 消息
+type MessageInfo struct {
+	ID           string                 `json:"id"`
+	DelegationID string                 `json:"delegation_id"`
+	SenderID     string                 `json:"sender_id"`
+	Kind         models.EnumMessageKind `json:"kind"` // text 文字，image 图片
+	Text         string                 `json:"text,omitempty"`
+	ImageURL     string                 `json:"image_url,omitempty"`
+	ReadBy       []ReadReceiptInfo      `json:"read_by"` // 除发送者之外已经读过的用户
+	CreateTime   int64                  `json:"create_time"`
+}
+
+// 已读回执
+type ReadReceiptInfo struct {
+	UserID   string `json:"user_id"`
+	ReadTime int64  `json:"read_time"`
+}
+
+// 实时推送的事件
+type ChatEvent struct {
+	Type    string       `json:"type"` // message 新消息，read 已读回执
+	Message *MessageInfo `json:"message,omitempty"`
+	Read    *ReadEvent   `json:"read,omitempty"`
+}
+
+// 用户读过了 up_to 以及之前的消息
+type ReadEvent struct {
+	UserID   string `json:"user_id"`
+	UpTo     string `json:"up_to"`
+	ReadTime int64  `json:"read_time"`
+}
+
+const (
+	ChatEventMessage = "message"
+	ChatEventRead    = "read"
+)
+
+func messageInfo(doc *models.MessageDoc) MessageInfo {
+	info := MessageInfo{
+		ID:           doc.ID.Hex(),
+		DelegationID: doc.DelegationID,
+		SenderID:     doc.SenderID,
+		Kind:         doc.Kind,
+		Text:         doc.Text,
+		ReadBy:       make([]ReadReceiptInfo, 0, len(doc.ReadBy)),
+		CreateTime:   doc.CreateTime,
+	}
+	if doc.AttachmentID != "" {
+		info.ImageURL = attachmentURL(doc.AttachmentID)
+	}
+	for _, r := range doc.ReadBy {
+		info.ReadBy = append(info.ReadBy, ReadReceiptInfo{UserID: r.UserID, ReadTime: r.ReadTime})
+	}
+	return info
+}
+
+// 委托的发布者和接受者可以聊天
+func isChatMember(delegation *models.DelegationDoc, openid string) bool {
+	if openid == "" {
+		return false
+	}
+	if delegation.PublisherID == openid {
+		return true
+	}
+	for _, receiverID := range delegation.ReceiverID {
+		if receiverID == openid {
+			return true
+		}
+	}
+	return false
+}
+
+// 检查用户是否可以查看委托的聊天
+func (s *messageService) getChat(ctx context.Context, openid, delegationID string) *models.DelegationDoc {
+	delegation := s.delegationModel.GetSpecificDelegation(ctx, delegationID)
+	lib.Assert(isChatMember(delegation, openid), "not_chat_member")
+	return delegation
+}
+
+func (s *messageService) Send(ctx context.Context, senderID, delegationID string, msg *MessageReq) *MessageInfo {
+	user := s.userModel.GetUserByOpenID(ctx, senderID)
+	lib.Assert(user != nil, "no_such_user")
+	assertUserActive(ctx, s.userModel, user)
+	delegation := s.getChat(ctx, senderID, delegationID)
+	// 多人委托在名额满之前仍然是 Published 状态，有接受者之后就可以聊天
+	lib.Assert(len(delegation.ReceiverID) > 0, "chat_not_open")
+	lib.Assert(delegation.DelegationState != models.Finished && delegation.DelegationState != models.Canceled, "chat_read_only")
+
+	doc := &models.MessageDoc{
+		DelegationID: delegationID,
+		SenderID:     senderID,
+		Kind:         msg.Kind,
+	}
+	switch msg.Kind {
+	case models.MessageText:
+		doc.Text = strings.TrimSpace(msg.Text)
+		lib.Assert(doc.Text != "" && msg.AttachmentID == "", "invalid_message")
+	case models.MessageImage:
+		lib.Assert(msg.AttachmentID != "" && strings.TrimSpace(msg.Text) == "", "invalid_message")
+		attachment := s.attachmentModel.GetAttachment(ctx, msg.AttachmentID)
+		lib.Assert(attachment != nil, "invalid_attachments")
+		lib.Assert(isImage(attachment.ContentType), "invalid_attachment_type")
+		lib.Assert(s.attachmentModel.LinkToDelegation(ctx, []string{msg.AttachmentID}, senderID, models.PurposeMessage, delegationID) == 1,
+			"invalid_attachments")
+		doc.AttachmentID = msg.AttachmentID
+	}
+	s.messageModel.CreateMessage(ctx, doc)
+	info := messageInfo(doc)
+	chat.publish(delegationID, ChatEvent{Type: ChatEventMessage, Message: &info})
+	return &info
+}
+
+func (s *messageService) GetMessages(ctx context.Context, viewerID, delegationID, after string, page, limit int) []MessageInfo {
+	s.getChat(ctx, viewerID, delegationID)
+	docs := s.messageModel.GetMessages(ctx, int64(page), int64(limit), delegationID, after)
+	res := make([]MessageInfo, 0, len(docs))
+	for i := range docs {
+		res = append(res, messageInfo(&docs[i]))
+	}
+	return res
+}
+
+// 委托结束之后仍然可以标记已读
+func (s *messageService) MarkRead(ctx context.Context, readerID, delegationID, upTo string) {
+	s.getChat(ctx, readerID, delegationID)
+	now := time.Now().Unix()
+	if s.messageModel.MarkRead(ctx, delegationID, upTo, readerID, now) > 0 {
+		chat.publish(delegationID, ChatEvent{Type: ChatEventRead, Read: &ReadEvent{UserID: readerID, UpTo: upTo, ReadTime: now}})
+	}
+}
+
+func (s *messageService) Subscribe(ctx context.Context, viewerID, delegationID string) (<-chan ChatEvent, func()) {
+	s.getChat(ctx, viewerID, delegationID)
+	return chat.subscribe(delegationID)
+}
+
+// 每个连接缓存的事件数量，客户端处理不过来时丢弃新的事件，客户端可以用 after 重新拉取
+const chatEventBuffer = 32
+
+// 实时推送的订阅，只在当前实例内有效
+type chatHub struct {
+	mu     sync.Mutex
+	subs   map[string]map[chan ChatEvent]struct{} // 委托 id -> 订阅的连接
+	closed bool
+}
+
+// singleton
+var chat = &chatHub{subs: make(map[string]map[chan ChatEvent]struct{})}
+
+func (h *chatHub) subscribe(delegationID string) (<-chan ChatEvent, func()) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	ch := make(chan ChatEvent, chatEventBuffer)
+	if h.closed {
+		close(ch)
+		return ch, func() {}
+	}
+	if h.subs[delegationID] == nil {
+		h.subs[delegationID] = make(map[chan ChatEvent]struct{})
+	}
+	h.subs[delegationID][ch] = struct{}{}
+	return ch, func() {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		if _, ok := h.subs[delegationID][ch]; !ok {
+			return
+		}
+		delete(h.subs[delegationID], ch)
+		if len(h.subs[delegationID]) == 0 {
+			delete(h.subs, delegationID)
+		}
+		close(ch)
+	}
+}
+
+func (h *chatHub) publish(delegationID string, event ChatEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for ch := range h.subs[delegationID] {
+		select {
+		case ch <- event:
+		default:
+		}
+	}
+}
+
+// CloseChat 关闭所有实时推送的连接，服务器关闭之前调用，否则关闭时要等待这些连接超时
+func CloseChat() {
+	chat.mu.Lock()
+	defer chat.mu.Unlock()
+	chat.closed = true
+	for delegationID, subs := range chat.subs {
+		for ch := range subs {
+			close(ch)
+		}
+		delete(chat.subs, delegationID)
+	}
+}
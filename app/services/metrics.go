@@ -0,0 +1,42 @@
+package services
+
+import (
+	"context"
+	"github.com/sysu-team/Back-end-development/app/models"
+)
+
+// MetricsService 业务指标
+type MetricsService interface {
+	// 各个状态的委托数量，没有委托的状态数量为 0
+	CountDelegationsByState(ctx context.Context) map[models.EnumDelegationState]int64
+	// 进行中的委托预冻结的积分总数
+	GetFrozenCredit(ctx context.Context) int64
+}
+
+func NewMetricsService() MetricsService {
+	return &metricsService{
+		models.GetModel().Delegation,
+	}
+}
+
+type metricsService struct {
+	delegationModel *models.DelegationModel
+}
+
+func (s *metricsService) CountDelegationsByState(ctx context.Context) map[models.EnumDelegationState]int64 {
+	res := map[models.EnumDelegationState]int64{
+		models.Published: 0,
+		models.Accepted:  0,
+		models.Canceled:  0,
+		models.Pending:   0,
+		models.Finished:  0,
+	}
+	for _, c := range s.delegationModel.CountByState(ctx) {
+		res[c.State] = c.Count
+	}
+	return res
+}
+
+func (s *metricsService) GetFrozenCredit(ctx context.Context) int64 {
+	return s.delegationModel.SumFrozenCredit(ctx)
+}
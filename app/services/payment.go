@@ -0,0 +1,410 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/sysu-team/Back-end-development/app/configs"
+	"github.com/sysu-team/Back-end-development/app/models"
+	"github.com/sysu-team/Back-end-development/app/utils"
+	"github.com/sysu-team/Back-end-development/lib"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// singleton，为 nil 时关闭充值和提现
+var paymentProvider utils.PaymentProvider
+
+// 充值和提现的规则
+var paymentPolicy = configs.PaymentConfig{FenPerCredit: 10, OrderExpires: 1800}
+
+// InitPayment 根据配置初始化支付平台，appID 为小程序的 appid
+func InitPayment(config *configs.PaymentConfig, appID string) {
+	paymentPolicy = *config
+	paymentProvider = utils.NewPaymentProvider(config, appID)
+}
+
+func assertPaymentEnabled() utils.PaymentProvider {
+	lib.Assert(paymentProvider != nil, "payment_disabled")
+	return paymentProvider
+}
+
+// 创建之后多久开始对账，等待支付结果通知
+const reconcileDelay = time.Minute
+
+// 批准之后多久没有转账结果时重试转账
+const transferRetryDelay = 5 * time.Minute
+
+// 每轮对账处理的订单和提现申请数量上限
+const reconcileBatch = 100
+
+// PaymentService 充值和提现
+// 充值在收到签名正确的支付结果通知或者主动查询到支付成功之后才发放积分
+// 提现申请时冻结积分，管理员批准之后转账，拒绝或者转账失败时返还
+type PaymentService interface {
+	CreateTopUp(ctx context.Context, openid string, credit int) *TopUpRes
+	GetOrder(ctx context.Context, openid, orderID string) *PaymentOrderInfo
+	GetOrders(ctx context.Context, openid string, page, limit int) []PaymentOrderInfo
+	// 处理支付结果通知，返回给支付平台的响应
+	HandleNotify(ctx context.Context, req *http.Request) (contentType string, body []byte)
+	RequestWithdrawal(ctx context.Context, openid string, credit int) *WithdrawalInfo
+	// openid 为空时查询所有用户的提现申请
+	GetWithdrawals(ctx context.Context, openid string, page, limit int, states ...models.EnumWithdrawalState) []WithdrawalInfo
+	ReviewWithdrawal(ctx context.Context, reviewerID, withdrawalID string, approve bool, reason string) *WithdrawalInfo
+	// 对账：查询没有收到通知的订单，关闭超时的订单，重试结果不确定的转账，由后台任务调用
+	Reconcile(ctx context.Context) int
+}
+
+func NewPaymentService() PaymentService {
+	return &paymentService{
+		models.GetModel().Payment,
+		models.GetModel().User,
+		NewCreditService(),
+	}
+}
+
+type paymentService struct {
+	paymentModel *models.PaymentModel
+	userModel    *models.UserModel
+	credit       CreditService
+}
+
+// 充值订单
+type PaymentOrderInfo struct {
+	ID         string                  `json:"id"`
+	OrderNo    string                  `json:"order_no"`
+	Credit     int                     `json:"credit"`
+	Amount     int64                   `json:"amount"` // 单位为分
+	State      models.EnumPaymentState `json:"state"`  // 0 等待支付，1 已经支付，2 已经关闭
+	ExpireTime int64                   `json:"expire_time"`
+	CreateTime int64                   `json:"create_time"`
+	UpdateTime int64                   `json:"update_time"`
+}
+
+// 创建充值订单的结果
+type TopUpRes struct {
+	Order     PaymentOrderInfo  `json:"order"`
+	PayParams map[string]string `json:"pay_params"` // 小程序调用 wx.requestPayment 的参数
+}
+
+// 提现申请
+type WithdrawalInfo struct {
+	ID         string                     `json:"id"`
+	OrderNo    string                     `json:"order_no"`
+	UserID     string                     `json:"user_id"`
+	Credit     int                        `json:"credit"`
+	Amount     int64                      `json:"amount"` // 单位为分
+	State      models.EnumWithdrawalState `json:"state"`  // 0 等待审核，1 正在转账，2 已经转账，3 被拒绝，4 转账失败
+	Reason     string                     `json:"reason"` // 拒绝或者转账失败的原因
+	CreateTime int64                      `json:"create_time"`
+	UpdateTime int64                      `json:"update_time"`
+}
+
+func paymentOrderInfo(doc *models.PaymentOrderDoc) PaymentOrderInfo {
+	return PaymentOrderInfo{
+		ID:         doc.ID.Hex(),
+		OrderNo:    doc.OrderNo,
+		Credit:     doc.Credit,
+		Amount:     doc.Amount,
+		State:      doc.State,
+		ExpireTime: doc.ExpireTime,
+		CreateTime: doc.CreateTime,
+		UpdateTime: doc.UpdateTime,
+	}
+}
+
+func withdrawalInfo(doc *models.WithdrawalDoc) WithdrawalInfo {
+	return WithdrawalInfo{
+		ID:         doc.ID.Hex(),
+		OrderNo:    doc.OrderNo,
+		UserID:     doc.UserID,
+		Credit:     doc.Credit,
+		Amount:     doc.Amount,
+		State:      doc.State,
+		Reason:     doc.Reason,
+		CreateTime: doc.CreateTime,
+		UpdateTime: doc.UpdateTime,
+	}
+}
+
+// 充值订单 T 开头，提现申请 W 开头，其余为时间和随机数字
+func newOrderNo(prefix string) string {
+	return prefix + time.Now().UTC().Format("20060102150405") + randomDigits(8)
+}
+
+// 创建充值订单，返回小程序发起支付的参数
+func (s *paymentService) CreateTopUp(ctx context.Context, openid string, credit int) *TopUpRes {
+	provider := assertPaymentEnabled()
+	lib.Assert(credit >= paymentPolicy.MinTopUp && credit <= paymentPolicy.MaxTopUp, "invalid_top_up_amount")
+	user := s.userModel.GetUserByOpenID(ctx, openid)
+	lib.Assert(user != nil, "no_such_user")
+	now := time.Now()
+	doc := &models.PaymentOrderDoc{
+		ID:         primitive.NewObjectID(),
+		OrderNo:    newOrderNo("T"),
+		UserID:     openid,
+		Credit:     credit,
+		Amount:     int64(credit) * int64(paymentPolicy.FenPerCredit),
+		State:      models.PaymentCreated,
+		ExpireTime: now.Add(time.Duration(paymentPolicy.OrderExpires) * time.Second).Unix(),
+		CreateTime: now.Unix(),
+		UpdateTime: now.Unix(),
+	}
+	s.paymentModel.CreateOrder(ctx, doc)
+	params, err := provider.CreateOrder(ctx, &utils.PaymentOrder{
+		OrderNo:     doc.OrderNo,
+		OpenID:      openid,
+		Amount:      doc.Amount,
+		Description: fmt.Sprintf("充值 %v 积分", credit),
+		ClientIP:    lib.RequestInfoFrom(ctx).IP,
+		ExpireAt:    doc.ExpireTime,
+	})
+	if e, ok := err.(*utils.PaymentError); ok && e.Final {
+		// 下单失败，订单不会被支付
+		s.paymentModel.MarkOrderClosed(ctx, doc.OrderNo)
+	}
+	lib.AssertErr(err, "payment_provider_error")
+	return &TopUpRes{paymentOrderInfo(doc), params}
+}
+
+// 获取自己的充值订单，还在等待支付时先向支付平台查询最新的状态
+func (s *paymentService) GetOrder(ctx context.Context, openid, orderID string) *PaymentOrderInfo {
+	order := s.paymentModel.GetOrder(ctx, orderID)
+	lib.Assert(order != nil && order.UserID == openid, "no_such_payment_order")
+	if order.State == models.PaymentCreated && paymentProvider != nil && s.reconcileOrder(ctx, order) {
+		order = s.paymentModel.GetOrder(ctx, orderID)
+	}
+	info := paymentOrderInfo(order)
+	return &info
+}
+
+func (s *paymentService) GetOrders(ctx context.Context, openid string, page, limit int) []PaymentOrderInfo {
+	docs := s.paymentModel.GetOrdersByUser(ctx, int64(page), int64(limit), openid)
+	res := make([]PaymentOrderInfo, 0, len(docs))
+	for i := range docs {
+		res = append(res, paymentOrderInfo(&docs[i]))
+	}
+	return res
+}
+
+// 处理支付结果通知
+// 签名错误、订单不存在时返回失败，支付平台会重新通知；重复的通知直接返回成功
+func (s *paymentService) HandleNotify(ctx context.Context, req *http.Request) (string, []byte) {
+	provider := assertPaymentEnabled()
+	err := s.handleNotify(ctx, provider, req)
+	if err != nil {
+		lib.Log(ctx).Warn().Err(err).Msg("reject payment notify")
+		return provider.NotifyResponse(false, "FAIL")
+	}
+	return provider.NotifyResponse(true, "OK")
+}
+
+func (s *paymentService) handleNotify(ctx context.Context, provider utils.PaymentProvider, req *http.Request) error {
+	result, err := provider.ParseNotify(req)
+	if err != nil {
+		return err
+	}
+	if result.State != utils.TradeSuccess {
+		// 支付失败的订单在超时之后由对账任务关闭
+		return nil
+	}
+	order := s.paymentModel.GetOrderByNo(ctx, result.OrderNo)
+	if order == nil {
+		return fmt.Errorf("unknown order %v", result.OrderNo)
+	}
+	s.settlePaid(ctx, order, result)
+	return nil
+}
+
+// 订单支付成功，金额一致时发放积分
+// 先把订单标记为已支付，只有修改了订单状态的一方发放积分，重复的通知和并发的对账不会重复发放
+// 已经关闭的订单仍然可能在关闭之前被支付，同样发放积分并记录日志，由管理员检查
+func (s *paymentService) settlePaid(ctx context.Context, order *models.PaymentOrderDoc, result *utils.PaymentResult) bool {
+	if order.State == models.PaymentPaid {
+		return false
+	}
+	if result.Amount != order.Amount {
+		// 需要人工处理，订单保持等待支付
+		lib.Log(ctx).Error().Str("order_no", order.OrderNo).Int64("amount", order.Amount).Int64("paid", result.Amount).
+			Msg("payment amount mismatch")
+		return false
+	}
+	ctx, cancel := lib.Detach(ctx)
+	defer cancel()
+	if !s.paymentModel.MarkOrderPaid(ctx, order.OrderNo, result.TransactionID, models.PaymentCreated) {
+		if !s.paymentModel.MarkOrderPaid(ctx, order.OrderNo, result.TransactionID, models.PaymentClosed) {
+			return false
+		}
+		lib.Log(ctx).Error().Str("order_no", order.OrderNo).Str("transaction_id", result.TransactionID).
+			Msg("closed payment order was paid")
+	}
+	defer func() {
+		// 订单已经标记为已支付，不会再被重试，发放失败时需要人工处理
+		if r := recover(); r != nil {
+			lib.Log(ctx).Error().Str("order_no", order.OrderNo).Interface("panic", r).Msg("grant credit for paid order")
+			panic(r)
+		}
+	}()
+	s.credit.GrantForOrder(ctx, AuditSystemActor, order.UserID, order.Credit, order.OrderNo, CreditTopUp)
+	recordAudit(ctx, AuditSystemActor, AuditPaymentTopUp, order.ID.Hex(), order, s.paymentModel.GetOrder(ctx, order.ID.Hex()))
+	return true
+}
+
+// 向支付平台查询订单的状态，返回订单的状态是否改变
+// 查询失败时只记录日志，下一轮对账重试
+func (s *paymentService) reconcileOrder(ctx context.Context, order *models.PaymentOrderDoc) bool {
+	result, err := paymentProvider.QueryOrder(ctx, order.OrderNo)
+	if err != nil {
+		lib.Log(ctx).Warn().Err(err).Str("order_no", order.OrderNo).Msg("query payment order")
+		return false
+	}
+	switch result.State {
+	case utils.TradeSuccess:
+		return s.settlePaid(ctx, order, result)
+	case utils.TradeClosed:
+		return s.paymentModel.MarkOrderClosed(ctx, order.OrderNo)
+	case utils.TradeNotPay:
+		if time.Now().Unix() < order.ExpireTime {
+			return false
+		}
+		// 先在支付平台关闭，避免关闭之后仍然被支付
+		if err := paymentProvider.CloseOrder(ctx, order.OrderNo); err != nil {
+			lib.Log(ctx).Warn().Err(err).Str("order_no", order.OrderNo).Msg("close payment order")
+			return false
+		}
+		return s.paymentModel.MarkOrderClosed(ctx, order.OrderNo)
+	}
+	return false
+}
+
+// 对账一个订单，失败时只记录日志，不影响同一轮的其他订单
+func (s *paymentService) tryReconcileOrder(ctx context.Context, order *models.PaymentOrderDoc) (changed bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			lib.Log(ctx).Error().Str("order_no", order.OrderNo).Interface("panic", r).Msg("reconcile payment order")
+		}
+	}()
+	return s.reconcileOrder(ctx, order)
+}
+
+// 申请提现，先冻结积分，创建失败时返还
+func (s *paymentService) RequestWithdrawal(ctx context.Context, openid string, credit int) *WithdrawalInfo {
+	assertPaymentEnabled()
+	lib.Assert(credit >= paymentPolicy.MinWithdrawal, "invalid_withdrawal_amount")
+	user := s.userModel.GetUserByOpenID(ctx, openid)
+	lib.Assert(user != nil, "no_such_user")
+	assertUserVerified(user)
+	lib.Assert(s.credit.CanSpend(user, credit), "not_enough_credit_to_withdraw")
+	now := time.Now().Unix()
+	doc := &models.WithdrawalDoc{
+		ID:         primitive.NewObjectID(),
+		OrderNo:    newOrderNo("W"),
+		UserID:     openid,
+		Credit:     credit,
+		Amount:     int64(credit) * int64(paymentPolicy.FenPerCredit),
+		State:      models.WithdrawalPending,
+		CreateTime: now,
+		UpdateTime: now,
+	}
+	// 冻结之后的操作不随请求取消，客户端断开时也要创建或者返还
+	ctx, cancel := lib.Detach(ctx)
+	defer cancel()
+	s.credit.SpendForOrder(ctx, openid, openid, credit, doc.OrderNo, CreditWithdrawal, "not_enough_credit_to_withdraw")
+	id := ""
+	defer func() {
+		if id == "" {
+			s.credit.GrantForOrder(ctx, openid, openid, credit, doc.OrderNo, CreditRefund)
+		}
+	}()
+	id = s.paymentModel.CreateWithdrawal(ctx, doc)
+	recordAudit(ctx, openid, AuditWithdrawalRequest, id, nil, doc)
+	info := withdrawalInfo(doc)
+	return &info
+}
+
+func (s *paymentService) GetWithdrawals(ctx context.Context, openid string, page, limit int, states ...models.EnumWithdrawalState) []WithdrawalInfo {
+	docs := s.paymentModel.GetWithdrawals(ctx, int64(page), int64(limit), openid, states...)
+	res := make([]WithdrawalInfo, 0, len(docs))
+	for i := range docs {
+		res = append(res, withdrawalInfo(&docs[i]))
+	}
+	return res
+}
+
+// 审核提现申请，批准之后立即转账，转账结果不确定时由对账任务重试
+func (s *paymentService) ReviewWithdrawal(ctx context.Context, reviewerID, withdrawalID string, approve bool, reason string) *WithdrawalInfo {
+	withdrawal := s.paymentModel.GetWithdrawal(ctx, withdrawalID)
+	lib.Assert(withdrawal != nil, "no_such_withdrawal")
+	if approve {
+		// 支付平台关闭之后仍然可以拒绝，返还积分
+		assertPaymentEnabled()
+		lib.Assert(s.paymentModel.ReviewWithdrawal(ctx, withdrawalID, models.WithdrawalApproved, reviewerID, ""), "withdrawal_not_pending")
+	} else {
+		lib.Assert(s.paymentModel.ReviewWithdrawal(ctx, withdrawalID, models.WithdrawalRejected, reviewerID, reason), "withdrawal_not_pending")
+		s.credit.GrantForOrder(ctx, reviewerID, withdrawal.UserID, withdrawal.Credit, withdrawal.OrderNo, CreditRefund)
+	}
+	reviewed := s.paymentModel.GetWithdrawal(ctx, withdrawalID)
+	recordAudit(ctx, reviewerID, AuditAdminWithdrawal, withdrawalID, withdrawal, reviewed)
+	if approve {
+		s.transfer(ctx, reviewerID, reviewed)
+		reviewed = s.paymentModel.GetWithdrawal(ctx, withdrawalID)
+	}
+	info := withdrawalInfo(reviewed)
+	return &info
+}
+
+// 转账，相同的单号重复转账只会转账一次
+// 确定失败时返还积分，结果不确定时保持已批准的状态，返回状态是否改变
+func (s *paymentService) transfer(ctx context.Context, actorID string, withdrawal *models.WithdrawalDoc) bool {
+	id := withdrawal.ID.Hex()
+	transactionID, err := paymentProvider.Transfer(ctx, &utils.PaymentTransfer{
+		TransferNo:  withdrawal.OrderNo,
+		OpenID:      withdrawal.UserID,
+		Amount:      withdrawal.Amount,
+		Description: "积分提现",
+	})
+	if err != nil {
+		e, ok := err.(*utils.PaymentError)
+		if !ok || !e.Final {
+			lib.Log(ctx).Warn().Err(err).Str("order_no", withdrawal.OrderNo).Msg("transfer withdrawal")
+			return false
+		}
+		if !s.paymentModel.FinishWithdrawal(ctx, id, models.WithdrawalFailed, "", e.Code+" "+e.Message) {
+			return false
+		}
+		s.credit.GrantForOrder(ctx, actorID, withdrawal.UserID, withdrawal.Credit, withdrawal.OrderNo, CreditRefund)
+	} else if !s.paymentModel.FinishWithdrawal(ctx, id, models.WithdrawalPaid, transactionID, "") {
+		return false
+	}
+	recordAudit(ctx, actorID, AuditWithdrawalTransfer, id, withdrawal, s.paymentModel.GetWithdrawal(ctx, id))
+	return true
+}
+
+// 对账，返回状态改变的订单和提现申请的数量
+func (s *paymentService) Reconcile(ctx context.Context) int {
+	if paymentProvider == nil {
+		return 0
+	}
+	now := time.Now()
+	n := 0
+	orders := s.paymentModel.GetCreatedOrders(ctx, now.Add(-reconcileDelay).Unix(), reconcileBatch)
+	for i := range orders {
+		if ctx.Err() != nil {
+			return n
+		}
+		if s.tryReconcileOrder(ctx, &orders[i]) {
+			n++
+		}
+	}
+	withdrawals := s.paymentModel.GetStaleApprovedWithdrawals(ctx, now.Add(-transferRetryDelay).Unix(), reconcileBatch)
+	for i := range withdrawals {
+		if ctx.Err() != nil {
+			return n
+		}
+		if s.transfer(ctx, AuditSystemActor, &withdrawals[i]) {
+			n++
+		}
+	}
+	return n
+}
@@ -0,0 +1,169 @@
+package services
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	"github.com/sysu-team/Back-end-development/app/models"
+	"github.com/sysu-team/Back-end-development/lib"
+)
+
+// 修改个人资料的请求，为 nil 的字段不修改
+type ProfileUpdateReq struct {
+	Name       *string        `json:"name" validate:"notblank,max=20"`
+	AvatarURL  *string        `json:"avatar_url" validate:"max=500"`
+	Campus     *string        `json:"campus" validate:"max=50"`
+	Dormitory  *string        `json:"dormitory" validate:"max=50"`
+	WechatID   *string        `json:"wechat_id" validate:"max=50"`
+	Phone      *string        `json:"phone" validate:"max=20"`
+	Bio        *string        `json:"bio" validate:"max=200"`
+	Visibility *VisibilityReq `json:"visibility"`
+	// 为 true 时不出现在排行榜中
+	HideFromLeaderboard *bool `json:"hide_from_leaderboard"`
+}
+
+type VisibilityReq struct {
+	Campus    *models.EnumVisibility `json:"campus" validate:"oneof=public counterparty private"`
+	Dormitory *models.EnumVisibility `json:"dormitory" validate:"oneof=public counterparty private"`
+	WechatID  *models.EnumVisibility `json:"wechat_id" validate:"oneof=public counterparty private"`
+	Phone     *models.EnumVisibility `json:"phone" validate:"oneof=public counterparty private"`
+}
+
+// 其他用户看到的个人资料，不可见的字段为空
+type ProfileInfo struct {
+	OpenID    string `json:"open_id"`
+	Name      string `json:"name"`
+	AvatarURL string `json:"avatar_url"`
+	Campus    string `json:"campus,omitempty"`
+	Dormitory string `json:"dormitory,omitempty"`
+	WechatID  string `json:"wechat_id,omitempty"`
+	Phone     string `json:"phone,omitempty"`
+	Bio       string `json:"bio"`
+}
+
+// 各个字段默认的可见范围，联系方式默认只对委托的另一方可见
+var defaultVisibility = models.ProfileVisibility{
+	Campus:    models.VisibilityPublic,
+	Dormitory: models.VisibilityCounterparty,
+	WechatID:  models.VisibilityCounterparty,
+	Phone:     models.VisibilityCounterparty,
+}
+
+// 填充未设置的可见范围
+func effectiveVisibility(v models.ProfileVisibility) models.ProfileVisibility {
+	pick := func(value, def models.EnumVisibility) models.EnumVisibility {
+		if value == models.VisibilityDefault {
+			return def
+		}
+		return value
+	}
+	return models.ProfileVisibility{
+		Campus:    pick(v.Campus, defaultVisibility.Campus),
+		Dormitory: pick(v.Dormitory, defaultVisibility.Dormitory),
+		WechatID:  pick(v.WechatID, defaultVisibility.WechatID),
+		Phone:     pick(v.Phone, defaultVisibility.Phone),
+	}
+}
+
+// 修改个人资料
+// 字段长度和可见范围在 controller 中已经检查过
+func (s *userService) UpdateProfile(ctx context.Context, openid string, req *ProfileUpdateReq) {
+	lib.Assert(req.Phone == nil || *req.Phone == "" || isPhoneNumber(*req.Phone), "invalid_phone")
+	lib.Assert(req.AvatarURL == nil || *req.AvatarURL == "" ||
+		strings.HasPrefix(*req.AvatarURL, "https://") || strings.HasPrefix(*req.AvatarURL, "http://"), "invalid_avatar_url")
+	update := &models.ProfileUpdate{
+		Name:      req.Name,
+		AvatarURL: req.AvatarURL,
+		Campus:    req.Campus,
+		Dormitory: req.Dormitory,
+		WechatID:  req.WechatID,
+		Phone:     req.Phone,
+		Bio:       req.Bio,
+	}
+	if req.Visibility != nil {
+		update.CampusVisibility = req.Visibility.Campus
+		update.DormitoryVisibility = req.Visibility.Dormitory
+		update.WechatIDVisibility = req.Visibility.WechatID
+		update.PhoneVisibility = req.Visibility.Phone
+	}
+	update.HideFromLeaderboard = req.HideFromLeaderboard
+	// 请求体为空或者只有未知的字段时不修改
+	if update.IsEmpty() {
+		return
+	}
+	s.userModel.UpdateProfileByOpenID(ctx, openid, update)
+	if req.HideFromLeaderboard != nil && *req.HideFromLeaderboard {
+		NewLeaderboardService().Forget(ctx, openid)
+	}
+}
+
+func isPhoneNumber(phone string) bool {
+	if len(phone) < 5 || len(phone) > 20 {
+		return false
+	}
+	for i, c := range phone {
+		if !(c >= '0' && c <= '9' || c == '-' || i == 0 && c == '+') {
+			return false
+		}
+	}
+	return true
+}
+
+// 获取其他用户的个人资料
+// 联系方式等字段按照用户设置的可见范围返回，只对进行中委托的另一方可见
+func (s *userService) GetProfile(ctx context.Context, viewerID, openid string) *ProfileInfo {
+	user := s.FindUserByOpenID(ctx, openid)
+	lib.Assert(user != nil, "no_such_user")
+	visibility := effectiveVisibility(user.Visibility)
+	isSelf := viewerID == openid
+	// 只在需要时查询委托关系
+	isCounterparty := false
+	checked := false
+	visible := func(v models.EnumVisibility) bool {
+		switch v {
+		case models.VisibilityPublic:
+			return true
+		case models.VisibilityCounterparty:
+			if isSelf {
+				return true
+			}
+			if !checked {
+				isCounterparty = viewerID != "" && s.delegationModel.HasAcceptedRelation(ctx, viewerID, openid)
+				checked = true
+			}
+			return isCounterparty
+		default:
+			return isSelf
+		}
+	}
+	info := &ProfileInfo{
+		OpenID:    user.OpenID,
+		Name:      user.Name,
+		AvatarURL: user.AvatarURL,
+		Bio:       user.Bio,
+	}
+	if visible(visibility.Campus) {
+		info.Campus = user.Campus
+	}
+	if visible(visibility.Dormitory) {
+		info.Dormitory = user.Dormitory
+	}
+	if visible(visibility.WechatID) {
+		info.WechatID = user.WechatID
+	}
+	if visible(visibility.Phone) {
+		info.Phone = user.Phone
+	}
+	return info
+}
+
+// 保存上传的头像，返回头像的地址
+// 头像作为附件保存，只接受图片
+func (s *userService) SaveAvatar(ctx context.Context, openid, fileName string, data []byte) string {
+	lib.Assert(isImage(http.DetectContentType(data)), "invalid_avatar_type")
+	info := NewAttachmentService().Upload(ctx, openid, models.PurposeAvatar, fileName, data)
+	s.userModel.UpdateProfileByOpenID(ctx, openid, &models.ProfileUpdate{AvatarURL: &info.URL})
+	lib.Log(ctx).Debug().Str("openid", openid).Int("size", len(data)).Msg("save avatar")
+	return info.URL
+}
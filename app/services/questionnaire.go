@@ -1,16 +1,15 @@
 package services
 
 import (
-	"fmt"
-	"github.com/rs/zerolog/log"
+	"context"
 	"github.com/sysu-team/Back-end-development/app/models"
 	"github.com/sysu-team/Back-end-development/lib"
 )
 
 type QuestionnaireService interface {
-	GetQuestionnairePreview(delegationID string) *models.SimpleQuestionnaire
-	GetFullQuestionnaire(userID, delegationID string) *models.QuestionnaireDoc
-	AddRecord(userID, delegationID string, doc *QuestionnaireInfo)
+	GetQuestionnairePreview(ctx context.Context, delegationID string) *models.SimpleQuestionnaire
+	GetFullQuestionnaire(ctx context.Context, userID, delegationID string) *models.QuestionnaireDoc
+	AddRecord(ctx context.Context, userID, delegationID string, doc *QuestionnaireInfo)
 }
 
 func NewQuestionnaireService() QuestionnaireService {
@@ -26,48 +25,60 @@ type questionnaireService struct {
 }
 
 type QuestionnaireInfo struct {
-	Title     string            `json:"Title"`
-	Questions []models.Question `json:"questions"`
+	Title     string            `json:"title"`
+	Questions []models.Question `json:"questions" validate:"min=1"`
 }
 
 // 获得用于填写的问卷，只包含问题，不包含统计数据
 // 输入的参数：委托的id
 // 输出的参数：不包含统计数据的问卷
-func (qs *questionnaireService) GetQuestionnairePreview(delegationID string) *models.SimpleQuestionnaire {
-	delegation := qs.delegationModel.GetSpecificDelegation(delegationID)
+func (qs *questionnaireService) GetQuestionnairePreview(ctx context.Context, delegationID string) *models.SimpleQuestionnaire {
+	delegation := qs.delegationModel.GetSpecificDelegation(ctx, delegationID)
 	qid := delegation.QuestionnaireID
-	log.Debug().Msg(fmt.Sprintf("不带统计的问卷: %+v", qs.questionnaireModel.GetQuestionnaire(qid)))
-	return qs.questionnaireModel.GetQuestionnaire(qid)
+	lib.Log(ctx).Debug().Interface("questionnaire", qs.questionnaireModel.GetQuestionnaire(ctx, qid)).Msg("questionnaire without statistics")
+	return qs.questionnaireModel.GetQuestionnaire(ctx, qid)
 }
 
 // 获得完整问卷
 // 输入的参数：委托的id
 // 输出的参数：完整问卷
-func (qs *questionnaireService) GetFullQuestionnaire(userID, delegationID string) *models.QuestionnaireDoc {
-	delegation := qs.delegationModel.GetSpecificDelegation(delegationID)
-	lib.Assert(delegation.PublisherID == userID, "invalid_full_questionnaire_not_get_by_publisher", 401)
-	return qs.questionnaireModel.GetFullQuestionnaire(delegation.QuestionnaireID)
+func (qs *questionnaireService) GetFullQuestionnaire(ctx context.Context, userID, delegationID string) *models.QuestionnaireDoc {
+	delegation := qs.delegationModel.GetSpecificDelegation(ctx, delegationID)
+	lib.Assert(delegation.PublisherID == userID, "invalid_full_questionnaire_not_get_by_publisher")
+	return qs.questionnaireModel.GetFullQuestionnaire(ctx, delegation.QuestionnaireID)
 }
 
 // 添加一个问卷填写的记录
 // TODO:需要条件：必须为已接受的用户
 // 输入参数：完整的一次问卷
 // 无输出
-func (qs *questionnaireService) AddRecord(userID, delegationID string, doc *QuestionnaireInfo) {
-	delegation := qs.delegationModel.GetSpecificDelegation(delegationID)
+func (qs *questionnaireService) AddRecord(ctx context.Context, userID, delegationID string, doc *QuestionnaireInfo) {
+	delegation := qs.delegationModel.GetSpecificDelegation(ctx, delegationID)
 	flag := 0
 	for _, tempReceiverID := range delegation.ReceiverID {
 		if tempReceiverID == userID {
 			flag = 1
 		}
 	}
-	lib.Assert(flag == 1, "invalid_not_add_by_current_receiver", 401)
-	oldQuestionnaire := qs.questionnaireModel.GetFullQuestionnaire(delegation.QuestionnaireID)
+	lib.Assert(flag == 1, "invalid_not_add_by_current_receiver")
+	oldQuestionnaire := qs.questionnaireModel.GetFullQuestionnaire(ctx, delegation.QuestionnaireID)
+	// 填写的问卷需要和原问卷的题目一一对应
+	lib.Assert(len(doc.Questions) == len(oldQuestionnaire.Questions), "questionnaire_mismatch")
+	for questionIndex, tempQuestion := range doc.Questions {
+		lib.Assert(len(tempQuestion.Answers) == len(oldQuestionnaire.Questions[questionIndex].Answers), "questionnaire_mismatch")
+	}
 	for questionIndex, tempQuestion := range doc.Questions {
 		for answerIndex, tempAnswer := range tempQuestion.Answers {
 			oldQuestionnaire.Questions[questionIndex].Answers[answerIndex].Count += tempAnswer.Count
 		}
 	}
 
-	qs.questionnaireModel.AddOneRecord(delegation.QuestionnaireID, oldQuestionnaire.Questions)
+	qs.questionnaireModel.AddOneRecord(ctx, delegation.QuestionnaireID, oldQuestionnaire.Questions)
+	recordAudit(ctx, userID, AuditQuestionnaireSubmit, delegationID, nil, questionnaireSubmitSnapshot{delegation.QuestionnaireID, doc.Questions})
+}
+
+// 提交的问卷的快照
+type questionnaireSubmitSnapshot struct {
+	QuestionnaireID string            `bson:"questionnaire_id"`
+	Questions       []models.Question `bson:"questions"`
 }
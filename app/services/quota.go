@@ -0,0 +1,42 @@
+package services
+
+import (
+	"context"
+	"time"
+
+	"github.com/sysu-team/Back-end-development/app/configs"
+	"github.com/sysu-team/Back-end-development/app/models"
+	"github.com/sysu-team/Back-end-development/lib"
+)
+
+// 业务配额，InitQuota 之前不限制
+var (
+	quota        configs.QuotaConfig
+	quotaLimiter lib.Limiter
+)
+
+// InitQuota 根据配置初始化业务配额
+// 每小时接受委托的次数使用令牌桶统计，和接口限流共用 limiter
+func InitQuota(config *configs.QuotaConfig, limiter lib.Limiter) {
+	quota = *config
+	quotaLimiter = limiter
+}
+
+// 检查发布者进行中的委托数量
+func assertOpenDelegationQuota(ctx context.Context, delegationModel *models.DelegationModel, publisherID string) {
+	if quota.MaxOpenDelegations <= 0 {
+		return
+	}
+	n := delegationModel.CountOpenByPublisher(ctx, publisherID)
+	lib.Assert(n < int64(quota.MaxOpenDelegations), "open_delegations_exceeded")
+}
+
+// 取出一次接受委托的配额，需要在其他检查都通过之后调用
+func takeAcceptQuota(ctx context.Context, receiverID string) {
+	if quota.AcceptsPerHour <= 0 || quotaLimiter == nil {
+		return
+	}
+	perHour := quota.AcceptsPerHour
+	allowed, wait := quotaLimiter.Take(ctx, "quota_accept:"+receiverID, float64(perHour)/time.Hour.Seconds(), perHour)
+	lib.AssertRate(allowed, wait, "accept_quota_exceeded")
+}
@@ -0,0 +1,242 @@
+package services
+
+import (
+	"context"
+	"crypto/rand"
+	"math/big"
+	"strings"
+	"time"
+
+	"github.com/sysu-team/Back-end-development/app/models"
+	"github.com/sysu-team/Back-end-development/lib"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// ShopService 积分商城
+// 兑换时先扣减库存再扣积分，任何一步失败都会归还之前扣减的库存和积分
+type ShopService interface {
+	// includeDisabled 为 true 时包括已经下架的商品，管理员使用
+	GetItems(ctx context.Context, includeDisabled bool) []ShopItemInfo
+	GetItem(ctx context.Context, itemID string) *ShopItemInfo
+	CreateItem(ctx context.Context, adminID string, item *ShopItemReq) *ShopItemInfo
+	UpdateItem(ctx context.Context, adminID, itemID string, item *ShopItemReq) *ShopItemInfo
+	Redeem(ctx context.Context, openid, itemID string) *RedemptionInfo
+	GetRedemptions(ctx context.Context, openid string, page, limit int) []RedemptionInfo
+	// 核销兑换码
+	UseRedemption(ctx context.Context, adminID, code string) *RedemptionInfo
+}
+
+func NewShopService() ShopService {
+	return &shopService{
+		models.GetModel().Shop,
+		models.GetModel().User,
+		NewCreditService(),
+	}
+}
+
+type shopService struct {
+	shopModel *models.ShopModel
+	userModel *models.UserModel
+	credit    CreditService
+}
+
+// 创建或者修改商品
+type ShopItemReq struct {
+	Name        string                  `json:"name" validate:"required,max=50"`
+	Description string                  `json:"description" validate:"max=500"`
+	Kind        models.EnumShopItemKind `json:"kind" validate:"required,oneof=coupon merchandise"`
+	Price       int                     `json:"price" validate:"min=1"` // 兑换需要的积分
+	Stock       int                     `json:"stock" validate:"min=0"` // 库存，修改时直接设置为这个值
+	Order       int                     `json:"order"`                  // 展示的顺序，从小到大
+	Enabled     bool                    `json:"enabled"`                // 是否上架
+}
+
+// 商品
+type ShopItemInfo struct {
+	ID          string                  `json:"id"`
+	Name        string                  `json:"name"`
+	Description string                  `json:"description"`
+	Kind        models.EnumShopItemKind `json:"kind"` // coupon 优惠券，merchandise 周边商品
+	Price       int                     `json:"price"`
+	Stock       int                     `json:"stock"`
+	Order       int                     `json:"order"`
+	Enabled     bool                    `json:"enabled"`
+	CreateTime  int64                   `json:"create_time"`
+	UpdateTime  int64                   `json:"update_time"`
+}
+
+// 兑换记录
+type RedemptionInfo struct {
+	ID         string                     `json:"id"`
+	OrderNo    string                     `json:"order_no"`
+	Code       string                     `json:"code"` // 兑换码，凭兑换码使用优惠券或者领取商品
+	ItemID     string                     `json:"item_id"`
+	ItemName   string                     `json:"item_name"`
+	ItemKind   models.EnumShopItemKind    `json:"item_kind"`
+	Price      int                        `json:"price"`
+	State      models.EnumRedemptionState `json:"state"` // 0 未使用，1 已使用
+	UsedTime   int64                      `json:"used_time"`
+	CreateTime int64                      `json:"create_time"`
+}
+
+func shopItemInfo(doc *models.ShopItemDoc) ShopItemInfo {
+	return ShopItemInfo{
+		ID:          doc.ID.Hex(),
+		Name:        doc.Name,
+		Description: doc.Description,
+		Kind:        doc.Kind,
+		Price:       doc.Price,
+		Stock:       doc.Stock,
+		Order:       doc.Order,
+		Enabled:     doc.Enabled,
+		CreateTime:  doc.CreateTime,
+		UpdateTime:  doc.UpdateTime,
+	}
+}
+
+func redemptionInfo(doc *models.RedemptionDoc) RedemptionInfo {
+	return RedemptionInfo{
+		ID:         doc.ID.Hex(),
+		OrderNo:    doc.OrderNo,
+		Code:       doc.Code,
+		ItemID:     doc.ItemID,
+		ItemName:   doc.ItemName,
+		ItemKind:   doc.ItemKind,
+		Price:      doc.Price,
+		State:      doc.State,
+		UsedTime:   doc.UsedTime,
+		CreateTime: doc.CreateTime,
+	}
+}
+
+// 兑换码的字符，去掉了容易混淆的 0 O 1 I
+const redemptionCodeChars = "ABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+
+const redemptionCodeLength = 10
+
+func newRedemptionCode() string {
+	var sb strings.Builder
+	for i := 0; i < redemptionCodeLength; i++ {
+		d, err := rand.Int(rand.Reader, big.NewInt(int64(len(redemptionCodeChars))))
+		lib.AssertErr(err)
+		sb.WriteByte(redemptionCodeChars[d.Int64()])
+	}
+	return sb.String()
+}
+
+func (s *shopService) GetItems(ctx context.Context, includeDisabled bool) []ShopItemInfo {
+	docs := s.shopModel.GetItems(ctx, !includeDisabled)
+	res := make([]ShopItemInfo, 0, len(docs))
+	for i := range docs {
+		res = append(res, shopItemInfo(&docs[i]))
+	}
+	return res
+}
+
+// 获取上架的商品
+func (s *shopService) GetItem(ctx context.Context, itemID string) *ShopItemInfo {
+	item := s.shopModel.GetItem(ctx, itemID)
+	lib.Assert(item != nil && item.Enabled, "no_such_shop_item")
+	info := shopItemInfo(item)
+	return &info
+}
+
+func (s *shopService) CreateItem(ctx context.Context, adminID string, item *ShopItemReq) *ShopItemInfo {
+	doc := &models.ShopItemDoc{
+		Name:        item.Name,
+		Description: item.Description,
+		Kind:        item.Kind,
+		Price:       item.Price,
+		Stock:       item.Stock,
+		Order:       item.Order,
+		Enabled:     item.Enabled,
+	}
+	id := s.shopModel.CreateItem(ctx, doc)
+	created := s.shopModel.GetItem(ctx, id)
+	recordAudit(ctx, adminID, AuditAdminShopItem, id, nil, created)
+	info := shopItemInfo(created)
+	return &info
+}
+
+func (s *shopService) UpdateItem(ctx context.Context, adminID, itemID string, item *ShopItemReq) *ShopItemInfo {
+	before := s.shopModel.GetItem(ctx, itemID)
+	lib.Assert(before != nil, "no_such_shop_item")
+	lib.Assert(s.shopModel.UpdateItem(ctx, itemID, &models.ShopItemDoc{
+		Name:        item.Name,
+		Description: item.Description,
+		Kind:        item.Kind,
+		Price:       item.Price,
+		Stock:       item.Stock,
+		Order:       item.Order,
+		Enabled:     item.Enabled,
+	}), "no_such_shop_item")
+	updated := s.shopModel.GetItem(ctx, itemID)
+	recordAudit(ctx, adminID, AuditAdminShopItem, itemID, before, updated)
+	info := shopItemInfo(updated)
+	return &info
+}
+
+// 兑换商品，按照扣减库存时的价格扣除积分
+func (s *shopService) Redeem(ctx context.Context, openid, itemID string) *RedemptionInfo {
+	user := s.userModel.GetUserByOpenID(ctx, openid)
+	lib.Assert(user != nil, "no_such_user")
+	assertUserActive(ctx, s.userModel, user)
+	item := s.shopModel.GetItem(ctx, itemID)
+	lib.Assert(item != nil && item.Enabled, "no_such_shop_item")
+	lib.Assert(s.credit.CanSpend(user, item.Price), "not_enough_credit_to_redeem")
+
+	// 扣减库存之后的操作不随请求取消，客户端断开时也要创建或者返还
+	ctx, cancel := lib.Detach(ctx)
+	defer cancel()
+	item = s.shopModel.TakeStock(ctx, itemID)
+	lib.Assert(item != nil, "shop_item_out_of_stock")
+	now := time.Now().Unix()
+	doc := &models.RedemptionDoc{
+		ID:         primitive.NewObjectID(),
+		OrderNo:    newOrderNo("R"),
+		Code:       newRedemptionCode(),
+		UserID:     openid,
+		ItemID:     itemID,
+		ItemName:   item.Name,
+		ItemKind:   item.Kind,
+		Price:      item.Price,
+		State:      models.RedemptionIssued,
+		CreateTime: now,
+	}
+	id, spent := "", false
+	defer func() {
+		if id != "" {
+			return
+		}
+		s.shopModel.ReturnStock(ctx, itemID)
+		if spent {
+			s.credit.GrantForOrder(ctx, openid, openid, doc.Price, doc.OrderNo, CreditRefund)
+		}
+	}()
+	s.credit.SpendForOrder(ctx, openid, openid, doc.Price, doc.OrderNo, CreditRedeem, "not_enough_credit_to_redeem")
+	spent = true
+	id = s.shopModel.CreateRedemption(ctx, doc)
+	recordAudit(ctx, openid, AuditShopRedeem, id, nil, doc)
+	info := redemptionInfo(doc)
+	return &info
+}
+
+func (s *shopService) GetRedemptions(ctx context.Context, openid string, page, limit int) []RedemptionInfo {
+	docs := s.shopModel.GetRedemptionsByUser(ctx, int64(page), int64(limit), openid)
+	res := make([]RedemptionInfo, 0, len(docs))
+	for i := range docs {
+		res = append(res, redemptionInfo(&docs[i]))
+	}
+	return res
+}
+
+func (s *shopService) UseRedemption(ctx context.Context, adminID, code string) *RedemptionInfo {
+	code = strings.ToUpper(strings.TrimSpace(code))
+	before := s.shopModel.GetRedemptionByCode(ctx, code)
+	lib.Assert(before != nil, "no_such_redemption")
+	lib.Assert(s.shopModel.UseRedemption(ctx, code, adminID), "redemption_already_used")
+	used := s.shopModel.GetRedemptionByCode(ctx, code)
+	recordAudit(ctx, adminID, AuditAdminRedemptionUse, used.ID.Hex(), before, used)
+	info := redemptionInfo(used)
+	return &info
+}
@@ -1,57 +1,106 @@
 package services
 
 import (
-	"fmt"
+	"context"
+	"io"
+	"time"
 
-	"github.com/rs/zerolog/log"
 	"github.com/sysu-team/Back-end-development/app/models"
 	"github.com/sysu-team/Back-end-development/lib"
 )
 
 // UserService 用户逻辑
 type UserService interface {
-	Register(name, studentNumber, openid string)
-	HasRegistered(openid string) bool
-	FindUserByOpenID(openid string) *models.UserDoc
-	GetUserInfo(openid string) *UserInfo
+	Register(ctx context.Context, name, studentNumber, openid string)
+	RecordLogin(ctx context.Context, openid string)
+	// 导出个人数据和注销
+	ExportUserData(ctx context.Context, openid string) *UserExport
+	DeleteAccount(ctx context.Context, openid string)
+	HasRegistered(ctx context.Context, openid string) bool
+	HasStudentNumRegistered(ctx context.Context, studentNum string) bool
+	FindUserByOpenID(ctx context.Context, openid string) *models.UserDoc
+	FindUserByStudentNum(ctx context.Context, studentNum string) *models.UserDoc
+	GetUserInfo(ctx context.Context, openid string) *UserInfo
+	// 账号状态
+	CheckUserStatus(ctx context.Context, openid string)
+	SetUserStatus(ctx context.Context, openid string, status models.EnumUserStatus, until int64, reason string)
+	// 学生身份验证
+	StartVerification(ctx context.Context, openid, email string) bool
+	ConfirmVerification(ctx context.Context, openid, code string)
+	MarkVerified(ctx context.Context, openid string)
+	ImportRoster(ctx context.Context, r io.Reader) int
+	// 个人资料
+	UpdateProfile(ctx context.Context, openid string, req *ProfileUpdateReq)
+	GetProfile(ctx context.Context, viewerID, openid string) *ProfileInfo
+	SaveAvatar(ctx context.Context, openid, fileName string, data []byte) string
 	// 获取用户相关的委托
-	GetUserPendingDelegation(page, limit int, receiverUserID string) []models.DelegationPreviewWrapper
-	GetUserPublishDelegation(page, limit int, publisherUserID string) []models.DelegationPreviewWrapper
-	GetUserReceiveDelegation(page, limit int, receiverUserID string) []models.DelegationPreviewWrapper
+	GetUserPendingDelegation(ctx context.Context, page, limit int, receiverUserID string) []models.DelegationPreviewWrapper
+	GetUserPublishDelegation(ctx context.Context, page, limit int, publisherUserID string) []models.DelegationPreviewWrapper
+	GetUserReceiveDelegation(ctx context.Context, page, limit int, receiverUserID string) []models.DelegationPreviewWrapper
 }
 
 func NewUserService() UserService {
 	return &userService{
 		models.GetModel().User,
 		models.GetModel().Delegation,
+		models.GetModel().Roster,
+		models.GetModel().Attachment,
+		models.GetModel().Verification,
+		models.GetModel().Audit,
+		models.GetModel().Payment,
+		models.GetModel().Shop,
+		models.GetModel().Message,
 	}
 }
 
 type userService struct {
-	userModel       *models.UserModel
-	delegationModel *models.DelegationModel
+	userModel         *models.UserModel
+	delegationModel   *models.DelegationModel
+	rosterModel       *models.RosterModel
+	attachmentModel   *models.AttachmentModel
+	verificationModel *models.VerificationModel
+	auditModel        *models.AuditModel
+	paymentModel      *models.PaymentModel
+	shopModel         *models.ShopModel
+	messageModel      *models.MessageModel
 }
 
-func (s *userService) Register(name, studentNumber, openid string) {
-	s.userModel.AddUser(&models.UserDoc{
+func (s *userService) Register(ctx context.Context, name, studentNumber, openid string) {
+	user := &models.UserDoc{
 		OpenID:        openid,
 		Name:          name,
 		StudentNumber: studentNumber,
-		Credit:        100,
-	})
+		// 不需要验证时直接视为已验证
+		Verified:     !verificationRequired(),
+		LastActiveAt: time.Now().Unix(),
+	}
+	s.userModel.AddUser(ctx, user)
+	recordAudit(ctx, openid, AuditRegister, openid, nil, user)
+	// 注销之后重新注册的微信账号或者学生不再发放注册奖励
+	if s.userModel.HasDeletedIdentity(ctx, openid, studentNumber) {
+		lib.Log(ctx).Info().Str("openid", openid).Msg("skip signup bonus for returning user")
+		return
+	}
+	NewCreditService().GrantSignupBonus(ctx, openid)
+}
+
+// 登陆成功后记录审计日志，同时更新最近活跃的时间
+func (s *userService) RecordLogin(ctx context.Context, openid string) {
+	s.userModel.TouchByOpenID(ctx, openid)
+	recordAudit(ctx, openid, AuditLogin, openid, nil, nil)
 }
 
 // 返回对应的用户
-func (s *userService) FindUserByOpenID(openid string) *models.UserDoc {
-	user := s.userModel.GetUserByOpenID(openid)
-	log.Debug().Msg(fmt.Sprintf("service get user by open id  %v: %v", openid, user))
+func (s *userService) FindUserByOpenID(ctx context.Context, openid string) *models.UserDoc {
+	user := s.userModel.GetUserByOpenID(ctx, openid)
+	lib.Log(ctx).Debug().Str("openid", openid).Bool("found", user != nil).Msg("get user by openid")
 	return user
 }
 
 // 按照学号来搜索用户 / 寻找是否有这个学号的用户
-func (s *userService) FindUserByStudentNum(studentNum string) *models.UserDoc {
-	user := s.userModel.GetUserByStudentNum(studentNum)
-	log.Debug().Msg(fmt.Sprintf("service get user by student number %v: %v", studentNum, user))
+func (s *userService) FindUserByStudentNum(ctx context.Context, studentNum string) *models.UserDoc {
+	user := s.userModel.GetUserByStudentNum(ctx, studentNum)
+	lib.Log(ctx).Debug().Str("student_num", studentNum).Bool("found", user != nil).Msg("get user by student number")
 	return user
 }
 
@@ -60,37 +109,110 @@ type UserInfo struct {
 	Name          string `json:"name"`
 	StudentNumber string `json:"studentNumber"`
 	Credit        int    `json:"credit"`
+	Verified      bool   `json:"verified"`
+	// 自己的个人资料全部可见
+	AvatarURL  string                   `json:"avatar_url"`
+	Campus     string                   `json:"campus"`
+	Dormitory  string                   `json:"dormitory"`
+	WechatID   string                   `json:"wechat_id"`
+	Phone      string                   `json:"phone"`
+	Bio        string                   `json:"bio"`
+	Visibility models.ProfileVisibility `json:"visibility"`
+	// 是否不出现在排行榜中
+	HideFromLeaderboard bool `json:"hide_from_leaderboard"`
 }
 
 // 获取用户信息
-func (s *userService) GetUserInfo(openid string) *UserInfo {
-	user := s.FindUserByOpenID(openid)
-	lib.Assert(user != nil, "unknown_error")
+func (s *userService) GetUserInfo(ctx context.Context, openid string) *UserInfo {
+	user := s.FindUserByOpenID(ctx, openid)
+	lib.Assert(user != nil, "no_such_user")
 	return &UserInfo{
-		user.Name,
-		user.StudentNumber,
-		user.Credit,
+		Name:                user.Name,
+		StudentNumber:       user.StudentNumber,
+		Credit:              user.Credit,
+		Verified:            user.Verified || !verificationRequired(),
+		AvatarURL:           user.AvatarURL,
+		Campus:              user.Campus,
+		Dormitory:           user.Dormitory,
+		WechatID:            user.WechatID,
+		Phone:               user.Phone,
+		Bio:                 user.Bio,
+		Visibility:          effectiveVisibility(user.Visibility),
+		HideFromLeaderboard: user.HideFromLeaderboard,
 	}
 }
 
 // 确认是否注册
-func (s *userService) HasRegistered(openid string) bool {
-	user := s.FindUserByOpenID(openid)
+func (s *userService) HasRegistered(ctx context.Context, openid string) bool {
+	user := s.FindUserByOpenID(ctx, openid)
 	//log.Debug().Interface("check user's register status " + openid, user)
 	return user != nil
 }
 
+// 确认学号是否已经被注册
+func (s *userService) HasStudentNumRegistered(ctx context.Context, studentNum string) bool {
+	return s.FindUserByStudentNum(ctx, studentNum) != nil
+}
+
+// 检查用户的账号状态，被封禁或者停用中的用户不能登陆和操作
+func (s *userService) CheckUserStatus(ctx context.Context, openid string) {
+	user := s.FindUserByOpenID(ctx, openid)
+	lib.Assert(user != nil, "unregister_user")
+	assertUserActive(ctx, s.userModel, user)
+}
+
+// 设置用户的账号状态，由管理员调用
+func (s *userService) SetUserStatus(ctx context.Context, openid string, status models.EnumUserStatus, until int64, reason string) {
+	switch status {
+	case models.UserActive:
+		until, reason = 0, ""
+	case models.UserSuspended:
+		lib.Assert(until > time.Now().Unix(), "invalid_suspended_until")
+	case models.UserBanned:
+		until = 0
+	default:
+		lib.Assert(false, "invalid_user_status")
+	}
+	user := s.FindUserByOpenID(ctx, openid)
+	lib.Assert(user != nil && user.Status != models.UserDeleted, "no_such_user")
+	s.userModel.SetStatusByOpenID(ctx, openid, status, until, reason)
+	recordAudit(ctx, auditActor(ctx), AuditAdminUserStatus, openid,
+		userStatusSnapshot{user.Status, user.SuspendedUntil, user.StatusReason},
+		userStatusSnapshot{status, until, reason})
+	lib.Log(ctx).Info().Str("openid", openid).Uint8("status", uint8(status)).Int64("until", until).Str("reason", reason).Msg("set user status")
+}
+
+// 账号状态的快照
+type userStatusSnapshot struct {
+	Status         models.EnumUserStatus `bson:"status"`
+	SuspendedUntil int64                 `bson:"suspended_until"`
+	Reason         string                `bson:"status_reason"`
+}
+
+// 断言用户处于正常状态
+// 停用期已经结束的用户会被自动恢复为正常状态
+func assertUserActive(ctx context.Context, userModel *models.UserModel, user *models.UserDoc) {
+	switch user.Status {
+	case models.UserBanned:
+		lib.Assert(false, "user_banned")
+	case models.UserSuspended:
+		lib.Assert(user.SuspendedUntil <= time.Now().Unix(), "user_suspended")
+		userModel.SetStatusByOpenID(ctx, user.OpenID, models.UserActive, 0, "")
+		user.Status, user.SuspendedUntil, user.StatusReason = models.UserActive, 0, ""
+	}
+}
+
 // 返回用户已完成的等待发布者确定的委托
-func (s *userService) GetUserPendingDelegation(page, limit int, receiverUserID string) []models.DelegationPreviewWrapper {
-	return s.delegationModel.GetUserPendingDelegationPreviewWithState(int64(page), int64(limit), receiverUserID, models.Pending)
+func (s *userService) GetUserPendingDelegation(ctx context.Context, page, limit int, receiverUserID string) []models.DelegationPreviewWrapper {
+	return s.delegationModel.GetUserPendingDelegationPreviewWithState(ctx, int64(page), int64(limit), receiverUserID, models.Pending)
 }
 
 // 返回用户发布的委托
-func (s *userService) GetUserPublishDelegation(page, limit int, publisherUserID string) []models.DelegationPreviewWrapper {
-	return s.delegationModel.GetUserPublishDelegationPreviewWithState(int64(page), int64(limit), publisherUserID, models.Published)
+func (s *userService) GetUserPublishDelegation(ctx context.Context, page, limit int, publisherUserID string) []models.DelegationPreviewWrapper {
+	return s.delegationModel.GetUserPublishDelegationPreviewWithState(ctx, int64(page), int64(limit), publisherUserID, models.Published)
 }
 
 // 返回处于接受状态的还没有完成的委托
-func (s *userService) GetUserReceiveDelegation(page, limit int, receiverUserID string) []models.DelegationPreviewWrapper {
-	return s.delegationModel.GetUserAcceptedDelegationPreviewWithState(int64(page), int64(limit), receiverUserID, models.Accepted)
+func (s *userService) GetUserReceiveDelegation(ctx context.Context, page, limit int, receiverUserID string) []models.DelegationPreviewWrapper {
+	return s.delegationModel.GetUserAcceptedDelegationPreviewWithState(ctx, int64(page), int64(limit), receiverUserID, models.Accepted)
 }
@@ -0,0 +1,208 @@
+package services
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"math/big"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"github.com/sysu-team/Back-end-development/app/configs"
+	"github.com/sysu-team/Back-end-development/app/models"
+	"github.com/sysu-team/Back-end-development/app/utils"
+	"github.com/sysu-team/Back-end-development/lib"
+)
+
+const (
+	VerifyNone   = "none"
+	VerifyRoster = "roster"
+	VerifyEmail  = "email"
+)
+
+// Verifier 学生身份验证方式
+type Verifier interface {
+	// 发起验证，返回是否已经直接通过验证
+	Start(ctx context.Context, user *models.UserDoc, email string) bool
+	// 提交验证码完成验证
+	Confirm(ctx context.Context, user *models.UserDoc, code string)
+}
+
+// singleton
+var verifier Verifier = &noneVerifier{}
+
+// InitVerifier 根据配置初始化学生身份验证方式
+func InitVerifier(config *configs.VerifyConfig, mailer utils.Mailer) {
+	switch config.Method {
+	case "", VerifyNone:
+		verifier = &noneVerifier{}
+	case VerifyRoster:
+		verifier = &rosterVerifier{models.GetModel().Roster}
+	case VerifyEmail:
+		expires := config.CodeExpires
+		if expires <= 0 {
+			expires = 600
+		}
+		verifier = &emailVerifier{
+			models.GetModel().Verification,
+			models.GetModel().User,
+			mailer,
+			strings.ToLower(config.EmailDomain),
+			time.Duration(expires) * time.Second,
+		}
+	default:
+		log.Panic().Msg("unknown verify method: " + config.Method)
+	}
+}
+
+// 是否需要进行身份验证
+func verificationRequired() bool {
+	_, ok := verifier.(*noneVerifier)
+	return !ok
+}
+
+// 断言用户已经通过身份验证，未验证的用户不能发布和接受委托
+func assertUserVerified(user *models.UserDoc) {
+	lib.Assert(user.Verified || !verificationRequired(), "user_unverified")
+}
+
+// 不需要验证
+type noneVerifier struct{}
+
+func (v *noneVerifier) Start(ctx context.Context, user *models.UserDoc, email string) bool {
+	return true
+}
+
+func (v *noneVerifier) Confirm(ctx context.Context, user *models.UserDoc, code string) {
+	lib.Assert(false, "verification_code_not_required")
+}
+
+// 使用导入的学生名单验证学号和姓名
+type rosterVerifier struct {
+	rosterModel *models.RosterModel
+}
+
+func (v *rosterVerifier) Start(ctx context.Context, user *models.UserDoc, email string) bool {
+	entry := v.rosterModel.GetByStudentNum(ctx, user.StudentNumber)
+	lib.Assert(entry != nil, "student_not_in_roster")
+	lib.Assert(entry.Name == user.Name, "student_name_mismatch")
+	return true
+}
+
+func (v *rosterVerifier) Confirm(ctx context.Context, user *models.UserDoc, code string) {
+	lib.Assert(false, "verification_code_not_required")
+}
+
+// 每个验证码最多提交的次数，超过之后需要重新获取
+const verifyMaxAttempts = 5
+
+// 向校园邮箱发送验证码
+// 同一个邮箱只能验证一个账号
+type emailVerifier struct {
+	verificationModel *models.VerificationModel
+	userModel         *models.UserModel
+	mailer            utils.Mailer
+	domain            string
+	expires           time.Duration
+}
+
+func (v *emailVerifier) Start(ctx context.Context, user *models.UserDoc, email string) bool {
+	email = strings.ToLower(strings.TrimSpace(email))
+	lib.Assert(strings.HasSuffix(email, "@"+v.domain) && len(email) > len(v.domain)+1, "invalid_campus_email")
+	other := v.userModel.GetUserByEmail(ctx, email)
+	lib.Assert(other == nil || other.OpenID == user.OpenID, "email_already_used")
+	code := randomDigits(6)
+	v.verificationModel.SetCode(ctx, user.OpenID, email, code, time.Now().Add(v.expires))
+	lib.AssertErr(v.mailer.Send(email, "学生身份验证",
+		fmt.Sprintf("你的验证码是 %v，%v 分钟内有效。", code, int(v.expires.Minutes()))), "mail_send_failed")
+	return false
+}
+
+func (v *emailVerifier) Confirm(ctx context.Context, user *models.UserDoc, code string) {
+	doc := v.verificationModel.GetCode(ctx, user.OpenID)
+	lib.Assert(doc != nil && doc.ExpireAt.After(time.Now()), "verification_code_expired")
+	attempts := v.verificationModel.AddAttempt(ctx, user.OpenID)
+	lib.Assert(attempts > 0, "verification_code_expired")
+	lib.Assert(attempts <= verifyMaxAttempts, "verification_attempts_exceeded")
+	if doc.Code != code {
+		if attempts == verifyMaxAttempts {
+			v.verificationModel.DeleteCode(ctx, user.OpenID)
+		}
+		lib.Assert(false, "invalid_verification_code")
+	}
+	v.verificationModel.DeleteCode(ctx, user.OpenID)
+	user.Email = doc.Email
+}
+
+// 生成指定长度的数字验证码
+func randomDigits(n int) string {
+	var sb strings.Builder
+	for i := 0; i < n; i++ {
+		d, err := rand.Int(rand.Reader, big.NewInt(10))
+		lib.AssertErr(err)
+		sb.WriteString(d.String())
+	}
+	return sb.String()
+}
+
+// 发起身份验证
+// 返回是否已经通过验证，邮箱验证需要再提交验证码
+func (s *userService) StartVerification(ctx context.Context, openid, email string) bool {
+	user := s.FindUserByOpenID(ctx, openid)
+	lib.Assert(user != nil, "unregister_user")
+	lib.Assert(!user.Verified, "already_verified")
+	if !verifier.Start(ctx, user, email) {
+		return false
+	}
+	s.userModel.SetVerifiedByOpenID(ctx, openid, user.Email)
+	return true
+}
+
+// 提交验证码完成身份验证
+func (s *userService) ConfirmVerification(ctx context.Context, openid, code string) {
+	user := s.FindUserByOpenID(ctx, openid)
+	lib.Assert(user != nil, "unregister_user")
+	lib.Assert(!user.Verified, "already_verified")
+	verifier.Confirm(ctx, user, code)
+	s.userModel.SetVerifiedByOpenID(ctx, openid, user.Email)
+}
+
+// 直接标记为已经通过验证，用于运维人员人工核实身份后处理
+func (s *userService) MarkVerified(ctx context.Context, openid string) {
+	user := s.FindUserByOpenID(ctx, openid)
+	lib.Assert(user != nil, "no_such_user")
+	s.userModel.SetVerifiedByOpenID(ctx, openid, user.Email)
+	recordAudit(ctx, auditActor(ctx), AuditAdminVerifyUser, openid, nil, nil)
+}
+
+// 导入学生名单
+// CSV 每行为 学号,姓名，第一行可以是表头
+func (s *userService) ImportRoster(ctx context.Context, r io.Reader) int {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+	records, err := reader.ReadAll()
+	lib.Assert(err == nil, "invalid_roster_csv")
+	entries := make([]models.RosterDoc, 0, len(records))
+	for i, record := range records {
+		lib.Assert(len(record) >= 2, "invalid_roster_csv")
+		studentNum, name := strings.TrimSpace(record[0]), strings.TrimSpace(record[1])
+		if i == 0 && (studentNum == "student_num" || studentNum == "学号") {
+			continue
+		}
+		lib.Assert(studentNum != "" && name != "", "invalid_roster_csv")
+		entries = append(entries, models.RosterDoc{StudentNumber: studentNum, Name: name})
+	}
+	n := s.rosterModel.ImportRoster(ctx, entries)
+	recordAudit(ctx, auditActor(ctx), AuditAdminImportRoster, "", nil, rosterImportSnapshot{len(entries), n})
+	return n
+}
+
+// 导入学生名单的结果
+type rosterImportSnapshot struct {
+	Entries  int `bson:"entries"`
+	Imported int `bson:"imported"`
+}
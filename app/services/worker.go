@@ -0,0 +1,73 @@
+package services
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Worker 按照固定间隔执行的后台任务
+type Worker struct {
+	Name     string
+	Interval time.Duration
+	Run      func(ctx context.Context)
+}
+
+// 服务器启动的后台任务
+func workers() []Worker {
+	return []Worker{
+		{"auto_confirm", time.Minute, func(ctx context.Context) {
+			if n := NewDelegationService().AutoConfirm(ctx); n != 0 {
+				log.Info().Int("count", n).Msg("auto confirmed delegations")
+			}
+		}},
+		{"credit_decay", time.Hour, func(ctx context.Context) {
+			if n := NewCreditService().Decay(ctx); n != 0 {
+				log.Info().Int("count", n).Msg("decayed credit of inactive users")
+			}
+		}},
+		{"payment_reconcile", 5 * time.Minute, func(ctx context.Context) {
+			if n := NewPaymentService().Reconcile(ctx); n != 0 {
+				log.Info().Int("count", n).Msg("reconciled payment orders and withdrawals")
+			}
+		}},
+		{"leaderboard_refresh", 10 * time.Minute, func(ctx context.Context) {
+			NewLeaderboardService().Refresh(ctx)
+		}},
+	}
+}
+
+// StartWorkers 启动后台任务
+// ctx 被取消后任务在当前一轮结束后退出，使用返回的 WaitGroup 等待所有任务退出
+func StartWorkers(ctx context.Context) *sync.WaitGroup {
+	wg := &sync.WaitGroup{}
+	for _, w := range workers() {
+		wg.Add(1)
+		go func(w Worker) {
+			defer wg.Done()
+			ticker := time.NewTicker(w.Interval)
+			defer ticker.Stop()
+			for {
+				runWorker(ctx, w)
+				select {
+				case <-ctx.Done():
+					return
+				case <-ticker.C:
+				}
+			}
+		}(w)
+	}
+	return wg
+}
+
+// 执行一轮任务，任务中的 panic 只记录日志，不影响下一轮
+func runWorker(ctx context.Context, w Worker) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Error().Str("worker", w.Name).Interface("panic", r).Msg("worker failed")
+		}
+	}()
+	w.Run(ctx)
+}
@@ -0,0 +1,53 @@
+package utils
+
+import (
+	"fmt"
+	"mime"
+	"net/smtp"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+	"github.com/sysu-team/Back-end-development/app/configs"
+)
+
+// Mailer 邮件发送接口
+type Mailer interface {
+	Send(to, subject, body string) error
+}
+
+// NewMailer 根据配置创建邮件发送器
+// 开发环境下可以使用 stub，验证码会直接输出到日志中，只有明确设置 stub 时才不发送
+func NewMailer(config *configs.SMTPConfig) Mailer {
+	if config.Stub {
+		return &stubMailer{}
+	}
+	return &smtpMailer{config}
+}
+
+type smtpMailer struct {
+	config *configs.SMTPConfig
+}
+
+func (m *smtpMailer) Send(to, subject, body string) error {
+	var auth smtp.Auth
+	if m.config.User != "" {
+		auth = smtp.PlainAuth("", m.config.User, m.config.Password, m.config.Host)
+	}
+	msg := strings.Join([]string{
+		"From: " + m.config.From,
+		"To: " + to,
+		"Subject: " + mime.BEncoding.Encode("UTF-8", subject),
+		"MIME-Version: 1.0",
+		"Content-Type: text/plain; charset=UTF-8",
+		"",
+		body,
+	}, "\r\n")
+	return smtp.SendMail(fmt.Sprintf("%v:%v", m.config.Host, m.config.Port), auth, m.config.From, []string{to}, []byte(msg))
+}
+
+type stubMailer struct{}
+
+func (m *stubMailer) Send(to, subject, body string) error {
+	log.Info().Str("to", to).Str("subject", subject).Str("body", body).Msg("stub mail")
+	return nil
+}
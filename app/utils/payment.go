@@ -0,0 +1,86 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/sysu-team/Back-end-development/app/configs"
+)
+
+const (
+	PaymentNone  = "none"
+	PaymentWxPay = "wxpay"
+)
+
+// 支付订单在支付平台的状态
+type PaymentTradeState string
+
+const (
+	TradeNotPay  PaymentTradeState = "NOTPAY"  // 未支付
+	TradeSuccess PaymentTradeState = "SUCCESS" // 支付成功
+	TradeClosed  PaymentTradeState = "CLOSED"  // 已关闭
+	TradeUnknown PaymentTradeState = ""        // 其他状态，例如支付中，稍后重新查询
+)
+
+// 创建支付订单的参数，金额单位为分
+type PaymentOrder struct {
+	OrderNo     string
+	OpenID      string
+	Amount      int64
+	Description string
+	ClientIP    string
+	ExpireAt    int64 // Unix时间戳
+}
+
+// 支付平台中订单的状态，由支付结果通知或者主动查询得到
+type PaymentResult struct {
+	OrderNo       string
+	TransactionID string // 支付平台的订单号
+	Amount        int64
+	State         PaymentTradeState
+}
+
+// 提现转账的参数，金额单位为分
+type PaymentTransfer struct {
+	TransferNo  string // 相同的单号重复转账只会转账一次
+	OpenID      string
+	Amount      int64
+	Description string
+}
+
+// PaymentError 支付平台返回的业务错误
+// Final 为 true 时操作确定没有成功，否则结果不确定，需要使用相同的单号重试
+type PaymentError struct {
+	Code    string
+	Message string
+	Final   bool
+}
+
+func (e *PaymentError) Error() string {
+	return fmt.Sprintf("payment error %v: %v", e.Code, e.Message)
+}
+
+// PaymentProvider 支付平台接口
+type PaymentProvider interface {
+	// 创建订单，返回小程序发起支付的参数
+	CreateOrder(ctx context.Context, order *PaymentOrder) (map[string]string, error)
+	// 查询订单的状态，用于对账
+	QueryOrder(ctx context.Context, orderNo string) (*PaymentResult, error)
+	// 关闭超时未支付的订单
+	CloseOrder(ctx context.Context, orderNo string) error
+	// 转账到用户的零钱，用于提现
+	Transfer(ctx context.Context, transfer *PaymentTransfer) (transactionID string, err error)
+	// 检查支付结果通知的签名，返回通知中的订单状态
+	ParseNotify(req *http.Request) (*PaymentResult, error)
+	// 支付结果通知的响应，ok 为 false 时支付平台稍后会重新通知
+	NotifyResponse(ok bool, msg string) (contentType string, body []byte)
+}
+
+// NewPaymentProvider 根据配置创建支付平台，provider 为 none 时返回 nil
+func NewPaymentProvider(config *configs.PaymentConfig, appID string) PaymentProvider {
+	if config.Provider == PaymentWxPay {
+		return newWxPay(config, appID)
+	}
+	return nil
+}
@@ -0,0 +1,67 @@
+package utils
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/sysu-team/Back-end-development/app/configs"
+)
+
+const (
+	StorageLocal = "local"
+	StorageS3    = "s3"
+)
+
+// BlobStore 上传文件的存储接口
+// key 由调用者生成，使用 / 分隔，本地存储忽略 ctx
+type BlobStore interface {
+	Put(ctx context.Context, key string, data []byte, contentType string) error
+	Get(ctx context.Context, key string) ([]byte, error)
+	Delete(ctx context.Context, key string) error
+}
+
+// NewBlobStore 根据配置创建存储，默认保存在本地目录中
+func NewBlobStore(config *configs.StorageConfig) BlobStore {
+	if config.Backend == StorageS3 {
+		return newS3Store(&config.S3)
+	}
+	dir := config.LocalDir
+	if dir == "" {
+		dir = "uploads"
+	}
+	return &localStore{dir}
+}
+
+// 保存在本地文件系统中
+type localStore struct {
+	dir string
+}
+
+func (s *localStore) path(key string) string {
+	// 防止 key 跳出存储目录
+	key = strings.Replace(key, "..", "", -1)
+	return filepath.Join(s.dir, filepath.FromSlash(key))
+}
+
+func (s *localStore) Put(ctx context.Context, key string, data []byte, contentType string) error {
+	p := s.path(key)
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(p, data, 0644)
+}
+
+func (s *localStore) Get(ctx context.Context, key string) ([]byte, error) {
+	return ioutil.ReadFile(s.path(key))
+}
+
+func (s *localStore) Delete(ctx context.Context, key string) error {
+	err := os.Remove(s.path(key))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
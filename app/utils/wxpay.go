@@ -0,0 +1,297 @@
+package utils
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"github.com/sysu-team/Back-end-development/app/configs"
+)
+
+// 微信支付的默认地址，可以在配置中替换为本地的模拟服务
+const wxPayEndpoint = "https://api.mch.weixin.qq.com"
+
+// 微信支付的时间使用北京时间
+var wxPayZone = time.FixedZone("CST", 8*3600)
+
+// 微信支付 v2 风格的接口：请求和响应为 XML，使用 HMAC-SHA256 签名
+// 转账需要商户证书，配置了 cert_file 和 key_file 时使用
+type wxPay struct {
+	config   *configs.PaymentConfig
+	appID    string
+	endpoint string
+	client   *http.Client
+}
+
+func newWxPay(config *configs.PaymentConfig, appID string) *wxPay {
+	client := &http.Client{Timeout: 10 * time.Second}
+	if config.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(config.CertFile, config.KeyFile)
+		if err != nil {
+			log.Panic().Err(err).Msg("Can't load payment certificate")
+		}
+		client.Transport = &http.Transport{TLSClientConfig: &tls.Config{Certificates: []tls.Certificate{cert}}}
+	}
+	endpoint := strings.TrimRight(config.Endpoint, "/")
+	if endpoint == "" {
+		endpoint = wxPayEndpoint
+	}
+	return &wxPay{config, appID, endpoint, client}
+}
+
+func (p *wxPay) CreateOrder(ctx context.Context, order *PaymentOrder) (map[string]string, error) {
+	res, err := p.call(ctx, "/pay/unifiedorder", map[string]string{
+		"appid":            p.appID,
+		"mch_id":           p.config.MchID,
+		"body":             order.Description,
+		"out_trade_no":     order.OrderNo,
+		"total_fee":        strconv.FormatInt(order.Amount, 10),
+		"spbill_create_ip": order.ClientIP,
+		"notify_url":       p.config.NotifyURL,
+		"trade_type":       "JSAPI",
+		"openid":           order.OpenID,
+		"time_expire":      time.Unix(order.ExpireAt, 0).In(wxPayZone).Format("20060102150405"),
+	}, true)
+	if err != nil {
+		return nil, err
+	}
+	// 小程序调用 wx.requestPayment 的参数
+	params := map[string]string{
+		"appId":     p.appID,
+		"timeStamp": strconv.FormatInt(time.Now().Unix(), 10),
+		"nonceStr":  nonceStr(),
+		"package":   "prepay_id=" + res["prepay_id"],
+		"signType":  "HMAC-SHA256",
+	}
+	params["paySign"] = p.sign(params)
+	return params, nil
+}
+
+func (p *wxPay) QueryOrder(ctx context.Context, orderNo string) (*PaymentResult, error) {
+	res, err := p.call(ctx, "/pay/orderquery", map[string]string{
+		"appid":        p.appID,
+		"mch_id":       p.config.MchID,
+		"out_trade_no": orderNo,
+	}, true)
+	if e, ok := err.(*PaymentError); ok && e.Code == "ORDERNOTEXIST" {
+		// 下单没有成功，订单不会再被支付
+		return &PaymentResult{OrderNo: orderNo, State: TradeClosed}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	result := &PaymentResult{OrderNo: orderNo, TransactionID: res["transaction_id"]}
+	result.Amount, _ = strconv.ParseInt(res["total_fee"], 10, 64)
+	switch res["trade_state"] {
+	case "SUCCESS", "REFUND":
+		result.State = TradeSuccess
+	case "NOTPAY":
+		result.State = TradeNotPay
+	case "CLOSED", "REVOKED", "PAYERROR":
+		result.State = TradeClosed
+	default:
+		result.State = TradeUnknown
+	}
+	return result, nil
+}
+
+func (p *wxPay) CloseOrder(ctx context.Context, orderNo string) error {
+	_, err := p.call(ctx, "/pay/closeorder", map[string]string{
+		"appid":        p.appID,
+		"mch_id":       p.config.MchID,
+		"out_trade_no": orderNo,
+	}, true)
+	return err
+}
+
+func (p *wxPay) Transfer(ctx context.Context, transfer *PaymentTransfer) (string, error) {
+	res, err := p.call(ctx, "/mmpaymkttransfers/promotion/transfers", map[string]string{
+		"mch_appid":        p.appID,
+		"mchid":            p.config.MchID,
+		"partner_trade_no": transfer.TransferNo,
+		"openid":           transfer.OpenID,
+		"check_name":       "NO_CHECK",
+		"amount":           strconv.FormatInt(transfer.Amount, 10),
+		"desc":             transfer.Description,
+	}, false)
+	if err != nil {
+		return "", err
+	}
+	return res["payment_no"], nil
+}
+
+// 支付结果通知的请求体的最大字节数
+const maxNotifySize = 64 << 10
+
+func (p *wxPay) ParseNotify(req *http.Request) (*PaymentResult, error) {
+	body, err := ioutil.ReadAll(io.LimitReader(req.Body, maxNotifySize))
+	if err != nil {
+		return nil, err
+	}
+	params, err := decodeWxPayXML(body)
+	if err != nil {
+		return nil, err
+	}
+	if params["return_code"] != "SUCCESS" {
+		return nil, fmt.Errorf("wxpay notify: %v %v", params["return_code"], params["return_msg"])
+	}
+	if !p.verify(params) {
+		return nil, fmt.Errorf("wxpay notify: invalid signature")
+	}
+	if params["appid"] != p.appID || params["mch_id"] != p.config.MchID {
+		return nil, fmt.Errorf("wxpay notify: unexpected merchant %v %v", params["appid"], params["mch_id"])
+	}
+	result := &PaymentResult{
+		OrderNo:       params["out_trade_no"],
+		TransactionID: params["transaction_id"],
+		State:         TradeUnknown,
+	}
+	result.Amount, _ = strconv.ParseInt(params["total_fee"], 10, 64)
+	if params["result_code"] == "SUCCESS" {
+		result.State = TradeSuccess
+	}
+	return result, nil
+}
+
+func (p *wxPay) NotifyResponse(ok bool, msg string) (string, []byte) {
+	code := "FAIL"
+	if ok {
+		code = "SUCCESS"
+	}
+	return "application/xml", encodeWxPayXML(map[string]string{"return_code": code, "return_msg": msg})
+}
+
+// 调用支付接口，自动添加随机串和签名，检查响应的签名
+// 通信失败和结果不确定的错误需要使用相同的单号重试
+func (p *wxPay) call(ctx context.Context, path string, params map[string]string, final bool) (map[string]string, error) {
+	params["nonce_str"] = nonceStr()
+	params["sign_type"] = "HMAC-SHA256"
+	params["sign"] = p.sign(params)
+	req, err := http.NewRequest("POST", p.endpoint+path, bytes.NewReader(encodeWxPayXML(params)))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/xml")
+	resp, err := p.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 300 {
+		return nil, fmt.Errorf("wxpay %v: %v %v", path, resp.StatusCode, string(body))
+	}
+	res, err := decodeWxPayXML(body)
+	if err != nil {
+		return nil, err
+	}
+	if res["return_code"] != "SUCCESS" {
+		return nil, fmt.Errorf("wxpay %v: %v %v", path, res["return_code"], res["return_msg"])
+	}
+	if !p.verify(res) {
+		return nil, fmt.Errorf("wxpay %v: invalid response signature", path)
+	}
+	if res["result_code"] != "SUCCESS" {
+		// 系统错误时结果不确定
+		return nil, &PaymentError{res["err_code"], res["err_code_des"], final || res["err_code"] != "SYSTEMERROR"}
+	}
+	return res, nil
+}
+
+// 签名：参数按照名字排序后拼接为 k=v&k=v&key=API密钥，计算 HMAC-SHA256 后转为大写的十六进制
+// sign 和空的参数不参与签名
+func (p *wxPay) sign(params map[string]string) string {
+	keys := make([]string, 0, len(params))
+	for k, v := range params {
+		if k != "sign" && v != "" {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	buf := &bytes.Buffer{}
+	for _, k := range keys {
+		buf.WriteString(k + "=" + params[k] + "&")
+	}
+	buf.WriteString("key=" + p.config.APIKey)
+	mac := hmac.New(sha256.New, []byte(p.config.APIKey))
+	mac.Write(buf.Bytes())
+	return strings.ToUpper(hex.EncodeToString(mac.Sum(nil)))
+}
+
+func (p *wxPay) verify(params map[string]string) bool {
+	return hmac.Equal([]byte(params["sign"]), []byte(p.sign(params)))
+}
+
+func nonceStr() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// 编码为 <xml><k>v</k>...</xml>，参数按照名字排序
+func encodeWxPayXML(params map[string]string) []byte {
+	keys := make([]string, 0, len(params))
+	for k := range params {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	buf := &bytes.Buffer{}
+	buf.WriteString("<xml>")
+	for _, k := range keys {
+		buf.WriteString("<" + k + ">")
+		_ = xml.EscapeText(buf, []byte(params[k]))
+		buf.WriteString("</" + k + ">")
+	}
+	buf.WriteString("</xml>")
+	return buf.Bytes()
+}
+
+// 解码只有一层子元素的 XML
+func decodeWxPayXML(data []byte) (map[string]string, error) {
+	params := make(map[string]string)
+	decoder := xml.NewDecoder(bytes.NewReader(data))
+	depth, key, value := 0, "", ""
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch t := token.(type) {
+		case xml.StartElement:
+			depth++
+			if depth == 2 {
+				key, value = t.Name.Local, ""
+			}
+		case xml.CharData:
+			if depth == 2 {
+				value += string(t)
+			}
+		case xml.EndElement:
+			if depth == 2 {
+				params[key] = value
+			}
+			depth--
+		}
+	}
+	return params, nil
+}
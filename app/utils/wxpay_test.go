@@ -0,0 +1,97 @@
+package utils
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/sysu-team/Back-end-development/app/configs"
+)
+
+func newTestWxPay(endpoint string) *wxPay {
+	return newWxPay(&configs.PaymentConfig{
+		Provider:  PaymentWxPay,
+		Endpoint:  endpoint,
+		MchID:     "1900000109",
+		APIKey:    "test-key",
+		NotifyURL: "https://example.com/payments/notify",
+	}, "wx-app")
+}
+
+// 模拟的支付平台检查请求的签名，并返回签名的响应
+func TestWxPayCreateOrder(t *testing.T) {
+	var p *wxPay
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		params, err := decodeWxPayXML(body)
+		if err != nil || !p.verify(params) || r.URL.Path != "/pay/unifiedorder" {
+			t.Errorf("unexpected request %v: %s", r.URL.Path, body)
+		}
+		if params["total_fee"] != "1000" || params["out_trade_no"] != "T1" || params["openid"] != "user" {
+			t.Errorf("unexpected params: %v", params)
+		}
+		res := map[string]string{"return_code": "SUCCESS", "result_code": "SUCCESS", "prepay_id": "wx123"}
+		res["sign"] = p.sign(res)
+		_, _ = w.Write(encodeWxPayXML(res))
+	}))
+	defer server.Close()
+	p = newTestWxPay(server.URL)
+
+	params, err := p.CreateOrder(context.Background(), &PaymentOrder{OrderNo: "T1", OpenID: "user", Amount: 1000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	paySign := params["paySign"]
+	delete(params, "paySign")
+	if params["package"] != "prepay_id=wx123" || paySign != p.sign(params) {
+		t.Errorf("unexpected pay params: %v", params)
+	}
+}
+
+func TestWxPayBusinessError(t *testing.T) {
+	var p *wxPay
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		res := map[string]string{"return_code": "SUCCESS", "result_code": "FAIL", "err_code": "SYSTEMERROR"}
+		res["sign"] = p.sign(res)
+		_, _ = w.Write(encodeWxPayXML(res))
+	}))
+	defer server.Close()
+	p = newTestWxPay(server.URL)
+
+	_, err := p.Transfer(context.Background(), &PaymentTransfer{TransferNo: "W1", OpenID: "user", Amount: 100})
+	if e, ok := err.(*PaymentError); !ok || e.Final {
+		t.Errorf("system error of transfer should not be final: %v", err)
+	}
+}
+
+func TestWxPayParseNotify(t *testing.T) {
+	p := newTestWxPay("")
+	params := map[string]string{
+		"return_code":    "SUCCESS",
+		"result_code":    "SUCCESS",
+		"appid":          "wx-app",
+		"mch_id":         "1900000109",
+		"out_trade_no":   "T1",
+		"transaction_id": "4200",
+		"total_fee":      "1000",
+	}
+	params["sign"] = p.sign(params)
+	req := httptest.NewRequest("POST", "/payments/notify", bytes.NewReader(encodeWxPayXML(params)))
+	result, err := p.ParseNotify(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.OrderNo != "T1" || result.TransactionID != "4200" || result.Amount != 1000 || result.State != TradeSuccess {
+		t.Errorf("unexpected result: %+v", result)
+	}
+
+	// 修改金额之后签名不再正确
+	params["total_fee"] = "1"
+	req = httptest.NewRequest("POST", "/payments/notify", bytes.NewReader(encodeWxPayXML(params)))
+	if _, err := p.ParseNotify(req); err == nil {
+		t.Error("expected invalid signature")
+	}
+}
@@ -1,37 +1,67 @@
 package lib
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"fmt"
+	"math"
+	"runtime/debug"
+	"strconv"
+	"time"
+
 	jsoniter "github.com/json-iterator/go"
 	"github.com/kataras/iris/context"
-	"github.com/rs/zerolog/log"
 )
 
+// AppError 业务代码中 panic 的错误，由 error handler 根据错误目录统一渲染
+type AppError struct {
+	Key    string
+	Errors []FieldError // 参数检查失败时每个字段的错误
+	Cause  error        // 错误的原因，只记录在日志中，不返回给客户端
+	// 超过频率限制时客户端需要等待的时间，返回在 Retry-After 中
+	RetryAfter time.Duration
+}
+
+func (e AppError) Error() string {
+	if e.Cause != nil {
+		return e.Key + ": " + e.Cause.Error()
+	}
+	return e.Key
+}
+
+// ErrorRes 错误响应
 type ErrorRes struct {
-	Code int
-	Msg  string
+	Code      int          `json:"code"`  // 稳定的错误码
+	Error     string       `json:"error"` // 错误的 key
+	Msg       string       `json:"msg"`   // 按照 Accept-Language 选择的错误信息
+	Errors    []FieldError `json:"errors,omitempty"`
+	RequestID string       `json:"request_id,omitempty"` // 内部错误的关联 id，用于在日志中查找错误原因
 }
 
 // Assert Web断言，产生的 panic 经由调用 chain 传播到 注册得中间件中的 error handler 中 recover 中，进行统一处理
-func Assert(condition bool, msg string, code ...int) {
+// key 必须在错误目录中注册，HTTP 状态码由错误目录决定
+func Assert(condition bool, key string) {
 	if !condition {
-		statusCode := 400
-		if len(code) > 0 {
-			statusCode = code[0]
-		}
-		panic(ErrorRes{Code: statusCode, Msg: msg})
+		panic(AppError{Key: key})
 	}
 }
 
 // AssertErr error断言
-func AssertErr(err error, code ...int) {
+// 默认作为内部错误处理，客户端只会收到 unknown_error 和关联 id；指定 key 时按照该错误返回
+func AssertErr(err error, key ...string) {
 	if err != nil {
-		log.Error().Msg(err.Error())
-		statusCode := 400
-		if len(code) > 0 {
-			statusCode = code[0]
+		appErr := AppError{Key: "unknown_error", Cause: err}
+		if len(key) > 0 {
+			appErr.Key = key[0]
 		}
-		panic(ErrorRes{Code: statusCode, Msg: err.Error()})
+		panic(appErr)
+	}
+}
+
+// AssertRate 频率或者配额限制的断言，retryAfter 为客户端需要等待的时间
+func AssertRate(allowed bool, retryAfter time.Duration, key string) {
+	if !allowed {
+		panic(AppError{Key: key, RetryAfter: retryAfter})
 	}
 }
 
@@ -43,26 +73,68 @@ func NewErrorHandler() context.Handler {
 				if ctx.IsStopped() {
 					return
 				}
-
-				switch err.(type) {
-				case ErrorRes:
-					res := err.(ErrorRes)
-					ctx.StatusCode(res.Code)
-					ctx.ContentType("application/json")
-					b, e := jsoniter.Marshal(res)
-					if e != nil {
-						break
-					}
-					_, err = ctx.Write(b)
-					log.Debug().Msg(fmt.Sprintf("code: %v, body : %v", res.Code, res.Msg))
-					if err == nil && res.Code < 500 {
-						return
+				appErr, ok := err.(AppError)
+				if !ok {
+					// 未预期的 panic 同样作为内部错误返回
+					appErr = AppError{
+						Key:   "unknown_error",
+						Cause: fmt.Errorf("panic: %v\n%s", err, debug.Stack()),
 					}
 				}
-				panic(err)
+				RenderError(ctx, appErr)
 			}
 		}()
 
 		ctx.Next()
 	}
 }
+
+// RenderError 按照错误目录返回错误
+// 5xx 错误不会返回错误原因，而是返回请求 id，错误原因记录在带有该 id 的日志中
+func RenderError(ctx context.Context, appErr AppError) {
+	def, registered := LookupError(appErr.Key)
+	res := ErrorRes{
+		Code:   def.Code,
+		Error:  def.Key,
+		Msg:    def.Message(PreferredLang(ctx.GetHeader("Accept-Language"))),
+		Errors: appErr.Errors,
+	}
+	if def.Status >= 500 {
+		event := RequestLogger(ctx).Error()
+		res.RequestID = RequestID(ctx)
+		if res.RequestID == "" {
+			// 没有经过请求 id 的中间件
+			res.RequestID = newCorrelationID()
+			event = event.Str("request_id", res.RequestID)
+		}
+		event = event.
+			Str("path", ctx.Path()).
+			Str("key", appErr.Key)
+		if appErr.Cause != nil {
+			event = event.Err(appErr.Cause)
+		}
+		if !registered {
+			event = event.Bool("unregistered", true)
+		}
+		event.Msg("internal error")
+	} else {
+		RequestLogger(ctx).Debug().Int("code", def.Code).Str("error", appErr.Error()).Msg("error response")
+	}
+	b, err := jsoniter.Marshal(res)
+	if err != nil {
+		panic(err)
+	}
+	ErrorResponsesTotal.Inc(strconv.Itoa(def.Code), def.Key)
+	if appErr.RetryAfter > 0 {
+		ctx.Header("Retry-After", strconv.Itoa(int(math.Ceil(appErr.RetryAfter.Seconds()))))
+	}
+	ctx.StatusCode(def.Status)
+	ctx.ContentType("application/json")
+	_, _ = ctx.Write(b)
+}
+
+func newCorrelationID() string {
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,231 @@
+package lib
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ErrorDef 错误的定义
+// Code 是稳定的错误码，客户端根据 Code 或者 Key 判断错误类型，不应该依赖于 Message
+type ErrorDef struct {
+	Code   int    `json:"code"`
+	Key    string `json:"key"`
+	Status int    `json:"status"` // HTTP 状态码
+	Zh     string `json:"zh"`
+	En     string `json:"en"`
+}
+
+// 错误码由 HTTP 状态码和序号组成，已经发布的错误码不能修改，废弃的错误码也不能被复用
+var errorCatalog = []ErrorDef{
+	// 通用错误
+	{40000, "invalid_params", 400, "请求参数错误", "Invalid request parameters"},
+	{40400, "route_not_found", 404, "接口不存在", "Route not found"},
+	{40500, "method_not_allowed", 405, "请求方法不被允许", "Method not allowed"},
+	{50000, "unknown_error", 500, "服务器内部错误", "Internal server error"},
+	{50300, "not_ready", 503, "服务暂时不可用", "Service is not ready"},
+
+	// 登陆和注册
+	{40100, "invalid_token", 401, "登陆状态已失效，请重新登陆", "Session expired, please log in again"},
+	{40101, "not_login", 401, "尚未登陆", "Not logged in"},
+	{40102, "unregister_user", 401, "用户尚未注册", "User is not registered"},
+	{40001, "invalid_wx_code", 400, "微信授权码无效", "Invalid WeChat authorization code"},
+	{50200, "wx_auth_failed", 502, "微信授权服务暂时不可用", "WeChat authorization service is unavailable"},
+	{40900, "already_login", 409, "已经登陆", "Already logged in"},
+	{40901, "duplicated_username", 409, "该微信账号已经注册", "This WeChat account is already registered"},
+	{40902, "duplicated_student_num", 409, "该学号已经注册", "This student number is already registered"},
+
+	// 用户状态和权限
+	{40300, "permission_denied", 403, "没有权限", "Permission denied"},
+	{40301, "user_banned", 403, "账号已被封禁", "Account is banned"},
+	{40302, "user_suspended", 403, "账号已被停用", "Account is suspended"},
+	{40303, "user_unverified", 403, "尚未完成学生身份验证", "Student identity is not verified"},
+	{40401, "no_such_user", 404, "用户不存在", "User not found"},
+	{40002, "invalid_user_status", 400, "无效的用户状态", "Invalid user status"},
+	{40003, "invalid_suspended_until", 400, "停用截止时间必须晚于当前时间", "Suspension end time must be in the future"},
+
+	// 学生身份验证
+	{40304, "student_not_in_roster", 403, "学号不在学生名单中", "Student number is not in the roster"},
+	{40305, "student_name_mismatch", 403, "姓名与学生名单不一致", "Name does not match the roster"},
+	{40004, "verification_code_not_required", 400, "当前验证方式不需要验证码", "Verification code is not required"},
+	{40005, "invalid_campus_email", 400, "请使用校园邮箱", "Please use a campus email address"},
+	{40006, "verification_code_expired", 400, "验证码已过期", "Verification code has expired"},
+	{40007, "invalid_verification_code", 400, "验证码错误", "Incorrect verification code"},
+	{40008, "invalid_roster_csv", 400, "学生名单格式错误", "Malformed roster CSV"},
+	{50201, "mail_send_failed", 502, "验证邮件发送失败，请稍后重试", "Failed to send the verification email, please try again later"},
+	{40903, "already_verified", 409, "已经完成学生身份验证", "Student identity is already verified"},
+	{40922, "email_already_used", 409, "该邮箱已经验证过其他账号", "The email has already verified another account"},
+	{42903, "verification_attempts_exceeded", 429, "验证码错误次数过多，请重新获取验证码", "Too many incorrect codes, please request a new code"},
+
+	// 个人资料
+	{40009, "invalid_phone", 400, "手机号格式错误", "Invalid phone number"},
+	{40010, "invalid_avatar_url", 400, "头像地址格式错误", "Invalid avatar URL"},
+	{41500, "invalid_avatar_type", 415, "头像只能是图片", "Avatar must be an image"},
+
+	// 委托
+	{40402, "no_such_delegation", 404, "委托不存在", "Delegation not found"},
+	{40011, "invalid_delegation_type", 400, "委托类型不存在或者已经停用", "Unknown or disabled delegation type"},
+	{40012, "reward_out_of_category_range", 400, "报酬不在该委托类型允许的范围内", "Reward is out of the range allowed by the category"},
+	{40013, "missing_required_field", 400, "缺少该委托类型要求的字段", "Missing a field required by the category"},
+	{40014, "invalid_location", 400, "无效的位置", "Invalid location"},
+	{40306, "no_enough_credit_to_create_delegation", 403, "积分不足，无法发布委托", "Not enough credit to publish the delegation"},
+	{40307, "not_enough_credit_to_receive", 403, "积分不足，无法接受委托", "Not enough credit to accept the delegation"},
+	{40308, "invalid_receiver_same_as_publisher", 403, "不能接受自己发布的委托", "Cannot accept your own delegation"},
+	{40309, "invalid_canceler_not_publisher_or_receiver", 403, "只有发布者或者接受者可以取消委托", "Only the publisher or a receiver can cancel the delegation"},
+	{40310, "invalid_canceler_not_finished_by_receiver", 403, "只有发布者或者接受者可以完成委托", "Only the publisher or a receiver can finish the delegation"},
+	{40904, "invalid_delegation_already_received", 409, "已经接受了该委托", "Delegation has already been accepted"},
+	{40905, "invalid_delegation_timeout", 409, "委托已经过期", "Delegation has expired"},
+	{40906, "invalid_delegation_state_cannot_be_canceled", 409, "委托当前状态不能取消", "Delegation cannot be cancelled in its current state"},
+	{40907, "invalid_delegation_not_pending", 409, "委托不在待确认状态", "Delegation is not pending confirmation"},
+	{40908, "invalid_delegation_not_accepted", 409, "委托不在进行中状态", "Delegation is not in progress"},
+
+	// 委托类型管理
+	{40015, "invalid_category_key", 400, "委托类型标识无效", "Invalid category key"},
+	{40016, "invalid_category_name", 400, "委托类型名称不能为空", "Category name must not be empty"},
+	{40017, "invalid_category_reward", 400, "报酬范围无效", "Invalid reward range"},
+	{40018, "invalid_category_handler", 400, "无效的委托类型处理方式", "Invalid category handler"},
+	{40019, "invalid_category_required_field", 400, "无效的必填字段", "Invalid required field"},
+
+	// 问卷
+	{40403, "no_such_questionnaire", 404, "问卷不存在", "Questionnaire not found"},
+	{40020, "questionnaire_mismatch", 400, "问卷回答与问卷题目不一致", "Answers do not match the questionnaire"},
+	{40311, "invalid_full_questionnaire_not_get_by_publisher", 403, "只有发布者可以查看问卷结果", "Only the publisher can view the questionnaire results"},
+	{40312, "invalid_not_add_by_current_receiver", 403, "只有委托的接受者可以填写问卷", "Only a receiver of the delegation can fill in the questionnaire"},
+
+	// 附件
+	{40404, "no_such_attachment", 404, "附件不存在", "Attachment not found"},
+	{40405, "no_such_thumbnail", 404, "附件没有缩略图", "Attachment has no thumbnail"},
+	{40021, "invalid_attachment_purpose", 400, "无效的附件用途", "Invalid attachment purpose"},
+	{40022, "invalid_attachments", 400, "附件不存在或者已经被使用", "Attachments do not exist or are already in use"},
+	{41300, "invalid_attachment_size", 413, "附件为空或者过大", "Attachment is empty or too large"},
+	{41501, "invalid_attachment_type", 415, "不支持的附件类型", "Unsupported attachment type"},
+
+	// 限流和配额
+	{42900, "too_many_requests", 429, "请求过于频繁，请稍后重试", "Too many requests, please try again later"},
+	{42901, "open_delegations_exceeded", 429, "进行中的委托数量已达上限", "Too many delegations in progress"},
+	{42902, "accept_quota_exceeded", 429, "接受委托过于频繁，请稍后重试", "Accepting delegations too often, please try again later"},
+
+	// 幂等键
+	{40023, "invalid_idempotency_key", 400, "Idempotency-Key 格式错误", "Malformed Idempotency-Key"},
+	{40909, "idempotency_key_conflict", 409, "该 Idempotency-Key 已经用于其他请求", "Idempotency-Key was already used with a different request"},
+	{40910, "idempotency_key_in_progress", 409, "相同 Idempotency-Key 的请求正在处理，请稍后重试", "A request with the same Idempotency-Key is still in progress"},
+	{41301, "request_too_large", 413, "请求体过大", "Request body is too large"},
+
+	// 并发修改
+	{40911, "delegation_conflict", 409, "委托已被其他操作修改，请刷新后重试", "Delegation was modified by another request, please refresh and retry"},
+
+	// 注销
+	{40912, "account_has_active_delegations", 409, "还有进行中的委托，完成或者取消之后才能注销", "Finish or cancel delegations in progress before deleting the account"},
+
+	// 积分
+	{40913, "already_checked_in", 409, "今天已经签到", "Already checked in today"},
+	{40313, "check_in_disabled", 403, "签到已关闭", "Check-in is disabled"},
+
+	// 充值和提现
+	{40314, "payment_disabled", 403, "充值和提现已关闭", "Top-up and withdrawal are disabled"},
+	{40024, "invalid_top_up_amount", 400, "充值的积分不在允许的范围内", "Top-up amount is out of the allowed range"},
+	{40025, "invalid_withdrawal_amount", 400, "提现的积分低于最低限额", "Withdrawal amount is below the minimum"},
+	{40315, "not_enough_credit_to_withdraw", 403, "积分不足，无法提现", "Not enough credit to withdraw"},
+	{40406, "no_such_payment_order", 404, "充值订单不存在", "Top-up order not found"},
+	{40407, "no_such_withdrawal", 404, "提现申请不存在", "Withdrawal not found"},
+	{40914, "withdrawal_not_pending", 409, "提现申请已经审核过", "Withdrawal has already been reviewed"},
+	{40915, "account_has_open_withdrawals", 409, "还有未完成的提现申请，完成之后才能注销", "Wait for withdrawals in progress before deleting the account"},
+	{50202, "payment_provider_error", 502, "支付服务暂时不可用，请稍后重试", "Payment service is unavailable, please try again later"},
+
+	// 积分商城
+	{40408, "no_such_shop_item", 404, "商品不存在或者已经下架", "Shop item not found"},
+	{40916, "shop_item_out_of_stock", 409, "商品已经兑换完", "Shop item is out of stock"},
+	{40316, "not_enough_credit_to_redeem", 403, "积分不足，无法兑换", "Not enough credit to redeem"},
+	{40409, "no_such_redemption", 404, "兑换码不存在", "Redemption code not found"},
+	{40917, "redemption_already_used", 409, "兑换码已经使用", "Redemption code has already been used"},
+
+	// 评分和排行榜
+	{40317, "invalid_rater_not_publisher", 403, "只有发布者可以为接受者评分", "Only the publisher can rate the receivers"},
+	{40918, "invalid_delegation_not_finished", 409, "委托还没有完成", "Delegation is not finished"},
+	{40026, "invalid_rating_receiver", 400, "该用户不是委托的接受者", "The user is not a receiver of the delegation"},
+	{40919, "already_rated", 409, "已经为该接受者评分", "The receiver has already been rated"},
+	{40027, "invalid_leaderboard", 400, "发布者没有评分排行榜", "There is no rating leaderboard for publishers"},
+
+	// 委托聊天
+	{40318, "not_chat_member", 403, "只有委托的发布者和接受者可以聊天", "Only the publisher and receivers of the delegation can chat"},
+	{40920, "chat_not_open", 409, "委托有接受者之后才能聊天", "Chat opens after the delegation has a receiver"},
+	{40921, "chat_read_only", 409, "委托已经完成或者取消，聊天只能查看", "Delegation is finished or canceled, the chat is read-only"},
+	{40028, "invalid_message", 400, "文字消息需要内容，图片消息需要一张图片", "Text messages need text and image messages need an image"},
+}
+
+var (
+	errorsByKey  = make(map[string]*ErrorDef)
+	errorsByCode = make(map[int]*ErrorDef)
+)
+
+func init() {
+	for i := range errorCatalog {
+		def := &errorCatalog[i]
+		if _, ok := errorsByKey[def.Key]; ok {
+			panic("duplicated error key: " + def.Key)
+		}
+		if _, ok := errorsByCode[def.Code]; ok {
+			panic("duplicated error code: " + strconv.Itoa(def.Code))
+		}
+		errorsByKey[def.Key] = def
+		errorsByCode[def.Code] = def
+	}
+}
+
+// LookupError 根据错误的 key 查找错误定义，未注册的错误按照内部错误处理
+func LookupError(key string) (*ErrorDef, bool) {
+	def, ok := errorsByKey[key]
+	if !ok {
+		return errorsByKey["unknown_error"], false
+	}
+	return def, true
+}
+
+// ErrorCatalog 按照错误码排序的所有错误
+func ErrorCatalog() []ErrorDef {
+	res := make([]ErrorDef, len(errorCatalog))
+	copy(res, errorCatalog)
+	sort.Slice(res, func(i, j int) bool { return res[i].Code < res[j].Code })
+	return res
+}
+
+// Message 返回指定语言的错误信息
+func (def *ErrorDef) Message(lang string) string {
+	if lang == LangEn {
+		return def.En
+	}
+	return def.Zh
+}
+
+const (
+	LangZh = "zh-CN"
+	LangEn = "en"
+)
+
+// PreferredLang 根据 Accept-Language 选择返回的语言，默认为中文
+func PreferredLang(acceptLanguage string) string {
+	lang, best := LangZh, 0.0
+	for _, part := range strings.Split(acceptLanguage, ",") {
+		fields := strings.Split(strings.TrimSpace(part), ";")
+		tag := strings.ToLower(strings.TrimSpace(fields[0]))
+		q := 1.0
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if v, err := strconv.ParseFloat(param[2:], 64); err == nil {
+					q = v
+				}
+			}
+		}
+		if q <= best {
+			continue
+		}
+		switch {
+		case tag == "zh" || strings.HasPrefix(tag, "zh-"):
+			lang, best = LangZh, q
+		case tag == "en" || strings.HasPrefix(tag, "en-"):
+			lang, best = LangEn, q
+		}
+	}
+	return lang
+}
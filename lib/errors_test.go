@@ -0,0 +1,61 @@
+package lib
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestPreferredLang(t *testing.T) {
+	cases := map[string]string{
+		"":                        LangZh,
+		"en":                      LangEn,
+		"en-US,en;q=0.9":          LangEn,
+		"zh-CN,zh;q=0.9,en;q=0.8": LangZh,
+		"fr,en;q=0.5":             LangEn,
+		"zh;q=0.3,en-GB;q=0.7":    LangEn,
+		"ja":                      LangZh,
+	}
+	for header, expected := range cases {
+		if lang := PreferredLang(header); lang != expected {
+			t.Errorf("%q: expected %v, got %v", header, expected, lang)
+		}
+	}
+}
+
+func TestErrorCatalog(t *testing.T) {
+	for _, def := range ErrorCatalog() {
+		if def.Code/100 != def.Status {
+			t.Errorf("%v: code %v does not match status %v", def.Key, def.Code, def.Status)
+		}
+		if def.Zh == "" || def.En == "" {
+			t.Errorf("%v: missing message", def.Key)
+		}
+	}
+}
+
+// 代码中使用的错误都必须在错误目录中注册
+func TestErrorKeysRegistered(t *testing.T) {
+	pattern := regexp.MustCompile(`(?:lib\.)?(?:Assert|AssertErr)\((?s:.*?)"([a-z_]+)"\)`)
+	err := filepath.Walk("..", func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() || !strings.HasSuffix(path, ".go") || strings.HasSuffix(path, "_test.go") {
+			return err
+		}
+		src, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		for _, match := range pattern.FindAllStringSubmatch(string(src), -1) {
+			if _, ok := LookupError(match[1]); !ok {
+				t.Errorf("%v: unregistered error key %v", path, match[1])
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
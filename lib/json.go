@@ -4,7 +4,6 @@ import (
 	jsoniter "github.com/json-iterator/go"
 	"github.com/kataras/iris"
 	"github.com/kataras/iris/context"
-	"github.com/rs/zerolog/log"
 )
 
 type BaseRes struct {
@@ -55,13 +54,13 @@ func JSON(ctx context.Context, arr ...interface{}) {
 	} else {
 		b, err = jsoniter.Marshal(DataListRes{Code: statusCode, Msg: "ok", Data: body, Pagination: page})
 	}
-	Assert(err == nil, "unknown_error", iris.StatusInternalServerError)
+	AssertErr(err)
 	ctx.StatusCode(statusCode)
 	if statusCode != iris.StatusNoContent {
 		ctx.ContentType("application/json")
 		_, err = ctx.Write(b)
-		log.Debug().Msg(string(b))
-		Assert(err == nil, "unknown_error", iris.StatusInternalServerError)
+		RequestLogger(ctx).Debug().RawJSON("response", b).Msg("write response")
+		AssertErr(err)
 
 	}
 }
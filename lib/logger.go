@@ -0,0 +1,184 @@
+package lib
+
+import (
+	"context"
+	"io"
+	"regexp"
+	"strings"
+	"time"
+
+	iriscontext "github.com/kataras/iris/context"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+// RequestIDHeader 请求的关联 id，客户端或者网关传入时沿用，否则由服务器生成，并在响应中返回
+const RequestIDHeader = "X-Request-ID"
+
+// 保存在 ctx.Values() 中的 key
+const (
+	requestIDValueKey = "request_id"
+	loggerValueKey    = "logger"
+	userIDValueKey    = "user_id"
+)
+
+// 沿用客户端传入的 id 时的限制，避免日志注入
+var requestIDPattern = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// NewRequestLogger 设置请求 id 和请求的日志的中间件，请求结束后记录一条访问日志
+// 需要在 error handler 之前注册，这样错误的日志也带有请求 id
+func NewRequestLogger() iriscontext.Handler {
+	return func(ctx iriscontext.Context) {
+		start := time.Now()
+		id := ctx.GetHeader(RequestIDHeader)
+		if !requestIDPattern.MatchString(id) {
+			id = newCorrelationID()
+		}
+		ctx.Values().Set(requestIDValueKey, id)
+		ctx.Header(RequestIDHeader, id)
+		route := unmatchedRoute
+		if r := ctx.GetCurrentRoute(); r != nil {
+			route = r.Path()
+		}
+		logger := log.With().Str("request_id", id).Str("route", route).Logger()
+		ctx.Values().Set(loggerValueKey, &logger)
+		defer func() {
+			RequestLogger(ctx).Info().
+				Str("method", ctx.Method()).
+				Str("path", ctx.Path()).
+				Int("status", ctx.GetStatusCode()).
+				Dur("latency", time.Since(start)).
+				Str("ip", ctx.RemoteAddr()).
+				Msg("request")
+		}()
+		ctx.Next()
+	}
+}
+
+// RequestID 返回请求 id，没有经过中间件时返回空字符串
+func RequestID(ctx iriscontext.Context) string {
+	return ctx.Values().GetString(requestIDValueKey)
+}
+
+// RequestLogger 返回请求的日志，没有经过中间件时返回全局的日志
+func RequestLogger(ctx iriscontext.Context) *zerolog.Logger {
+	if logger, ok := ctx.Values().Get(loggerValueKey).(*zerolog.Logger); ok {
+		return logger
+	}
+	return &log.Logger
+}
+
+// SetLogUser 登录检查通过后在请求的日志中加上用户 id
+func SetLogUser(ctx iriscontext.Context, userID string) {
+	logger := RequestLogger(ctx).With().Str("user_id", userID).Logger()
+	ctx.Values().Set(loggerValueKey, &logger)
+	ctx.Values().Set(userIDValueKey, userID)
+}
+
+type (
+	loggerCtxKey      struct{}
+	requestInfoCtxKey struct{}
+)
+
+// RequestInfo 请求的来源，用于审计日志
+type RequestInfo struct {
+	ID     string
+	IP     string
+	UserID string // 登录检查通过之后才有
+}
+
+// RequestContext 返回带有请求的日志和请求来源的 context，传给 service 和 model
+func RequestContext(ctx iriscontext.Context) context.Context {
+	c := context.WithValue(ctx.Request().Context(), loggerCtxKey{}, RequestLogger(ctx))
+	return context.WithValue(c, requestInfoCtxKey{}, RequestInfo{
+		ID:     RequestID(ctx),
+		IP:     ctx.RemoteAddr(),
+		UserID: ctx.Values().GetString(userIDValueKey),
+	})
+}
+
+// 不随请求取消的写操作的超时时间
+const detachedTimeout = 30 * time.Second
+
+// Detach 返回不随请求取消的 context，保留请求的日志和请求来源
+// 扣除积分之后的创建、失败时的返还和状态修改之后的发放需要全部完成，客户端断开时也不能中途停止
+func Detach(ctx context.Context) (context.Context, context.CancelFunc) {
+	c := context.Background()
+	if logger, ok := ctx.Value(loggerCtxKey{}).(*zerolog.Logger); ok {
+		c = context.WithValue(c, loggerCtxKey{}, logger)
+	}
+	if info, ok := ctx.Value(requestInfoCtxKey{}).(RequestInfo); ok {
+		c = context.WithValue(c, requestInfoCtxKey{}, info)
+	}
+	return context.WithTimeout(c, detachedTimeout)
+}
+
+// RequestInfoFrom 返回 context 中的请求来源，后台任务等没有请求时返回零值
+func RequestInfoFrom(ctx context.Context) RequestInfo {
+	info, _ := ctx.Value(requestInfoCtxKey{}).(RequestInfo)
+	return info
+}
+
+// Log 返回 context 中的请求的日志，后台任务等没有请求时返回全局的日志
+func Log(ctx context.Context) *zerolog.Logger {
+	if logger, ok := ctx.Value(loggerCtxKey{}).(*zerolog.Logger); ok {
+		return logger
+	}
+	return &log.Logger
+}
+
+// SensitiveKeys 日志中需要隐藏值的字段，匹配时忽略大小写和下划线
+var SensitiveKeys = []string{"session_key", "secret", "secret_key", "access_key", "password", "authorization", "cookie"}
+
+const redacted = "[REDACTED]"
+
+// 匹配 "key":"value"、消息中转义的 \"key\":\"value\" 以及 key=value、key: value
+var sensitivePattern = func() *regexp.Regexp {
+	keys := make([]string, len(SensitiveKeys))
+	for i, key := range SensitiveKeys {
+		keys[i] = strings.Replace(regexp.QuoteMeta(key), "_", "_?", -1)
+	}
+	return regexp.MustCompile(`(?i)((?:` + strings.Join(keys, "|") + `)(?:\\?")?\s*[:=]\s*)` +
+		`(\\"[^"]*?\\"|"(?:[^"\\]|\\.)*"|[^\s,&}\]"\\]+)`)
+}()
+
+// Redact 隐藏一行日志中敏感字段的值
+func Redact(line []byte) []byte {
+	return sensitivePattern.ReplaceAllFunc(line, func(match []byte) []byte {
+		sub := sensitivePattern.FindSubmatch(match)
+		value := string(sub[2])
+		switch {
+		case strings.HasPrefix(value, `\"`):
+			value = `\"` + redacted + `\"`
+		case strings.HasPrefix(value, `"`):
+			value = `"` + redacted + `"`
+		default:
+			value = redacted
+		}
+		return append(append([]byte{}, sub[1]...), value...)
+	})
+}
+
+type redactWriter struct {
+	out io.Writer
+}
+
+// NewRedactWriter 在输出之前隐藏敏感字段，zerolog 每次 Write 写入一条完整的日志
+func NewRedactWriter(out io.Writer) io.Writer {
+	return redactWriter{out}
+}
+
+func (w redactWriter) Write(p []byte) (int, error) {
+	if _, err := w.out.Write(Redact(p)); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// NewLogWriter 按照格式创建日志的输出，json 每行一条日志，console 为便于阅读的格式
+func NewLogWriter(out io.Writer, format string) io.Writer {
+	if format == "console" {
+		out = zerolog.ConsoleWriter{Out: out}
+	}
+	return NewRedactWriter(out)
+}
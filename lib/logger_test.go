@@ -0,0 +1,72 @@
+package lib
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/rs/zerolog"
+)
+
+func TestRedact(t *testing.T) {
+	cases := map[string]string{
+		`{"session_key":"abc","openid":"o1"}`:                      `{"session_key":"[REDACTED]","openid":"o1"}`,
+		`{"wx_res":"{\"session_key\":\"abc\",\"openid\":\"o1\"}"}`: `{"wx_res":"{\"session_key\":\"[REDACTED]\",\"openid\":\"o1\"}"}`,
+		`{"message":"appid=a&secret=s3&js_code=c"}`:                `{"message":"appid=a&secret=[REDACTED]&js_code=c"}`,
+		`{"message":"{OpenId:o1 SessionKey:abc}"}`:                 `{"message":"{OpenId:o1 SessionKey:[REDACTED]}"}`,
+		`{"password":"a\"b","level":"info"}`:                       `{"password":"[REDACTED]","level":"info"}`,
+		`{"Authorization": "Bearer x"}`:                            `{"Authorization": "[REDACTED]"}`,
+		`{"message":"no secrets here"}`:                            `{"message":"no secrets here"}`,
+	}
+	for in, expected := range cases {
+		if out := string(Redact([]byte(in))); out != expected {
+			t.Errorf("%v: expected %v, got %v", in, expected, out)
+		}
+	}
+}
+
+func TestRedactWriter(t *testing.T) {
+	buf := &bytes.Buffer{}
+	logger := zerolog.New(NewLogWriter(buf, "json"))
+	logger.Info().Str("secret_key", "s3").Str("request_id", "r1").Msg("upload")
+	out := buf.String()
+	if strings.Contains(out, "s3") || !strings.Contains(out, `"request_id":"r1"`) {
+		t.Errorf("unexpected log line: %v", out)
+	}
+}
+
+func TestRequestIDPattern(t *testing.T) {
+	for id, ok := range map[string]bool{
+		"0123abcd":              true,
+		"req-1.a_b":             true,
+		"":                      false,
+		"bad id":                false,
+		"x\nforged":             false,
+		strings.Repeat("a", 65): false,
+		`"},{"level":"error"`:   false,
+	} {
+		if requestIDPattern.MatchString(id) != ok {
+			t.Errorf("%q: expected %v", id, ok)
+		}
+	}
+}
+
+func TestDetach(t *testing.T) {
+	logger := zerolog.Nop()
+	parent, cancel := context.WithCancel(context.Background())
+	parent = context.WithValue(parent, loggerCtxKey{}, &logger)
+	parent = context.WithValue(parent, requestInfoCtxKey{}, RequestInfo{ID: "r1", UserID: "u1"})
+	ctx, stop := Detach(parent)
+	defer stop()
+	cancel()
+	if ctx.Err() != nil {
+		t.Errorf("detached context canceled with the request: %v", ctx.Err())
+	}
+	if Log(ctx) != &logger || RequestInfoFrom(ctx).ID != "r1" || RequestInfoFrom(ctx).UserID != "u1" {
+		t.Errorf("request values are not kept")
+	}
+	if _, ok := ctx.Deadline(); !ok {
+		t.Errorf("detached context has no timeout")
+	}
+}
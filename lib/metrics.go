@@ -0,0 +1,267 @@
+package lib
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kataras/iris/context"
+)
+
+// Prometheus 文本格式的指标，只实现了用到的计数器、直方图和采集时计算的指标
+
+// Collector 输出一组同名的指标
+type Collector interface {
+	Write(w io.Writer)
+}
+
+// Registry 指标的集合
+type Registry struct {
+	mu         sync.Mutex
+	collectors []Collector
+}
+
+// DefaultRegistry 服务器使用的指标集合
+var DefaultRegistry = &Registry{}
+
+// Register 添加指标，输出时按照添加的顺序
+func (r *Registry) Register(collectors ...Collector) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.collectors = append(r.collectors, collectors...)
+}
+
+// Write 输出所有的指标
+func (r *Registry) Write(w io.Writer) {
+	r.mu.Lock()
+	collectors := append([]Collector{}, r.collectors...)
+	r.mu.Unlock()
+	for _, c := range collectors {
+		c.Write(w)
+	}
+}
+
+// 标签的值按顺序用 \xff 连接作为 key
+func labelKey(values []string) string {
+	return strings.Join(values, "\xff")
+}
+
+// 输出 {a="x",b="y"} 形式的标签
+func formatLabels(names, values []string, extra ...string) string {
+	pairs := make([]string, 0, len(names)+len(extra)/2)
+	for i, name := range names {
+		pairs = append(pairs, fmt.Sprintf("%v=%q", name, values[i]))
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, fmt.Sprintf("%v=%q", extra[i], extra[i+1]))
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatFloat(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func writeHeader(w io.Writer, name, help, kind string) {
+	fmt.Fprintf(w, "# HELP %v %v\n# TYPE %v %v\n", name, help, name, kind)
+}
+
+// CounterVec 按标签区分的计数器
+type CounterVec struct {
+	name   string
+	help   string
+	labels []string
+	mu     sync.Mutex
+	values map[string]float64
+	keys   map[string][]string
+}
+
+func NewCounterVec(name, help string, labels ...string) *CounterVec {
+	return &CounterVec{name: name, help: help, labels: labels, values: make(map[string]float64), keys: make(map[string][]string)}
+}
+
+// Inc 计数加一，标签的值和创建时的标签一一对应
+func (c *CounterVec) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+func (c *CounterVec) Add(v float64, labelValues ...string) {
+	key := labelKey(labelValues)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.keys[key]; !ok {
+		c.keys[key] = append([]string{}, labelValues...)
+	}
+	c.values[key] += v
+}
+
+// Get 返回计数，用于测试
+func (c *CounterVec) Get(labelValues ...string) float64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.values[labelKey(labelValues)]
+}
+
+func (c *CounterVec) Write(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	writeHeader(w, c.name, c.help, "counter")
+	for _, key := range sortedKeys(c.keys) {
+		fmt.Fprintf(w, "%v%v %v\n", c.name, formatLabels(c.labels, c.keys[key]), formatFloat(c.values[key]))
+	}
+}
+
+// HistogramVec 按标签区分的直方图
+type HistogramVec struct {
+	name    string
+	help    string
+	labels  []string
+	buckets []float64
+	mu      sync.Mutex
+	series  map[string]*histogram
+}
+
+type histogram struct {
+	labelValues []string
+	counts      []uint64 // 每个桶的累计数量
+	count       uint64
+	sum         float64
+}
+
+// DefaultDurationBuckets 请求耗时的桶，单位秒
+var DefaultDurationBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+func NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	return &HistogramVec{name: name, help: help, labels: labels, buckets: buckets, series: make(map[string]*histogram)}
+}
+
+// Observe 记录一个值
+func (h *HistogramVec) Observe(v float64, labelValues ...string) {
+	key := labelKey(labelValues)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s, ok := h.series[key]
+	if !ok {
+		s = &histogram{labelValues: append([]string{}, labelValues...), counts: make([]uint64, len(h.buckets))}
+		h.series[key] = s
+	}
+	for i, bound := range h.buckets {
+		if v <= bound {
+			s.counts[i]++
+		}
+	}
+	s.count++
+	s.sum += v
+}
+
+func (h *HistogramVec) Write(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	writeHeader(w, h.name, h.help, "histogram")
+	keys := make([]string, 0, len(h.series))
+	for key := range h.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		s := h.series[key]
+		for i, bound := range h.buckets {
+			fmt.Fprintf(w, "%v_bucket%v %v\n", h.name, formatLabels(h.labels, s.labelValues, "le", formatFloat(bound)), s.counts[i])
+		}
+		fmt.Fprintf(w, "%v_bucket%v %v\n", h.name, formatLabels(h.labels, s.labelValues, "le", "+Inf"), s.count)
+		fmt.Fprintf(w, "%v_sum%v %v\n", h.name, formatLabels(h.labels, s.labelValues), formatFloat(s.sum))
+		fmt.Fprintf(w, "%v_count%v %v\n", h.name, formatLabels(h.labels, s.labelValues), s.count)
+	}
+}
+
+// GaugeSample 采集时计算的指标的一个值
+type GaugeSample struct {
+	LabelValues []string
+	Value       float64
+}
+
+// GaugeFunc 在输出时调用 collect 计算的指标，例如数据库中的统计
+type GaugeFunc struct {
+	name    string
+	help    string
+	labels  []string
+	collect func() []GaugeSample
+}
+
+func NewGaugeFunc(name, help string, collect func() []GaugeSample, labels ...string) *GaugeFunc {
+	return &GaugeFunc{name: name, help: help, labels: labels, collect: collect}
+}
+
+// 计算失败时不输出该指标，避免一个指标的错误影响其他指标
+func (g *GaugeFunc) Write(w io.Writer) {
+	var samples []GaugeSample
+	func() {
+		defer func() {
+			if r := recover(); r != nil {
+				samples = nil
+			}
+		}()
+		samples = g.collect()
+	}()
+	if samples == nil {
+		return
+	}
+	writeHeader(w, g.name, g.help, "gauge")
+	for _, s := range samples {
+		fmt.Fprintf(w, "%v%v %v\n", g.name, formatLabels(g.labels, s.LabelValues), formatFloat(s.Value))
+	}
+}
+
+func sortedKeys(m map[string][]string) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// 请求和错误的指标
+var (
+	HTTPRequestsTotal = NewCounterVec("http_requests_total",
+		"Number of HTTP requests by route and status.", "method", "route", "status")
+	HTTPRequestDuration = NewHistogramVec("http_request_duration_seconds",
+		"HTTP request latency by route.", DefaultDurationBuckets, "method", "route")
+	ErrorResponsesTotal = NewCounterVec("error_responses_total",
+		"Number of error responses by error code.", "code", "error")
+)
+
+func init() {
+	DefaultRegistry.Register(HTTPRequestsTotal, HTTPRequestDuration, ErrorResponsesTotal)
+}
+
+// 没有路由信息时使用的路由标签，路由标签使用路由的模板而不是请求的路径，避免产生大量的标签
+const unmatchedRoute = "unmatched"
+
+// NewMetricsHandler 记录请求数量和耗时的中间件，需要在 error handler 之前注册
+func NewMetricsHandler() context.Handler {
+	return func(ctx context.Context) {
+		start := time.Now()
+		defer func() {
+			route := unmatchedRoute
+			if r := ctx.GetCurrentRoute(); r != nil {
+				route = r.Path()
+			}
+			method := ctx.Method()
+			HTTPRequestDuration.Observe(time.Since(start).Seconds(), method, route)
+			HTTPRequestsTotal.Inc(method, route, strconv.Itoa(ctx.GetStatusCode()))
+		}()
+		ctx.Next()
+	}
+}
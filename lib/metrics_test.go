@@ -0,0 +1,51 @@
+package lib
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestMetricsText(t *testing.T) {
+	r := &Registry{}
+	counter := NewCounterVec("test_requests_total", "Test counter.", "route", "status")
+	histogram := NewHistogramVec("test_duration_seconds", "Test histogram.", []float64{0.1, 1}, "route")
+	gauge := NewGaugeFunc("test_gauge", "Test gauge.", func() []GaugeSample {
+		return []GaugeSample{{LabelValues: []string{"a"}, Value: 3}}
+	}, "state")
+	broken := NewGaugeFunc("test_broken", "Broken gauge.", func() []GaugeSample {
+		panic(errors.New("db down"))
+	})
+	r.Register(counter, histogram, gauge, broken)
+
+	counter.Inc("/users", "200")
+	counter.Inc("/users", "200")
+	counter.Inc(`/a"b`, "404")
+	histogram.Observe(0.05, "/users")
+	histogram.Observe(0.5, "/users")
+
+	buf := &bytes.Buffer{}
+	r.Write(buf)
+	out := buf.String()
+	for _, line := range []string{
+		"# TYPE test_requests_total counter",
+		`test_requests_total{route="/users",status="200"} 2`,
+		`test_requests_total{route="/a\"b",status="404"} 1`,
+		"# TYPE test_duration_seconds histogram",
+		`test_duration_seconds_bucket{route="/users",le="0.1"} 1`,
+		`test_duration_seconds_bucket{route="/users",le="1"} 2`,
+		`test_duration_seconds_bucket{route="/users",le="+Inf"} 2`,
+		`test_duration_seconds_sum{route="/users"} 0.55`,
+		`test_duration_seconds_count{route="/users"} 2`,
+		`test_gauge{state="a"} 3`,
+	} {
+		if !strings.Contains(out, line+"\n") {
+			t.Errorf("missing %q in output:\n%v", line, out)
+		}
+	}
+	// 计算失败的指标不输出
+	if strings.Contains(out, "test_broken") {
+		t.Errorf("broken gauge should be skipped:\n%v", out)
+	}
+}
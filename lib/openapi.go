@@ -0,0 +1,468 @@
+package lib
+
+import (
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/json-iterator/go/extra"
+)
+
+// NamingStrategy 没有 json 标签的字段的命名方式，序列化和接口文档都使用这个规则
+var NamingStrategy = extra.LowerCaseWithUnderscores
+
+// RouteDoc 接口的说明，请求和响应的结构由类型反射得到
+// 字段的约束来自 validate 标签，和参数检查的规则保持一致
+type RouteDoc struct {
+	Method      string
+	Path        string // 完整的路径，和注册路由时的格式一致，例如 /delegations/{param1:string}
+	Summary     string
+	Description string
+	Params      []string    // 路径参数的说明，按照出现的顺序
+	Query       interface{} // 查询参数，使用 form 标签
+	Body        interface{} // json 请求体
+	Form        interface{} // multipart 表单，使用 form 标签，[]byte 字段为文件
+	RawBody     string      // 其他格式的请求体的 Content-Type，例如 text/csv
+	Res         interface{} // 响应中 data 字段的内容，nil 代表没有 data
+	Paged       bool        // 响应带有分页信息
+	RawRes      string      // 直接返回文件时的 Content-Type
+	Auth        bool        // 需要登陆
+	Admin       bool        // 需要管理员权限
+}
+
+// OpenAPI 3 文档
+type OpenAPI struct {
+	OpenAPI    string                           `json:"openapi"`
+	Info       OpenAPIInfo                      `json:"info"`
+	Paths      map[string]map[string]*Operation `json:"paths"`
+	Components OpenAPIComponents                `json:"components"`
+
+	types map[string]reflect.Type // 已经生成的 schema 对应的类型，用于处理重名
+}
+
+type OpenAPIInfo struct {
+	Title   string `json:"title"`
+	Version string `json:"version"`
+}
+
+type OpenAPIComponents struct {
+	Schemas         map[string]*Schema         `json:"schemas"`
+	SecuritySchemes map[string]*SecurityScheme `json:"securitySchemes"`
+}
+
+type SecurityScheme struct {
+	Type string `json:"type"`
+	In   string `json:"in"`
+	Name string `json:"name"`
+}
+
+type Operation struct {
+	Tags        []string              `json:"tags,omitempty"`
+	Summary     string                `json:"summary,omitempty"`
+	Description string                `json:"description,omitempty"`
+	Parameters  []*Parameter          `json:"parameters,omitempty"`
+	RequestBody *RequestBody          `json:"requestBody,omitempty"`
+	Responses   map[string]*Response  `json:"responses"`
+	Security    []map[string][]string `json:"security,omitempty"`
+}
+
+type Parameter struct {
+	Name        string  `json:"name"`
+	In          string  `json:"in"`
+	Description string  `json:"description,omitempty"`
+	Required    bool    `json:"required"`
+	Schema      *Schema `json:"schema"`
+}
+
+type RequestBody struct {
+	Required bool                  `json:"required"`
+	Content  map[string]*MediaType `json:"content"`
+}
+
+type MediaType struct {
+	Schema *Schema `json:"schema"`
+}
+
+type Response struct {
+	Description string                `json:"description"`
+	Content     map[string]*MediaType `json:"content,omitempty"`
+}
+
+type Schema struct {
+	Ref                  string             `json:"$ref,omitempty"`
+	Type                 string             `json:"type,omitempty"`
+	Format               string             `json:"format,omitempty"`
+	Description          string             `json:"description,omitempty"`
+	Properties           map[string]*Schema `json:"properties,omitempty"`
+	Required             []string           `json:"required,omitempty"`
+	Items                *Schema            `json:"items,omitempty"`
+	AdditionalProperties *Schema            `json:"additionalProperties,omitempty"`
+	Enum                 []string           `json:"enum,omitempty"`
+	Minimum              *float64           `json:"minimum,omitempty"`
+	Maximum              *float64           `json:"maximum,omitempty"`
+	ExclusiveMinimum     bool               `json:"exclusiveMinimum,omitempty"`
+	MinLength            *int               `json:"minLength,omitempty"`
+	MaxLength            *int               `json:"maxLength,omitempty"`
+	MinItems             *int               `json:"minItems,omitempty"`
+	MaxItems             *int               `json:"maxItems,omitempty"`
+	Pattern              string             `json:"pattern,omitempty"`
+}
+
+// 会话使用的安全方案的名字
+const sessionSecurity = "session"
+
+// NewOpenAPI 创建空的文档，cookie 为登陆状态使用的 cookie 名
+func NewOpenAPI(title, version, cookie string) *OpenAPI {
+	return &OpenAPI{
+		OpenAPI: "3.0.2",
+		Info:    OpenAPIInfo{Title: title, Version: version},
+		Paths:   make(map[string]map[string]*Operation),
+		Components: OpenAPIComponents{
+			Schemas: make(map[string]*Schema),
+			SecuritySchemes: map[string]*SecurityScheme{
+				sessionSecurity: {Type: "apiKey", In: "cookie", Name: cookie},
+			},
+		},
+		types: make(map[string]reflect.Type),
+	}
+}
+
+var routeParamPattern = regexp.MustCompile(`\{(\w+)(?::[^}]*)?\}`)
+
+// OpenAPIPath 把路由的路径转换成 OpenAPI 的格式，例如 /delegations/{param1:string} 转换成 /delegations/{param1}
+func OpenAPIPath(path string) string {
+	path = routeParamPattern.ReplaceAllString(path, "{$1}")
+	if len(path) > 1 {
+		path = strings.TrimSuffix(path, "/")
+	}
+	return path
+}
+
+// Operation 查找接口，不存在时返回 nil
+func (o *OpenAPI) Operation(method, path string) *Operation {
+	return o.Paths[OpenAPIPath(path)][strings.ToLower(method)]
+}
+
+// AddRoute 根据接口说明添加接口
+func (o *OpenAPI) AddRoute(doc RouteDoc) {
+	path := OpenAPIPath(doc.Path)
+	op := &Operation{
+		Summary:     doc.Summary,
+		Description: doc.Description,
+		Responses:   make(map[string]*Response),
+	}
+	if segments := strings.Split(strings.Trim(path, "/"), "/"); segments[0] != "" {
+		op.Tags = []string{segments[0]}
+	}
+	if doc.Auth {
+		op.Security = []map[string][]string{{sessionSecurity: {}}}
+	}
+	if doc.Admin {
+		op.Description = strings.TrimSpace(op.Description + "\n\n需要管理员权限")
+	}
+
+	// 路径参数
+	for i, match := range routeParamPattern.FindAllStringSubmatch(doc.Path, -1) {
+		param := &Parameter{Name: match[1], In: "path", Required: true, Schema: &Schema{Type: "string"}}
+		if i < len(doc.Params) {
+			param.Description = doc.Params[i]
+		}
+		op.Parameters = append(op.Parameters, param)
+	}
+	// 查询参数
+	if doc.Query != nil {
+		for _, field := range o.formFields(reflect.TypeOf(doc.Query)) {
+			op.Parameters = append(op.Parameters, &Parameter{
+				Name:     field.name,
+				In:       "query",
+				Required: field.required,
+				Schema:   field.schema,
+			})
+		}
+	}
+
+	// 请求体
+	switch {
+	case doc.Body != nil:
+		op.RequestBody = &RequestBody{Required: true, Content: map[string]*MediaType{
+			"application/json": {o.SchemaOf(reflect.TypeOf(doc.Body))},
+		}}
+	case doc.Form != nil:
+		form := &Schema{Type: "object", Properties: make(map[string]*Schema)}
+		for _, field := range o.formFields(reflect.TypeOf(doc.Form)) {
+			form.Properties[field.name] = field.schema
+			if field.required {
+				form.Required = append(form.Required, field.name)
+			}
+		}
+		op.RequestBody = &RequestBody{Required: true, Content: map[string]*MediaType{
+			"multipart/form-data": {form},
+		}}
+	case doc.RawBody != "":
+		op.RequestBody = &RequestBody{Required: true, Content: map[string]*MediaType{
+			doc.RawBody: {&Schema{Type: "string"}},
+		}}
+	}
+
+	// 响应
+	if doc.RawRes != "" {
+		op.Responses["200"] = &Response{Description: "ok", Content: map[string]*MediaType{
+			doc.RawRes: {&Schema{Type: "string", Format: "binary"}},
+		}}
+	} else {
+		op.Responses["200"] = &Response{Description: "ok", Content: map[string]*MediaType{
+			"application/json": {o.envelope(doc)},
+		}}
+	}
+	op.Responses["default"] = &Response{Description: "错误，参考 GET /errors", Content: map[string]*MediaType{
+		"application/json": {o.SchemaOf(reflect.TypeOf(ErrorRes{}))},
+	}}
+
+	if o.Paths[path] == nil {
+		o.Paths[path] = make(map[string]*Operation)
+	}
+	o.Paths[path][strings.ToLower(doc.Method)] = op
+}
+
+// 响应的外层结构，参考 lib.JSON
+func (o *OpenAPI) envelope(doc RouteDoc) *Schema {
+	s := &Schema{
+		Type: "object",
+		Properties: map[string]*Schema{
+			"code": {Type: "integer"},
+			"msg":  {Type: "string"},
+		},
+		Required: []string{"code", "msg"},
+	}
+	if doc.Res != nil {
+		s.Properties["data"] = o.SchemaOf(reflect.TypeOf(doc.Res))
+		s.Required = append(s.Required, "data")
+	}
+	if doc.Paged {
+		s.Properties["pagination"] = o.SchemaOf(reflect.TypeOf(Page{}))
+		s.Required = append(s.Required, "pagination")
+	}
+	return s
+}
+
+type formField struct {
+	name     string
+	required bool
+	schema   *Schema
+}
+
+// 使用 form 标签的字段，匿名的结构体字段会被展开
+func (o *OpenAPI) formFields(t reflect.Type) []formField {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	res := make([]formField, 0)
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.Anonymous && f.Type.Kind() == reflect.Struct {
+			res = append(res, o.formFields(f.Type)...)
+			continue
+		}
+		name := f.Tag.Get("form")
+		if name == "" || name == "-" {
+			continue
+		}
+		var schema *Schema
+		if f.Type.Kind() == reflect.Slice && f.Type.Elem().Kind() == reflect.Uint8 {
+			schema = &Schema{Type: "string", Format: "binary"}
+		} else {
+			schema = o.SchemaOf(f.Type)
+		}
+		rules := validateRules(f)
+		applyRules(schema, rules)
+		res = append(res, formField{name, hasRule(rules, "required"), schema})
+	}
+	return res
+}
+
+// SchemaOf 生成类型对应的 schema，有名字的结构体放在 components 中
+func (o *OpenAPI) SchemaOf(t reflect.Type) *Schema {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	switch t.PkgPath() + "." + t.Name() {
+	case "time.Time":
+		return &Schema{Type: "string", Format: "date-time"}
+	case "go.mongodb.org/mongo-driver/bson/primitive.ObjectID":
+		return &Schema{Type: "string", Pattern: objectIDPattern.String()}
+	case "encoding/json.RawMessage":
+		return &Schema{Type: "object"}
+	}
+	switch t.Kind() {
+	case reflect.Bool:
+		return &Schema{Type: "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Uint, reflect.Uint16, reflect.Uint32:
+		return &Schema{Type: "integer"}
+	case reflect.Int64, reflect.Uint64:
+		return &Schema{Type: "integer", Format: "int64"}
+	case reflect.Float32, reflect.Float64:
+		return &Schema{Type: "number"}
+	case reflect.String:
+		return &Schema{Type: "string"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return &Schema{Type: "string", Format: "byte"}
+		}
+		return &Schema{Type: "array", Items: o.SchemaOf(t.Elem())}
+	case reflect.Map:
+		return &Schema{Type: "object", AdditionalProperties: o.SchemaOf(t.Elem())}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return o.structSchema(t)
+		}
+		name := o.schemaName(t)
+		if _, ok := o.Components.Schemas[name]; !ok {
+			// 先占位，避免递归的类型无限展开
+			o.Components.Schemas[name] = &Schema{}
+			*o.Components.Schemas[name] = *o.structSchema(t)
+		}
+		return &Schema{Ref: "#/components/schemas/" + name}
+	}
+	return &Schema{}
+}
+
+// 不同包中的同名类型加上包名区分
+func (o *OpenAPI) schemaName(t reflect.Type) string {
+	name := t.Name()
+	if existing, ok := o.types[name]; ok && existing != t {
+		pkg := t.PkgPath()
+		name = pkg[strings.LastIndex(pkg, "/")+1:] + "." + name
+	}
+	o.types[name] = t
+	return name
+}
+
+func (o *OpenAPI) structSchema(t reflect.Type) *Schema {
+	s := &Schema{Type: "object", Properties: make(map[string]*Schema)}
+	o.addStructFields(s, t)
+	return s
+}
+
+// 字段名的规则和 json 序列化一致，匿名的结构体字段会被展开
+func (o *OpenAPI) addStructFields(s *Schema, t reflect.Type) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" {
+			continue
+		}
+		tag := strings.Split(f.Tag.Get("json"), ",")
+		if tag[0] == "-" {
+			continue
+		}
+		if f.Anonymous && tag[0] == "" {
+			ft := f.Type
+			for ft.Kind() == reflect.Ptr {
+				ft = ft.Elem()
+			}
+			if ft.Kind() == reflect.Struct {
+				o.addStructFields(s, ft)
+				continue
+			}
+		}
+		name := tag[0]
+		if name == "" {
+			name = NamingStrategy(f.Name)
+		}
+		field := o.SchemaOf(f.Type)
+		rules := validateRules(f)
+		if len(rules) != 0 {
+			if field.Ref != "" {
+				// $ref 不能和其他属性同时出现，约束只作用于基本类型和数组
+				rules = nil
+			}
+			applyRules(field, rules)
+		}
+		s.Properties[name] = field
+		if hasRule(rules, "required") {
+			s.Required = append(s.Required, name)
+		}
+	}
+}
+
+func validateRules(f reflect.StructField) []string {
+	tag := f.Tag.Get("validate")
+	if tag == "" || tag == "-" {
+		return nil
+	}
+	return strings.Split(tag, ",")
+}
+
+func hasRule(rules []string, name string) bool {
+	for _, rule := range rules {
+		if rule == name {
+			return true
+		}
+		if rule == "dive" {
+			return false
+		}
+	}
+	return false
+}
+
+// 把 validate 的规则转换成 schema 的约束，规则的含义参考 Validate
+func applyRules(s *Schema, rules []string) {
+	for i, rule := range rules {
+		name, arg := rule, ""
+		if idx := strings.Index(rule, "="); idx >= 0 {
+			name, arg = rule[:idx], rule[idx+1:]
+		}
+		switch name {
+		case "dive":
+			if s.Items != nil && s.Items.Ref == "" {
+				applyRules(s.Items, rules[i+1:])
+			}
+			return
+		case "notblank":
+			s.MinLength = intPtr(1)
+		case "positive":
+			s.Minimum, s.ExclusiveMinimum = floatPtr(0), true
+		case "nonnegative":
+			s.Minimum = floatPtr(0)
+		case "min", "max":
+			limit, _ := strconv.ParseFloat(arg, 64)
+			isMin := name == "min"
+			switch s.Type {
+			case "string":
+				if isMin {
+					s.MinLength = intPtr(int(limit))
+				} else {
+					s.MaxLength = intPtr(int(limit))
+				}
+			case "array":
+				if isMin {
+					s.MinItems = intPtr(int(limit))
+				} else {
+					s.MaxItems = intPtr(int(limit))
+				}
+			case "integer", "number":
+				if isMin {
+					s.Minimum = floatPtr(limit)
+				} else {
+					s.Maximum = floatPtr(limit)
+				}
+			}
+		case "future":
+			s.Description = strings.TrimSpace(s.Description + " 将来的 Unix 时间戳")
+		case "oneof":
+			s.Enum = strings.Fields(arg)
+		case "objectid":
+			s.Pattern = objectIDPattern.String()
+		case "numeric":
+			s.Pattern = numericPattern.String()
+		}
+	}
+}
+
+func intPtr(v int) *int {
+	return &v
+}
+
+func floatPtr(v float64) *float64 {
+	return &v
+}
@@ -0,0 +1,53 @@
+package lib
+
+import (
+	"reflect"
+	"testing"
+)
+
+type openAPIItem struct {
+	ID string `json:"id" validate:"objectid"`
+}
+
+type openAPIReq struct {
+	Name      string        `json:"name" validate:"required,max=20"`
+	Reward    int           `json:"reward" validate:"positive"`
+	Tags      []string      `json:"tags" validate:"max=3,dive,oneof=a b"`
+	Items     []openAPIItem `json:"items"`
+	CreatedAt int64
+	Ignored   string `json:"-"`
+}
+
+func TestOpenAPISchema(t *testing.T) {
+	spec := NewOpenAPI("test", "1.0.0", "session")
+	spec.AddRoute(RouteDoc{Method: "POST", Path: "/items/{param1:string}", Body: openAPIReq{}, Res: openAPIItem{}})
+	op := spec.Operation("POST", "/items/{param1}")
+	if op == nil {
+		t.Fatal("operation not found")
+	}
+	if len(op.Parameters) != 1 || op.Parameters[0].Name != "param1" || op.Parameters[0].In != "path" {
+		t.Errorf("unexpected parameters: %+v", op.Parameters)
+	}
+	s := spec.Components.Schemas["openAPIReq"]
+	if s == nil {
+		t.Fatal("schema not found")
+	}
+	if !reflect.DeepEqual(s.Required, []string{"name"}) {
+		t.Errorf("unexpected required: %v", s.Required)
+	}
+	if *s.Properties["name"].MaxLength != 20 || !s.Properties["reward"].ExclusiveMinimum {
+		t.Errorf("constraints not applied: %+v", s.Properties)
+	}
+	if *s.Properties["tags"].MaxItems != 3 || !reflect.DeepEqual(s.Properties["tags"].Items.Enum, []string{"a", "b"}) {
+		t.Errorf("array constraints not applied: %+v", s.Properties["tags"])
+	}
+	if s.Properties["items"].Items.Ref != "#/components/schemas/openAPIItem" {
+		t.Errorf("unexpected items: %+v", s.Properties["items"].Items)
+	}
+	if _, ok := s.Properties["created_at"]; !ok {
+		t.Error("untagged field should use the naming strategy")
+	}
+	if _, ok := s.Properties["ignored"]; ok {
+		t.Error("ignored field should not appear")
+	}
+}
@@ -0,0 +1,112 @@
+package lib
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+
+	iriscontext "github.com/kataras/iris/context"
+)
+
+// Limiter 令牌桶限流，key 相同的请求共用一个桶
+type Limiter interface {
+	// Take 从桶中取出一个令牌，桶的容量为 burst，每秒补充 rate 个令牌
+	// 没有令牌时返回 false 和需要等待的时间
+	Take(ctx context.Context, key string, rate float64, burst int) (bool, time.Duration)
+}
+
+// Bucket 令牌桶的状态，Updated 为零值时视为装满的桶
+type Bucket struct {
+	Tokens  float64
+	Updated time.Time
+}
+
+// Take 补充从上次更新到 now 的令牌后取出一个令牌
+func (b *Bucket) Take(now time.Time, rate float64, burst int) (bool, time.Duration) {
+	if b.Updated.IsZero() {
+		b.Tokens = float64(burst)
+	} else if elapsed := now.Sub(b.Updated).Seconds(); elapsed > 0 {
+		b.Tokens = math.Min(float64(burst), b.Tokens+elapsed*rate)
+	}
+	b.Updated = now
+	if b.Tokens >= 1 {
+		b.Tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - b.Tokens) / rate * float64(time.Second))
+}
+
+// FullAt 桶重新装满的时间，之后可以删除这个桶
+func (b *Bucket) FullAt(rate float64, burst int) time.Time {
+	return b.Updated.Add(time.Duration((float64(burst) - b.Tokens) / rate * float64(time.Second)))
+}
+
+// 清理已经装满的桶的间隔
+const sweepInterval = time.Minute
+
+type memoryBucket struct {
+	Bucket
+	fullAt time.Time
+}
+
+// MemoryLimiter 保存在进程内的令牌桶，只对单个实例有效
+type MemoryLimiter struct {
+	mu        sync.Mutex
+	buckets   map[string]*memoryBucket
+	lastSweep time.Time
+	now       func() time.Time
+}
+
+func NewMemoryLimiter() *MemoryLimiter {
+	return &MemoryLimiter{buckets: make(map[string]*memoryBucket), now: time.Now}
+}
+
+func (l *MemoryLimiter) Take(ctx context.Context, key string, rate float64, burst int) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	if now.Sub(l.lastSweep) >= sweepInterval {
+		for k, b := range l.buckets {
+			if !now.Before(b.fullAt) {
+				delete(l.buckets, k)
+			}
+		}
+		l.lastSweep = now
+	}
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &memoryBucket{}
+		l.buckets[key] = b
+	}
+	allowed, wait := b.Take(now, rate, burst)
+	b.fullAt = b.FullAt(rate, burst)
+	return allowed, wait
+}
+
+// RateRule 限流规则，Rate 为每分钟补充的请求数，为 0 时不限制
+type RateRule struct {
+	Name  string
+	Rate  int
+	Burst int
+}
+
+// RateLimitedTotal 被限流的请求数
+var RateLimitedTotal = NewCounterVec("rate_limited_total", "Number of requests rejected by rate limit rules.", "rule")
+
+func init() {
+	DefaultRegistry.Register(RateLimitedTotal)
+}
+
+// CheckRateLimit 按照规则限流，超过限制时返回 429 和 Retry-After
+// key 区分不同的调用方，例如 IP 或者用户 id
+func CheckRateLimit(ctx iriscontext.Context, limiter Limiter, rule RateRule, key string) {
+	if limiter == nil || rule.Rate <= 0 {
+		return
+	}
+	allowed, wait := limiter.Take(RequestContext(ctx), rule.Name+":"+key, float64(rule.Rate)/60, rule.Burst)
+	if !allowed {
+		RateLimitedTotal.Inc(rule.Name)
+	}
+	AssertRate(allowed, wait, "too_many_requests")
+}
@@ -0,0 +1,61 @@
+package lib
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestBucket(t *testing.T) {
+	now := time.Unix(1000, 0)
+	b := &Bucket{}
+	// 新的桶是满的，可以连续取出 burst 个令牌
+	for i := 0; i < 3; i++ {
+		if ok, _ := b.Take(now, 1, 3); !ok {
+			t.Fatalf("take %v should be allowed", i)
+		}
+	}
+	ok, wait := b.Take(now, 1, 3)
+	if ok || wait != time.Second {
+		t.Errorf("expected to wait 1s, got %v %v", ok, wait)
+	}
+	// 半秒之后补充了半个令牌
+	ok, wait = b.Take(now.Add(500*time.Millisecond), 1, 3)
+	if ok || wait != 500*time.Millisecond {
+		t.Errorf("expected to wait 500ms, got %v %v", ok, wait)
+	}
+	if ok, _ := b.Take(now.Add(time.Second), 1, 3); !ok {
+		t.Error("take after refill should be allowed")
+	}
+	// 补充的令牌不超过 burst
+	b.Take(now.Add(time.Hour), 1, 3)
+	if b.Tokens != 2 {
+		t.Errorf("expected 2 tokens, got %v", b.Tokens)
+	}
+	if full := b.FullAt(1, 3); !full.Equal(now.Add(time.Hour + time.Second)) {
+		t.Errorf("unexpected full time %v", full)
+	}
+}
+
+func TestMemoryLimiter(t *testing.T) {
+	now := time.Unix(1000, 0)
+	l := NewMemoryLimiter()
+	l.now = func() time.Time { return now }
+	ctx := context.Background()
+	if ok, _ := l.Take(ctx, "a", 1, 1); !ok {
+		t.Fatal("first take should be allowed")
+	}
+	if ok, _ := l.Take(ctx, "a", 1, 1); ok {
+		t.Error("second take should be limited")
+	}
+	// 不同的 key 使用不同的桶
+	if ok, _ := l.Take(ctx, "b", 1, 1); !ok {
+		t.Error("other keys should not be limited")
+	}
+	// 装满的桶被清理
+	now = now.Add(2 * sweepInterval)
+	l.Take(ctx, "c", 1, 1)
+	if len(l.buckets) != 1 {
+		t.Errorf("expected full buckets to be removed, got %v buckets", len(l.buckets))
+	}
+}
@@ -0,0 +1,300 @@
+package lib
+
+import (
+	"fmt"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/kataras/iris/context"
+)
+
+// FieldError 字段级别的参数错误
+type FieldError struct {
+	Field string `json:"field"`
+	Error string `json:"error"`
+}
+
+var (
+	objectIDPattern = regexp.MustCompile("^[0-9a-fA-F]{24}$")
+	numericPattern  = regexp.MustCompile("^[0-9]+$")
+)
+
+// IsObjectID 判断是否是合法的 ObjectID 字符串
+func IsObjectID(id string) bool {
+	return objectIDPattern.MatchString(id)
+}
+
+// Validate 按照结构体字段的 validate 标签检查参数
+// 有错误时 panic，由 error handler 统一返回所有字段的错误
+//
+// 支持的规则，多个规则用逗号分隔，每个字段只报告第一个错误：
+// required 必须填写；notblank 字符串不能为空白；positive 必须大于 0；nonnegative 不能为负数；
+// min=N / max=N 数字的大小、字符串的长度或者数组的元素个数；future 必须是将来的 Unix 时间戳；
+// oneof=a b 只能取列出的值；objectid 必须是 ObjectID；numeric 只能包含数字；
+// dive 之后的规则作用于数组中的每个元素
+// 结构体和结构体数组会被递归检查，nil 指针只检查 required
+func Validate(v interface{}) {
+	errs := ValidateStruct(v)
+	if len(errs) != 0 {
+		panic(AppError{Key: "invalid_params", Errors: errs})
+	}
+}
+
+// ValidateStruct 检查参数，返回所有字段的错误
+func ValidateStruct(v interface{}) []FieldError {
+	errs := make([]FieldError, 0)
+	validateValue(reflect.ValueOf(v), "", &errs)
+	return errs
+}
+
+func validateValue(v reflect.Value, prefix string, errs *[]FieldError) {
+	for v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface {
+		if v.IsNil() {
+			return
+		}
+		v = v.Elem()
+	}
+	switch v.Kind() {
+	case reflect.Struct:
+		t := v.Type()
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			if f.PkgPath != "" {
+				continue
+			}
+			if f.Anonymous {
+				validateValue(v.Field(i), prefix, errs)
+				continue
+			}
+			path := joinFieldPath(prefix, fieldName(f))
+			if tag := f.Tag.Get("validate"); tag != "" && tag != "-" {
+				if !checkRules(v.Field(i), strings.Split(tag, ","), path, errs) {
+					continue
+				}
+			}
+			validateValue(v.Field(i), path, errs)
+		}
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			validateValue(v.Index(i), fmt.Sprintf("%v[%v]", prefix, i), errs)
+		}
+	}
+}
+
+// 字段名使用 json 标签，查询参数使用 form 标签
+func fieldName(f reflect.StructField) string {
+	for _, key := range []string{"json", "form"} {
+		if name := strings.Split(f.Tag.Get(key), ",")[0]; name != "" && name != "-" {
+			return name
+		}
+	}
+	return f.Name
+}
+
+func joinFieldPath(prefix, name string) string {
+	if prefix == "" {
+		return name
+	}
+	return prefix + "." + name
+}
+
+// 按顺序检查规则，返回字段是否通过
+func checkRules(v reflect.Value, rules []string, path string, errs *[]FieldError) bool {
+	for v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			for _, rule := range rules {
+				if rule == "required" {
+					*errs = append(*errs, FieldError{path, "required"})
+					return false
+				}
+			}
+			return true
+		}
+		v = v.Elem()
+	}
+	for i, rule := range rules {
+		name, arg := rule, ""
+		if idx := strings.Index(rule, "="); idx >= 0 {
+			name, arg = rule[:idx], rule[idx+1:]
+		}
+		if name == "dive" {
+			ok := true
+			for j := 0; j < v.Len(); j++ {
+				if !checkRules(v.Index(j), rules[i+1:], fmt.Sprintf("%v[%v]", path, j), errs) {
+					ok = false
+				}
+			}
+			return ok
+		}
+		if msg := checkRule(v, name, arg); msg != "" {
+			*errs = append(*errs, FieldError{path, msg})
+			return false
+		}
+	}
+	return true
+}
+
+func checkRule(v reflect.Value, name, arg string) string {
+	switch name {
+	case "required":
+		if isZeroValue(v) {
+			return "required"
+		}
+	case "notblank":
+		if v.Kind() == reflect.String && strings.TrimSpace(v.String()) == "" {
+			return "must_not_be_blank"
+		}
+	case "positive":
+		if n, ok := numberOf(v); ok && n <= 0 {
+			return "must_be_positive"
+		}
+	case "nonnegative":
+		if n, ok := numberOf(v); ok && n < 0 {
+			return "must_not_be_negative"
+		}
+	case "min", "max":
+		limit, err := strconv.ParseFloat(arg, 64)
+		if err != nil {
+			panic("invalid validate rule: " + name + "=" + arg)
+		}
+		return checkRange(v, name == "min", limit)
+	case "future":
+		if n, ok := numberOf(v); ok && n <= float64(time.Now().Unix()) {
+			return "must_be_in_future"
+		}
+	case "oneof":
+		if v.Kind() == reflect.String && v.String() != "" {
+			for _, option := range strings.Fields(arg) {
+				if v.String() == option {
+					return ""
+				}
+			}
+			return "invalid_value"
+		}
+	case "objectid":
+		if v.Kind() == reflect.String && v.String() != "" && !IsObjectID(v.String()) {
+			return "invalid_id"
+		}
+	case "numeric":
+		if v.Kind() == reflect.String && v.String() != "" && !numericPattern.MatchString(v.String()) {
+			return "must_be_numeric"
+		}
+	default:
+		panic("unknown validate rule: " + name)
+	}
+	return ""
+}
+
+// 数字比较大小，字符串比较长度，数组比较元素个数
+func checkRange(v reflect.Value, isMin bool, limit float64) string {
+	var size float64
+	var tooSmall, tooLarge string
+	switch v.Kind() {
+	case reflect.String:
+		size, tooSmall, tooLarge = float64(utf8.RuneCountInString(v.String())), "too_short", "too_long"
+	case reflect.Slice, reflect.Array, reflect.Map:
+		size, tooSmall, tooLarge = float64(v.Len()), "too_few_items", "too_many_items"
+	default:
+		n, ok := numberOf(v)
+		if !ok {
+			return ""
+		}
+		size, tooSmall, tooLarge = n, "too_small", "too_large"
+	}
+	if isMin && size < limit {
+		return tooSmall
+	}
+	if !isMin && size > limit {
+		return tooLarge
+	}
+	return ""
+}
+
+func numberOf(v reflect.Value) (float64, bool) {
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(v.Int()), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return float64(v.Uint()), true
+	case reflect.Float32, reflect.Float64:
+		return v.Float(), true
+	}
+	return 0, false
+}
+
+func isZeroValue(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.String:
+		return strings.TrimSpace(v.String()) == ""
+	case reflect.Slice, reflect.Map:
+		return v.Len() == 0
+	case reflect.Ptr, reflect.Interface:
+		return v.IsNil()
+	case reflect.Bool:
+		return !v.Bool()
+	case reflect.Struct:
+		return false
+	}
+	n, ok := numberOf(v)
+	return ok && n == 0
+}
+
+// BindQuery 按照 form 标签读取 url 中的参数并检查
+// 没有出现的参数保持零值，格式错误的参数和检查的错误一起返回
+func BindQuery(ctx context.Context, v interface{}) {
+	errs := make([]FieldError, 0)
+	bindQueryValue(ctx, reflect.ValueOf(v).Elem(), &errs)
+	if len(errs) != 0 {
+		panic(AppError{Key: "invalid_params", Errors: errs})
+	}
+	Validate(v)
+}
+
+func bindQueryValue(ctx context.Context, v reflect.Value, errs *[]FieldError) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.Anonymous && f.Type.Kind() == reflect.Struct {
+			bindQueryValue(ctx, v.Field(i), errs)
+			continue
+		}
+		name := f.Tag.Get("form")
+		if name == "" || name == "-" {
+			continue
+		}
+		raw := ctx.URLParam(name)
+		if raw == "" {
+			continue
+		}
+		field := v.Field(i)
+		var err error
+		switch field.Kind() {
+		case reflect.String:
+			field.SetString(raw)
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			var n int64
+			if n, err = strconv.ParseInt(raw, 10, 64); err == nil {
+				field.SetInt(n)
+			}
+		case reflect.Float32, reflect.Float64:
+			var n float64
+			if n, err = strconv.ParseFloat(raw, 64); err == nil {
+				field.SetFloat(n)
+			}
+		case reflect.Bool:
+			var b bool
+			if b, err = strconv.ParseBool(raw); err == nil {
+				field.SetBool(b)
+			}
+		default:
+			panic("unsupported query field: " + f.Name)
+		}
+		if err != nil {
+			*errs = append(*errs, FieldError{name, "invalid_type"})
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package lib
+
+import (
+	"testing"
+)
+
+type validateItem struct {
+	ID string `json:"id" validate:"objectid"`
+}
+
+type validateReq struct {
+	Name     string         `json:"name" validate:"required,max=5"`
+	Reward   float64        `json:"reward" validate:"positive"`
+	Count    *int           `json:"count" validate:"min=1"`
+	Kind     string         `json:"kind" validate:"oneof=a b"`
+	Deadline int64          `json:"deadline" validate:"future"`
+	Tags     []string       `json:"tags" validate:"max=2,dive,numeric"`
+	Items    []validateItem `json:"items"`
+}
+
+func TestValidateStruct(t *testing.T) {
+	zero := 0
+	errs := ValidateStruct(&validateReq{
+		Name:     "too long name",
+		Reward:   -1,
+		Count:    &zero,
+		Kind:     "c",
+		Deadline: 1,
+		Tags:     []string{"1", "x"},
+		Items:    []validateItem{{ID: "5d0f6d7e8f1b2c3d4e5f6a7b"}, {ID: "bad"}},
+	})
+	expected := map[string]string{
+		"name":        "too_long",
+		"reward":      "must_be_positive",
+		"count":       "too_small",
+		"kind":        "invalid_value",
+		"deadline":    "must_be_in_future",
+		"tags[1]":     "must_be_numeric",
+		"items[1].id": "invalid_id",
+	}
+	if len(errs) != len(expected) {
+		t.Fatalf("expected %v errors, got %v", len(expected), errs)
+	}
+	for _, e := range errs {
+		if expected[e.Field] != e.Error {
+			t.Errorf("field %v: expected %v, got %v", e.Field, expected[e.Field], e.Error)
+		}
+	}
+}
+
+func TestValidateOptional(t *testing.T) {
+	// 可选字段为空时只检查 required
+	errs := ValidateStruct(&validateReq{Reward: 1, Deadline: 1 << 40})
+	if len(errs) != 1 || errs[0].Field != "name" || errs[0].Error != "required" {
+		t.Errorf("unexpected errors: %v", errs)
+	}
+}
+
+func TestIsObjectID(t *testing.T) {
+	if !IsObjectID("5d0f6d7e8f1b2c3d4e5f6a7b") || IsObjectID("5d0f6d7e8f1b2c3d4e5f6a7") || IsObjectID("zzzzzzzzzzzzzzzzzzzzzzzz") {
+		t.Error("IsObjectID")
+	}
+}
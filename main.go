@@ -1,13 +1,11 @@
 package main
 
 import (
-	"flag"
-	"github.com/sysu-team/Back-end-development/app"
+	"os"
+
+	"github.com/sysu-team/Back-end-development/app/cli"
 )
 
 func main() {
-	// todo: using command line option
-	configFile := flag.String("c", "config.yaml", "Config file")
-	flag.Parse()
-	app.Run(*configFile)
+	os.Exit(cli.Run(os.Args[1:]))
 }